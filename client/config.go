@@ -7,36 +7,94 @@ import (
 
 // Config for client
 type Config struct {
-	LocalAddr    string `json:"localaddr"`
-	RemoteAddr   string `json:"remoteaddr"`
-	Key          string `json:"key"`
-	Crypt        string `json:"crypt"`
-	Mode         string `json:"mode"`
-	Conn         int    `json:"conn"`
-	AutoExpire   int    `json:"autoexpire"`
-	ScavengeTTL  int    `json:"scavengettl"`
-	MTU          int    `json:"mtu"`
-	SndWnd       int    `json:"sndwnd"`
-	RcvWnd       int    `json:"rcvwnd"`
-	DataShard    int    `json:"datashard"`
-	ParityShard  int    `json:"parityshard"`
-	DSCP         int    `json:"dscp"`
-	NoComp       bool   `json:"nocomp"`
-	AckNodelay   bool   `json:"acknodelay"`
-	NoDelay      int    `json:"nodelay"`
-	Interval     int    `json:"interval"`
-	Resend       int    `json:"resend"`
-	NoCongestion int    `json:"nc"`
-	SockBuf      int    `json:"sockbuf"`
-	SmuxVer      int    `json:"smuxver"`
-	SmuxBuf      int    `json:"smuxbuf"`
-	StreamBuf    int    `json:"streambuf"`
-	KeepAlive    int    `json:"keepalive"`
-	Log          string `json:"log"`
-	SnmpLog      string `json:"snmplog"`
-	SnmpPeriod   int    `json:"snmpperiod"`
-	Quiet        bool   `json:"quiet"`
-	TCP          bool   `json:"tcp"`
+	LocalAddr       string    `json:"localaddr"`
+	Route           string    `json:"route"`
+	Forwards        []Forward `json:"forwards"`
+	RemoteAddr      string    `json:"remoteaddr"`
+	Key             string    `json:"key"`
+	KDF             string    `json:"kdf"`
+	KDFSalt         string    `json:"kdfsalt"`
+	KDFParams       string    `json:"kdfparams"`
+	RawKey          string    `json:"rawkey"`
+	NextKey         string    `json:"nextkey"`
+	NextRawKey      string    `json:"nextrawkey"`
+	NextCrypt       string    `json:"nextcrypt"`
+	SwitchAt        string    `json:"switchat"`
+	User            string    `json:"user"`
+	Credential      string    `json:"credential"`
+	AntiProbe       bool      `json:"antiprobe"`
+	Allow           []string  `json:"allow"`
+	Deny            []string  `json:"deny"`
+	Knock           string    `json:"knock"`
+	KnockIP         string    `json:"knockip"`
+	Crypt           string    `json:"crypt"`
+	Mode            string    `json:"mode"`
+	Conn            int       `json:"conn"`
+	AutoExpire      int       `json:"autoexpire"`
+	ScavengeTTL     int       `json:"scavengettl"`
+	MTU             int       `json:"mtu"`
+	SndWnd          int       `json:"sndwnd"`
+	RcvWnd          int       `json:"rcvwnd"`
+	DataShard       int       `json:"datashard"`
+	ParityShard     int       `json:"parityshard"`
+	DSCP            int       `json:"dscp"`
+	NoComp          bool      `json:"nocomp"`
+	AckNodelay      bool      `json:"acknodelay"`
+	NoDelay         int       `json:"nodelay"`
+	Interval        int       `json:"interval"`
+	Resend          int       `json:"resend"`
+	NoCongestion    int       `json:"nc"`
+	SockBuf         int       `json:"sockbuf"`
+	SmuxVer         int       `json:"smuxver"`
+	SmuxBuf         int       `json:"smuxbuf"`
+	StreamBuf       int       `json:"streambuf"`
+	KeepAlive       int       `json:"keepalive"`
+	Log             string    `json:"log"`
+	LogFormat       string    `json:"logformat"`
+	LogLevel        string    `json:"loglevel"`
+	LogMaxSize      int       `json:"logmaxsize"`
+	LogKeep         int       `json:"logkeep"`
+	AccessLog       string    `json:"accesslog"`
+	AccessLogFormat string    `json:"accesslogformat"`
+	AccessLogSample float64   `json:"accesslogsample"`
+	Hooks           []string  `json:"hooks"`
+	HookRate        float64   `json:"hookrate"`
+	HookTimeout     int       `json:"hooktimeout"`
+	AlertLoss       float64   `json:"alertloss"`
+	AlertRTT        int       `json:"alertrtt"`
+	AlertFEC        float64   `json:"alertfec"`
+	AlertPeriod     int       `json:"alertperiod"`
+	Capture         string    `json:"capture"`
+	CaptureSize     int       `json:"capturesize"`
+	CaptureDuration int       `json:"captureduration"`
+	CaptureSmux     bool      `json:"capturesmux"`
+	SnmpLog         string    `json:"snmplog"`
+	SnmpPeriod      int       `json:"snmpperiod"`
+	SnmpFormat      string    `json:"snmpformat"`
+	SnmpDelta       bool      `json:"snmpdelta"`
+	SnmpKeep        int       `json:"snmpkeep"`
+	SnmpMaxSize     int       `json:"snmpmaxsize"`
+	Metrics         string    `json:"metrics"`
+	SessionStats    bool      `json:"sessionstats"`
+	Pprof           bool      `json:"pprof"`
+	Admin           string    `json:"admin"`
+	AdminToken      string    `json:"admintoken"`
+	Quiet           bool      `json:"quiet"`
+	TCP             bool      `json:"tcp"`
+	Uplink          string    `json:"uplink"`
+	Downlink        string    `json:"downlink"`
+	Proxy           string    `json:"proxy"`
+	ShareSock       bool      `json:"sharesock"`
+	Pacing          bool      `json:"pacing"`
+	PaceRate        int       `json:"pacerate"`
+	PaceBurst       int       `json:"paceburst"`
+	NetemOut        string    `json:"netemout"`
+	NetemIn         string    `json:"netemin"`
+	NetemSeed       int64     `json:"netemseed"`
+	Handshake       bool      `json:"handshake"`
+	ServerPub       string    `json:"serverpub"`
+	RekeyVolume     int       `json:"rekeyvolume"`
+	RekeyPeriod     int       `json:"rekeyperiod"`
 }
 
 func parseJSONConfig(config *Config, path string) error {
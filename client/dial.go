@@ -4,6 +4,8 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"fmt"
+	"net"
+	"sync"
 
 	"github.com/pkg/errors"
 	kcp "github.com/xtaci/kcp-go/v5"
@@ -11,7 +13,35 @@ import (
 	"github.com/xtaci/tcpraw"
 )
 
-func dial(config *Config, block kcp.BlockCrypt) (*kcp.UDPSession, error) {
+// kcpSession is a kcp.UDPSession closing the transport it was created on,
+// kcp-go only closes the sockets it opened itself.
+type kcpSession struct {
+	*kcp.UDPSession
+	transport net.PacketConn
+	stats     *generic.SessionStats // nil until tracked
+}
+
+// Close closes the session and its transport
+func (s *kcpSession) Close() error {
+	err := s.UDPSession.Close()
+	s.transport.Close()
+	if s.stats != nil {
+		s.stats.Close()
+	}
+	return err
+}
+
+// stack is how packets are processed beneath KCP, packets are encrypted by
+// either block within KCP or crypt beneath it.
+type stack struct {
+	block    kcp.BlockCrypt
+	crypt    generic.PacketCrypt
+	tokenKey func() []byte // key of the tokens, nil without --antiprobe
+	knockKey func() []byte // key of the knocks, nil without --knock
+}
+
+// dial creates a session to the server
+func dial(config *Config, st *stack) (*kcpSession, error) {
 	mp, err := generic.ParseMultiPort(config.RemoteAddr)
 	if err != nil {
 		return nil, err
@@ -25,13 +55,227 @@ func dial(config *Config, block kcp.BlockCrypt) (*kcp.UDPSession, error) {
 
 	remoteAddr := fmt.Sprintf("%v:%v", mp.Host, uint64(mp.MinPort)+randport%uint64(mp.MaxPort-mp.MinPort+1))
 
-	if config.TCP {
-		conn, err := tcpraw.Dial("tcp", remoteAddr)
+	if st.knockKey != nil {
+		if err := knock(config, st, mp.Host); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.ShareSock {
+		return dialShared(config, st, remoteAddr)
+	}
+
+	conn, raddr, err := openTransport(config, st, remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	var conv uint32
+	if err := binary.Read(rand.Reader, binary.LittleEndian, &conv); err != nil {
+		conn.Close()
+		return nil, errors.WithStack(err)
+	}
+	return newSession(config, st.block, conv, raddr, conn)
+}
+
+// knock sends a knock to the knock port of the server at host, so the
+// server admits the address of the client
+func knock(config *Config, st *stack, host string) error {
+	addr := config.Knock
+	if _, _, err := net.SplitHostPort(addr); err != nil { // a port only
+		addr = net.JoinHostPort(host, addr)
+	}
+	var ip net.IP
+	if config.KnockIP != "" {
+		if ip = net.ParseIP(config.KnockIP); ip == nil {
+			return errors.Errorf("invalid knock ip: %v", config.KnockIP)
+		}
+	}
+	return errors.Wrap(generic.SendKnock(addr, st.knockKey(), config.User, ip), "knock")
+}
+
+// newSession creates a session over conn, through a pacer if configured
+func newSession(config *Config, block kcp.BlockCrypt, conv uint32, raddr net.Addr, conn net.PacketConn) (*kcpSession, error) {
+	var pacer *generic.PacedConn
+	if config.Pacing {
+		pacer = generic.NewPacedConn(conn, config.PaceRate, config.PaceBurst)
+		conn = pacer
+	}
+	if config.SessionStats {
+		conn = generic.NewPacketStatsConn(conn, config.DataShard, config.ParityShard)
+	}
+	if capture != nil {
+		conn = capture.Conn(conn)
+	}
+
+	sess, err := kcp.NewConn3(conv, raddr, block, config.DataShard, config.ParityShard, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if pacer != nil {
+		pacer.SetEstimator(raddr, generic.WindowEstimator(sess, config.SndWnd, config.MTU))
+	}
+	return &kcpSession{UDPSession: sess, transport: conn}, nil
+}
+
+// the transport shared by all sessions with --sharesock
+var shared struct {
+	mux   *generic.ConnMux
+	raddr net.Addr // non-nil if the transport is bound to a single remote address
+	sync.Mutex
+}
+
+// dialShared creates a session on the shared transport, with a distinct
+// conversation id.
+func dialShared(config *Config, st *stack, remoteAddr string) (*kcpSession, error) {
+	shared.Lock()
+	defer shared.Unlock()
+
+	if shared.mux == nil || shared.mux.IsClosed() {
+		conn, raddr, err := openTransport(config, st, remoteAddr)
+		if err != nil {
+			return nil, err
+		}
+		if shared.mux != nil {
+			shared.mux.Close()
+		}
+		shared.mux = generic.NewConnMux(conn, st.block, config.DataShard, config.ParityShard)
+		// only an unconnected udp socket can hop between ports
+		shared.raddr = nil
+		if config.Uplink != config.Downlink || config.Uplink == "tcp" {
+			shared.raddr = raddr
+		}
+	}
+
+	raddr := shared.raddr
+	if raddr == nil {
+		udpaddr, err := net.ResolveUDPAddr("udp", remoteAddr)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		raddr = udpaddr
+	}
+
+	conn, err := shared.mux.Open()
+	if err != nil {
+		return nil, err
+	}
+	return newSession(config, st.block, conn.Conv, raddr, conn)
+}
+
+// openTransport opens the packet connection to remoteAddr, with uplink and
+// downlink over different transports if configured.
+// The network impairments are emulated on top of it, and tokens sent
+// ahead of the conversations, if configured.
+func openTransport(config *Config, st *stack, remoteAddr string) (net.PacketConn, net.Addr, error) {
+	out, in, err := impairments(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var conn net.PacketConn
+	var raddr net.Addr
+	if config.Uplink == config.Downlink {
+		conn, raddr, err = dialTransport(config, config.Uplink, st.crypt, remoteAddr)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		up, upAddr, err := dialTransport(config, config.Uplink, st.crypt, remoteAddr)
+		if err != nil {
+			return nil, nil, err
+		}
+		down, downAddr, err := dialTransport(config, config.Downlink, st.crypt, remoteAddr)
+		if err != nil {
+			up.Close()
+			return nil, nil, err
+		}
+		conn, raddr = generic.NewSplitConn(up, upAddr, down, downAddr, st.block), upAddr
+	}
+
+	if out != nil || in != nil {
+		conn = generic.NewNetemConn(conn, out, in, config.NetemSeed)
+	}
+	if st.tokenKey != nil {
+		conn = generic.NewTokenConn(conn, st.tokenKey)
+	}
+	return conn, raddr, nil
+}
+
+// impairments parses the emulated network impairments, nil if not configured
+func impairments(config *Config) (out, in *generic.Impairment, err error) {
+	if config.NetemOut != "" {
+		if out, err = generic.ParseImpairment(config.NetemOut); err != nil {
+			return nil, nil, err
+		}
+	}
+	if config.NetemIn != "" {
+		if in, err = generic.ParseImpairment(config.NetemIn); err != nil {
+			return nil, nil, err
+		}
+	}
+	return out, in, nil
+}
+
+// dialTransport opens a packet connection to remoteAddr over "udp" or "tcp"(emulated),
+// through the proxy if configured, and encrypted by crypt if not nil.
+func dialTransport(config *Config, transport string, crypt generic.PacketCrypt, remoteAddr string) (net.PacketConn, net.Addr, error) {
+	conn, raddr, err := dialRaw(config, transport, remoteAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if crypt != nil {
+		conn = generic.NewCryptConn(conn, crypt)
+	}
+	return conn, raddr, nil
+}
+
+func dialRaw(config *Config, transport string, remoteAddr string) (net.PacketConn, net.Addr, error) {
+	var proxy *generic.Proxy
+	if config.Proxy != "" {
+		p, err := generic.ParseProxy(config.Proxy)
 		if err != nil {
-			return nil, errors.Wrap(err, "tcpraw.Dial()")
+			return nil, nil, err
 		}
-		return kcp.NewConn(remoteAddr, block, config.DataShard, config.ParityShard, conn)
+		proxy = p
 	}
-	return kcp.DialWithOptions(remoteAddr, block, config.DataShard, config.ParityShard)
 
+	switch transport {
+	case "tcp":
+		if proxy != nil {
+			return nil, nil, errors.New("tcp(emulated) transport cannot go through a proxy")
+		}
+		raddr, err := net.ResolveTCPAddr("tcp", remoteAddr)
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		conn, err := tcpraw.Dial("tcp", remoteAddr)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "tcpraw.Dial()")
+		}
+		return conn, raddr, nil
+	case "udp":
+		raddr, err := net.ResolveUDPAddr("udp", remoteAddr)
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		if proxy != nil {
+			conn, err := generic.DialSOCKS5(proxy)
+			if err != nil {
+				return nil, nil, errors.Wrap(err, "generic.DialSOCKS5()")
+			}
+			return conn, raddr, nil
+		}
+
+		network := "udp4"
+		if raddr.IP.To4() == nil {
+			network = "udp"
+		}
+		conn, err := net.ListenUDP(network, nil)
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		return conn, raddr, nil
+	}
+	return nil, nil, errors.Errorf("unknown transport: %v", transport)
 }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/kcptun/generic"
+)
+
+// Forward is a local listener forwarding through its own sessions to the
+// target of the route of the server, its default target if Route is empty
+type Forward struct {
+	LocalAddr string `json:"localaddr"`
+	Route     string `json:"route,omitempty"`
+}
+
+// parseForwards parses forwards like "127.0.0.1:2222=ssh", the route being optional
+func parseForwards(list []string) ([]Forward, error) {
+	var forwards []Forward
+	for _, s := range list {
+		kv := strings.SplitN(s, "=", 2)
+		f := Forward{LocalAddr: kv[0]}
+		if len(kv) == 2 {
+			f.Route = kv[1]
+		}
+		if f.LocalAddr == "" {
+			return nil, errors.Errorf("invalid forward: %v", s)
+		}
+		forwards = append(forwards, f)
+	}
+	return forwards, nil
+}
+
+// listen listens on addr, a unix socket if not host:port
+func listen(addr string) (net.Listener, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		uaddr, err := net.ResolveUnixAddr("unix", addr)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		lis, err := net.ListenUnix("unix", uaddr)
+		return lis, errors.WithStack(err)
+	}
+	taddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	lis, err := net.ListenTCP("tcp", taddr)
+	return lis, errors.WithStack(err)
+}
+
+// forwarder runs the forwards, added and removed at runtime
+type forwarder struct {
+	serve     func(f Forward, lis net.Listener) // until lis is closed
+	forwards  []Forward                         // in the order added
+	listeners map[string]net.Listener
+	mu        sync.Mutex
+}
+
+func newForwarder(serve func(f Forward, lis net.Listener)) *forwarder {
+	return &forwarder{serve: serve, listeners: make(map[string]net.Listener)}
+}
+
+// add listens on the local address of f, and forwards its connections
+func (fw *forwarder) add(f Forward) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if _, ok := fw.listeners[f.LocalAddr]; ok {
+		return errors.Errorf("already forwarding: %v", f.LocalAddr)
+	}
+	lis, err := listen(f.LocalAddr)
+	if err != nil {
+		return err
+	}
+	logForward.Info("forward added", "local", lis.Addr(), "route", f.Route)
+	fw.listeners[f.LocalAddr] = lis
+	fw.forwards = append(fw.forwards, f)
+	go fw.serve(f, lis)
+	return nil
+}
+
+// remove stops listening on localAddr, the streams opened are kept
+func (fw *forwarder) remove(localAddr string) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	lis, ok := fw.listeners[localAddr]
+	if !ok {
+		return errors.Errorf("no such forward: %v", localAddr)
+	}
+	lis.Close()
+	delete(fw.listeners, localAddr)
+	for i, f := range fw.forwards {
+		if f.LocalAddr == localAddr {
+			fw.forwards = append(fw.forwards[:i], fw.forwards[i+1:]...)
+			break
+		}
+	}
+	logForward.Info("forward removed", "local", localAddr)
+	return nil
+}
+
+// list returns the forwards
+func (fw *forwarder) list() []Forward {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	return append([]Forward{}, fw.forwards...)
+}
+
+// handler serves GET /forwards listing the forwards, POST /forwards adding
+// one, and DELETE /forwards?localaddr=ADDR removing it
+func (fw *forwarder) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var f Forward
+			if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := fw.add(f); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		case http.MethodDelete:
+			if err := fw.remove(r.URL.Query().Get("localaddr")); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(fw.list())
+	})
+}
+
+// saveHandler serves POST /config/save, saving the forwards to the config
+// file at path, the first one as the local address
+func (fw *forwarder) saveHandler(path string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fields := map[string]interface{}{"localaddr": "", "route": "", "forwards": []Forward{}}
+		if forwards := fw.list(); len(forwards) > 0 {
+			fields["localaddr"], fields["route"], fields["forwards"] = forwards[0].LocalAddr, forwards[0].Route, forwards[1:]
+		}
+		if err := generic.SaveJSONConfig(path, fields); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logAdmin.Info("config saved", "path", path)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"saved": path})
+	})
+}
+
+// closeWhenIdle closes the sessions of a removed forward once their streams are closed
+func closeWhenIdle(muxes []timedSession) {
+	for {
+		alive := false
+		for _, m := range muxes {
+			if m.session == nil || m.session.IsClosed() {
+				continue
+			}
+			if m.session.NumStreams() == 0 {
+				m.session.Close()
+			} else {
+				alive = true
+			}
+		}
+		if !alive {
+			return
+		}
+		time.Sleep(time.Second)
+	}
+}
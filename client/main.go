@@ -1,69 +1,97 @@
 package main
 
 import (
-	"crypto/sha1"
 	"fmt"
 	"io"
 	"log"
 	"math/rand"
 	"net"
+	"net/http"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"golang.org/x/crypto/pbkdf2"
-
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
-	kcp "github.com/xtaci/kcp-go/v5"
 	"github.com/xtaci/kcptun/generic"
 	"github.com/xtaci/smux"
 )
 
 const (
-	// SALT is use for pbkdf2 key expansion
+	// SALT is the default salt of the key derivation
 	SALT = "kcp-go"
 	// maximum supported smux version
 	maxSmuxVer = 2
 	// stream copy buffer size
 	bufSize = 4096
+	// how often the acl files are checked for changes
+	reloadPeriod = 5 * time.Second
 )
 
 // VERSION is injected by buildflags
 var VERSION = "SELFBUILD"
 
-// handleClient aggregates connection p1 on mux with 'writeLock'
-func handleClient(session *smux.Session, p1 net.Conn, quiet bool) {
-	logln := func(v ...interface{}) {
-		if !quiet {
-			log.Println(v...)
-		}
-	}
+// the loggers of the components of the client
+var (
+	logSession = generic.NewLogger("session")
+	logStream  = generic.NewLogger("stream")
+	logForward = generic.NewLogger("forward")
+	logAdmin   = generic.NewLogger("admin")
+)
+
+// accessLog logs a record of every stream, if enabled
+var accessLog *generic.AccessLog
+
+// capture records the plaintext of the tunnel, if enabled
+var capture *generic.Capture
+
+// handleClient aggregates connection p1 on mux with 'writeLock', counted in
+// the statistics of the session, and logged in the access log once closed
+func handleClient(session *smux.Session, stats *generic.SessionStats, p1 net.Conn) {
+	stlog := logStream.With("session", stats.ID(), "remote", p1.RemoteAddr(), "local", p1.LocalAddr())
+	record := &generic.AccessRecord{Start: time.Now(), Session: stats.ID(), Source: p1.RemoteAddr().String(), Target: session.RemoteAddr().String()}
 	defer p1.Close()
 	p2, err := session.OpenStream()
 	if err != nil {
-		logln(err)
+		stlog.Warn("stream failed", "err", err)
+		record.End = generic.EndDialError
+		accessLog.Log(record)
 		return
 	}
+	record.Stream = p2.ID()
+	ss := stats.OpenStream(p2.ID(), p2)
+	defer ss.Close()
 
 	defer p2.Close()
 
-	logln("stream opened", "in:", p1.RemoteAddr(), "out:", fmt.Sprint(p2.RemoteAddr(), "(", p2.ID(), ")"))
-	defer logln("stream closed", "in:", p1.RemoteAddr(), "out:", fmt.Sprint(p2.RemoteAddr(), "(", p2.ID(), ")"))
+	stlog = stlog.With("stream", p2.ID())
+	stlog.Info("stream opened")
+	defer stlog.Info("stream closed")
 
-	// start tunnel & wait for tunnel termination
-	streamCopy := func(dst io.Writer, src io.ReadCloser) {
-		if _, err := generic.Copy(dst, src); err != nil {
-			// report protocol error
-			if err == smux.ErrInvalidProtocol {
-				log.Println("smux", err, "in:", p1.RemoteAddr(), "out:", fmt.Sprint(p2.RemoteAddr(), "(", p2.ID(), ")"))
-			}
+	// start tunnel & wait for tunnel termination, the first copy ending
+	// telling how the stream ended
+	var ended sync.Once
+	streamCopy := func(dst io.Writer, src io.ReadCloser, written *int64) {
+		n, err := generic.Copy(dst, src)
+		// report protocol error
+		if err == smux.ErrInvalidProtocol {
+			stlog.Warn("smux failed", "err", err)
 		}
+		*written = n
+		ended.Do(func() { record.End = generic.EndReason(src == p1, err) })
 		p1.Close()
 		p2.Close()
 	}
 
-	go streamCopy(p1, p2)
-	streamCopy(p2, p1)
+	done := make(chan struct{})
+	go func() {
+		streamCopy(ss.In(p1), p2, &record.BytesOut)
+		close(done)
+	}()
+	streamCopy(ss.Out(p2), p1, &record.BytesIn)
+	<-done
+	accessLog.Log(record)
 }
 
 func checkError(err error) {
@@ -75,15 +103,12 @@ func checkError(err error) {
 
 type timedSession struct {
 	session    *smux.Session
+	stats      *generic.SessionStats
 	expiryDate time.Time
 }
 
 func main() {
 	rand.Seed(int64(time.Now().Nanosecond()))
-	if VERSION == "SELFBUILD" {
-		// add more log flags for debugging
-		log.SetFlags(log.LstdFlags | log.Lshortfile)
-	}
 
 	myApp := cli.NewApp()
 	myApp.Name = "kcptun"
@@ -95,6 +120,15 @@ func main() {
 			Value: ":12948",
 			Usage: "local listen address",
 		},
+		cli.StringFlag{
+			Name:  "route",
+			Value: "",
+			Usage: "route of the server to the target of the local address, its default target if empty",
+		},
+		cli.StringSliceFlag{
+			Name:  "forward",
+			Usage: `another local listen address, with the route of the server to its target, eg: "127.0.0.1:2222=ssh"`,
+		},
 		cli.StringFlag{
 			Name:  "remoteaddr, r",
 			Value: "vps:29900",
@@ -106,10 +140,64 @@ func main() {
 			Usage:  "pre-shared secret between client and server",
 			EnvVar: "KCPTUN_KEY",
 		},
+		cli.StringFlag{
+			Name:  "kdf",
+			Value: "pbkdf2",
+			Usage: "key derivation function: pbkdf2, argon2id, scrypt",
+		},
+		cli.StringFlag{
+			Name:  "kdfsalt",
+			Value: SALT,
+			Usage: "salt of the key derivation, set a deployment-specific one",
+		},
+		cli.StringFlag{
+			Name:  "kdfparams",
+			Value: "",
+			Usage: `cost of the key derivation, eg: "iter=4096" for pbkdf2, "t=3,m=65536,p=4" for argon2id(m in KiB), "n=32768,r=8,p=1" for scrypt`,
+		},
+		cli.StringFlag{
+			Name:   "rawkey",
+			Value:  "",
+			Usage:  "hex encoded 256-bit key used as is, instead of deriving one from --key",
+			EnvVar: "KCPTUN_RAWKEY",
+		},
+		cli.StringFlag{
+			Name:   "nextkey",
+			Value:  "",
+			Usage:  "staged pre-shared secret, replacing --key at --switchat",
+			EnvVar: "KCPTUN_NEXTKEY",
+		},
+		cli.StringFlag{
+			Name:   "nextrawkey",
+			Value:  "",
+			Usage:  "staged raw key, instead of --nextkey",
+			EnvVar: "KCPTUN_NEXTRAWKEY",
+		},
+		cli.StringFlag{
+			Name:  "nextcrypt",
+			Value: "",
+			Usage: "crypt of the staged key, the same as --crypt if empty",
+		},
+		cli.StringFlag{
+			Name:  "switchat",
+			Value: "",
+			Usage: `time to switch to the staged key, in RFC3339, eg: "2006-01-02T15:04:05Z"`,
+		},
+		cli.StringFlag{
+			Name:  "user",
+			Value: "",
+			Usage: "user id in the users file of the server, the key and crypt must be those of the user",
+		},
+		cli.StringFlag{
+			Name:   "credential",
+			Value:  "",
+			Usage:  "credential issued by the operator of the server, presented when a session starts, requires --handshake",
+			EnvVar: "KCPTUN_CREDENTIAL",
+		},
 		cli.StringFlag{
 			Name:  "crypt",
 			Value: "aes",
-			Usage: "aes, aes-128, aes-192, salsa20, blowfish, twofish, cast5, 3des, tea, xtea, xor, sm4, none, null",
+			Usage: "aes, aes-128, aes-192, salsa20, blowfish, twofish, cast5, 3des, tea, xtea, xor, sm4, none, null, or aes-gcm, chacha20-poly1305 to authenticate every packet, the clocks must be in sync",
 		},
 		cli.StringFlag{
 			Name:  "mode",
@@ -225,30 +313,305 @@ func main() {
 			Value: 60,
 			Usage: "snmp collect period, in seconds",
 		},
+		cli.StringFlag{
+			Name:  "snmpformat",
+			Value: "csv",
+			Usage: "format of the snmp log: csv, jsonl",
+		},
+		cli.BoolFlag{
+			Name:  "snmpdelta",
+			Usage: "log the counters of each period with throughput, loss, retransmit and FEC recovery ratios, instead of cumulative counters",
+		},
+		cli.IntFlag{
+			Name:  "snmpkeep",
+			Value: 0,
+			Usage: "number of time formatted snmp log files kept, 0 to keep all",
+		},
+		cli.IntFlag{
+			Name:  "snmpmaxsize",
+			Value: 0,
+			Usage: "total size of the snmp log files kept, in MB, 0 for no limit",
+		},
 		cli.StringFlag{
 			Name:  "log",
 			Value: "",
-			Usage: "specify a log file to output, default goes to stderr",
+			Usage: `specify a log file to output, reopened on SIGHUP, or "syslog" or "journald", default goes to stderr`,
+		},
+		cli.StringFlag{
+			Name:  "logformat",
+			Value: "text",
+			Usage: "format of the logs, text or json",
+		},
+		cli.StringFlag{
+			Name:  "loglevel",
+			Value: "info",
+			Usage: `level of the logs, debug, info, warn or error, then of some components, eg: "info,session=debug,stream=warn"`,
+		},
+		cli.IntFlag{
+			Name:  "logmaxsize",
+			Value: 0,
+			Usage: "size in MB of the log file and the access log before they are rotated, never if 0",
+		},
+		cli.IntFlag{
+			Name:  "logkeep",
+			Value: 5,
+			Usage: "number of the rotated log files kept",
+		},
+		cli.StringFlag{
+			Name:  "accesslog",
+			Value: "",
+			Usage: `file of the access log, a record of every stream, reopened on SIGHUP, "-" for stdout`,
+		},
+		cli.StringFlag{
+			Name:  "accesslogformat",
+			Value: "text",
+			Usage: "format of the access log, text, json, or a template of the fields {start} {duration} {session} {stream} {source} {target} {bytesin} {bytesout} {end}",
+		},
+		cli.Float64Flag{
+			Name:  "accesslogsample",
+			Value: 1,
+			Usage: "share of the streams in the access log, those ending on an error always are",
+		},
+		cli.StringSliceFlag{
+			Name:  "hook",
+			Usage: `script run, or http(s) URL posted, with a JSON event on session_open, session_close, reconnect, ban and alert, only on some events after a prefix like "ban,alert=", repeatable`,
+		},
+		cli.Float64Flag{
+			Name:  "hookrate",
+			Value: 10,
+			Usage: "events per second run by each hook, the others dropped",
+		},
+		cli.IntFlag{
+			Name:  "hooktimeout",
+			Value: 5,
+			Usage: "seconds a hook may run before it is killed",
+		},
+		cli.Float64Flag{
+			Name:  "alertloss",
+			Usage: "alert when the packets retransmitted by a session exceed this percent, never if 0, enables --sessionstats",
+		},
+		cli.IntFlag{
+			Name:  "alertrtt",
+			Usage: "alert when the smoothed RTT of a session exceeds this many milliseconds, never if 0",
+		},
+		cli.Float64Flag{
+			Name:  "alertfec",
+			Usage: "alert when the FEC errors per second exceed this, never if 0",
+		},
+		cli.IntFlag{
+			Name:  "alertperiod",
+			Value: 10,
+			Usage: "alert check period, in seconds",
+		},
+		cli.StringFlag{
+			Name:  "capture",
+			Value: "",
+			Usage: "pcap file of the decrypted, FEC decoded KCP segments, for Wireshark with examples/kcptun.lua",
+		},
+		cli.IntFlag{
+			Name:  "capturesize",
+			Value: 100,
+			Usage: "MB captured before the capture stops, never if 0",
+		},
+		cli.IntFlag{
+			Name:  "captureduration",
+			Usage: "seconds captured before the capture stops, never if 0",
+		},
+		cli.BoolFlag{
+			Name:  "capturesmux",
+			Usage: "also capture the smux frames",
+		},
+		cli.BoolFlag{
+			Name:  "pprof",
+			Usage: "expose the profiles of net/http/pprof on the admin API",
 		},
 		cli.BoolFlag{
 			Name:  "quiet",
-			Usage: "to suppress the 'stream open/close' messages",
+			Usage: "to suppress the 'stream open/close' messages, as --loglevel stream=warn",
 		},
 		cli.BoolFlag{
 			Name:  "tcp",
 			Usage: "to emulate a TCP connection(linux)",
 		},
+		cli.StringFlag{
+			Name:  "uplink",
+			Value: "",
+			Usage: "transport for packets sent to the server: udp, tcp, defaults to udp, or tcp with --tcp",
+		},
+		cli.StringFlag{
+			Name:  "downlink",
+			Value: "",
+			Usage: "transport for packets received from the server: udp, tcp, defaults to udp, or tcp with --tcp",
+		},
+		cli.BoolFlag{
+			Name:  "sharesock",
+			Usage: "share a single socket among all connections to the server, requires --byconv on the server",
+		},
+		cli.StringFlag{
+			Name:   "proxy",
+			Value:  "",
+			Usage:  `reach the server through a proxy, eg: "socks5://user:pass@IP:1080", credentials default to $KCPTUN_PROXY_USER and $KCPTUN_PROXY_PASSWORD`,
+			EnvVar: "KCPTUN_PROXY",
+		},
+		cli.BoolFlag{
+			Name:  "pacing",
+			Usage: "spread outgoing packets over time instead of sending a whole window at once",
+		},
+		cli.IntFlag{
+			Name:  "pacerate",
+			Value: 0,
+			Usage: "cap of the pacing rate in bytes per second, 0 to derive it from sndwnd*mtu/RTT only",
+		},
+		cli.IntFlag{
+			Name:  "paceburst",
+			Value: 16384,
+			Usage: "bytes allowed to be sent back-to-back when pacing",
+		},
+		cli.StringFlag{
+			Name:  "netemout",
+			Value: "",
+			Usage: `emulate network impairments on outgoing packets, in tc-netem terms, eg: "delay 100ms 20ms loss 1% duplicate 0.5% reorder 5% rate 2mbit", or "loss gemodel 1% 10%" for burst loss`,
+		},
+		cli.StringFlag{
+			Name:  "netemin",
+			Value: "",
+			Usage: "emulate network impairments on incoming packets, see --netemout",
+		},
+		cli.Int64Flag{
+			Name:  "netemseed",
+			Value: 1,
+			Usage: "seed of the random impairments, the same seed reproduces the same conditions",
+		},
+		cli.BoolFlag{
+			Name:  "handshake",
+			Usage: "establish per-session keys with an ephemeral key exchange, both sides must enable it",
+		},
+		cli.StringFlag{
+			Name:  "serverpub",
+			Value: "",
+			Usage: "pin the public key of the server in the handshake, base64 encoded, as logged by the server",
+		},
+		cli.IntFlag{
+			Name:  "rekeyvolume",
+			Value: 1024,
+			Usage: "MB sent before the session key is renewed with --handshake, 0 to disable",
+		},
+		cli.IntFlag{
+			Name:  "rekeyperiod",
+			Value: 3600,
+			Usage: "seconds before the session key is renewed with --handshake, 0 to disable",
+		},
+		cli.BoolFlag{
+			Name:  "antiprobe",
+			Usage: "present a token authenticated with the key ahead of every conversation, for servers with --antiprobe",
+		},
+		cli.StringFlag{
+			Name:  "knock",
+			Value: "",
+			Usage: `knock port of the server, or its udp address, a knock is sent before every connection, for servers with --knock`,
+		},
+		cli.StringFlag{
+			Name:  "knockip",
+			Value: "",
+			Usage: "IP the server admits on a knock, the source address of the knock if empty",
+		},
+		cli.StringSliceFlag{
+			Name:  "allow",
+			Usage: `source IPs or CIDRs allowed, eg: "10.0.0.0/8,2001:db8::/32", or "@path" of a file of them, reloaded when modified, all others are denied`,
+		},
+		cli.StringSliceFlag{
+			Name:  "deny",
+			Usage: `source IPs or CIDRs denied, or "@path" of a file of them, reloaded when modified`,
+		},
+		cli.StringFlag{
+			Name:  "metrics",
+			Value: "",
+			Usage: `address of the http server of the Prometheus metrics on /metrics, eg: "127.0.0.1:9100"`,
+		},
+		cli.StringFlag{
+			Name:  "admin",
+			Value: "",
+			Usage: `address of the admin API listing and closing sessions and streams, a unix socket if not host:port, eg: "127.0.0.1:6061"`,
+		},
+		cli.StringFlag{
+			Name:   "admintoken",
+			Value:  "",
+			Usage:  "bearer token of the admin API, required on tcp",
+			EnvVar: "KCPTUN_ADMINTOKEN",
+		},
+		cli.BoolFlag{
+			Name:  "sessionstats",
+			Usage: "count the packets, retransmissions and FEC recoveries of every session, logged with the snmp log",
+		},
 		cli.StringFlag{
 			Name:  "c",
 			Value: "", // when the value is not empty, the config path must exists
 			Usage: "config from json file, which will override the command from shell",
 		},
 	}
+	myApp.Commands = []cli.Command{
+		{
+			Name:  "genkey",
+			Usage: "print a random key and kdf salt, and a random raw key",
+			Action: func(c *cli.Context) error {
+				return generic.GenKey(os.Stdout)
+			},
+		},
+		{
+			Name:  "top",
+			Usage: "show the sessions of a running client live, from its admin API",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "admin",
+					Value: "",
+					Usage: `address of the admin API, a unix socket if not host:port, eg: "127.0.0.1:6061"`,
+				},
+				cli.StringFlag{
+					Name:   "admintoken",
+					Value:  "",
+					Usage:  "bearer token of the admin API",
+					EnvVar: "KCPTUN_ADMINTOKEN",
+				},
+				cli.DurationFlag{
+					Name:  "interval",
+					Value: time.Second,
+					Usage: "refresh interval",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return generic.Top(c.String("admin"), c.String("admintoken"), c.Duration("interval"))
+			},
+		},
+		{
+			Name:      "replay",
+			Usage:     "send the packets sent by a client in a capture to a server again, for regression testing",
+			ArgsUsage: "CAPTURE",
+			Flags:     replayFlags,
+			Action:    replay,
+		},
+	}
 	myApp.Action = func(c *cli.Context) error {
 		config := Config{}
 		config.LocalAddr = c.String("localaddr")
+		config.Route = c.String("route")
+		forwards, err := parseForwards(c.StringSlice("forward"))
+		checkError(err)
+		config.Forwards = forwards
 		config.RemoteAddr = c.String("remoteaddr")
 		config.Key = c.String("key")
+		config.KDF = c.String("kdf")
+		config.KDFSalt = c.String("kdfsalt")
+		config.KDFParams = c.String("kdfparams")
+		config.RawKey = c.String("rawkey")
+		config.NextKey = c.String("nextkey")
+		config.NextRawKey = c.String("nextrawkey")
+		config.NextCrypt = c.String("nextcrypt")
+		config.SwitchAt = c.String("switchat")
+		config.User = c.String("user")
+		config.Credential = c.String("credential")
+		config.AntiProbe = c.Bool("antiprobe")
+		config.Knock = c.String("knock")
+		config.KnockIP = c.String("knockip")
 		config.Crypt = c.String("crypt")
 		config.Mode = c.String("mode")
 		config.Conn = c.Int("conn")
@@ -272,22 +635,115 @@ func main() {
 		config.SmuxVer = c.Int("smuxver")
 		config.KeepAlive = c.Int("keepalive")
 		config.Log = c.String("log")
+		config.LogFormat = c.String("logformat")
+		config.LogLevel = c.String("loglevel")
+		config.LogMaxSize = c.Int("logmaxsize")
+		config.LogKeep = c.Int("logkeep")
+		config.AccessLog = c.String("accesslog")
+		config.AccessLogFormat = c.String("accesslogformat")
+		config.AccessLogSample = c.Float64("accesslogsample")
+		config.Hooks = c.StringSlice("hook")
+		config.HookRate = c.Float64("hookrate")
+		config.HookTimeout = c.Int("hooktimeout")
+		config.AlertLoss = c.Float64("alertloss")
+		config.AlertRTT = c.Int("alertrtt")
+		config.AlertFEC = c.Float64("alertfec")
+		config.AlertPeriod = c.Int("alertperiod")
+		config.Capture = c.String("capture")
+		config.CaptureSize = c.Int("capturesize")
+		config.CaptureDuration = c.Int("captureduration")
+		config.CaptureSmux = c.Bool("capturesmux")
 		config.SnmpLog = c.String("snmplog")
 		config.SnmpPeriod = c.Int("snmpperiod")
+		config.SnmpFormat = c.String("snmpformat")
+		config.SnmpDelta = c.Bool("snmpdelta")
+		config.SnmpKeep = c.Int("snmpkeep")
+		config.SnmpMaxSize = c.Int("snmpmaxsize")
+		config.Pprof = c.Bool("pprof")
 		config.Quiet = c.Bool("quiet")
 		config.TCP = c.Bool("tcp")
+		config.Uplink = c.String("uplink")
+		config.Downlink = c.String("downlink")
+		config.Proxy = c.String("proxy")
+		config.ShareSock = c.Bool("sharesock")
+		config.Pacing = c.Bool("pacing")
+		config.PaceRate = c.Int("pacerate")
+		config.PaceBurst = c.Int("paceburst")
+		config.NetemOut = c.String("netemout")
+		config.NetemIn = c.String("netemin")
+		config.NetemSeed = c.Int64("netemseed")
+		config.Handshake = c.Bool("handshake")
+		config.ServerPub = c.String("serverpub")
+		config.RekeyVolume = c.Int("rekeyvolume")
+		config.RekeyPeriod = c.Int("rekeyperiod")
+
+		config.Metrics = c.String("metrics")
+		config.SessionStats = c.Bool("sessionstats")
+		config.Admin = c.String("admin")
+		config.AdminToken = c.String("admintoken")
+		config.Allow = c.StringSlice("allow")
+		config.Deny = c.StringSlice("deny")
 
 		if c.String("c") != "" {
 			err := parseJSONConfig(&config, c.String("c"))
 			checkError(err)
 		}
 
+		// the loss alert needs the packets counted by --sessionstats
+		if config.AlertLoss > 0 {
+			config.SessionStats = true
+		}
+
 		// log redirect
-		if config.Log != "" {
-			f, err := os.OpenFile(config.Log, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-			checkError(err)
-			defer f.Close()
-			log.SetOutput(f)
+		logLevel := config.LogLevel
+		if config.Quiet {
+			logLevel += ",stream=warn"
+		}
+		checkError(generic.SetupLog(generic.LogConfig{
+			Output:  config.Log,
+			Format:  config.LogFormat,
+			Level:   logLevel,
+			MaxSize: int64(config.LogMaxSize) << 20,
+			Keep:    config.LogKeep,
+		}))
+		accessLog, err = generic.NewAccessLog(generic.AccessLogConfig{
+			Path:    config.AccessLog,
+			Format:  config.AccessLogFormat,
+			Sample:  config.AccessLogSample,
+			MaxSize: int64(config.LogMaxSize) << 20,
+			Keep:    config.LogKeep,
+		})
+		checkError(err)
+		hooks, err := generic.NewHooks(generic.HookConfig{Hooks: config.Hooks, Rate: config.HookRate, Timeout: time.Duration(config.HookTimeout) * time.Second})
+		checkError(err)
+		generic.SetHooks(hooks)
+		go generic.WatchAlerts(generic.AlertConfig{
+			Interval: time.Duration(config.AlertPeriod) * time.Second,
+			Loss:     config.AlertLoss,
+			RTT:      time.Duration(config.AlertRTT) * time.Millisecond,
+			FECErrs:  config.AlertFEC,
+		})
+		capture, err = generic.NewCapture(generic.CaptureConfig{
+			Path:         config.Capture,
+			MaxSize:      int64(config.CaptureSize) << 20,
+			Duration:     time.Duration(config.CaptureDuration) * time.Second,
+			Smux:         config.CaptureSmux,
+			Server:       false,
+			DataShards:   config.DataShard,
+			ParityShards: config.ParityShard,
+		})
+		checkError(err)
+
+		// transports default to --tcp
+		defaultTransport := "udp"
+		if config.TCP {
+			defaultTransport = "tcp"
+		}
+		if config.Uplink == "" {
+			config.Uplink = defaultTransport
+		}
+		if config.Downlink == "" {
+			config.Downlink = defaultTransport
 		}
 
 		switch config.Mode {
@@ -302,26 +758,24 @@ func main() {
 		}
 
 		log.Println("version:", VERSION)
-		var listener net.Listener
-		var isUnix bool
-		if _, _, err := net.SplitHostPort(config.LocalAddr); err != nil {
-			isUnix = true
+		log.Println("smux version:", config.SmuxVer)
+		log.Println("encryption:", config.Crypt)
+		if config.NextKey != "" || config.NextRawKey != "" {
+			log.Println("nextcrypt:", config.NextCrypt, "switchat:", config.SwitchAt)
 		}
-		if isUnix {
-			addr, err := net.ResolveUnixAddr("unix", config.LocalAddr)
-			checkError(err)
-			listener, err = net.ListenUnix("unix", addr)
-			checkError(err)
-		} else {
-			addr, err := net.ResolveTCPAddr("tcp", config.LocalAddr)
-			checkError(err)
-			listener, err = net.ListenTCP("tcp", addr)
+		if config.User != "" {
+			log.Println("user:", config.User)
+		}
+		if config.Credential != "" {
+			// a credential is a bearer token, readable by every holder of
+			// the key without the keys of the handshake
+			if !config.Handshake {
+				log.Fatal("--credential requires --handshake")
+			}
+			cred, _, _, err := generic.ParseCredential(config.Credential)
 			checkError(err)
+			log.Println("credential:", cred.ID, "user:", cred.User, "expires:", cred.Expiry())
 		}
-
-		log.Println("smux version:", config.SmuxVer)
-		log.Println("listening on:", listener.Addr())
-		log.Println("encryption:", config.Crypt)
 		log.Println("nodelay parameters:", config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
 		log.Println("remote address:", config.RemoteAddr)
 		log.Println("sndwnd:", config.SndWnd, "rcvwnd:", config.RcvWnd)
@@ -339,72 +793,148 @@ func main() {
 		log.Println("scavengettl:", config.ScavengeTTL)
 		log.Println("snmplog:", config.SnmpLog)
 		log.Println("snmpperiod:", config.SnmpPeriod)
+		log.Println("snmpformat:", config.SnmpFormat, "snmpdelta:", config.SnmpDelta, "snmpkeep:", config.SnmpKeep, "snmpmaxsize:", config.SnmpMaxSize)
+		log.Println("metrics:", config.Metrics)
+		log.Println("sessionstats:", config.SessionStats)
+		log.Println("admin:", config.Admin)
+		log.Println("pprof:", config.Pprof)
+		log.Println("log:", config.Log, "logformat:", config.LogFormat, "loglevel:", config.LogLevel, "logmaxsize:", config.LogMaxSize, "logkeep:", config.LogKeep)
+		log.Println("accesslog:", config.AccessLog, "accesslogformat:", config.AccessLogFormat, "accesslogsample:", config.AccessLogSample)
+		log.Println("hooks:", generic.RedactURLs(config.Hooks), "hookrate:", config.HookRate, "hooktimeout:", config.HookTimeout)
+		log.Println("alertloss:", config.AlertLoss, "alertrtt:", config.AlertRTT, "alertfec:", config.AlertFEC, "alertperiod:", config.AlertPeriod)
+		log.Println("capture:", config.Capture, "capturesize:", config.CaptureSize, "captureduration:", config.CaptureDuration, "capturesmux:", config.CaptureSmux)
 		log.Println("quiet:", config.Quiet)
 		log.Println("tcp:", config.TCP)
+		log.Println("uplink:", config.Uplink, "downlink:", config.Downlink)
+		log.Println("sharesock:", config.ShareSock)
+		log.Println("pacing:", config.Pacing, "pacerate:", config.PaceRate, "paceburst:", config.PaceBurst)
+		if config.NetemOut != "" || config.NetemIn != "" {
+			_, _, err := impairments(&config)
+			checkError(err)
+			log.Printf("netem: out %q, in %q, seed %v", config.NetemOut, config.NetemIn, config.NetemSeed)
+		}
+		log.Println("antiprobe:", config.AntiProbe)
+		log.Println("allow:", config.Allow, "deny:", config.Deny)
+		log.Println("knock:", config.Knock, "knockip:", config.KnockIP)
+		log.Println("handshake:", config.Handshake, "serverpub:", config.ServerPub, "rekeyvolume:", config.RekeyVolume, "rekeyperiod:", config.RekeyPeriod)
+		if config.Proxy != "" {
+			proxy, err := generic.ParseProxy(config.Proxy)
+			checkError(err)
+			log.Println("proxy:", proxy.Scheme+"://"+proxy.Addr)
+		}
 
 		// parameters check
 		if config.SmuxVer > maxSmuxVer {
 			log.Fatal("unsupported smux version:", config.SmuxVer)
 		}
 
-		log.Println("initiating key derivation")
-		pass := pbkdf2.Key([]byte(config.Key), []byte(SALT), 4096, 32, sha1.New)
-		log.Println("key derivation done")
-		var block kcp.BlockCrypt
-		switch config.Crypt {
-		case "null":
-			block = nil
-		case "sm4":
-			block, _ = kcp.NewSM4BlockCrypt(pass[:16])
-		case "tea":
-			block, _ = kcp.NewTEABlockCrypt(pass[:16])
-		case "xor":
-			block, _ = kcp.NewSimpleXORBlockCrypt(pass)
-		case "none":
-			block, _ = kcp.NewNoneBlockCrypt(pass)
-		case "aes-128":
-			block, _ = kcp.NewAESBlockCrypt(pass[:16])
-		case "aes-192":
-			block, _ = kcp.NewAESBlockCrypt(pass[:24])
-		case "blowfish":
-			block, _ = kcp.NewBlowfishBlockCrypt(pass)
-		case "twofish":
-			block, _ = kcp.NewTwofishBlockCrypt(pass)
-		case "cast5":
-			block, _ = kcp.NewCast5BlockCrypt(pass[:16])
-		case "3des":
-			block, _ = kcp.NewTripleDESBlockCrypt(pass[:24])
-		case "xtea":
-			block, _ = kcp.NewXTEABlockCrypt(pass[:16])
-		case "salsa20":
-			block, _ = kcp.NewSalsa20BlockCrypt(pass)
-		default:
-			config.Crypt = "aes"
-			block, _ = kcp.NewAESBlockCrypt(pass)
+		deriveKey := func(password, rawKey string) []byte {
+			if rawKey != "" {
+				key, err := generic.DecodeRawKey(rawKey)
+				checkError(err)
+				log.Println("using raw key")
+				return key
+			}
+			log.Println("initiating key derivation:", config.KDF, config.KDFParams)
+			key, err := generic.DeriveKey(password, config.KDF, config.KDFSalt, config.KDFParams)
+			checkError(err)
+			log.Println("key derivation done")
+			return key
 		}
+		pass := deriveKey(config.Key, config.RawKey)
+		method, block, crypt, err := generic.NewCrypt(config.Crypt, pass)
+		checkError(err)
+		config.Crypt = method
 
-		createConn := func() (*smux.Session, error) {
-			kcpconn, err := dial(&config, block)
+		var ring *generic.KeyRing
+		if config.NextKey != "" || config.NextRawKey != "" { // the staged key replaces the key at switchat
+			switchAt, err := time.Parse(time.RFC3339, config.SwitchAt)
 			if err != nil {
-				return nil, errors.Wrap(err, "dial()")
+				log.Fatal("--nextkey requires --switchat: ", err)
+			}
+			if config.NextCrypt == "" {
+				config.NextCrypt = config.Crypt
+			}
+			next, err := generic.NewRingKey("next", config.NextCrypt, deriveKey(config.NextKey, config.NextRawKey))
+			checkError(err)
+			next.From = switchAt
+			cur, err := generic.NewRingKey("current", config.Crypt, pass)
+			checkError(err)
+			ring = generic.NewKeyRing(false, cur, next)
+			block, crypt = nil, ring
+			if d := time.Until(switchAt); d > 0 {
+				time.AfterFunc(d, func() { log.Println("switched to the next key") })
+			}
+		}
+		if config.User != "" { // packets carry the key id of the user, outside of the encryption
+			if crypt == nil {
+				crypt = generic.NewBlockPacketCrypt(block)
+				block = nil
+			}
+			crypt = generic.NewKeyIDCrypt(config.User, crypt)
+		}
+		currentKey := func() []byte {
+			if ring != nil {
+				return ring.Current().PSK
 			}
+			return pass
+		}
+		st := &stack{block: block, crypt: crypt}
+		if (config.SessionStats || config.Capture != "") && st.crypt == nil { // packets are counted and captured in plaintext
+			st.block, st.crypt = nil, generic.NewBlockPacketCrypt(block)
+		}
+		if config.AntiProbe {
+			if st.crypt == nil { // tokens are encrypted like other packets
+				st.block, st.crypt = nil, generic.NewBlockPacketCrypt(block)
+			}
+			st.tokenKey = currentKey
+		}
+		if config.Knock != "" {
+			st.knockKey = currentKey
+		}
+
+		var handshake *generic.HandshakeConfig
+		if config.Handshake {
+			handshake = &generic.HandshakeConfig{
+				PSK:           pass,
+				RekeyBytes:    int64(config.RekeyVolume) << 20,
+				RekeyInterval: time.Duration(config.RekeyPeriod) * time.Second,
+			}
+			if config.ServerPub != "" {
+				key, err := generic.DecodeKey(config.ServerPub)
+				checkError(err)
+				handshake.ServerKey = key
+			}
+		}
+
+		createConn := func(f Forward) (*smux.Session, *generic.SessionStats, error) {
+			kcpconn, err := dial(&config, st)
+			if err != nil {
+				return nil, nil, errors.Wrap(err, "dial()")
+			}
+			kcpconn.stats = generic.TrackSession(kcpconn.UDPSession, f.LocalAddr)
 			kcpconn.SetStreamMode(true)
 			kcpconn.SetWriteDelay(false)
 			kcpconn.SetNoDelay(config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
 			kcpconn.SetWindowSize(config.SndWnd, config.RcvWnd)
-			kcpconn.SetMtu(config.MTU)
+			if st.crypt != nil { // room for the packet encryption
+				kcpconn.SetMtu(config.MTU - st.crypt.Overhead())
+			} else {
+				kcpconn.SetMtu(config.MTU)
+			}
 			kcpconn.SetACKNoDelay(config.AckNodelay)
 
+			slog := logSession.With("session", kcpconn.stats.ID(), "remote", kcpconn.RemoteAddr(), "local", kcpconn.LocalAddr())
 			if err := kcpconn.SetDSCP(config.DSCP); err != nil {
-				log.Println("SetDSCP:", err)
+				slog.Warn("SetDSCP failed", "err", err)
 			}
 			if err := kcpconn.SetReadBuffer(config.SockBuf); err != nil {
-				log.Println("SetReadBuffer:", err)
+				slog.Warn("SetReadBuffer failed", "err", err)
 			}
 			if err := kcpconn.SetWriteBuffer(config.SockBuf); err != nil {
-				log.Println("SetWriteBuffer:", err)
+				slog.Warn("SetWriteBuffer failed", "err", err)
 			}
-			log.Println("smux version:", config.SmuxVer, "on connection:", kcpconn.LocalAddr(), "->", kcpconn.RemoteAddr())
+			slog.Info("session opened", "smux", config.SmuxVer, "route", f.Route)
 			smuxConfig := smux.DefaultConfig()
 			smuxConfig.Version = config.SmuxVer
 			smuxConfig.MaxReceiveBuffer = config.SmuxBuf
@@ -415,62 +945,158 @@ func main() {
 				log.Fatalf("%+v", err)
 			}
 
+			var conn net.Conn = kcpconn.stats.Conn(kcpconn)
+			if handshake != nil {
+				h := *handshake
+				if ring != nil { // the key the session starts with
+					h.PSK = ring.Current().PSK
+				}
+				secure, err := h.Client(conn)
+				if err != nil {
+					kcpconn.Close()
+					return nil, nil, errors.Wrap(err, "handshake")
+				}
+				conn = secure
+			}
+			if config.Credential != "" {
+				if err := generic.PresentCredential(conn, config.Credential); err != nil {
+					conn.Close()
+					return nil, nil, err
+				}
+			}
+
 			// stream multiplex
-			var session *smux.Session
-			if config.NoComp {
-				session, err = smux.Client(kcpconn, smuxConfig)
-			} else {
-				session, err = smux.Client(generic.NewCompStream(kcpconn), smuxConfig)
+			if !config.NoComp {
+				comp := generic.NewCompStream(conn)
+				kcpconn.stats.SetComp(comp)
+				conn = comp
+			}
+			if f.Route != "" {
+				if err := generic.WriteRoute(conn, f.Route); err != nil {
+					conn.Close()
+					return nil, nil, err
+				}
 			}
+			conn = capture.Stream(conn, kcpconn.GetConv())
+			session, err := smux.Client(conn, smuxConfig)
 			if err != nil {
-				return nil, errors.Wrap(err, "createConn()")
+				return nil, nil, errors.Wrap(err, "createConn()")
 			}
-			return session, nil
+			kcpconn.stats.SetCloser(session)
+			return session, kcpconn.stats, nil
 		}
 
 		// wait until a connection is ready
-		waitConn := func() *smux.Session {
+		waitConn := func(f Forward) (*smux.Session, *generic.SessionStats) {
 			for {
-				if session, err := createConn(); err == nil {
-					return session
+				if session, stats, err := createConn(f); err == nil {
+					return session, stats
 				} else {
-					log.Println("re-connecting:", err)
+					logSession.Warn("re-connecting", "local", f.LocalAddr, "err", err)
 					time.Sleep(time.Second)
 				}
 			}
 		}
 
 		// start snmp logger
-		go generic.SnmpLogger(config.SnmpLog, config.SnmpPeriod)
+		checkError(generic.CheckSnmpFormat(config.SnmpFormat))
+		snmpLog := generic.SnmpLogConfig{
+			Path:     config.SnmpLog,
+			Interval: config.SnmpPeriod,
+			Format:   config.SnmpFormat,
+			Delta:    config.SnmpDelta,
+			Keep:     config.SnmpKeep,
+			MaxSize:  int64(config.SnmpMaxSize) << 20,
+		}
+		go generic.SnmpLogger(snmpLog)
+		go generic.SessionLogger(snmpLog)
+		if config.Metrics != "" {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", generic.MetricsHandler())
+			go func() { checkError(http.ListenAndServe(config.Metrics, mux)) }()
+		}
+		var acl *generic.ACL
+		if len(config.Allow) > 0 || len(config.Deny) > 0 {
+			acl, err = generic.NewACL(config.Allow, config.Deny)
+			checkError(err)
+			go acl.Watch(reloadPeriod)
+		}
 
 		// start scavenger
 		chScavenger := make(chan timedSession, 128)
 		go scavenger(chScavenger, &config)
 
-		// start listener
-		numconn := uint16(config.Conn)
-		muxes := make([]timedSession, numconn)
-		rr := uint16(0)
-		for {
-			p1, err := listener.Accept()
-			if err != nil {
-				log.Fatalf("%+v", err)
-			}
-			idx := rr % numconn
-
-			// do auto expiration && reconnection
-			if muxes[idx].session == nil || muxes[idx].session.IsClosed() ||
-				(config.AutoExpire > 0 && time.Now().After(muxes[idx].expiryDate)) {
-				muxes[idx].session = waitConn()
-				muxes[idx].expiryDate = time.Now().Add(time.Duration(config.AutoExpire) * time.Second)
-				if config.AutoExpire > 0 { // only when autoexpire set
-					chScavenger <- muxes[idx]
+		// forward the connections of each listener through its own sessions
+		fw := newForwarder(func(f Forward, listener net.Listener) {
+			numconn := uint16(config.Conn)
+			muxes := make([]timedSession, numconn)
+			rr := uint16(0)
+			for {
+				p1, err := listener.Accept()
+				if errors.Is(err, net.ErrClosed) { // removed
+					closeWhenIdle(muxes)
+					return
+				} else if err != nil {
+					log.Fatalf("%+v", err)
+				}
+				if acl != nil && !acl.Allowed(p1.RemoteAddr()) {
+					atomic.AddUint64(&generic.DefaultSnmp.ACLRejects, 1)
+					logStream.Info("connection denied", "remote", p1.RemoteAddr(), "local", p1.LocalAddr())
+					p1.Close()
+					continue
 				}
+				idx := rr % numconn
+
+				// do auto expiration && reconnection
+				if muxes[idx].session == nil || muxes[idx].session.IsClosed() ||
+					(config.AutoExpire > 0 && time.Now().After(muxes[idx].expiryDate)) {
+					reason := ""
+					if muxes[idx].session != nil {
+						atomic.AddUint64(&generic.DefaultSnmp.Reconnects, 1)
+						reason = "closed"
+						if !muxes[idx].session.IsClosed() {
+							reason = "expired"
+						}
+					}
+					muxes[idx].session, muxes[idx].stats = waitConn(f)
+					if reason != "" {
+						e := generic.SessionEvent(generic.EventReconnect, muxes[idx].stats.Snapshot())
+						e.Reason = reason
+						generic.FireHook(e)
+					}
+					muxes[idx].expiryDate = time.Now().Add(time.Duration(config.AutoExpire) * time.Second)
+					if config.AutoExpire > 0 { // only when autoexpire set
+						chScavenger <- muxes[idx]
+					}
+				}
+
+				go handleClient(muxes[idx].session, muxes[idx].stats, p1)
+				rr++
 			}
+		})
+		if config.LocalAddr != "" {
+			checkError(fw.add(Forward{config.LocalAddr, config.Route}))
+		}
+		for _, f := range config.Forwards {
+			checkError(fw.add(f))
+		}
 
-			go handleClient(muxes[idx].session, p1, config.Quiet)
-			rr++
+		if config.Admin != "" {
+			admin := generic.NewAdmin(config.AdminToken, &config, config.Pprof)
+			// the sessions closed are dialed again on the next connection
+			admin.Handle("/reconnect", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost {
+					http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+					return
+				}
+				fmt.Fprintf(w, "{\"closed\": %v}\n", generic.CloseSessions())
+			}))
+			admin.Handle("/forwards", fw.handler())
+			admin.Handle("/config/save", fw.saveHandler(c.String("c")))
+			go func() { checkError(generic.ServeAdmin(config.Admin, admin)) }()
 		}
+
+		select {}
 	}
 	myApp.Run(os.Args)
 }
@@ -490,6 +1116,7 @@ func scavenger(ch chan timedSession, config *Config) {
 		case item := <-ch:
 			sessionList = append(sessionList, timedSession{
 				item.session,
+				item.stats,
 				item.expiryDate.Add(time.Duration(config.ScavengeTTL) * time.Second)})
 		case <-ticker.C:
 			if len(sessionList) == 0 {
@@ -500,10 +1127,10 @@ func scavenger(ch chan timedSession, config *Config) {
 			for k := range sessionList {
 				s := sessionList[k]
 				if s.session.IsClosed() {
-					log.Println("scavenger: session normally closed:", s.session.LocalAddr())
+					logSession.Info("session closed", "session", s.stats.ID(), "local", s.session.LocalAddr())
 				} else if time.Now().After(s.expiryDate) {
 					s.session.Close()
-					log.Println("scavenger: session closed due to ttl:", s.session.LocalAddr())
+					logSession.Info("session expired", "session", s.stats.ID(), "local", s.session.LocalAddr())
 				} else {
 					newList = append(newList, sessionList[k])
 				}
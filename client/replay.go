@@ -0,0 +1,106 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"github.com/xtaci/kcptun/generic"
+)
+
+// replayFlags are the flags of the replay subcommand
+var replayFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "remoteaddr, r",
+		Value: "vps:29900",
+		Usage: "kcp server address",
+	},
+	cli.StringFlag{
+		Name:   "key",
+		Value:  "it's a secrect",
+		Usage:  "pre-shared secret between client and server",
+		EnvVar: "KCPTUN_KEY",
+	},
+	cli.StringFlag{
+		Name:  "kdf",
+		Value: "pbkdf2",
+		Usage: "key derivation function: pbkdf2, argon2id, scrypt",
+	},
+	cli.StringFlag{
+		Name:  "kdfsalt",
+		Value: SALT,
+		Usage: "salt of the key derivation",
+	},
+	cli.StringFlag{
+		Name:  "kdfparams",
+		Value: "",
+		Usage: "cost of the key derivation",
+	},
+	cli.StringFlag{
+		Name:   "rawkey",
+		Value:  "",
+		Usage:  "hex encoded 256-bit key used as is, instead of deriving one from --key",
+		EnvVar: "KCPTUN_RAWKEY",
+	},
+	cli.StringFlag{
+		Name:  "crypt",
+		Value: "aes",
+		Usage: "cipher of the packets, as --crypt of the client",
+	},
+	cli.Float64Flag{
+		Name:  "speed",
+		Value: 1,
+		Usage: "speed of the replay against the capture, as fast as possible if 0",
+	},
+	cli.DurationFlag{
+		Name:  "wait",
+		Value: 3 * time.Second,
+		Usage: "time waited for the replies after the last packet",
+	},
+}
+
+// replay sends the packets sent by the client in a capture to a server
+// again, the server must run without --user, --antiprobe and --knock, and
+// with the routes of the capture. Captures of sessions with --handshake,
+// and so with --credential, can't be replayed, their keys being ephemeral.
+func replay(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errors.New("replay requires a capture file")
+	}
+	f, err := os.Open(c.Args().First())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	var key []byte
+	if c.String("rawkey") != "" {
+		key, err = generic.DecodeRawKey(c.String("rawkey"))
+	} else {
+		key, err = generic.DeriveKey(c.String("key"), c.String("kdf"), c.String("kdfsalt"), c.String("kdfparams"))
+	}
+	if err != nil {
+		return err
+	}
+	_, block, crypt, err := generic.NewCrypt(c.String("crypt"), key)
+	if err != nil {
+		return err
+	}
+	if crypt == nil {
+		crypt = generic.NewBlockPacketCrypt(block)
+	}
+
+	stats, err := generic.Replay(f, generic.ReplayConfig{
+		RemoteAddr: c.String("remoteaddr"),
+		Crypt:      crypt,
+		Speed:      c.Float64("speed"),
+		Wait:       c.Duration("wait"),
+	})
+	if err != nil {
+		return err
+	}
+	log.Println("sessions:", stats.Sessions, "packets:", stats.Packets, "replies:", stats.Replies)
+	return nil
+}
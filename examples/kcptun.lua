@@ -0,0 +1,122 @@
+-- Wireshark dissector of the captures of kcptun (--capture), install it in
+-- the personal Lua plugins folder, or: wireshark -X lua_script:kcptun.lua kcptun.pcap
+--
+-- every packet is a record of link type USER0, little endian:
+-- | VERSION(1B) | KIND(1B) | DIR(1B) | RESERVED(1B) | CONV(4B) | FEC SEQID(4B) | PORT(2B) | ADDR(16B) | DATA |
+-- DATA is the KCP segments of a packet, or a smux frame
+
+local kcptun = Proto("kcptun", "kcptun capture")
+local kcp = Proto("kcp", "KCP segment")
+local smux = Proto("smux", "smux frame")
+
+local kinds = { [0] = "kcp", [1] = "fec data", [2] = "fec recovered", [3] = "smux" }
+local dirs = { [0] = "client -> server", [1] = "server -> client" }
+local cmds = { [81] = "PUSH", [82] = "ACK", [83] = "WASK", [84] = "WINS" }
+local smuxcmds = { [0] = "SYN", [1] = "FIN", [2] = "PSH", [3] = "NOP", [4] = "UPD" }
+
+local f = kcptun.fields
+f.version = ProtoField.uint8("kcptun.version", "Version")
+f.kind = ProtoField.uint8("kcptun.kind", "Kind", base.DEC, kinds)
+f.dir = ProtoField.uint8("kcptun.dir", "Direction", base.DEC, dirs)
+f.conv = ProtoField.uint32("kcptun.conv", "Conversation", base.HEX)
+f.fecseq = ProtoField.uint32("kcptun.fecseq", "FEC seqid")
+f.port = ProtoField.uint16("kcptun.port", "Peer port")
+f.addr = ProtoField.ipv6("kcptun.addr", "Peer address")
+
+local k = kcp.fields
+k.conv = ProtoField.uint32("kcp.conv", "Conversation", base.HEX)
+k.cmd = ProtoField.uint8("kcp.cmd", "Command", base.DEC, cmds)
+k.frg = ProtoField.uint8("kcp.frg", "Fragment")
+k.wnd = ProtoField.uint16("kcp.wnd", "Window")
+k.ts = ProtoField.uint32("kcp.ts", "Timestamp")
+k.sn = ProtoField.uint32("kcp.sn", "Sequence number")
+k.una = ProtoField.uint32("kcp.una", "Unacknowledged")
+k.len = ProtoField.uint32("kcp.len", "Length")
+k.data = ProtoField.bytes("kcp.data", "Data")
+
+local s = smux.fields
+s.ver = ProtoField.uint8("smux.ver", "Version")
+s.cmd = ProtoField.uint8("smux.cmd", "Command", base.DEC, smuxcmds)
+s.len = ProtoField.uint16("smux.len", "Length")
+s.sid = ProtoField.uint32("smux.sid", "Stream")
+s.data = ProtoField.bytes("smux.data", "Data")
+
+local function dissect_kcp(buf, pinfo, tree)
+    local off, summary = 0, {}
+    while buf:len() - off >= 24 do
+        local len = buf(off + 20, 4):le_uint()
+        if len > buf:len() - off - 24 then
+            break
+        end
+        local cmd = buf(off + 4, 1):uint()
+        local sn = buf(off + 12, 4):le_uint()
+        local t = tree:add(kcp, buf(off, 24 + len))
+        t:add_le(k.conv, buf(off, 4))
+        t:add(k.cmd, buf(off + 4, 1))
+        t:add(k.frg, buf(off + 5, 1))
+        t:add_le(k.wnd, buf(off + 6, 2))
+        t:add_le(k.ts, buf(off + 8, 4))
+        t:add_le(k.sn, buf(off + 12, 4))
+        t:add_le(k.una, buf(off + 16, 4))
+        t:add_le(k.len, buf(off + 20, 4))
+        if len > 0 then
+            t:add(k.data, buf(off + 24, len))
+        end
+        t:append_text(string.format(", %s sn=%d len=%d", cmds[cmd] or cmd, sn, len))
+        summary[#summary + 1] = string.format("%s sn=%d", cmds[cmd] or cmd, sn)
+        off = off + 24 + len
+    end
+    return table.concat(summary, ", ")
+end
+
+local function dissect_smux(buf, pinfo, tree)
+    if buf:len() < 8 then
+        return ""
+    end
+    local cmd = buf(1, 1):uint()
+    local len = buf(2, 2):le_uint()
+    local sid = buf(4, 4):le_uint()
+    local t = tree:add(smux, buf())
+    t:add(s.ver, buf(0, 1))
+    t:add(s.cmd, buf(1, 1))
+    t:add_le(s.len, buf(2, 2))
+    t:add_le(s.sid, buf(4, 4))
+    if len > 0 and buf:len() > 8 then
+        t:add(s.data, buf(8))
+    end
+    return string.format("%s stream=%d len=%d", smuxcmds[cmd] or cmd, sid, len)
+end
+
+function kcptun.dissector(buf, pinfo, tree)
+    if buf:len() <= 30 then
+        return
+    end
+    pinfo.cols.protocol = "kcptun"
+    local kind = buf(1, 1):uint()
+    local dir = buf(2, 1):uint()
+    local t = tree:add(kcptun, buf(0, 30))
+    t:add(f.version, buf(0, 1))
+    t:add(f.kind, buf(1, 1))
+    t:add(f.dir, buf(2, 1))
+    t:add_le(f.conv, buf(4, 4))
+    if kind == 1 or kind == 2 then
+        t:add_le(f.fecseq, buf(8, 4))
+    end
+    t:add_le(f.port, buf(12, 2))
+    t:add(f.addr, buf(14, 16))
+
+    local data = buf(30):tvb()
+    local info
+    if kind == 3 then
+        pinfo.cols.protocol = "smux"
+        info = dissect_smux(data, pinfo, tree)
+    else
+        pinfo.cols.protocol = "kcp"
+        info = dissect_kcp(data, pinfo, tree)
+    end
+    pinfo.cols.info = string.format("%s conv=%08x %s%s", dirs[dir] or dir, buf(4, 4):le_uint(),
+        kind == 2 and "[recovered] " or "", info)
+end
+
+local encap = wtap_encaps and wtap_encaps.USER0 or wtap.USER0
+DissectorTable.get("wtap_encap"):add(encap, kcptun)
@@ -0,0 +1,175 @@
+package generic
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/smux"
+)
+
+// the ways a stream ends, as logged in the access log
+const (
+	EndLocalEOF    = "local_eof"    // the local side closed first
+	EndRemoteClose = "remote_close" // the other end of the tunnel closed first
+	EndDialError   = "dial_error"   // the target or the stream could not be opened
+	EndNoRoute     = "no_route"     // the route of the session is unknown
+	EndDenied      = "denied"       // the user or credential may not connect to the target
+	EndTimeout     = "timeout"
+	EndError       = "error"
+)
+
+// EndReason returns how a stream ended, after the copy from its local side,
+// or from the other end of the tunnel, returned err, io.EOF for the copies
+// from smux streams
+func EndReason(local bool, err error) string {
+	var ne net.Error
+	closed := err == nil || errors.Is(err, io.EOF)
+	switch {
+	case closed && local:
+		return EndLocalEOF
+	case closed:
+		return EndRemoteClose
+	case errors.Is(err, smux.ErrTimeout) || (errors.As(err, &ne) && ne.Timeout()):
+		return EndTimeout
+	}
+	return EndError
+}
+
+// AccessRecord is the record of a stream in the access log
+type AccessRecord struct {
+	Start    time.Time
+	Session  uint64
+	Stream   uint32
+	Source   string // address of the client of the stream
+	Target   string
+	BytesIn  int64 // from the source to the target
+	BytesOut int64 // from the target to the source
+	End      string
+}
+
+// accessFields are the fields of the records, in order
+var accessFields = []string{"start", "duration", "session", "stream", "source", "target", "bytesin", "bytesout", "end"}
+
+// accessFormats are the formats of the access log by name, templates of {field}
+var accessFormats = map[string]string{
+	"text": "{start} {source} -> {target} session={session} stream={stream} in={bytesin} out={bytesout} duration={duration} end={end}",
+}
+
+var accessPlaceholder = regexp.MustCompile(`{[a-z]+}`)
+
+// accessField returns the index of the field of the placeholder p, -1 if none
+func accessField(p string) int {
+	for i, field := range accessFields {
+		if p[1:len(p)-1] == field {
+			return i
+		}
+	}
+	return -1
+}
+
+// values returns the values of r by field, the duration until now in milliseconds
+func (r *AccessRecord) values(now time.Time) []interface{} {
+	return []interface{}{r.Start.Format("2006-01-02T15:04:05.000Z07:00"), now.Sub(r.Start).Milliseconds(),
+		r.Session, r.Stream, r.Source, r.Target, r.BytesIn, r.BytesOut, r.End}
+}
+
+// AccessLogConfig is the config of the access log
+type AccessLogConfig struct {
+	Path    string  // "-" for stdout
+	Format  string  // "text", "json", or a template like "{source} {target} {end}"
+	Sample  float64 // share of the streams logged, those ending on an error always are
+	MaxSize int64   // of the file in bytes before it is rotated, never if 0
+	Keep    int     // rotated files kept
+}
+
+// AccessLog logs a record of every stream, a nil AccessLog logs nothing
+type AccessLog struct {
+	format string
+	sample float64
+	w      io.Writer
+	mu     sync.Mutex
+}
+
+// NewAccessLog opens the access log, nil if config.Path is empty
+func NewAccessLog(config AccessLogConfig) (*AccessLog, error) {
+	if config.Path == "" {
+		return nil, nil
+	}
+	format := config.Format
+	if f, ok := accessFormats[format]; ok {
+		format = f
+	} else if format != "json" {
+		for _, p := range accessPlaceholder.FindAllString(format, -1) {
+			if accessField(p) < 0 {
+				return nil, errors.Errorf("unknown access log field: %v", p)
+			}
+		}
+		if !accessPlaceholder.MatchString(format) {
+			return nil, errors.Errorf("unknown access log format: %v", format)
+		}
+	}
+	if config.Sample <= 0 || config.Sample > 1 {
+		return nil, errors.Errorf("access log sample out of (0, 1]: %v", config.Sample)
+	}
+
+	a := &AccessLog{format: format, sample: config.Sample, w: os.Stdout}
+	if config.Path != "-" {
+		f, err := newFileSink(config.Path, config.MaxSize, config.Keep)
+		if err != nil {
+			return nil, err
+		}
+		logs.mu.Lock()
+		logs.files = append(logs.files, f)
+		logs.mu.Unlock()
+		a.w = f
+	}
+	return a, nil
+}
+
+// Log logs r as ending now, if sampled
+func (a *AccessLog) Log(r *AccessRecord) {
+	if a == nil {
+		return
+	}
+	failed := r.End != EndLocalEOF && r.End != EndRemoteClose
+	if !failed && a.sample < 1 && rand.Float64() >= a.sample {
+		return
+	}
+
+	var b bytes.Buffer
+	values := r.values(time.Now())
+	if a.format == "json" {
+		b.WriteByte('{')
+		for i, field := range accessFields {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			v, _ := json.Marshal(values[i])
+			fmt.Fprintf(&b, "%q:%s", field, v)
+		}
+		b.WriteByte('}')
+	} else {
+		b.WriteString(accessPlaceholder.ReplaceAllStringFunc(a.format, func(p string) string {
+			if i := accessField(p); i >= 0 {
+				return fmt.Sprint(values[i])
+			}
+			return p
+		}))
+	}
+	b.WriteByte('\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.w.Write(b.Bytes()); err != nil {
+		logAccess.Error("access log failed", "err", err)
+	}
+}
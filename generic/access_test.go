@@ -0,0 +1,65 @@
+package generic
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+func TestEndReason(t *testing.T) {
+	if EndReason(true, nil) != EndLocalEOF || EndReason(false, nil) != EndRemoteClose || EndReason(false, io.EOF) != EndRemoteClose ||
+		EndReason(false, smux.ErrTimeout) != EndTimeout || EndReason(true, os.ErrDeadlineExceeded) != EndTimeout ||
+		EndReason(false, io.ErrClosedPipe) != EndError {
+		t.Fatal("unexpected reasons")
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	dir := t.TempDir()
+	for _, format := range []string{"xml", "{source} {bytes}"} {
+		if _, err := NewAccessLog(AccessLogConfig{Path: filepath.Join(dir, "x.log"), Format: format, Sample: 1}); err == nil {
+			t.Fatal("invalid format accepted", format)
+		}
+	}
+	if a, err := NewAccessLog(AccessLogConfig{}); a != nil || err != nil {
+		t.Fatal("access log without path")
+	}
+
+	record := &AccessRecord{Start: time.Now().Add(-time.Second), Session: 1, Stream: 3, Source: "10.0.0.1:4000",
+		Target: "127.0.0.1:22", BytesIn: 100, BytesOut: 2000, End: EndRemoteClose}
+	path := filepath.Join(dir, "access.log")
+	a, err := NewAccessLog(AccessLogConfig{Path: path, Format: "json", Sample: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Log(record)
+	var entry map[string]interface{}
+	b, _ := os.ReadFile(path)
+	if err := json.Unmarshal(b, &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["source"] != "10.0.0.1:4000" || entry["bytesout"] != 2000.0 || entry["end"] != "remote_close" || entry["duration"].(float64) < 1000 {
+		t.Fatal("unexpected record", string(b))
+	}
+
+	// only the failed streams out of a tiny sample
+	path = filepath.Join(dir, "sampled.log")
+	a, err = NewAccessLog(AccessLogConfig{Path: path, Format: "{stream} {end}", Sample: 1e-9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		a.Log(record)
+	}
+	record.End = EndDialError
+	a.Log(record)
+	if b, _ := os.ReadFile(path); strings.TrimSpace(string(b)) != "3 dial_error" {
+		t.Fatal("unexpected records", string(b))
+	}
+}
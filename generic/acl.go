@@ -0,0 +1,208 @@
+package generic
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ACL is a list of the source addresses allowed and denied, as IPs or
+// CIDRs, IPv4 or IPv6. An entry "@path" is a file of entries, one per line,
+// with # comments, read again by Reload when modified.
+//
+// Denied addresses are rejected; if an allow list is configured, all other
+// addresses are rejected too, every address if it is empty, as a truncated
+// file.
+type ACL struct {
+	allow, deny []string // entries as configured
+
+	allowNets, denyNets []*net.IPNet
+	modTimes            map[string]time.Time // of the files
+	mu                  sync.RWMutex
+}
+
+// NewACL creates an ACL of the entries allowed and denied
+func NewACL(allow, deny []string) (*ACL, error) {
+	a := &ACL{allow: allow, deny: deny}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// load parses the entries, and reads the files
+func (a *ACL) load() error {
+	modTimes := make(map[string]time.Time)
+	allowNets, err := parseACLEntries(a.allow, modTimes)
+	if err != nil {
+		return err
+	}
+	denyNets, err := parseACLEntries(a.deny, modTimes)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.allowNets, a.denyNets, a.modTimes = allowNets, denyNets, modTimes
+	a.mu.Unlock()
+	return nil
+}
+
+// Reload reads the files again if any was modified
+func (a *ACL) Reload() error {
+	a.mu.RLock()
+	modified := false
+	for path, modTime := range a.modTimes {
+		if fi, err := os.Stat(path); err != nil || !fi.ModTime().Equal(modTime) {
+			modified = true
+		}
+	}
+	a.mu.RUnlock()
+	if !modified {
+		return nil
+	}
+	if err := a.load(); err != nil {
+		return err
+	}
+	a.mu.RLock()
+	logACL.Info("acl loaded", "allowed", len(a.allowNets), "denied", len(a.denyNets))
+	a.mu.RUnlock()
+	return nil
+}
+
+// Watch reloads the ACL every interval
+func (a *ACL) Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := a.Reload(); err != nil {
+			logACL.Error("acl reload failed", "err", err)
+		}
+	}
+}
+
+// parseACLEntries parses entries, or lists of entries separated by commas,
+// recording the modification time of the files
+func parseACLEntries(entries []string, modTimes map[string]time.Time) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(strings.Join(entries, ","), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		if !strings.HasPrefix(entry, "@") {
+			n, err := parseCIDR(entry)
+			if err != nil {
+				return nil, err
+			}
+			nets = append(nets, n)
+			continue
+		}
+
+		path := entry[1:]
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		modTimes[path] = fi.ModTime()
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for line := 1; scanner.Scan(); line++ {
+			text := scanner.Text()
+			if i := strings.IndexByte(text, '#'); i >= 0 {
+				text = text[:i]
+			}
+			if text = strings.TrimSpace(text); text == "" {
+				continue
+			}
+			n, err := parseCIDR(text)
+			if err != nil {
+				return nil, errors.Wrapf(err, "%v:%v", path, line)
+			}
+			nets = append(nets, n)
+		}
+	}
+	return nets, nil
+}
+
+// parseCIDR parses a CIDR, or an IP as a network of its own
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, errors.Errorf("invalid address: %v", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return n, nil
+}
+
+// Allowed reports whether the source address addr is allowed, unix socket
+// addresses always are
+func (a *ACL) Allowed(addr net.Addr) bool {
+	if _, ok := addr.(*net.UnixAddr); ok {
+		return true
+	}
+	ip := addrIP(addr)
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, n := range a.denyNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, n := range a.allowNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Gate returns conn dropping the packets of the addresses not allowed
+func (a *ACL) Gate(conn net.PacketConn) *ACLGate {
+	return &ACLGate{conn, a}
+}
+
+// ACLGate is a net.PacketConn dropping the packets of the addresses not
+// allowed by an ACL, see ACL.Gate.
+type ACLGate struct {
+	net.PacketConn
+	acl *ACL
+}
+
+// ReadFrom implements the PacketConn ReadFrom method.
+func (g *ACLGate) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		n, addr, err = g.PacketConn.ReadFrom(p)
+		if err != nil || g.acl.Allowed(addr) {
+			return n, addr, err
+		}
+		atomic.AddUint64(&DefaultSnmp.ACLDrops, 1)
+	}
+}
+
+// SetReadBuffer sets the socket read buffer of the underlying connection
+func (g *ACLGate) SetReadBuffer(bytes int) error { return SetReadBuffer(g.PacketConn, bytes) }
+
+// SetWriteBuffer sets the socket write buffer of the underlying connection
+func (g *ACLGate) SetWriteBuffer(bytes int) error { return SetWriteBuffer(g.PacketConn, bytes) }
+
+// SetDSCP sets DSCP of the underlying connection
+func (g *ACLGate) SetDSCP(dscp int) error { return SetDSCP(g.PacketConn, dscp) }
@@ -0,0 +1,69 @@
+package generic
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestACL(t *testing.T) {
+	addr := func(ip string) net.Addr { return &net.UDPAddr{IP: net.ParseIP(ip), Port: 1} }
+	path := filepath.Join(t.TempDir(), "deny.txt")
+	if err := os.WriteFile(path, []byte("# denied\n10.1.0.0/16\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewACL([]string{"10.0.0.0/33"}, nil); err == nil {
+		t.Fatal("invalid CIDR accepted")
+	}
+
+	acl, err := NewACL([]string{"10.0.0.0/8, 2001:db8::/32", "192.168.1.1"}, []string{"@" + path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, allowed := range map[string]bool{
+		"10.2.3.4":    true,
+		"10.1.3.4":    false,
+		"192.168.1.1": true,
+		"192.168.1.2": false,
+		"2001:db8::1": true,
+		"2001:db9::1": false,
+	} {
+		if acl.Allowed(addr(ip)) != allowed {
+			t.Fatal("unexpected decision for", ip)
+		}
+	}
+	if !acl.Allowed(&net.TCPAddr{IP: net.ParseIP("10.2.3.4")}) || !acl.Allowed(&net.UnixAddr{Name: "@kcptun"}) {
+		t.Fatal("unexpected decision for other networks")
+	}
+
+	// the file of denied addresses is modified
+	os.WriteFile(path, []byte("10.2.0.0/16\n"), 0600)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	if err := acl.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if acl.Allowed(addr("10.2.3.4")) || !acl.Allowed(addr("10.1.3.4")) {
+		t.Fatal("file not reloaded")
+	}
+}
+
+func TestACLEmptyAllowList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allow.txt")
+	if err := os.WriteFile(path, []byte("# truncated\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	acl, err := NewACL([]string{"@" + path}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acl.Allowed(&net.UDPAddr{IP: net.ParseIP("10.2.3.4"), Port: 1}) {
+		t.Fatal("allowed by an empty allow list")
+	}
+
+	acl, _ = NewACL(nil, []string{"10.1.0.0/16"})
+	if !acl.Allowed(&net.UDPAddr{IP: net.ParseIP("10.2.3.4"), Port: 1}) {
+		t.Fatal("denied without an allow list")
+	}
+}
@@ -0,0 +1,294 @@
+package generic
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// secret fields of the configs, hidden by the admin API
+var adminSecrets = map[string]bool{
+	"key": true, "rawkey": true, "prevkey": true, "prevrawkey": true,
+	"nextkey": true, "nextrawkey": true, "admintoken": true, "credential": true,
+}
+
+// fields of the configs holding URLs, or lists of them, served without
+// their userinfo and query
+var adminURLs = map[string]bool{"proxy": true, "hooks": true}
+
+// Admin is the admin API, serving as JSON the sessions with their streams
+// and the effective config, and closing sessions and streams, to requests
+// carrying its token as "Authorization: Bearer TOKEN".
+type Admin struct {
+	token  string
+	config interface{}
+	mux    *http.ServeMux
+}
+
+// adminSession is a session as served by the admin API
+type adminSession struct {
+	ID         uint64        `json:"id"`
+	Listener   string        `json:"listener"`
+	Remote     string        `json:"remote"`
+	Transport  string        `json:"transport"`
+	Conv       string        `json:"conv"`
+	Age        float64       `json:"age"` // seconds
+	Streams    int           `json:"streams"`
+	SRTT       int64         `json:"srtt"` // milliseconds
+	RTO        int64         `json:"rto"`  // milliseconds
+	BytesIn    uint64        `json:"bytesin"`
+	BytesOut   uint64        `json:"bytesout"`
+	PktsIn     uint64        `json:"pktsin"`
+	PktsOut    uint64        `json:"pktsout"`
+	Retrans    uint64        `json:"retrans"`
+	Recovered  uint64        `json:"recovered"`
+	CompSaved  int64         `json:"compsaved"`
+	StreamList []adminStream `json:"streamlist,omitempty"`
+}
+
+// adminStream is a stream as served by the admin API
+type adminStream struct {
+	ID       uint32  `json:"id"`
+	Age      float64 `json:"age"` // seconds
+	BytesIn  uint64  `json:"bytesin"`
+	BytesOut uint64  `json:"bytesout"`
+}
+
+// NewAdmin creates the admin API of the config, a struct with json tags,
+// with the profiles of net/http/pprof if pprofiles is set
+func NewAdmin(token string, config interface{}, pprofiles bool) *Admin {
+	a := &Admin{token: token, config: config, mux: http.NewServeMux()}
+	a.mux.HandleFunc("/sessions", a.serveSessions)
+	a.mux.HandleFunc("/sessions/", a.serveSession)
+	a.mux.HandleFunc("/config", a.serveConfig)
+	if pprofiles {
+		a.mux.HandleFunc("/debug/pprof/", pprof.Index)
+		a.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		a.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		a.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		a.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return a
+}
+
+// Handle registers the handler for the pattern, behind the token
+func (a *Admin) Handle(pattern string, handler http.Handler) {
+	a.mux.Handle(pattern, handler)
+}
+
+// ServeHTTP serves the requests carrying the token
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a.token != "" {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(a.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+// ServeAdmin serves the admin API on addr, a unix socket if not host:port,
+// a token is required on TCP
+func ServeAdmin(addr string, a *Admin) error {
+	network := "tcp"
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		network = "unix"
+	}
+	if network == "tcp" && a.token == "" {
+		return errors.New("admin token required on tcp")
+	}
+	lis, err := net.Listen(network, addr)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(http.Serve(lis, a))
+}
+
+// serveSessions serves GET /sessions
+func (a *Admin) serveSessions(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	list := []adminSession{}
+	for _, s := range Sessions() {
+		list = append(list, newAdminSession(&s, false))
+	}
+	writeJSON(w, list)
+}
+
+// serveSession serves GET /sessions/ID, GET /sessions/ID/streams,
+// POST /sessions/ID/close and POST /sessions/ID/streams/SID/close
+func (a *Admin) serveSession(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/sessions/"), "/")
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	var snap *SessionSnapshot
+	for _, s := range Sessions() {
+		if s.ID == id {
+			snap = &s
+			break
+		}
+	}
+	if snap == nil {
+		http.Error(w, "no such session", http.StatusNotFound)
+		return
+	}
+
+	switch route := strings.Join(parts[1:], "/"); {
+	case route == "" || route == "streams":
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		as := newAdminSession(snap, true)
+		if route == "" {
+			writeJSON(w, as)
+		} else {
+			writeJSON(w, as.StreamList)
+		}
+	case route == "close":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		CloseSession(id)
+		writeJSON(w, map[string]uint64{"closed": id})
+	case len(parts) == 4 && parts[1] == "streams" && parts[3] == "close":
+		sid, err := strconv.ParseUint(parts[2], 10, 32)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		if !CloseStream(id, uint32(sid)) {
+			http.Error(w, "no such stream", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, map[string]uint64{"closed": sid})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveConfig serves GET /config, without the secrets
+func (a *Admin) serveConfig(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	b, err := json.Marshal(a.config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var config map[string]interface{}
+	if err := json.Unmarshal(b, &config); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for name, value := range config {
+		if adminSecrets[name] && value != "" {
+			config[name] = "******"
+		}
+		if adminURLs[name] {
+			switch v := value.(type) {
+			case string:
+				config[name] = redactURL(v)
+			case []interface{}:
+				for i := range v {
+					if s, ok := v[i].(string); ok {
+						v[i] = redactURL(s)
+					}
+				}
+			}
+		}
+	}
+	writeJSON(w, config)
+}
+
+// redactURL removes the userinfo and the query of the URL in s, which may
+// follow the events of a hook, other values are returned as is
+func redactURL(s string) string {
+	prefix := ""
+	if i, j := strings.Index(s, "="), strings.Index(s, "://"); i > 0 && i < j {
+		prefix, s = s[:i+1], s[i+1:]
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return prefix + s
+	}
+	u.User = nil
+	if u.RawQuery != "" {
+		u.RawQuery = "******"
+	}
+	return prefix + u.String()
+}
+
+// RedactURLs returns the hooks in list with their URLs redacted, to be logged
+func RedactURLs(list []string) []string {
+	redacted := make([]string, len(list))
+	for i := range list {
+		redacted[i] = redactURL(list[i])
+	}
+	return redacted
+}
+
+// newAdminSession converts the snapshot of a session, with its streams if streams is set
+func newAdminSession(s *SessionSnapshot, streams bool) adminSession {
+	as := adminSession{
+		ID:        s.ID,
+		Listener:  s.Listener,
+		Remote:    s.Remote,
+		Transport: s.Transport,
+		Conv:      fmt.Sprintf("%08x", s.Conv),
+		Age:       s.Duration.Seconds(),
+		Streams:   len(s.StreamsAlive),
+		SRTT:      s.SRTT.Milliseconds(),
+		RTO:       s.RTO.Milliseconds(),
+		BytesIn:   s.BytesIn,
+		BytesOut:  s.BytesOut,
+		PktsIn:    s.PktsIn,
+		PktsOut:   s.PktsOut,
+		Retrans:   s.Retrans,
+		Recovered: s.Recovered,
+		CompSaved: s.CompSaved,
+	}
+	if streams {
+		as.StreamList = []adminStream{}
+		for _, ss := range s.StreamsAlive {
+			as.StreamList = append(as.StreamList, adminStream{ss.ID, ss.Duration.Seconds(), ss.BytesIn, ss.BytesOut})
+		}
+	}
+	return as
+}
+
+// allowMethod replies an error to the requests of other methods than method
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+// writeJSON writes v as indented JSON
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
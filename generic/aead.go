@@ -0,0 +1,356 @@
+package generic
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	aeadSaltSize    = 8
+	aeadTimeSize    = 8
+	aeadCounterSize = 8
+	aeadHeaderSize  = aeadSaltSize + aeadTimeSize + aeadCounterSize
+	aeadInfo        = "kcptun aead"
+	replayWindow    = 1024             // packets accepted out of order, in bits
+	replayExpire    = 30 * time.Minute // senders idle longer are forgotten
+	replayMaxAge    = time.Minute      // packets stamped further from now are stale
+)
+
+var (
+	errAuthentication = errors.New("message authentication failed")
+	errReplay         = errors.New("replayed packet")
+	errStale          = errors.New("stale packet")
+)
+
+// PacketCrypt encrypts whole packets, unlike kcp.BlockCrypt it may change
+// their size, and it may reject packets.
+type PacketCrypt interface {
+	// Seal appends p encrypted for addr to dst
+	Seal(dst, p []byte, addr net.Addr) ([]byte, error)
+	// Open appends p decrypted from addr to dst
+	Open(dst, p []byte, addr net.Addr) ([]byte, error)
+	// Overhead is the size difference between an encrypted and a plain packet
+	Overhead() int
+}
+
+// AEADCrypt is a PacketCrypt authenticating every packet, and dropping
+// replays through a sliding window.
+//
+// A packet on the wire is | SALT(8B) | TIME(8B) | COUNTER(8B) | CIPHERTEXT | TAG(16B) |,
+// the sender picks a random salt for every destination, encrypts with a
+// subkey derived from the shared key and the salt, and numbers its packets
+// with the counter used as nonce. Receivers keep a replay window for every
+// salt seen recently, whatever address it comes from.
+//
+// TIME is the sending time in unix milliseconds, authenticated with the
+// header. Packets stamped more than replayMaxAge away from now, or before the
+// receiver started, are dropped, so a salt forgotten once idle, or by a
+// restart, can't be replayed. The clocks of both ends must be in sync.
+type AEADCrypt struct {
+	newAEAD  func(key []byte) (cipher.AEAD, error)
+	key      []byte
+	overhead int
+	start    int64 // unix milliseconds
+
+	senders   map[string]*aeadSender
+	receivers map[[aeadSaltSize]byte]*aeadReceiver
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+// aeadSender is the sending state to a destination
+type aeadSender struct {
+	salt    [aeadSaltSize]byte
+	aead    cipher.AEAD
+	counter uint64
+	seen    time.Time
+}
+
+// aeadReceiver is the receiving state of a remote salt
+type aeadReceiver struct {
+	aead   cipher.AEAD
+	last   uint64 // highest counter received
+	bitmap [replayWindow / 64]uint64
+	seen   time.Time
+}
+
+// NewAEADCrypt creates an AEADCrypt of method "aes-gcm" or
+// "chacha20-poly1305" with a 32 bytes key.
+func NewAEADCrypt(method string, key []byte) (*AEADCrypt, error) {
+	c := new(AEADCrypt)
+	switch method {
+	case "aes-gcm":
+		c.newAEAD = func(key []byte) (cipher.AEAD, error) {
+			block, err := aes.NewCipher(key)
+			if err != nil {
+				return nil, err
+			}
+			return cipher.NewGCM(block)
+		}
+	case "chacha20-poly1305":
+		c.newAEAD = chacha20poly1305.New
+	default:
+		return nil, errors.Errorf("unknown aead: %v", method)
+	}
+	if len(key) != 32 {
+		return nil, errors.New("aead key must be 32 bytes")
+	}
+	c.key = append([]byte(nil), key...)
+
+	aead, err := c.newAEAD(c.key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	c.overhead = aeadHeaderSize + aead.Overhead()
+	c.senders = make(map[string]*aeadSender)
+	c.receivers = make(map[[aeadSaltSize]byte]*aeadReceiver)
+	c.start = time.Now().UnixNano() / int64(time.Millisecond)
+	return c, nil
+}
+
+// subkey derives the cipher of salt
+func (c *AEADCrypt) subkey(salt []byte) (cipher.AEAD, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, c.key, salt, []byte(aeadInfo)), key); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	aead, err := c.newAEAD(key)
+	return aead, errors.WithStack(err)
+}
+
+// sweep forgets idle peers, c.mu held
+func (c *AEADCrypt) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < replayExpire {
+		return
+	}
+	for addr, s := range c.senders {
+		if now.Sub(s.seen) > replayExpire {
+			delete(c.senders, addr)
+		}
+	}
+	for salt, r := range c.receivers {
+		if now.Sub(r.seen) > replayExpire {
+			delete(c.receivers, salt)
+		}
+	}
+	c.lastSweep = now
+}
+
+// nonce fills the nonce of a counter, the counter is right-aligned
+func nonce(buf []byte, counter uint64) []byte {
+	for i := range buf {
+		buf[i] = 0
+	}
+	binary.BigEndian.PutUint64(buf[len(buf)-aeadCounterSize:], counter)
+	return buf
+}
+
+// Overhead returns the header and tag size
+func (c *AEADCrypt) Overhead() int { return c.overhead }
+
+// Seal implements PacketCrypt
+func (c *AEADCrypt) Seal(dst, p []byte, addr net.Addr) ([]byte, error) {
+	return c.seal(dst, p, addr, time.Now())
+}
+
+// seal encrypts p stamped with now
+func (c *AEADCrypt) seal(dst, p []byte, addr net.Addr, now time.Time) ([]byte, error) {
+	c.mu.Lock()
+	c.sweep(now)
+	s, ok := c.senders[addr.String()]
+	if !ok {
+		s = new(aeadSender)
+		if _, err := io.ReadFull(rand.Reader, s.salt[:]); err != nil {
+			c.mu.Unlock()
+			return nil, errors.WithStack(err)
+		}
+		aead, err := c.subkey(s.salt[:])
+		if err != nil {
+			c.mu.Unlock()
+			return nil, err
+		}
+		s.aead = aead
+		c.senders[addr.String()] = s
+	}
+	s.seen = now
+	counter := s.counter
+	s.counter++
+	c.mu.Unlock()
+
+	var hdr [aeadHeaderSize]byte
+	copy(hdr[:], s.salt[:])
+	binary.BigEndian.PutUint64(hdr[aeadSaltSize:], uint64(now.UnixNano()/int64(time.Millisecond)))
+	binary.BigEndian.PutUint64(hdr[aeadSaltSize+aeadTimeSize:], counter)
+	dst = append(dst, hdr[:]...)
+
+	var nbuf [chacha20poly1305.NonceSize]byte
+	return s.aead.Seal(dst, nonce(nbuf[:s.aead.NonceSize()], counter), p, hdr[:]), nil
+}
+
+// Open implements PacketCrypt, packets failing authentication, stale or
+// replayed are rejected.
+func (c *AEADCrypt) Open(dst, p []byte, addr net.Addr) ([]byte, error) {
+	if len(p) < c.overhead {
+		return nil, errors.WithStack(errAuthentication)
+	}
+	var salt [aeadSaltSize]byte
+	copy(salt[:], p)
+	stamp := int64(binary.BigEndian.Uint64(p[aeadSaltSize:]))
+	counter := binary.BigEndian.Uint64(p[aeadSaltSize+aeadTimeSize:])
+
+	now := time.Now()
+	c.mu.Lock()
+	c.sweep(now)
+	r, ok := c.receivers[salt]
+	if ok && !r.check(counter) {
+		c.mu.Unlock()
+		return nil, errors.WithStack(errReplay)
+	}
+	c.mu.Unlock()
+
+	// the subkey of an unknown salt is derived without holding c.mu
+	var aead cipher.AEAD
+	if ok {
+		aead = r.aead
+	} else {
+		var err error
+		if aead, err = c.subkey(salt[:]); err != nil {
+			return nil, err
+		}
+	}
+
+	var nbuf [chacha20poly1305.NonceSize]byte
+	dst, err := aead.Open(dst, nonce(nbuf[:aead.NonceSize()], counter), p[aeadHeaderSize:], p[:aeadHeaderSize])
+	if err != nil {
+		return nil, errors.WithStack(errAuthentication)
+	}
+
+	// the stamp is checked once authenticated, garbage fails authentication
+	age := now.UnixNano()/int64(time.Millisecond) - stamp
+	if stamp < c.start || age > int64(replayMaxAge/time.Millisecond) || -age > int64(replayMaxAge/time.Millisecond) {
+		return nil, errors.WithStack(errStale)
+	}
+
+	// only authenticated senders are remembered, the window is checked
+	// again as the same packet may have been opened meanwhile
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cur, found := c.receivers[salt]; found {
+		r = cur
+	} else if r == nil {
+		r = &aeadReceiver{aead: aead}
+	}
+	if !r.check(counter) {
+		return nil, errors.WithStack(errReplay)
+	}
+	r.update(counter)
+	r.seen = now
+	c.receivers[salt] = r
+	return dst, nil
+}
+
+// check tells whether counter is new to the window
+func (p *aeadReceiver) check(counter uint64) bool {
+	if counter > p.last {
+		return true
+	}
+	if p.last-counter >= replayWindow {
+		return false
+	}
+	idx := counter % replayWindow
+	return p.bitmap[idx/64]&(1<<(idx%64)) == 0
+}
+
+// update slides the window to counter if it's ahead, and marks it
+func (p *aeadReceiver) update(counter uint64) {
+	if counter > p.last {
+		if counter-p.last >= replayWindow {
+			p.bitmap = [replayWindow / 64]uint64{}
+		} else {
+			for i := p.last + 1; i < counter; i++ {
+				idx := i % replayWindow
+				p.bitmap[idx/64] &^= 1 << (idx % 64)
+			}
+		}
+		p.last = counter
+	}
+	idx := counter % replayWindow
+	p.bitmap[idx/64] |= 1 << (idx % 64)
+}
+
+// countCryptError counts a packet rejected by a PacketCrypt
+func countCryptError(err error) {
+	switch errors.Cause(err) {
+	case errReplay, errStale:
+		atomic.AddUint64(&DefaultSnmp.ReplayDrops, 1)
+	case errUnknownKey:
+		atomic.AddUint64(&DefaultSnmp.UnknownKeys, 1)
+	default:
+		atomic.AddUint64(&DefaultSnmp.CryptErrs, 1)
+	}
+}
+
+// CryptConn is a net.PacketConn encrypting the packets written to it, and
+// decrypting the packets read from it, packets failing to decrypt are dropped.
+type CryptConn struct {
+	net.PacketConn
+	crypt PacketCrypt
+}
+
+// NewCryptConn encrypts the packets over conn with crypt
+func NewCryptConn(conn net.PacketConn, crypt PacketCrypt) *CryptConn {
+	return &CryptConn{conn, crypt}
+}
+
+// ReadFrom implements the PacketConn ReadFrom method.
+func (c *CryptConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	buf := peekBuf.Get().([]byte)
+	defer peekBuf.Put(buf)
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		plain, err := c.crypt.Open(p[:0], buf[:n], addr)
+		if err != nil {
+			countCryptError(err)
+			continue
+		}
+		return copy(p, plain), addr, nil
+	}
+}
+
+// WriteTo implements the PacketConn WriteTo method.
+func (c *CryptConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	buf := peekBuf.Get().([]byte)
+	defer peekBuf.Put(buf)
+	sealed, err := c.crypt.Seal(buf[:0], p, addr)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.PacketConn.WriteTo(sealed, addr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// SetReadBuffer sets the socket read buffer of the underlying connection
+func (c *CryptConn) SetReadBuffer(bytes int) error { return SetReadBuffer(c.PacketConn, bytes) }
+
+// SetWriteBuffer sets the socket write buffer of the underlying connection
+func (c *CryptConn) SetWriteBuffer(bytes int) error { return SetWriteBuffer(c.PacketConn, bytes) }
+
+// SetDSCP sets DSCP of the underlying connection
+func (c *CryptConn) SetDSCP(dscp int) error { return SetDSCP(c.PacketConn, dscp) }
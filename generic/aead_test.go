@@ -0,0 +1,156 @@
+package generic
+
+import (
+	"crypto/sha1"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go/v5"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const benchPacketSize = 1350
+
+var (
+	testKey  = pbkdf2.Key([]byte("it's a secrect"), []byte("kcp-go"), 4096, 32, sha1.New)
+	testAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 29900}
+)
+
+func TestAEADCrypt(t *testing.T) {
+	for _, method := range []string{"aes-gcm", "chacha20-poly1305"} {
+		sender, err := NewAEADCrypt(method, testKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		receiver, err := NewAEADCrypt(method, testKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var packets [][]byte
+		for i := 0; i < replayWindow+10; i++ {
+			p, _ := sender.Seal(nil, []byte{byte(i), byte(i >> 8)}, testAddr)
+			if len(p) != 2+sender.Overhead() {
+				t.Fatal(method, "unexpected overhead", len(p)-2)
+			}
+			packets = append(packets, p)
+		}
+
+		// out of order within the window
+		for _, i := range []int{1, 0, 3, 2} {
+			plain, err := receiver.Open(nil, packets[i], testAddr)
+			if err != nil || plain[0] != byte(i) {
+				t.Fatal(method, "packet", i, err)
+			}
+		}
+		if _, err := receiver.Open(nil, packets[2], testAddr); err == nil {
+			t.Fatal(method, "replay accepted")
+		}
+
+		// tampered
+		p := append([]byte(nil), packets[4]...)
+		p[len(p)-1] ^= 1
+		if _, err := receiver.Open(nil, p, testAddr); err == nil {
+			t.Fatal(method, "tampered packet accepted")
+		}
+		if _, err := receiver.Open(nil, packets[4], testAddr); err != nil {
+			t.Fatal(method, err)
+		}
+
+		// too old once the window has moved on
+		if _, err := receiver.Open(nil, packets[replayWindow+9], testAddr); err != nil {
+			t.Fatal(method, err)
+		}
+		if _, err := receiver.Open(nil, packets[5], testAddr); err == nil {
+			t.Fatal(method, "packet older than the window accepted")
+		}
+
+		// a different key
+		other, _ := NewAEADCrypt(method, make([]byte, 32))
+		if _, err := other.Open(nil, packets[6], testAddr); err == nil {
+			t.Fatal(method, "opened with a wrong key")
+		}
+
+		// garbage fails authentication, whatever its stamp
+		if _, err := receiver.Open(nil, make([]byte, 64), testAddr); errors.Cause(err) != errAuthentication {
+			t.Fatal(method, "garbage not rejected as unauthenticated", err)
+		}
+
+		// forgotten by a restart, or stamped too far from now
+		restarted, _ := NewAEADCrypt(method, testKey)
+		restarted.start++
+		if _, err := restarted.Open(nil, packets[7], testAddr); err == nil {
+			t.Fatal(method, "packet sent before a restart accepted")
+		}
+		for _, d := range []time.Duration{-2 * replayMaxAge, 2 * replayMaxAge} {
+			p, _ := sender.seal(nil, []byte{1}, testAddr, time.Now().Add(d))
+			receiver.start = 0
+			if _, err := receiver.Open(nil, p, testAddr); err == nil {
+				t.Fatal(method, "stale packet accepted", d)
+			}
+		}
+	}
+}
+
+func benchmarkPacketCrypt(b *testing.B, method string) {
+	sender, err := NewAEADCrypt(method, testKey)
+	if err != nil {
+		b.Fatal(err)
+	}
+	receiver, _ := NewAEADCrypt(method, testKey)
+	data := make([]byte, benchPacketSize-sender.Overhead())
+	buf := make([]byte, 0, mtuLimit)
+	plain := make([]byte, 0, mtuLimit)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p, _ := sender.Seal(buf[:0], data, testAddr)
+		if _, err := receiver.Open(plain[:0], p, testAddr); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAESGCM(b *testing.B)           { benchmarkPacketCrypt(b, "aes-gcm") }
+func BenchmarkChaCha20Poly1305(b *testing.B) { benchmarkPacketCrypt(b, "chacha20-poly1305") }
+
+// the kcp-go ciphers, encrypting and decrypting in place
+func benchmarkBlockCrypt(b *testing.B, block kcp.BlockCrypt) {
+	data := make([]byte, benchPacketSize)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data) - cryptHeaderSize))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		block.Encrypt(data, data)
+		block.Decrypt(data, data)
+	}
+}
+
+func BenchmarkAES(b *testing.B) {
+	block, _ := kcp.NewAESBlockCrypt(testKey)
+	benchmarkBlockCrypt(b, block)
+}
+
+func BenchmarkAES128(b *testing.B) {
+	block, _ := kcp.NewAESBlockCrypt(testKey[:16])
+	benchmarkBlockCrypt(b, block)
+}
+
+func BenchmarkSalsa20(b *testing.B) {
+	block, _ := kcp.NewSalsa20BlockCrypt(testKey)
+	benchmarkBlockCrypt(b, block)
+}
+
+func BenchmarkBlowfish(b *testing.B) {
+	block, _ := kcp.NewBlowfishBlockCrypt(testKey)
+	benchmarkBlockCrypt(b, block)
+}
+
+func BenchmarkXOR(b *testing.B) {
+	block, _ := kcp.NewSimpleXORBlockCrypt(testKey)
+	benchmarkBlockCrypt(b, block)
+}
@@ -0,0 +1,288 @@
+package generic
+
+import (
+	"encoding/binary"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// BanKind is a kind of failure counted towards a ban
+type BanKind int
+
+const (
+	BanCsum BanKind = iota // packets failing to decrypt or authenticate
+	BanKCP                 // decrypted packets not shaped as KCP
+	BanSmux                // smux sessions with invalid frames
+	banKinds
+)
+
+var banKindNames = [banKinds]string{"csum", "kcp", "smux"}
+
+const banWindow = time.Minute // failures are counted over this window
+
+// ParseBanThresholds parses thresholds of failures per minute, like
+// "csum=20,kcp=20,smux=3", 0 or missing kinds are never banned for.
+func ParseBanThresholds(s string) (thresholds [banKinds]int, err error) {
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return thresholds, errors.Errorf("invalid ban threshold: %v", kv)
+		}
+		n, err := strconv.Atoi(parts[1])
+		if err != nil || n < 0 {
+			return thresholds, errors.Errorf("invalid ban threshold: %v", kv)
+		}
+		kind := banKinds
+		for k, name := range banKindNames {
+			if name == parts[0] {
+				kind = BanKind(k)
+			}
+		}
+		if kind == banKinds {
+			return thresholds, errors.Errorf("unknown failure: %v", parts[0])
+		}
+		thresholds[kind] = n
+	}
+	return thresholds, nil
+}
+
+// Banner bans the source addresses exceeding thresholds of failures per
+// minute, packets of banned sources are dropped before they are decrypted.
+//
+// A ban lasts banTime, doubled at every ban of the same source, up to
+// banMax; a source without bans for banMax starts over. If hook is set it
+// is run as "hook ban IP SECONDS" at every ban, to add the source to a
+// firewall set, its entry is meant to time out after SECONDS.
+//
+// UDP sources are easily spoofed: the packet failures of a source which sent
+// a valid packet within banWindow aren't counted, nor are replayed or stale
+// packets, still anyone may get an idle address banned.
+type Banner struct {
+	thresholds      [banKinds]int
+	banTime, banMax time.Duration
+	hook            string
+
+	sources   map[string]*banSource // by ip
+	lastSweep time.Time
+	mu        sync.RWMutex
+}
+
+type banSource struct {
+	failures    [banKinds]int
+	windowStart time.Time
+	until       time.Time // banned until
+	bans        int       // bans in a row
+	valid       time.Time // of the latest valid packet
+}
+
+// NewBanner creates a Banner
+func NewBanner(thresholds [banKinds]int, banTime, banMax time.Duration, hook string) *Banner {
+	b := new(Banner)
+	b.thresholds = thresholds
+	b.banTime = banTime
+	b.banMax = banMax
+	b.hook = hook
+	b.sources = make(map[string]*banSource)
+	b.lastSweep = time.Now()
+	return b
+}
+
+// Banned reports whether the source of addr is banned
+func (b *Banner) Banned(addr net.Addr) bool {
+	now := time.Now()
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	s, ok := b.sources[addrIP(addr).String()]
+	return ok && now.Before(s.until)
+}
+
+// valid records a valid packet from addr, its source has a session in
+// progress
+func (b *Banner) valid(addr net.Addr) {
+	ip := addrIP(addr).String()
+	now := time.Now()
+	b.mu.RLock()
+	s, ok := b.sources[ip]
+	fresh := ok && now.Sub(s.valid) < time.Second
+	b.mu.RUnlock()
+	if fresh {
+		return
+	}
+
+	b.mu.Lock()
+	if s, ok = b.sources[ip]; !ok {
+		s = new(banSource)
+		b.sources[ip] = s
+	}
+	s.valid = now
+	b.mu.Unlock()
+}
+
+// Fail counts a failure of kind from addr, and bans its source over the
+// threshold, packet failures of a source with a session in progress aren't
+// counted
+func (b *Banner) Fail(addr net.Addr, kind BanKind) {
+	if b.thresholds[kind] == 0 {
+		return
+	}
+	ip := addrIP(addr).String()
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, ok := b.sources[ip]
+	if !ok {
+		s = new(banSource)
+		b.sources[ip] = s
+	}
+	if now.Before(s.until) { // packets already in flight
+		return
+	}
+	if kind != BanSmux && now.Sub(s.valid) < banWindow {
+		return
+	}
+	if now.Sub(s.windowStart) > banWindow {
+		s.failures = [banKinds]int{}
+		s.windowStart = now
+	}
+	if s.bans > 0 && now.Sub(s.until) > b.banMax {
+		s.bans = 0
+	}
+
+	s.failures[kind]++
+	if s.failures[kind] >= b.thresholds[kind] {
+		d := b.banTime << uint(s.bans)
+		if d >= b.banMax {
+			d = b.banMax
+		} else {
+			s.bans++
+		}
+		s.until = now.Add(d)
+		s.failures = [banKinds]int{}
+		atomic.AddUint64(&DefaultSnmp.Bans, 1)
+		logBan.Warn("banned", "remote", ip, "for", d, "failures", b.thresholds[kind], "kind", banKindNames[kind])
+		if b.hook != "" {
+			go b.runHook(ip, d)
+		}
+		FireHook(&HookEvent{Event: EventBan, Remote: ip, Duration: d.Seconds(), Reason: banKindNames[kind]})
+	}
+
+	if now.Sub(b.lastSweep) > banWindow {
+		for ip, s := range b.sources {
+			if now.Sub(s.windowStart) > banWindow && now.Sub(s.until) > b.banMax && now.Sub(s.valid) > banWindow {
+				delete(b.sources, ip)
+			}
+		}
+		b.lastSweep = now
+	}
+}
+
+// runHook runs the ban hook for ip banned for d
+func (b *Banner) runHook(ip string, d time.Duration) {
+	seconds := strconv.Itoa(int((d + time.Second - 1) / time.Second))
+	if out, err := exec.Command(b.hook, "ban", ip, seconds).CombinedOutput(); err != nil {
+		logBan.Error("ban hook failed", "remote", ip, "err", err, "output", strings.TrimSpace(string(out)))
+	}
+}
+
+// Crypt returns crypt counting the packets it fails to open, but the
+// replayed and stale ones, which may be duplicates of valid packets
+func (b *Banner) Crypt(crypt PacketCrypt) PacketCrypt {
+	return &banCrypt{crypt, b}
+}
+
+type banCrypt struct {
+	PacketCrypt
+	banner *Banner
+}
+
+// Open implements PacketCrypt
+func (c *banCrypt) Open(dst, p []byte, addr net.Addr) ([]byte, error) {
+	plain, err := c.PacketCrypt.Open(dst, p, addr)
+	if err != nil {
+		switch errors.Cause(err) {
+		case errReplay, errStale:
+		default:
+			c.banner.Fail(addr, BanCsum)
+		}
+	}
+	return plain, err
+}
+
+// Gate returns the raw socket conn dropping the packets of banned sources
+func (b *Banner) Gate(conn net.PacketConn) *BanGate {
+	return &BanGate{conn, b, false}
+}
+
+// Check returns conn, a CryptConn, dropping the decrypted packets not shaped
+// as KCP, counted as failures of their source.
+func (b *Banner) Check(conn net.PacketConn) *BanGate {
+	return &BanGate{conn, b, true}
+}
+
+// BanGate is a net.PacketConn dropping the packets of sources banned by a
+// Banner, or the malformed packets, see Banner.Gate and Banner.Check.
+type BanGate struct {
+	net.PacketConn
+	banner *Banner
+	check  bool
+}
+
+// ReadFrom implements the PacketConn ReadFrom method.
+func (g *BanGate) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		n, addr, err = g.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+		if !g.check && g.banner.Banned(addr) {
+			atomic.AddUint64(&DefaultSnmp.BanDrops, 1)
+			continue
+		}
+		if g.check {
+			if !kcpShaped(p[:n]) {
+				g.banner.Fail(addr, BanKCP)
+				continue
+			}
+			g.banner.valid(addr)
+		}
+		return n, addr, nil
+	}
+}
+
+// SetReadBuffer sets the socket read buffer of the underlying connection
+func (g *BanGate) SetReadBuffer(bytes int) error { return SetReadBuffer(g.PacketConn, bytes) }
+
+// SetWriteBuffer sets the socket write buffer of the underlying connection
+func (g *BanGate) SetWriteBuffer(bytes int) error { return SetWriteBuffer(g.PacketConn, bytes) }
+
+// SetDSCP sets DSCP of the underlying connection
+func (g *BanGate) SetDSCP(dscp int) error { return SetDSCP(g.PacketConn, dscp) }
+
+// kcpShaped reports whether a decrypted packet may be accepted by KCP, a
+// FEC shard or a KCP segment, or a token of ProbeGuard
+func kcpShaped(p []byte) bool {
+	if isToken(p) {
+		return true
+	}
+	if len(p) >= fecHeaderSize {
+		switch binary.LittleEndian.Uint16(p[4:]) {
+		case typeData:
+			return len(p) >= fecHeaderSizePlus2
+		case typeParity:
+			return true
+		}
+	}
+	return len(p) >= kcp.IKCP_OVERHEAD && p[4] >= kcp.IKCP_CMD_PUSH && p[4] <= kcp.IKCP_CMD_WINS
+}
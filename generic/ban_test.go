@@ -0,0 +1,77 @@
+package generic
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBanner(t *testing.T) {
+	if _, err := ParseBanThresholds("csum=3,fec=1"); err == nil {
+		t.Fatal("unknown failure accepted")
+	}
+	thresholds, err := ParseBanThresholds("csum=3, kcp=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewBanner(thresholds, 100*time.Millisecond, time.Second, "")
+	other := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 2}
+
+	// packets failing to decrypt, from any port of the source
+	aead, _ := NewAEADCrypt("aes-gcm", testKey)
+	crypt := b.Crypt(aead)
+	for i := 0; i < 3; i++ {
+		if b.Banned(testAddr) {
+			t.Fatal("banned under the threshold")
+		}
+		crypt.Open(nil, make([]byte, 64), &net.UDPAddr{IP: testAddr.IP, Port: i})
+	}
+	if !b.Banned(testAddr) || b.Banned(other) {
+		t.Fatal("unexpected bans")
+	}
+	b.Fail(other, BanSmux) // not a failure banned for
+	if b.Banned(other) {
+		t.Fatal("banned for smux failures")
+	}
+
+	// the ban ends, and the next one lasts twice as long
+	time.Sleep(150 * time.Millisecond)
+	if b.Banned(testAddr) {
+		t.Fatal("ban not ended")
+	}
+	b.Fail(testAddr, BanKCP)
+	b.Fail(testAddr, BanKCP)
+	time.Sleep(150 * time.Millisecond)
+	if !b.Banned(testAddr) {
+		t.Fatal("ban not escalated")
+	}
+
+	// replayed packets, as duplicated by the network, aren't failures
+	client := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 3}
+	sender, _ := NewAEADCrypt("aes-gcm", testKey)
+	p, _ := sender.Seal(nil, []byte("hello"), client)
+	for i := 0; i < 4; i++ {
+		crypt.Open(nil, p, client)
+	}
+	if b.Banned(client) {
+		t.Fatal("banned for replays")
+	}
+
+	// nor are the packet failures of a source with a session in progress,
+	// spoofed or not
+	b.valid(client)
+	for i := 0; i < 4; i++ {
+		crypt.Open(nil, make([]byte, 64), client)
+		b.Fail(client, BanKCP)
+	}
+	if b.Banned(client) {
+		t.Fatal("source with a session in progress banned")
+	}
+
+	segment := make([]byte, 32)
+	segment[4] = 81
+	token, _ := NewToken(testKey, 1)
+	if !kcpShaped(segment) || !kcpShaped(token) || kcpShaped(segment[:20]) || kcpShaped(make([]byte, 32)) {
+		t.Fatal("unexpected packet shape")
+	}
+}
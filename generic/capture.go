@@ -0,0 +1,588 @@
+package generic
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/reedsolomon"
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go/v5"
+	"golang.org/x/crypto/curve25519"
+)
+
+// a capture is a pcap file of link type LINKTYPE_USER0, every packet of it
+// is a record of the tunnel in plaintext, little endian:
+// | VERSION(1B) | KIND(1B) | DIR(1B) | RESERVED(1B) | CONV(4B) | FEC SEQID(4B) | PORT(2B) | ADDR(16B) | DATA |
+// ADDR is the IPv6, or IPv4-mapped, address of the peer, DATA the KCP
+// segments of a packet, or a smux frame. See examples/kcptun.lua.
+const (
+	captureVersion    = 1
+	captureHeaderSize = 30
+	captureLinkType   = 147 // LINKTYPE_USER0
+	captureSnapLen    = 1 << 18
+	pcapMagic         = 0xa1b2c3d4 // microsecond timestamps
+	pcapHeaderSize    = 24
+	pcapRecordSize    = 16
+	smuxHeaderSize    = 8 // | VER(1B) | CMD(1B) | LENGTH(2B) | SID(4B) |
+)
+
+// the kinds of the records of a capture
+const (
+	CaptureKCP       = iota // the KCP segments of a packet without FEC
+	CaptureFEC              // the KCP segments of a FEC data shard
+	CaptureRecovered        // the KCP segments of a data shard recovered from parity shards
+	CaptureSmux             // a smux frame
+)
+
+// CaptureRecord is a record of a capture
+type CaptureRecord struct {
+	Time     time.Time
+	Kind     byte
+	ToServer bool // sent by the client
+	Conv     uint32
+	SeqID    uint32 // of the FEC shard
+	Addr     *net.UDPAddr
+	Data     []byte
+}
+
+// CaptureConfig is the config of a capture
+type CaptureConfig struct {
+	Path                     string
+	MaxSize                  int64         // bytes written before the capture stops, never if 0
+	Duration                 time.Duration // before the capture stops, never if 0
+	Smux                     bool          // also capture the smux frames
+	Server                   bool          // captured by the server
+	DataShards, ParityShards int
+}
+
+// Capture records the plaintext of the tunnel to a pcap file, until its
+// size or duration is reached, a nil Capture records nothing
+type Capture struct {
+	config  CaptureConfig
+	f       *os.File // nil once stopped
+	size    int64
+	timer   *time.Timer
+	stopped int32
+	mu      sync.Mutex
+}
+
+// NewCapture starts a capture, nil if config.Path is empty
+func NewCapture(config CaptureConfig) (*Capture, error) {
+	if config.Path == "" {
+		return nil, nil
+	}
+	f, err := os.Create(config.Path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var hdr [pcapHeaderSize]byte
+	binary.LittleEndian.PutUint32(hdr[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], captureSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:], captureLinkType)
+	if _, err := f.Write(hdr[:]); err != nil {
+		f.Close()
+		return nil, errors.WithStack(err)
+	}
+
+	c := &Capture{config: config, f: f, size: pcapHeaderSize}
+	if config.Duration > 0 {
+		c.timer = time.AfterFunc(config.Duration, func() {
+			c.mu.Lock()
+			c.stop("duration")
+			c.mu.Unlock()
+		})
+	}
+	logCapture.Info("capture started", "path", config.Path, "maxsize", config.MaxSize, "duration", config.Duration, "smux", config.Smux)
+	return c, nil
+}
+
+// Close stops the capture
+func (c *Capture) Close() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stop("closed")
+	return nil
+}
+
+// stop stops the capture, with c.mu held
+func (c *Capture) stop(reason string) {
+	if c.f == nil {
+		return
+	}
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.f.Close()
+	c.f = nil
+	atomic.StoreInt32(&c.stopped, 1)
+	logCapture.Info("capture stopped", "path", c.config.Path, "reason", reason, "bytes", c.size)
+}
+
+func (c *Capture) active() bool { return atomic.LoadInt32(&c.stopped) == 0 }
+
+// toServer returns whether a packet sent, or received, by this end goes to the server
+func (c *Capture) toServer(out bool) bool { return out != c.config.Server }
+
+// write records data of the kind, stopping the capture once it is full
+func (c *Capture) write(kind byte, toServer bool, conv, seqid uint32, addr net.Addr, data []byte) {
+	now := time.Now()
+	n := captureHeaderSize + len(data)
+	incl := n
+	if incl > captureSnapLen {
+		incl = captureSnapLen
+	}
+	buf := make([]byte, pcapRecordSize+incl)
+	binary.LittleEndian.PutUint32(buf[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(buf[8:], uint32(incl))
+	binary.LittleEndian.PutUint32(buf[12:], uint32(n))
+
+	hdr := buf[pcapRecordSize:]
+	hdr[0] = captureVersion
+	hdr[1] = kind
+	if !toServer {
+		hdr[2] = 1
+	}
+	binary.LittleEndian.PutUint32(hdr[4:], conv)
+	binary.LittleEndian.PutUint32(hdr[8:], seqid)
+	if udpaddr := captureAddr(addr); udpaddr != nil {
+		binary.LittleEndian.PutUint16(hdr[12:], uint16(udpaddr.Port))
+		copy(hdr[14:30], udpaddr.IP.To16())
+	}
+	copy(hdr[captureHeaderSize:], data)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f == nil {
+		return
+	}
+	if c.config.MaxSize > 0 && c.size+int64(len(buf)) > c.config.MaxSize {
+		c.stop("size")
+		return
+	}
+	if _, err := c.f.Write(buf); err != nil {
+		logCapture.Error("capture failed", "path", c.config.Path, "err", err)
+		c.stop("error")
+		return
+	}
+	c.size += int64(len(buf))
+}
+
+// captureAddr returns the ip and port of addr, nil if it has none
+func captureAddr(addr net.Addr) *net.UDPAddr {
+	switch a := addr.(type) {
+	case *ConvAddr:
+		return captureAddr(a.Addr)
+	case *net.UDPAddr:
+		return a
+	case *net.TCPAddr:
+		return &net.UDPAddr{IP: a.IP, Port: a.Port}
+	case nil:
+		return nil
+	}
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	p, err := strconv.Atoi(port)
+	if ip == nil || err != nil {
+		return nil
+	}
+	return &net.UDPAddr{IP: ip, Port: p}
+}
+
+// segmentConv returns the conversation of the KCP segments b
+func segmentConv(b []byte) uint32 {
+	if len(b) < 4 {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+// Conn records the KCP segments of the packets over conn, which must be
+// plaintext, conn itself if c is nil
+func (c *Capture) Conn(conn net.PacketConn) net.PacketConn {
+	if c == nil {
+		return conn
+	}
+	cc := &CaptureConn{PacketConn: conn, c: c, flows: make(map[string]*captureFlow)}
+	if c.config.DataShards > 0 && c.config.ParityShards > 0 {
+		cc.codec, _ = reedsolomon.New(c.config.DataShards, c.config.ParityShards)
+	}
+	return cc
+}
+
+// CaptureConn is a net.PacketConn beneath KCP recording the KCP segments of
+// the packets it sends and receives. The data shards missing from a FEC
+// group are recovered from its parity shards like kcp-go does, the parity
+// shards themselves are not recorded.
+type CaptureConn struct {
+	net.PacketConn
+	c     *Capture
+	codec reedsolomon.Encoder // nil without FEC
+
+	flows map[string]*captureFlow // FEC groups by peer and direction
+	mu    sync.Mutex
+}
+
+// captureFlow is the FEC groups of a peer in one direction
+type captureFlow struct {
+	groups   map[uint32]*captureGroup
+	last     uint32 // latest group
+	lastSeen time.Time
+}
+
+// captureGroup is the shards received of a FEC group, until it is recovered
+type captureGroup struct {
+	shards  [][]byte
+	n, data int
+	done    bool
+}
+
+// ReadFrom implements the PacketConn ReadFrom method.
+func (cc *CaptureConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	n, addr, err = cc.PacketConn.ReadFrom(p)
+	if err == nil {
+		cc.record(p[:n], addr, false)
+	}
+	return n, addr, err
+}
+
+// WriteTo implements the PacketConn WriteTo method.
+func (cc *CaptureConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	n, err = cc.PacketConn.WriteTo(p, addr)
+	if err == nil {
+		cc.record(p, addr, true)
+	}
+	return n, err
+}
+
+// SetReadBuffer sets the socket read buffer of the underlying connection
+func (cc *CaptureConn) SetReadBuffer(bytes int) error { return SetReadBuffer(cc.PacketConn, bytes) }
+
+// SetWriteBuffer sets the socket write buffer of the underlying connection
+func (cc *CaptureConn) SetWriteBuffer(bytes int) error { return SetWriteBuffer(cc.PacketConn, bytes) }
+
+// SetDSCP sets DSCP of the underlying connection
+func (cc *CaptureConn) SetDSCP(dscp int) error { return SetDSCP(cc.PacketConn, dscp) }
+
+// record records the segments of the packet p from or to addr
+func (cc *CaptureConn) record(p []byte, addr net.Addr, out bool) {
+	if !cc.c.active() || len(p) < fecHeaderSizePlus2 {
+		return
+	}
+	toServer := cc.c.toServer(out)
+	switch flag := binary.LittleEndian.Uint16(p[4:]); flag {
+	case typeData, typeParity:
+		if flag == typeData {
+			segments := p[fecHeaderSizePlus2:]
+			cc.c.write(CaptureFEC, toServer, segmentConv(segments), binary.LittleEndian.Uint32(p), addr, segments)
+		}
+		if cc.codec != nil && !out { // nothing to recover from the packets sent
+			cc.recover(p, addr, toServer)
+		}
+	default:
+		cc.c.write(CaptureKCP, toServer, segmentConv(p), 0, addr, p)
+	}
+}
+
+// recover keeps the FEC shard p, and records the data shards of its group
+// recovered once as many shards as data shards arrived
+func (cc *CaptureConn) recover(p []byte, addr net.Addr, toServer bool) {
+	dataShards := cc.c.config.DataShards
+	size := uint32(dataShards + cc.c.config.ParityShards)
+	seqid := binary.LittleEndian.Uint32(p)
+	id, idx := seqid/size, int(seqid%size)
+	key := addr.String() + ">"
+	if !toServer {
+		key = addr.String() + "<"
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	now := time.Now()
+	flow, ok := cc.flows[key]
+	if !ok {
+		for k, f := range cc.flows {
+			if now.Sub(f.lastSeen) > convExpire {
+				delete(cc.flows, k)
+			}
+		}
+		flow = &captureFlow{groups: make(map[uint32]*captureGroup)}
+		cc.flows[key] = flow
+	}
+	flow.lastSeen = now
+	g, ok := flow.groups[id]
+	if !ok {
+		g = &captureGroup{shards: make([][]byte, size)}
+		flow.groups[id] = g
+		if int32(id-flow.last) > 0 {
+			flow.last = id
+		}
+		if len(flow.groups) > fecGroupsKept {
+			for gid := range flow.groups {
+				if int32(flow.last-gid) >= fecGroupsKept/2 {
+					delete(flow.groups, gid)
+				}
+			}
+		}
+	}
+	if g.done || g.shards[idx] != nil {
+		return
+	}
+	g.shards[idx] = append([]byte(nil), p[fecHeaderSize:]...)
+	g.n++
+	if idx < dataShards {
+		g.data++
+	}
+	if g.data == dataShards {
+		g.done, g.shards = true, nil
+		return
+	} else if g.n < dataShards {
+		return
+	}
+
+	// the shards are zero padded to the longest, as the encoder of kcp-go does
+	g.done = true
+	shards := g.shards
+	g.shards = nil
+	maxlen := 0
+	for _, shard := range shards {
+		if len(shard) > maxlen {
+			maxlen = len(shard)
+		}
+	}
+	var missing []int
+	for i, shard := range shards {
+		if shard == nil {
+			if i < dataShards {
+				missing = append(missing, i)
+			}
+			continue
+		}
+		shards[i] = append(shard, make([]byte, maxlen-len(shard))...)
+	}
+	if err := cc.codec.ReconstructData(shards); err != nil {
+		return
+	}
+	for _, i := range missing {
+		r := shards[i]
+		if sz := int(binary.LittleEndian.Uint16(r)); sz >= 2 && sz <= len(r) && sz-2 >= kcp.IKCP_OVERHEAD {
+			cc.c.write(CaptureRecovered, toServer, segmentConv(r[2:sz]), id*size+uint32(i), addr, r[2:sz])
+		}
+	}
+}
+
+// Stream records the smux frames over conn, the session of conv, if the
+// capture includes them, conn itself otherwise
+func (c *Capture) Stream(conn net.Conn, conv uint32) net.Conn {
+	if c == nil || !c.config.Smux {
+		return conn
+	}
+	return &captureStream{Conn: conn, c: c, conv: conv}
+}
+
+// captureStream is a net.Conn beneath smux recording its frames
+type captureStream struct {
+	net.Conn
+	c       *Capture
+	conv    uint32
+	in, out []byte // partial frames
+}
+
+func (s *captureStream) Read(p []byte) (n int, err error) {
+	n, err = s.Conn.Read(p)
+	s.in = s.frames(s.in, p[:n], false)
+	return n, err
+}
+
+func (s *captureStream) Write(p []byte) (n int, err error) {
+	n, err = s.Conn.Write(p)
+	s.out = s.frames(s.out, p[:n], true)
+	return n, err
+}
+
+// frames records the frames completed by p after the partial frame buf,
+// returning the partial frame left
+func (s *captureStream) frames(buf, p []byte, out bool) []byte {
+	if !s.c.active() {
+		return nil
+	}
+	buf = append(buf, p...)
+	for len(buf) >= smuxHeaderSize {
+		n := smuxHeaderSize + int(binary.LittleEndian.Uint16(buf[2:]))
+		if len(buf) < n {
+			break
+		}
+		s.c.write(CaptureSmux, s.c.toServer(out), s.conv, 0, s.RemoteAddr(), buf[:n])
+		buf = buf[n:]
+	}
+	if len(buf) == 0 {
+		return nil
+	}
+	return append([]byte(nil), buf...)
+}
+
+// ReadCapture calls fn on every record of the capture r, until fn returns
+// an error
+func ReadCapture(r io.Reader, fn func(*CaptureRecord) error) error {
+	var hdr [pcapHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return errors.WithStack(err)
+	}
+	if binary.LittleEndian.Uint32(hdr[0:]) != pcapMagic || binary.LittleEndian.Uint32(hdr[20:]) != captureLinkType {
+		return errors.New("not a kcptun capture")
+	}
+
+	var rec [pcapRecordSize]byte
+	for {
+		if _, err := io.ReadFull(r, rec[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.WithStack(err)
+		}
+		incl := binary.LittleEndian.Uint32(rec[8:])
+		if incl > captureSnapLen {
+			return errors.Errorf("capture record too large: %v bytes", incl)
+		}
+		data := make([]byte, incl)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return errors.WithStack(err)
+		}
+		if len(data) < captureHeaderSize || data[0] != captureVersion {
+			return errors.New("invalid capture record")
+		}
+		record := &CaptureRecord{
+			Time:     time.Unix(int64(binary.LittleEndian.Uint32(rec[0:])), int64(binary.LittleEndian.Uint32(rec[4:]))*1000),
+			Kind:     data[1],
+			ToServer: data[2] == 0,
+			Conv:     binary.LittleEndian.Uint32(data[4:]),
+			SeqID:    binary.LittleEndian.Uint32(data[8:]),
+			Addr:     &net.UDPAddr{IP: net.IP(data[14:30]), Port: int(binary.LittleEndian.Uint16(data[12:]))},
+			Data:     data[captureHeaderSize:],
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+}
+
+// ReplayConfig is the config of a replay
+type ReplayConfig struct {
+	RemoteAddr string
+	Crypt      PacketCrypt   // of the packets sent, they are sent in plaintext if nil
+	Speed      float64       // of the replay against the capture, as fast as possible if 0
+	Wait       time.Duration // for the replies after the last packet
+}
+
+// ReplayStats are the statistics of a replay
+type ReplayStats struct {
+	Sessions int
+	Packets  int
+	Replies  uint64
+}
+
+// Replay sends the KCP segments sent to the server in the capture r to
+// config.RemoteAddr, through a socket by conversation so the server sees
+// every session of the capture again, the replies are counted and dropped.
+// It stops at the first session starting with a handshake, whose keys are
+// ephemeral, as do the credentials presented over it.
+func Replay(r io.Reader, config ReplayConfig) (*ReplayStats, error) {
+	raddr, err := net.ResolveUDPAddr("udp", config.RemoteAddr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	stats := new(ReplayStats)
+	var replies uint64
+	conns := make(map[uint32]net.PacketConn)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	var start, first time.Time
+	err = ReadCapture(r, func(rec *CaptureRecord) error {
+		if !rec.ToServer || rec.Kind == CaptureSmux {
+			return nil
+		}
+		if start.IsZero() {
+			start, first = time.Now(), rec.Time
+		} else if config.Speed > 0 {
+			if wait := time.Duration(float64(rec.Time.Sub(first))/config.Speed) - time.Since(start); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+
+		if err := replayable(rec.Data); err != nil {
+			return err
+		}
+		conn, ok := conns[rec.Conv]
+		if !ok {
+			udpconn, err := net.ListenUDP("udp", nil)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			conn = udpconn
+			if config.Crypt != nil {
+				conn = NewCryptConn(conn, config.Crypt)
+			}
+			conns[rec.Conv] = conn
+			stats.Sessions++
+			go func() {
+				buf := make([]byte, mtuLimit)
+				for {
+					if _, _, err := conn.ReadFrom(buf); err != nil {
+						return
+					}
+					atomic.AddUint64(&replies, 1)
+				}
+			}()
+		}
+		if _, err := conn.WriteTo(rec.Data, raddr); err != nil {
+			return errors.WithStack(err)
+		}
+		stats.Packets++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	time.Sleep(config.Wait)
+	stats.Replies = atomic.LoadUint64(&replies)
+	return stats, nil
+}
+
+// replayable returns an error if the KCP segments b start a session with a
+// handshake, the first write of its client, unlike a smux session starting
+// with a SYN or NOP frame
+func replayable(b []byte) error {
+	for len(b) >= kcp.IKCP_OVERHEAD {
+		sn := binary.LittleEndian.Uint32(b[12:])
+		length := binary.LittleEndian.Uint32(b[20:])
+		if uint64(length) > uint64(len(b)-kcp.IKCP_OVERHEAD) {
+			return nil
+		}
+		data := b[kcp.IKCP_OVERHEAD : kcp.IKCP_OVERHEAD+int(length)]
+		if b[4] == kcp.IKCP_CMD_PUSH && sn == 0 && len(data) >= 1+curve25519.PointSize && data[0] == handshakeVersion {
+			smux := len(data) >= smuxHeaderSize && (data[1] == 0 || data[1] == 3) && data[2] == 0 && data[3] == 0
+			if !smux {
+				return errors.Errorf("session %v starts with a handshake, which can't be replayed", segmentConv(b))
+			}
+		}
+		b = b[kcp.IKCP_OVERHEAD+int(length):]
+	}
+	return nil
+}
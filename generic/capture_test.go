@@ -0,0 +1,196 @@
+package generic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/reedsolomon"
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// segment returns a KCP push segment of conv carrying data
+func segment(conv, sn uint32, data string) []byte {
+	seg := make([]byte, kcp.IKCP_OVERHEAD, kcp.IKCP_OVERHEAD+len(data))
+	binary.LittleEndian.PutUint32(seg, conv)
+	seg[4] = kcp.IKCP_CMD_PUSH
+	binary.LittleEndian.PutUint32(seg[12:], sn)
+	binary.LittleEndian.PutUint32(seg[20:], uint32(len(data)))
+	return append(seg, data...)
+}
+
+// fecShards returns the data shards then the parity shard of a FEC group of
+// 2 data shards and 1 parity shard, as kcp-go sends them
+func fecShards(t *testing.T, seqid uint32, segments ...[]byte) [][]byte {
+	maxlen := 0
+	shards := make([][]byte, 3)
+	for i, seg := range segments {
+		shards[i] = make([]byte, fecHeaderSizePlus2, fecHeaderSizePlus2+len(seg))
+		binary.LittleEndian.PutUint32(shards[i], seqid+uint32(i))
+		binary.LittleEndian.PutUint16(shards[i][4:], typeData)
+		binary.LittleEndian.PutUint16(shards[i][fecHeaderSize:], uint16(2+len(seg)))
+		shards[i] = append(shards[i], seg...)
+		if len(shards[i]) > maxlen {
+			maxlen = len(shards[i])
+		}
+	}
+	shards[2] = make([]byte, maxlen)
+	binary.LittleEndian.PutUint32(shards[2], seqid+2)
+	binary.LittleEndian.PutUint16(shards[2][4:], typeParity)
+
+	codec, _ := reedsolomon.New(2, 1)
+	cache := make([][]byte, 3)
+	for i, shard := range shards {
+		padded := append([]byte(nil), shard...)
+		cache[i] = append(padded, make([]byte, maxlen-len(shard))...)[fecHeaderSize:]
+	}
+	if err := codec.Encode(cache); err != nil {
+		t.Fatal(err)
+	}
+	copy(shards[2][fecHeaderSize:], cache[2])
+	return shards
+}
+
+func TestCapture(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kcptun.pcap")
+	c, err := NewCapture(CaptureConfig{Path: path, Smux: true, Server: true, DataShards: 2, ParityShards: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	defer client.Close()
+	conn, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	server := c.Conn(conn)
+	defer server.Close()
+
+	// the second data shard is lost, and recovered from the parity shard
+	shards := fecShards(t, 3, segment(7, 0, "hello"), segment(7, 1, "tunnel!"))
+	for _, p := range [][]byte{shards[0], shards[2]} {
+		client.WriteTo(p, server.LocalAddr())
+		buf := make([]byte, mtuLimit)
+		server.SetReadDeadline(time.Now().Add(time.Second))
+		if _, _, err := server.ReadFrom(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server.WriteTo(segment(7, 0, ""), client.LocalAddr())
+
+	// a smux frame written in two parts
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			if _, err := p2.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	stream := c.Stream(p1, 7)
+	frame := []byte{2, 2, 3, 0, 1, 0, 0, 0, 'a', 'b', 'c'}
+	stream.Write(frame[:5])
+	stream.Write(frame[5:])
+	c.Close()
+
+	var records []*CaptureRecord
+	f, _ := os.Open(path)
+	defer f.Close()
+	if err := ReadCapture(f, func(r *CaptureRecord) error { records = append(records, r); return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 {
+		t.Fatal("unexpected records", len(records))
+	}
+	if r := records[0]; r.Kind != CaptureFEC || !r.ToServer || r.Conv != 7 || r.SeqID != 3 || !bytes.Equal(r.Data, segment(7, 0, "hello")) ||
+		r.Addr.String() != client.LocalAddr().String() {
+		t.Fatal("unexpected record", r)
+	}
+	if r := records[1]; r.Kind != CaptureRecovered || !r.ToServer || r.SeqID != 4 || !bytes.Equal(r.Data, segment(7, 1, "tunnel!")) {
+		t.Fatal("unexpected recovered record", r)
+	}
+	if r := records[2]; r.Kind != CaptureKCP || r.ToServer {
+		t.Fatal("unexpected record", r)
+	}
+	if r := records[3]; r.Kind != CaptureSmux || r.ToServer || r.Conv != 7 || !bytes.Equal(r.Data, frame) {
+		t.Fatal("unexpected smux record", r)
+	}
+
+	// a record larger than the snapshot length
+	data, _ := os.ReadFile(path)
+	binary.LittleEndian.PutUint32(data[pcapHeaderSize+8:], captureSnapLen+1)
+	if err := ReadCapture(bytes.NewReader(data), func(*CaptureRecord) error { return nil }); err == nil {
+		t.Fatal("oversized record accepted")
+	}
+
+	// stopped once full
+	path = filepath.Join(t.TempDir(), "full.pcap")
+	c, _ = NewCapture(CaptureConfig{Path: path, MaxSize: 200})
+	for i := 0; i < 10; i++ {
+		c.write(CaptureKCP, true, 7, 0, client.LocalAddr(), segment(7, uint32(i), "0123456789"))
+	}
+	if info, _ := os.Stat(path); info.Size() > 200 || c.active() {
+		t.Fatal("capture not stopped")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	block, _ := kcp.NewAESBlockCrypt(make([]byte, 32))
+	crypt := NewBlockPacketCrypt(block)
+	conn, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	server := NewCryptConn(conn, crypt)
+	defer server.Close()
+	received := make(chan []byte, 16)
+	go func() {
+		for {
+			buf := make([]byte, mtuLimit)
+			n, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			received <- buf[:n]
+			server.WriteTo(segment(binary.LittleEndian.Uint32(buf), 0, ""), addr)
+		}
+	}()
+
+	path := filepath.Join(t.TempDir(), "kcptun.pcap")
+	c, _ := NewCapture(CaptureConfig{Path: path, Smux: true})
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4000}
+	c.write(CaptureKCP, true, 7, 0, addr, segment(7, 0, "a"))
+	c.write(CaptureKCP, false, 7, 0, addr, segment(7, 0, "from the server"))
+	c.write(CaptureSmux, true, 7, 0, addr, []byte{2, 3, 0, 0, 1, 0, 0, 0})
+	c.write(CaptureKCP, true, 9, 0, addr, segment(9, 0, "b"))
+	c.Close()
+
+	f, _ := os.Open(path)
+	defer f.Close()
+	stats, err := Replay(f, ReplayConfig{RemoteAddr: conn.LocalAddr().String(), Crypt: crypt, Wait: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Sessions != 2 || stats.Packets != 2 || stats.Replies != 2 {
+		t.Fatal("unexpected replay", stats)
+	}
+	if p := <-received; !bytes.Equal(p, segment(7, 0, "a")) {
+		t.Fatal("unexpected packet", p)
+	}
+
+	// a session starting with a handshake is refused, not one starting with smux
+	syn := "\x01\x00\x00\x00\x01\x00\x00\x00" + "\x01\x02\x19\x00\x01\x00\x00\x00" + strings.Repeat("a", 25)
+	if err := replayable(segment(7, 0, syn)); err != nil {
+		t.Fatal(err)
+	}
+	path = filepath.Join(t.TempDir(), "handshake.pcap")
+	c, _ = NewCapture(CaptureConfig{Path: path})
+	c.write(CaptureKCP, true, 11, 0, addr, segment(11, 0, "\x01"+strings.Repeat("\xaa", 32)))
+	c.Close()
+	f, _ = os.Open(path)
+	defer f.Close()
+	if _, err := Replay(f, ReplayConfig{RemoteAddr: conn.LocalAddr().String(), Crypt: crypt}); err == nil {
+		t.Fatal("handshake replayed")
+	}
+}
@@ -2,6 +2,7 @@ package generic
 
 import (
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/snappy"
@@ -12,10 +13,15 @@ type CompStream struct {
 	conn net.Conn
 	w    *snappy.Writer
 	r    *snappy.Reader
+
+	rawIn, wireIn, rawOut, wireOut uint64
 }
 
 func (c *CompStream) Read(p []byte) (n int, err error) {
-	return c.r.Read(p)
+	n, err = c.r.Read(p)
+	atomic.AddUint64(&c.rawIn, uint64(n))
+	atomic.AddUint64(&DefaultSnmp.CompRawIn, uint64(n))
+	return n, err
 }
 
 func (c *CompStream) Write(p []byte) (n int, err error) {
@@ -26,9 +32,16 @@ func (c *CompStream) Write(p []byte) (n int, err error) {
 	if err := c.w.Flush(); err != nil {
 		return 0, errors.WithStack(err)
 	}
+	atomic.AddUint64(&c.rawOut, uint64(len(p)))
+	atomic.AddUint64(&DefaultSnmp.CompRawOut, uint64(len(p)))
 	return len(p), err
 }
 
+// Counters returns the bytes read and written, decompressed and compressed
+func (c *CompStream) Counters() (rawIn, wireIn, rawOut, wireOut uint64) {
+	return atomic.LoadUint64(&c.rawIn), atomic.LoadUint64(&c.wireIn), atomic.LoadUint64(&c.rawOut), atomic.LoadUint64(&c.wireOut)
+}
+
 func (c *CompStream) Close() error {
 	return c.conn.Close()
 }
@@ -56,7 +69,7 @@ func (c *CompStream) SetWriteDeadline(t time.Time) error {
 func NewCompStream(conn net.Conn) *CompStream {
 	c := new(CompStream)
 	c.conn = conn
-	c.w = snappy.NewBufferedWriter(conn)
-	c.r = snappy.NewReader(conn)
+	c.w = snappy.NewBufferedWriter(&countWriter{&countWriter{conn, &c.wireOut}, &DefaultSnmp.CompWireOut})
+	c.r = snappy.NewReader(&countReader{&countReader{conn, &c.wireIn}, &DefaultSnmp.CompWireIn})
 	return c
 }
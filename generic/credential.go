@@ -0,0 +1,358 @@
+package generic
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	credentialPrefix  = "kcptun1."
+	credentialTimeout = 10 * time.Second
+	maxCredentialSize = 4096
+)
+
+var (
+	errCredential        = errors.New("invalid credential")
+	errCredentialExpired = errors.New("credential expired")
+	errCredentialRevoked = errors.New("credential revoked")
+)
+
+// Credential grants a user access to the server, it is signed by the
+// operator key, so the server needs nothing but the operator's public key
+// to verify it. The encoded form is "kcptun1.<payload>.<signature>", both
+// base64url encoded.
+type Credential struct {
+	ID      string   `json:"id"`                // random id, to revoke the credential
+	User    string   `json:"user"`              // user id
+	Expires int64    `json:"exp"`               // unix time
+	Targets []string `json:"targets,omitempty"` // targets allowed, any if empty
+	Class   string   `json:"class,omitempty"`   // bandwidth class
+}
+
+// Expiry returns the expiry of the credential
+func (c *Credential) Expiry() time.Time { return time.Unix(c.Expires, 0) }
+
+// Allowed tells whether the credential allows connecting to target
+func (c *Credential) Allowed(target string) bool { return allowedTarget(c.Targets, target) }
+
+// LoadOperatorKey reads the base64 ed25519 seed in path, a new key is
+// generated and saved there if the file doesn't exist.
+func LoadOperatorKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key.Seed())+"\n"), 0600); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return key, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.Errorf("%v: ed25519 keys are %v bytes", path, ed25519.SeedSize)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// DecodeOperatorKey decodes a base64 ed25519 public key
+func DecodeOperatorKey(s string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, errors.Errorf("ed25519 public keys are %v bytes", ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// IssueCredential signs cred with key, a random ID is set if empty
+func IssueCredential(key ed25519.PrivateKey, cred *Credential) (string, error) {
+	if cred.ID == "" {
+		id := make([]byte, 8)
+		if _, err := io.ReadFull(rand.Reader, id); err != nil {
+			return "", errors.WithStack(err)
+		}
+		cred.ID = hex.EncodeToString(id)
+	}
+	payload, err := json.Marshal(cred)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return credentialPrefix + base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, payload)), nil
+}
+
+// ParseCredential decodes s without verifying it, the signed payload and
+// the signature are returned along.
+func ParseCredential(s string) (cred *Credential, payload, sig []byte, err error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, credentialPrefix) {
+		return nil, nil, nil, errors.WithStack(errCredential)
+	}
+	parts := strings.Split(s[len(credentialPrefix):], ".")
+	if len(parts) != 2 {
+		return nil, nil, nil, errors.WithStack(errCredential)
+	}
+	if payload, err = base64.RawURLEncoding.DecodeString(parts[0]); err != nil {
+		return nil, nil, nil, errors.Wrap(err, "credential payload")
+	}
+	if sig, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+		return nil, nil, nil, errors.Wrap(err, "credential signature")
+	}
+	cred = new(Credential)
+	if err := json.Unmarshal(payload, cred); err != nil {
+		return nil, nil, nil, errors.Wrap(err, "credential payload")
+	}
+	return cred, payload, sig, nil
+}
+
+// VerifyCredential verifies the signature and expiry of s
+func VerifyCredential(s string, pub ed25519.PublicKey) (*Credential, error) {
+	cred, payload, sig, err := ParseCredential(s)
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(pub, payload, sig) {
+		return nil, errors.WithStack(errCredential)
+	}
+	if time.Now().After(cred.Expiry()) {
+		return nil, errors.Wrap(errCredentialExpired, cred.ID)
+	}
+	return cred, nil
+}
+
+// CredentialVerifier verifies the credentials presented by clients, and
+// closes the sessions of credentials revoked or expired.
+//
+// The revocation list is a file of credential ids, one per line, lines
+// starting with # are ignored, Reload applies its changes.
+type CredentialVerifier struct {
+	pub     ed25519.PublicKey
+	path    string // revocation list, none if empty
+	revoked map[string]bool
+	modTime time.Time
+
+	sessions map[string]map[io.Closer]struct{}
+	mu       sync.Mutex
+}
+
+// NewCredentialVerifier creates a CredentialVerifier of the credentials
+// signed by pub, and revoked in the file path unless empty.
+func NewCredentialVerifier(pub ed25519.PublicKey, path string) (*CredentialVerifier, error) {
+	v := &CredentialVerifier{
+		pub:      pub,
+		path:     path,
+		revoked:  make(map[string]bool),
+		sessions: make(map[string]map[io.Closer]struct{}),
+	}
+	if err := v.Reload(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Reload reads the revocation list again if modified, and closes the
+// sessions of the credentials revoked.
+func (v *CredentialVerifier) Reload() error {
+	if v.path == "" {
+		return nil
+	}
+	fi, err := os.Stat(v.path)
+	if os.IsNotExist(err) { // nothing revoked yet
+		return nil
+	} else if err != nil {
+		return errors.WithStack(err)
+	}
+	v.mu.Lock()
+	modified := !fi.ModTime().Equal(v.modTime)
+	v.mu.Unlock()
+	if !modified {
+		return nil
+	}
+
+	revoked, err := ReadRevocationList(v.path)
+	if err != nil {
+		return err
+	}
+
+	var closers []io.Closer
+	v.mu.Lock()
+	for id := range revoked {
+		for s := range v.sessions[id] {
+			closers = append(closers, s)
+		}
+		if len(v.sessions[id]) > 0 {
+			logAuth.Info("credential revoked", "credential", id)
+		}
+		delete(v.sessions, id)
+	}
+	v.revoked = revoked
+	v.modTime = fi.ModTime()
+	v.mu.Unlock()
+
+	for _, s := range closers {
+		s.Close()
+	}
+	return nil
+}
+
+// Watch reloads the revocation list every interval, until the process exits
+func (v *CredentialVerifier) Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := v.Reload(); err != nil {
+			logAuth.Error("revocation list reload failed", "err", err)
+		}
+	}
+}
+
+// Verify verifies the credential s, and that it is not revoked
+func (v *CredentialVerifier) Verify(s string) (*Credential, error) {
+	cred, err := VerifyCredential(s, v.pub)
+	if err != nil {
+		return nil, err
+	}
+	v.mu.Lock()
+	revoked := v.revoked[cred.ID]
+	v.mu.Unlock()
+	if revoked {
+		return nil, errors.Wrap(errCredentialRevoked, cred.ID)
+	}
+	return cred, nil
+}
+
+// Track registers the session s of cred, to be closed once cred expires or
+// is revoked, until untrack is called.
+func (v *CredentialVerifier) Track(cred *Credential, s io.Closer) (untrack func()) {
+	v.mu.Lock()
+	if v.revoked[cred.ID] {
+		v.mu.Unlock()
+		s.Close()
+		return func() {}
+	}
+	sessions := v.sessions[cred.ID]
+	if sessions == nil {
+		sessions = make(map[io.Closer]struct{})
+		v.sessions[cred.ID] = sessions
+	}
+	sessions[s] = struct{}{}
+	v.mu.Unlock()
+
+	expire := time.AfterFunc(time.Until(cred.Expiry()), func() {
+		logAuth.Info("credential expired", "credential", cred.ID)
+		s.Close()
+	})
+	return func() {
+		expire.Stop()
+		v.mu.Lock()
+		delete(v.sessions[cred.ID], s)
+		if len(v.sessions[cred.ID]) == 0 {
+			delete(v.sessions, cred.ID)
+		}
+		v.mu.Unlock()
+	}
+}
+
+// ReadRevocationList reads the ids in the revocation list path
+func ReadRevocationList(path string) (map[string]bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	revoked := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			revoked[strings.Fields(line)[0]] = true
+		}
+	}
+	return revoked, errors.WithStack(scanner.Err())
+}
+
+// RevokeCredential appends id to the revocation list path, with a comment
+func RevokeCredential(path, id, comment string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	line := id
+	if comment != "" {
+		line += " # " + comment
+	}
+	if _, err := f.WriteString(line + "\n"); err != nil {
+		f.Close()
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(f.Close())
+}
+
+// PresentCredential sends the credential s over conn, as the client of a
+// session, and waits for the server to accept it.
+func PresentCredential(conn net.Conn, s string) error {
+	conn.SetDeadline(time.Now().Add(credentialTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	s = strings.TrimSpace(s)
+	if len(s) > maxCredentialSize {
+		return errors.WithStack(errCredential)
+	}
+	msg := make([]byte, 2, 2+len(s))
+	binary.BigEndian.PutUint16(msg, uint16(len(s)))
+	if _, err := conn.Write(append(msg, s...)); err != nil {
+		return errors.WithStack(err)
+	}
+	var ack [1]byte
+	if _, err := io.ReadFull(conn, ack[:]); err != nil {
+		return errors.Wrap(err, "credential rejected")
+	}
+	return nil
+}
+
+// AcceptCredential receives and verifies the credential of the client of
+// a session over conn, and acknowledges it if valid.
+func (v *CredentialVerifier) AcceptCredential(conn net.Conn) (*Credential, error) {
+	conn.SetDeadline(time.Now().Add(credentialTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	n := int(binary.BigEndian.Uint16(hdr[:]))
+	if n > maxCredentialSize {
+		return nil, errors.WithStack(errCredential)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	cred, err := v.Verify(string(msg))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte{0}); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return cred, nil
+}
@@ -0,0 +1,109 @@
+package generic
+
+import (
+	"crypto/ed25519"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCredential(t *testing.T) {
+	dir := t.TempDir()
+	key, err := LoadOperatorKey(filepath.Join(dir, "operator.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := LoadOperatorKey(filepath.Join(dir, "operator.key")); !key.Equal(again) {
+		t.Fatal("operator key not saved")
+	}
+	pub := key.Public().(ed25519.PublicKey)
+
+	cred := &Credential{User: "alice", Expires: time.Now().Add(time.Hour).Unix(), Targets: []string{"127.0.0.1:22"}, Class: "basic"}
+	s, err := IssueCredential(key, cred)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := VerifyCredential(s, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != cred.ID || got.User != "alice" || !got.Allowed("127.0.0.1:22") || got.Allowed("127.0.0.1:80") {
+		t.Fatal("unexpected credential", got)
+	}
+
+	// tampered, another operator, expired
+	forged, _ := IssueCredential(key, &Credential{User: "mallory", Expires: cred.Expires})
+	parts, forgedParts := strings.Split(s, "."), strings.Split(forged, ".")
+	tampered := strings.Join([]string{parts[0], forgedParts[1], parts[2]}, ".")
+	if _, err := VerifyCredential(tampered, pub); err == nil {
+		t.Fatal("tampered credential accepted")
+	}
+	_, other, _ := ed25519.GenerateKey(nil)
+	if _, err := VerifyCredential(s, other.Public().(ed25519.PublicKey)); err == nil {
+		t.Fatal("credential of another operator accepted")
+	}
+	expired, _ := IssueCredential(key, &Credential{User: "bob", Expires: time.Now().Add(-time.Second).Unix()})
+	if _, err := VerifyCredential(expired, pub); err == nil {
+		t.Fatal("expired credential accepted")
+	}
+
+	// presented over a session, then revoked
+	revoked := filepath.Join(dir, "revoked.txt")
+	v, err := NewCredentialVerifier(pub, revoked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, srv := net.Pipe()
+	chErr := make(chan error, 1)
+	go func() { chErr <- PresentCredential(c, s) }()
+	accepted, err := v.AcceptCredential(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-chErr; err != nil {
+		t.Fatal(err)
+	}
+	var closed closeFlag
+	defer v.Track(accepted, &closed)()
+
+	if err := RevokeCredential(revoked, cred.ID, "test"); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(revoked, time.Now().Add(time.Second), time.Now().Add(time.Second))
+	if err := v.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !closed {
+		t.Fatal("session of a revoked credential not closed")
+	}
+	if _, err := v.Verify(s); err == nil {
+		t.Fatal("revoked credential accepted")
+	}
+}
+
+func TestLimitConn(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			if _, err := s.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	// the burst, then 1 second at the rate
+	conn := NewLimitConn(c, 100000)
+	start := time.Now()
+	buf := make([]byte, 1000)
+	for i := 0; i < 116; i++ {
+		conn.Write(buf)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatal("unexpected duration", elapsed)
+	}
+}
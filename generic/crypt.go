@@ -0,0 +1,122 @@
+package generic
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// Authenticates tells whether the crypt of method authenticates every packet
+func Authenticates(method string) bool {
+	return method == "aes-gcm" || method == "chacha20-poly1305"
+}
+
+// NewCrypt creates the cipher of method with a key of KeySize bytes, either
+// a kcp.BlockCrypt for the ciphers of kcp-go, or a PacketCrypt for the AEAD
+// modes. Unknown methods fall back to "aes", the returned method is the one
+// in use.
+func NewCrypt(method string, key []byte) (string, kcp.BlockCrypt, PacketCrypt, error) {
+	var block kcp.BlockCrypt
+	var err error
+	switch method {
+	case "aes-gcm", "chacha20-poly1305":
+		aead, err := NewAEADCrypt(method, key)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		return method, nil, aead, nil
+	case "null":
+		block = nil
+	case "sm4":
+		block, err = kcp.NewSM4BlockCrypt(key[:16])
+	case "tea":
+		block, err = kcp.NewTEABlockCrypt(key[:16])
+	case "xor":
+		block, err = kcp.NewSimpleXORBlockCrypt(key)
+	case "none":
+		block, err = kcp.NewNoneBlockCrypt(key)
+	case "aes-128":
+		block, err = kcp.NewAESBlockCrypt(key[:16])
+	case "aes-192":
+		block, err = kcp.NewAESBlockCrypt(key[:24])
+	case "blowfish":
+		block, err = kcp.NewBlowfishBlockCrypt(key)
+	case "twofish":
+		block, err = kcp.NewTwofishBlockCrypt(key)
+	case "cast5":
+		block, err = kcp.NewCast5BlockCrypt(key[:16])
+	case "3des":
+		block, err = kcp.NewTripleDESBlockCrypt(key[:24])
+	case "xtea":
+		block, err = kcp.NewXTEABlockCrypt(key[:16])
+	case "salsa20":
+		block, err = kcp.NewSalsa20BlockCrypt(key)
+	default:
+		method = "aes"
+		block, err = kcp.NewAESBlockCrypt(key)
+	}
+	if err != nil {
+		return "", nil, nil, errors.WithStack(err)
+	}
+	return method, block, nil, nil
+}
+
+// BlockPacketCrypt is a PacketCrypt framing packets as kcp-go does with a
+// kcp.BlockCrypt: | NONCE(16B) | CRC32(4B) | DATA |, all encrypted; so
+// packets can be encrypted beneath a KCP session created without one.
+// A nil block leaves packets as they are, like kcp-go.
+type BlockPacketCrypt struct {
+	block kcp.BlockCrypt
+}
+
+// NewBlockPacketCrypt creates a BlockPacketCrypt of block
+func NewBlockPacketCrypt(block kcp.BlockCrypt) *BlockPacketCrypt {
+	return &BlockPacketCrypt{block}
+}
+
+// Seal implements PacketCrypt
+func (c *BlockPacketCrypt) Seal(dst, p []byte, addr net.Addr) ([]byte, error) {
+	if c.block == nil {
+		return append(dst, p...), nil
+	}
+	off := len(dst)
+	var hdr [cryptHeaderSize]byte
+	if _, err := io.ReadFull(rand.Reader, hdr[:nonceSize]); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	binary.LittleEndian.PutUint32(hdr[nonceSize:], crc32.ChecksumIEEE(p))
+	dst = append(append(dst, hdr[:]...), p...)
+	c.block.Encrypt(dst[off:], dst[off:])
+	return dst, nil
+}
+
+// Open implements PacketCrypt
+func (c *BlockPacketCrypt) Open(dst, p []byte, addr net.Addr) ([]byte, error) {
+	if c.block == nil {
+		return append(dst, p...), nil
+	}
+	if len(p) < cryptHeaderSize {
+		return nil, errors.WithStack(errAuthentication)
+	}
+	off := len(dst)
+	dst = append(dst, p...)
+	plain := dst[off:]
+	c.block.Decrypt(plain, plain)
+	if crc32.ChecksumIEEE(plain[cryptHeaderSize:]) != binary.LittleEndian.Uint32(plain[nonceSize:]) {
+		return nil, errors.WithStack(errAuthentication)
+	}
+	return append(dst[:off], plain[cryptHeaderSize:]...), nil
+}
+
+// Overhead returns the size of the nonce and checksum
+func (c *BlockPacketCrypt) Overhead() int {
+	if c.block == nil {
+		return 0
+	}
+	return cryptHeaderSize
+}
@@ -0,0 +1,204 @@
+package generic
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	handshakeVersion = 1
+	handshakeTimeout = 10 * time.Second
+	handshakeLabel   = "kcptun handshake v1"
+	confirmSize      = 16
+)
+
+var errHandshake = errors.New("handshake failed")
+
+// HandshakeConfig establishes per-session keys before the smux session
+// starts, in the spirit of the Noise NK pattern with a pre-shared key:
+//
+//	-> e
+//	<- e, s, ee, es, confirm
+//
+// The client learns the server's static key s in the handshake, and can pin
+// it. Both DH results are mixed with the PSK, so only peers knowing the PSK
+// and, for the server, the private key of s, derive the same keys. The
+// ephemeral keys give forward secrecy to recorded traffic.
+type HandshakeConfig struct {
+	PSK           []byte        // pre-shared key
+	StaticKey     []byte        // X25519 private key of the server
+	ServerKey     []byte        // X25519 public key pinned by the client, nil to accept any
+	RekeyBytes    int64         // bytes sent before a new key is ratcheted, 0 to disable
+	RekeyInterval time.Duration // time before a new key is ratcheted, 0 to disable
+}
+
+// GeneratePrivateKey returns a new X25519 private key
+func GeneratePrivateKey() ([]byte, error) {
+	key := make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return key, nil
+}
+
+// LoadStaticKey reads the base64 private key in path, a new key is
+// generated and saved there if the file doesn't exist.
+func LoadStaticKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		key, err := GeneratePrivateKey()
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return key, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return DecodeKey(string(data))
+}
+
+// DecodeKey decodes a base64 X25519 key
+func DecodeKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(key) != curve25519.PointSize {
+		return nil, errors.New("x25519 keys are 32 bytes")
+	}
+	return key, nil
+}
+
+// PublicKey returns the public key of the private key priv
+func PublicKey(priv []byte) ([]byte, error) {
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	return pub, errors.WithStack(err)
+}
+
+// handshakeKeys derives the session keys from the transcript and the DH results
+func (h *HandshakeConfig) handshakeKeys(ec, es, ss, ee, dhes []byte) (c2s, s2c, confirm []byte) {
+	hash := sha256.New()
+	hash.Write([]byte(handshakeLabel))
+	hash.Write(ec)
+	hash.Write(es)
+	hash.Write(ss)
+	transcript := hash.Sum(nil)
+
+	ikm := append(append([]byte(nil), ee...), dhes...)
+	r := hkdf.New(sha256.New, ikm, h.PSK, transcript)
+	c2s = make([]byte, 32)
+	s2c = make([]byte, 32)
+	mac := make([]byte, 32)
+	io.ReadFull(r, c2s)
+	io.ReadFull(r, s2c)
+	io.ReadFull(r, mac)
+
+	m := hmac.New(sha256.New, mac)
+	m.Write(transcript)
+	return c2s, s2c, m.Sum(nil)[:confirmSize]
+}
+
+// Client performs the handshake as the client over conn
+func (h *HandshakeConfig) Client(conn net.Conn) (*SecureConn, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	priv, err := GeneratePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	ec, err := PublicKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append([]byte{handshakeVersion}, ec...)); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	msg := make([]byte, 1+2*curve25519.PointSize+confirmSize)
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if msg[0] != handshakeVersion {
+		return nil, errors.Errorf("unsupported handshake version %v", msg[0])
+	}
+	es := msg[1 : 1+curve25519.PointSize]
+	ss := msg[1+curve25519.PointSize : 1+2*curve25519.PointSize]
+	if h.ServerKey != nil && !hmac.Equal(ss, h.ServerKey) {
+		return nil, errors.Errorf("server key %v doesn't match the pinned key", base64.StdEncoding.EncodeToString(ss))
+	}
+
+	ee, err := curve25519.X25519(priv, es)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	dhes, err := curve25519.X25519(priv, ss)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	c2s, s2c, confirm := h.handshakeKeys(ec, es, ss, ee, dhes)
+	if !hmac.Equal(confirm, msg[1+2*curve25519.PointSize:]) {
+		return nil, errors.WithStack(errHandshake)
+	}
+	return newSecureConn(conn, c2s, s2c, h)
+}
+
+// Server performs the handshake as the server over conn, the client is
+// authenticated by its first record.
+func (h *HandshakeConfig) Server(conn net.Conn) (*SecureConn, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	msg := make([]byte, 1+curve25519.PointSize)
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if msg[0] != handshakeVersion {
+		return nil, errors.Errorf("unsupported handshake version %v", msg[0])
+	}
+	ec := msg[1:]
+
+	priv, err := GeneratePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	es, err := PublicKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	ss, err := PublicKey(h.StaticKey)
+	if err != nil {
+		return nil, err
+	}
+	ee, err := curve25519.X25519(priv, ec)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	dhes, err := curve25519.X25519(h.StaticKey, ec)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	c2s, s2c, confirm := h.handshakeKeys(ec, es, ss, ee, dhes)
+
+	reply := append([]byte{handshakeVersion}, es...)
+	reply = append(reply, ss...)
+	reply = append(reply, confirm...)
+	if _, err := conn.Write(reply); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return newSecureConn(conn, s2c, c2s, h)
+}
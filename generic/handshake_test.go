@@ -0,0 +1,76 @@
+package generic
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+)
+
+func handshakePair(t *testing.T, client, server *HandshakeConfig) (*SecureConn, *SecureConn, error) {
+	c, s := net.Pipe()
+	chServer := make(chan *SecureConn, 1)
+	go func() {
+		conn, err := server.Server(s)
+		if err != nil {
+			s.Close()
+		}
+		chServer <- conn
+	}()
+	conn, err := client.Client(c)
+	if err != nil {
+		c.Close()
+		<-chServer
+		return nil, nil, err
+	}
+	return conn, <-chServer, nil
+}
+
+func TestHandshake(t *testing.T) {
+	priv, _ := GeneratePrivateKey()
+	pub, _ := PublicKey(priv)
+	server := &HandshakeConfig{PSK: testKey, StaticKey: priv, RekeyBytes: 4096}
+	client := &HandshakeConfig{PSK: testKey, ServerKey: pub, RekeyBytes: 4096}
+
+	c, s, err := handshakePair(t, client, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// both directions, across several rekeys
+	data := make([]byte, 100000)
+	io.ReadFull(rand.Reader, data)
+	done := make(chan struct{})
+	go func() {
+		c.Write(data)
+		close(done)
+	}()
+	go io.Copy(s, s)
+
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data mismatch")
+	}
+	<-done
+	// every record of 16KB exceeds the volume, so no key seals 2 records
+	if c.w.counter != 1 || c.r.counter != 1 {
+		t.Fatal("never rekeyed")
+	}
+	c.Close()
+
+	// another server key
+	other, _ := GeneratePrivateKey()
+	if _, _, err := handshakePair(t, client, &HandshakeConfig{PSK: testKey, StaticKey: other}); err == nil {
+		t.Fatal("pinned key not enforced")
+	}
+
+	// another PSK
+	client.ServerKey = nil
+	if _, _, err := handshakePair(t, client, &HandshakeConfig{PSK: make([]byte, 32), StaticKey: priv}); err == nil {
+		t.Fatal("handshake with a different PSK")
+	}
+}
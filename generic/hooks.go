@@ -0,0 +1,316 @@
+package generic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// the events of the hooks
+const (
+	EventSessionOpen  = "session_open"
+	EventSessionClose = "session_close"
+	EventReconnect    = "reconnect"
+	EventBan          = "ban"
+	EventAlert        = "alert"
+)
+
+var hookEvents = []string{EventSessionOpen, EventSessionClose, EventReconnect, EventBan, EventAlert}
+
+const hookQueue = 64 // events queued per hook, the others dropped
+
+// HookEvent is the JSON payload of the hooks
+type HookEvent struct {
+	Event     string    `json:"event"`
+	Time      time.Time `json:"time"`
+	Session   uint64    `json:"session,omitempty"`
+	Listener  string    `json:"listener,omitempty"`
+	Remote    string    `json:"remote,omitempty"`
+	Transport string    `json:"transport,omitempty"`
+	Conv      string    `json:"conv,omitempty"`
+	Duration  float64   `json:"duration,omitempty"` // seconds
+	BytesIn   uint64    `json:"bytesin,omitempty"`
+	BytesOut  uint64    `json:"bytesout,omitempty"`
+	SRTT      int64     `json:"srtt,omitempty"` // milliseconds
+	Reason    string    `json:"reason,omitempty"`
+	Alert     string    `json:"alert,omitempty"` // loss, rtt or fec
+	Value     float64   `json:"value,omitempty"`
+	Threshold float64   `json:"threshold,omitempty"`
+}
+
+// SessionEvent returns the event of the session of snap
+func SessionEvent(event string, snap SessionSnapshot) *HookEvent {
+	return &HookEvent{
+		Event:     event,
+		Session:   snap.ID,
+		Listener:  snap.Listener,
+		Remote:    snap.Remote,
+		Transport: snap.Transport,
+		Conv:      fmt.Sprintf("%08x", snap.Conv),
+		Duration:  snap.Duration.Seconds(),
+		BytesIn:   snap.BytesIn,
+		BytesOut:  snap.BytesOut,
+		SRTT:      snap.SRTT.Milliseconds(),
+	}
+}
+
+// HookConfig is the config of the hooks
+type HookConfig struct {
+	Hooks   []string // scripts or http(s) URLs, after "event,event=" to run for these events only
+	Rate    float64  // events per second of each hook, with a burst as large but of one at least, the others dropped
+	Timeout time.Duration
+}
+
+// hook runs a script or posts to a URL on the events it filters
+type hook struct {
+	target string
+	events map[string]bool // all if nil
+	queue  chan *HookEvent
+	limit  *bucket
+}
+
+// Hooks run the hooks on the events, asynchronously: the events are queued
+// and dropped when a hook is too slow or fired too often. The scripts run
+// as "script EVENT" with the event on stdin, the URLs are posted the event.
+type Hooks struct {
+	hooks   []*hook
+	timeout time.Duration
+	client  *http.Client
+}
+
+// NewHooks starts the hooks, nil if there are none
+func NewHooks(config HookConfig) (*Hooks, error) {
+	if len(config.Hooks) == 0 {
+		return nil, nil
+	}
+	if config.Rate <= 0 || config.Timeout <= 0 {
+		return nil, errors.New("the rate and timeout of the hooks must be positive")
+	}
+	h := &Hooks{timeout: config.Timeout, client: &http.Client{Timeout: config.Timeout}}
+	for _, spec := range config.Hooks {
+		k, err := parseHook(spec)
+		if err != nil {
+			return nil, err
+		}
+		k.queue = make(chan *HookEvent, hookQueue)
+		burst := math.Max(1, config.Rate) // an event at least, below one per second
+		k.limit = &bucket{rate: config.Rate, burst: burst, tokens: burst, last: time.Now()}
+		h.hooks = append(h.hooks, k)
+		go h.run(k)
+	}
+	return h, nil
+}
+
+// parseHook parses a hook like "ban,alert=http://127.0.0.1:8080/kcptun"
+func parseHook(spec string) (*hook, error) {
+	k := &hook{target: spec}
+	if i := strings.Index(spec, "="); i > 0 {
+		events := make(map[string]bool)
+		for _, event := range strings.Split(spec[:i], ",") {
+			if !hookEvent(event) {
+				events = nil
+				break
+			}
+			events[event] = true
+		}
+		if events != nil {
+			k.target, k.events = spec[i+1:], events
+		}
+	}
+	if k.target == "" {
+		return nil, errors.Errorf("invalid hook: %v", spec)
+	}
+	return k, nil
+}
+
+func hookEvent(event string) bool {
+	for _, e := range hookEvents {
+		if event == e {
+			return true
+		}
+	}
+	return false
+}
+
+// Fire queues e for the hooks of its event, never blocking
+func (h *Hooks) Fire(e *HookEvent) {
+	if h == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	for _, k := range h.hooks {
+		if k.events != nil && !k.events[e.Event] {
+			continue
+		}
+		if !k.limit.tryTake(1) {
+			atomic.AddUint64(&DefaultSnmp.HookDrops, 1)
+			continue
+		}
+		select {
+		case k.queue <- e:
+		default:
+			atomic.AddUint64(&DefaultSnmp.HookDrops, 1)
+		}
+	}
+}
+
+// run runs the hook k on its events, one at a time
+func (h *Hooks) run(k *hook) {
+	for e := range k.queue {
+		atomic.AddUint64(&DefaultSnmp.Hooks, 1)
+		if err := h.call(k, e); err != nil {
+			atomic.AddUint64(&DefaultSnmp.HookFailures, 1)
+			logHook.Warn("hook failed", "hook", k.target, "event", e.Event, "err", err)
+		}
+	}
+}
+
+// call runs the hook k on e, until the timeout
+func (h *Hooks) call(k *hook, e *HookEvent) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if strings.HasPrefix(k.target, "http://") || strings.HasPrefix(k.target, "https://") {
+		resp, err := h.client.Post(k.target, "application/json", bytes.NewReader(payload))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return errors.Errorf("%v", resp.Status)
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, k.target, e.Event)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(), "KCPTUN_EVENT="+e.Event)
+	// no output kept, a pipe would be waited for as long as the children of the script hold it
+	return errors.WithStack(cmd.Run())
+}
+
+// hooks are the hooks of the process, see SetHooks
+var hooks struct {
+	h  *Hooks
+	mu sync.RWMutex
+}
+
+// SetHooks sets the hooks fired by FireHook
+func SetHooks(h *Hooks) {
+	hooks.mu.Lock()
+	hooks.h = h
+	hooks.mu.Unlock()
+}
+
+// FireHook fires e on the hooks of the process, if any
+func FireHook(e *HookEvent) {
+	hooks.mu.RLock()
+	h := hooks.h
+	hooks.mu.RUnlock()
+	h.Fire(e)
+}
+
+// AlertConfig is the config of the alerts, fired as hook events once a
+// threshold is crossed, and again once back under it then crossed again
+type AlertConfig struct {
+	Interval time.Duration
+	Loss     float64       // retransmitted share of the packets sent by a session, in percent
+	RTT      time.Duration // smoothed RTT of a session
+	FECErrs  float64       // FEC errors per second of all the sessions
+}
+
+// alertKey is an alert of a session, 0 for all of them
+type alertKey struct {
+	alert   string
+	session uint64
+}
+
+// alertWatcher keeps the samples and the alerts raised between checks
+type alertWatcher struct {
+	config   AlertConfig
+	pkts     map[uint64][2]uint64 // packets sent and retransmitted by session
+	fecErrs  uint64
+	alerting map[alertKey]bool
+}
+
+func newAlertWatcher(config AlertConfig) *alertWatcher {
+	return &alertWatcher{config: config, pkts: make(map[uint64][2]uint64), alerting: make(map[alertKey]bool)}
+}
+
+// check returns the alerts of the sessions and the FEC errors after d
+func (w *alertWatcher) check(list []SessionSnapshot, fecErrs uint64, d time.Duration) []*HookEvent {
+	var alerts []*HookEvent
+	raise := func(key alertKey, value, threshold float64, snap *SessionSnapshot) {
+		if value <= threshold {
+			delete(w.alerting, key)
+			return
+		}
+		if w.alerting[key] {
+			return
+		}
+		w.alerting[key] = true
+		e := &HookEvent{Event: EventAlert}
+		if snap != nil {
+			e = SessionEvent(EventAlert, *snap)
+		}
+		e.Alert, e.Value, e.Threshold = key.alert, value, threshold
+		alerts = append(alerts, e)
+	}
+
+	pkts := make(map[uint64][2]uint64, len(list))
+	for i := range list {
+		s := &list[i]
+		pkts[s.ID] = [2]uint64{s.PktsOut, s.Retrans}
+		if prev, ok := w.pkts[s.ID]; ok && w.config.Loss > 0 && s.PktsOut > prev[0] {
+			loss := float64(s.Retrans-prev[1]) / float64(s.PktsOut-prev[0]) * 100
+			raise(alertKey{"loss", s.ID}, loss, w.config.Loss, s)
+		}
+		if w.config.RTT > 0 {
+			raise(alertKey{"rtt", s.ID}, float64(s.SRTT.Milliseconds()), float64(w.config.RTT.Milliseconds()), s)
+		}
+	}
+	if w.config.FECErrs > 0 && d > 0 {
+		raise(alertKey{"fec", 0}, float64(fecErrs-w.fecErrs)/d.Seconds(), w.config.FECErrs, nil)
+	}
+	for key := range w.alerting {
+		if _, ok := pkts[key.session]; !ok && key.session != 0 {
+			delete(w.alerting, key)
+		}
+	}
+	w.pkts, w.fecErrs = pkts, fecErrs
+	return alerts
+}
+
+// WatchAlerts fires the alerts every interval, until the process exits
+func WatchAlerts(config AlertConfig) {
+	if config.Interval <= 0 || (config.Loss <= 0 && config.RTT <= 0 && config.FECErrs <= 0) {
+		return
+	}
+	w := newAlertWatcher(config)
+	w.fecErrs = kcp.DefaultSnmp.Copy().FECErrs
+	last := time.Now()
+	for now := range time.Tick(config.Interval) {
+		for _, e := range w.check(Sessions(), kcp.DefaultSnmp.Copy().FECErrs, now.Sub(last)) {
+			logHook.Info("alert", "alert", e.Alert, "session", e.Session, "value", e.Value, "threshold", e.Threshold)
+			FireHook(e)
+		}
+		last = now
+	}
+}
@@ -0,0 +1,110 @@
+package generic
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestParseHook(t *testing.T) {
+	k, err := parseHook("ban,alert=http://127.0.0.1:8080/x?a=b")
+	if err != nil || k.target != "http://127.0.0.1:8080/x?a=b" || !k.events[EventBan] || k.events[EventSessionOpen] {
+		t.Fatal("unexpected hook", k, err)
+	}
+	// not a filter, a script with "=" in its path
+	if k, err := parseHook("/opt/a=b/hook.sh"); err != nil || k.target != "/opt/a=b/hook.sh" || k.events != nil {
+		t.Fatal("unexpected hook", k, err)
+	}
+	if _, err := parseHook("ban="); err == nil {
+		t.Fatal("empty hook accepted")
+	}
+}
+
+func TestHooks(t *testing.T) {
+	events := make(chan *HookEvent, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e HookEvent
+		b, _ := io.ReadAll(r.Body)
+		json.Unmarshal(b, &e)
+		events <- &e
+	}))
+	defer srv.Close()
+
+	h, err := NewHooks(HookConfig{Hooks: []string{"ban,alert=" + srv.URL}, Rate: 2, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Fire(&HookEvent{Event: EventSessionOpen})
+	for i := 0; i < 3; i++ {
+		h.Fire(&HookEvent{Event: EventBan, Remote: "10.0.0.1"})
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-events:
+			if e.Event != EventBan || e.Remote != "10.0.0.1" || e.Time.IsZero() {
+				t.Fatal("unexpected event", e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("hook not run")
+		}
+	}
+	select {
+	case e := <-events:
+		t.Fatal("event over the rate", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// a rate below one per second still runs a hook now and then
+	h, _ = NewHooks(HookConfig{Hooks: []string{srv.URL}, Rate: 0.5, Timeout: time.Second})
+	if !h.hooks[0].limit.tryTake(1) || h.hooks[0].limit.tryTake(1) {
+		t.Fatal("burst of a slow hook not of one event")
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	// a script too slow is killed
+	script := filepath.Join(t.TempDir(), "hook.sh")
+	os.WriteFile(script, []byte("#!/bin/sh\nsleep 10\n"), 0755)
+	h, _ = NewHooks(HookConfig{Hooks: []string{script}, Rate: 1, Timeout: 100 * time.Millisecond})
+	if err := h.call(h.hooks[0], &HookEvent{Event: EventReconnect}); err == nil {
+		t.Fatal("slow hook not killed")
+	}
+}
+
+func TestAlerts(t *testing.T) {
+	w := newAlertWatcher(AlertConfig{Loss: 5, RTT: 200 * time.Millisecond, FECErrs: 1})
+	s := SessionSnapshot{ID: 1, PktsOut: 1000, Retrans: 10, SRTT: 50 * time.Millisecond}
+	if alerts := w.check([]SessionSnapshot{s}, 0, time.Second); len(alerts) != 0 {
+		t.Fatal("unexpected alerts", alerts)
+	}
+
+	// 10% lost and slow, raised once
+	s.PktsOut, s.Retrans, s.SRTT = 2000, 110, 300*time.Millisecond
+	alerts := w.check([]SessionSnapshot{s}, 10, time.Second)
+	if len(alerts) != 3 || alerts[0].Alert != "loss" || alerts[0].Value != 10 || alerts[0].Session != 1 ||
+		alerts[1].Alert != "rtt" || alerts[2].Alert != "fec" || alerts[2].Value != 10 {
+		t.Fatal("unexpected alerts", alerts)
+	}
+	s.PktsOut, s.Retrans = 3000, 210
+	if alerts := w.check([]SessionSnapshot{s}, 20, time.Second); len(alerts) != 0 {
+		t.Fatal("alerts raised again", alerts)
+	}
+
+	// back under the thresholds, then over again
+	s.PktsOut, s.SRTT = 4000, 50*time.Millisecond
+	w.check([]SessionSnapshot{s}, 20, time.Second)
+	s.PktsOut, s.Retrans = 5000, 1210
+	if alerts := w.check([]SessionSnapshot{s}, 20, time.Second); len(alerts) != 1 || alerts[0].Alert != "loss" {
+		t.Fatal("alert not raised again", alerts)
+	}
+	if w.check(nil, 20, time.Second); len(w.alerting) != 0 {
+		t.Fatal("alerts of closed sessions kept", w.alerting)
+	}
+}
@@ -0,0 +1,162 @@
+package generic
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"sync"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// wire format constants of kcp-go, a packet on the wire is:
+// | NONCE(16B) | CRC32(4B) | FEC SEQID(4B) | FEC TYPE(2B) | SIZE(2B) | KCP SEGMENTS |
+// the crypto header only exists with encryption, the FEC header only with FEC.
+const (
+	nonceSize          = 16
+	crcSize            = 4
+	cryptHeaderSize    = nonceSize + crcSize
+	fecHeaderSize      = 6
+	fecHeaderSizePlus2 = fecHeaderSize + 2
+	typeData           = 0xf1
+	typeParity         = 0xf2
+	mtuLimit           = 1500
+)
+
+var peekBuf = sync.Pool{
+	New: func() interface{} { return make([]byte, mtuLimit) },
+}
+
+// kcpShard is the conversation id and the FEC header of a packet
+type kcpShard struct {
+	conv   uint32 // none in a parity shard
+	seqid  uint32 // FEC seqid, if fec
+	fec    bool
+	parity bool
+}
+
+// PeekConv extracts the KCP conversation id from a packet as seen on the wire,
+// a copy of the packet is decrypted if block is not nil, data is left untouched.
+//
+// ok is false if the packet fails the checksum, or it's a FEC parity shard
+// which carries no conversation id.
+func PeekConv(block kcp.BlockCrypt, data []byte) (conv uint32, ok bool) {
+	s, ok := peekShard(block, data)
+	if !ok || s.parity {
+		return 0, false
+	}
+	return s.conv, true
+}
+
+// peekShard is PeekConv also extracting the FEC header, ok is true for the
+// parity shards
+func peekShard(block kcp.BlockCrypt, data []byte) (s kcpShard, ok bool) {
+	if block != nil {
+		if len(data) < cryptHeaderSize || len(data) > mtuLimit {
+			return s, false
+		}
+		buf := peekBuf.Get().([]byte)
+		defer peekBuf.Put(buf)
+		plain := buf[:len(data)]
+		block.Decrypt(plain, data)
+		plain = plain[nonceSize:]
+		if crc32.ChecksumIEEE(plain[crcSize:]) != binary.LittleEndian.Uint32(plain) {
+			return s, false
+		}
+		return peekPlainShard(plain[crcSize:])
+	}
+	return peekPlainShard(data)
+}
+
+// peekPlainConv extracts the conversation id from a decrypted packet
+func peekPlainConv(data []byte) (conv uint32, ok bool) {
+	s, ok := peekPlainShard(data)
+	if !ok || s.parity {
+		return 0, false
+	}
+	return s.conv, true
+}
+
+// peekPlainShard extracts the conversation id and the FEC header from a
+// decrypted packet
+func peekPlainShard(data []byte) (s kcpShard, ok bool) {
+	if len(data) < kcp.IKCP_OVERHEAD {
+		return s, false
+	}
+
+	switch binary.LittleEndian.Uint16(data[4:]) {
+	case typeData:
+		if len(data) < fecHeaderSizePlus2+kcp.IKCP_OVERHEAD {
+			return s, false
+		}
+		s.seqid, s.fec = binary.LittleEndian.Uint32(data), true
+		s.conv = binary.LittleEndian.Uint32(data[fecHeaderSizePlus2:])
+	case typeParity:
+		s.seqid, s.fec, s.parity = binary.LittleEndian.Uint32(data), true, true
+	default:
+		s.conv = binary.LittleEndian.Uint32(data)
+	}
+	return s, true
+}
+
+// fecOwnersKept is the number of FEC groups followed by fecOwners, in each
+// of its two generations
+const fecOwnersKept = 1024
+
+// fecOwners maps the recent FEC groups of a flow to the conversation of
+// their data shards, for the parity shards which carry no conversation id.
+// Every session numbers its shards from 0: a group seen with the data
+// shards of several conversations is ambiguous, its parity shards are
+// dropped, as the FEC decoder of a wrong session would recover garbage from
+// them.
+type fecOwners struct {
+	shards    uint32           // data and parity shards per group
+	cur, prev map[uint32]int64 // conversation by group, -1 if ambiguous
+	lastSeen  time.Time
+}
+
+func newFECOwners(dataShards, parityShards int) *fecOwners {
+	o := new(fecOwners)
+	o.shards = uint32(dataShards + parityShards)
+	o.cur = make(map[uint32]int64)
+	return o
+}
+
+// lookup returns the owner of the group of seqid
+func (o *fecOwners) lookup(seqid uint32) (owner int64, ok bool) {
+	id := seqid / o.shards
+	if owner, ok = o.cur[id]; !ok {
+		owner, ok = o.prev[id]
+	}
+	return owner, ok
+}
+
+// data records a data shard of conv
+func (o *fecOwners) data(seqid, conv uint32) {
+	if o.shards == 0 {
+		return
+	}
+	owner, ok := o.lookup(seqid)
+	if !ok || owner == int64(conv) {
+		owner = int64(conv)
+	} else {
+		owner = -1
+	}
+	if len(o.cur) >= fecOwnersKept {
+		o.prev, o.cur = o.cur, make(map[uint32]int64)
+	}
+	o.cur[seqid/o.shards] = owner
+}
+
+// parity returns the conversation of the parity shard seqid, ok is false
+// if its group is unknown or ambiguous
+func (o *fecOwners) parity(seqid uint32) (conv uint32, ok bool) {
+	if o.shards == 0 {
+		return 0, false
+	}
+	owner, ok := o.lookup(seqid)
+	if !ok || owner < 0 {
+		return 0, false
+	}
+	return uint32(owner), true
+}
@@ -0,0 +1,107 @@
+package generic
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// KeySize is the size of the keys derived from the password
+const KeySize = 32
+
+// default cost parameters of every KDF, pbkdf2 defaults to the historical
+// 4096 iterations of SHA1
+var kdfDefaults = map[string]map[string]int{
+	"pbkdf2":   {"iter": 4096},
+	"argon2id": {"t": 3, "m": 64 * 1024, "p": 4}, // m in KiB
+	"scrypt":   {"n": 32768, "r": 8, "p": 1},
+}
+
+// KDFParams returns the cost parameters of method, params like "t=3,m=65536"
+// override the defaults.
+func KDFParams(method, params string) (map[string]int, error) {
+	defaults, ok := kdfDefaults[method]
+	if !ok {
+		return nil, errors.Errorf("unknown kdf: %v", method)
+	}
+	p := make(map[string]int)
+	for k, v := range defaults {
+		p[k] = v
+	}
+
+	for _, kv := range strings.Split(params, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			return nil, errors.Errorf("kdf parameter %q is not name=value", kv)
+		}
+		name := strings.ToLower(kv[:i])
+		if _, ok := defaults[name]; !ok {
+			return nil, errors.Errorf("unknown %v parameter: %v", method, name)
+		}
+		v, err := strconv.Atoi(kv[i+1:])
+		if err != nil || v <= 0 {
+			return nil, errors.Errorf("invalid %v parameter: %v", method, kv)
+		}
+		p[name] = v
+	}
+	return p, nil
+}
+
+// DeriveKey derives a key of KeySize bytes from password and salt, with
+// method "pbkdf2", "argon2id" or "scrypt", see KDFParams for params.
+func DeriveKey(password, method, salt, params string) ([]byte, error) {
+	p, err := KDFParams(method, params)
+	if err != nil {
+		return nil, err
+	}
+
+	switch method {
+	case "argon2id":
+		if p["p"] > 255 {
+			return nil, errors.New("argon2id parallelism is at most 255")
+		}
+		return argon2.IDKey([]byte(password), []byte(salt), uint32(p["t"]), uint32(p["m"]), uint8(p["p"]), KeySize), nil
+	case "scrypt":
+		key, err := scrypt.Key([]byte(password), []byte(salt), p["n"], p["r"], p["p"], KeySize)
+		return key, errors.WithStack(err)
+	default:
+		return pbkdf2.Key([]byte(password), []byte(salt), p["iter"], KeySize, sha1.New), nil
+	}
+}
+
+// DecodeRawKey decodes a hex encoded key of KeySize bytes
+func DecodeRawKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(key) != KeySize {
+		return nil, errors.Errorf("raw key must be %v bytes", KeySize)
+	}
+	return key, nil
+}
+
+// GenKey prints a random password and salt for the KDF, and a random raw key
+func GenKey(w io.Writer) error {
+	buf := make([]byte, 2*KeySize+16)
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		return errors.WithStack(err)
+	}
+	fmt.Fprintln(w, "key:", base64.RawURLEncoding.EncodeToString(buf[:KeySize]))
+	fmt.Fprintln(w, "kdfsalt:", base64.RawURLEncoding.EncodeToString(buf[2*KeySize:]))
+	fmt.Fprintln(w, "rawkey:", hex.EncodeToString(buf[KeySize:2*KeySize]))
+	return nil
+}
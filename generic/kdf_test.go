@@ -0,0 +1,47 @@
+package generic
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDeriveKey(t *testing.T) {
+	// existing deployments keep their key
+	key, err := DeriveKey("it's a secrect", "pbkdf2", "kcp-go", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, testKey) {
+		t.Fatal("pbkdf2 defaults changed the key")
+	}
+
+	for _, method := range []string{"argon2id", "scrypt"} {
+		key, err := DeriveKey("it's a secrect", method, "kcp-go", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(key) != KeySize || bytes.Equal(key, testKey) {
+			t.Fatal(method, "unexpected key")
+		}
+	}
+
+	p, err := KDFParams("argon2id", "t=1, m=1024")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p["t"] != 1 || p["m"] != 1024 || p["p"] != 4 {
+		t.Fatal("unexpected params", p)
+	}
+	for _, params := range []string{"iter=1", "t", "t=0", "m=x"} {
+		if _, err := KDFParams("argon2id", params); err == nil {
+			t.Fatalf("%q accepted", params)
+		}
+	}
+	if _, err := DeriveKey("", "md5", "", ""); err == nil {
+		t.Fatal("unknown kdf accepted")
+	}
+
+	if _, err := DecodeRawKey("00ff"); err == nil {
+		t.Fatal("short raw key accepted")
+	}
+}
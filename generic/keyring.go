@@ -0,0 +1,187 @@
+package generic
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RingKey is a key of a KeyRing, in use from From to Until, zero for no bound
+type RingKey struct {
+	Name  string // shown in logs, like "current" or "previous"
+	PSK   []byte
+	From  time.Time
+	Until time.Time
+	crypt PacketCrypt
+}
+
+// NewRingKey creates a RingKey of the cipher method with key
+func NewRingKey(name, method string, key []byte) (*RingKey, error) {
+	_, block, crypt, err := NewCrypt(method, key)
+	if err != nil {
+		return nil, err
+	}
+	if crypt == nil {
+		crypt = NewBlockPacketCrypt(block)
+	}
+	return &RingKey{Name: name, PSK: key, crypt: crypt}, nil
+}
+
+// valid reports whether the key is in use at now
+func (k *RingKey) valid(now time.Time) bool {
+	return !now.Before(k.From) && (k.Until.IsZero() || now.Before(k.Until))
+}
+
+// KeyRing is a PacketCrypt with several keys in use at once, so the key or
+// crypt can be rotated without interrupting the sessions.
+//
+// Packets are opened with the keys in use, by trial, starting with the key
+// which opened the last packet from the address. Packets are sealed with the
+// newest key in use, or, with follow, with the key of the last packet from
+// the destination, so the server answers every client in the key it uses.
+type KeyRing struct {
+	keys   []*RingKey // oldest first
+	follow bool
+
+	addrs     map[string]*userAddr
+	lastSweep time.Time
+	mu        sync.RWMutex
+}
+
+// NewKeyRing creates a KeyRing of keys, ordered from the oldest to the newest
+func NewKeyRing(follow bool, keys ...*RingKey) *KeyRing {
+	r := new(KeyRing)
+	r.keys = keys
+	r.follow = follow
+	r.addrs = make(map[string]*userAddr)
+	return r
+}
+
+// Current returns the newest key in use
+func (r *KeyRing) Current() *RingKey {
+	now := time.Now()
+	for i := len(r.keys) - 1; i > 0; i-- {
+		if r.keys[i].valid(now) {
+			return r.keys[i]
+		}
+	}
+	return r.keys[0]
+}
+
+// Keys returns the keys in use
+func (r *KeyRing) Keys() []*RingKey {
+	now := time.Now()
+	var keys []*RingKey
+	for _, k := range r.keys {
+		if k.valid(now) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// Lookup returns the key of the last packet from addr, nil if unknown
+func (r *KeyRing) Lookup(addr net.Addr) *RingKey {
+	if caddr, ok := addr.(*ConvAddr); ok {
+		addr = caddr.Addr
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if a, ok := r.addrs[addr.String()]; ok {
+		return r.key(a.id)
+	}
+	return nil
+}
+
+// key returns the key named name
+func (r *KeyRing) key(name string) *RingKey {
+	for _, k := range r.keys {
+		if k.Name == name {
+			return k
+		}
+	}
+	return nil
+}
+
+// Seal implements PacketCrypt
+func (r *KeyRing) Seal(dst, p []byte, addr net.Addr) ([]byte, error) {
+	if r.follow {
+		if k := r.Lookup(addr); k != nil && k.valid(time.Now()) {
+			return k.crypt.Seal(dst, p, addr)
+		}
+	}
+	return r.Current().crypt.Seal(dst, p, addr)
+}
+
+// Open implements PacketCrypt, a packet failing with every key reports the
+// error of the key last used by addr.
+func (r *KeyRing) Open(dst, p []byte, addr net.Addr) ([]byte, error) {
+	now := time.Now()
+	var lastErr error
+	last := r.Lookup(addr)
+	if last != nil && last.valid(now) {
+		plain, err := last.crypt.Open(dst, p, addr)
+		if err == nil {
+			r.remember(addr, last, now)
+			return plain, nil
+		}
+		lastErr = err
+	}
+
+	err := errors.WithStack(errAuthentication)
+	for i := len(r.keys) - 1; i >= 0; i-- {
+		k := r.keys[i]
+		if k == last || !k.valid(now) {
+			continue
+		}
+		var plain []byte
+		if plain, err = k.crypt.Open(dst, p, addr); err == nil {
+			r.remember(addr, k, now)
+			return plain, nil
+		}
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, err
+}
+
+// remember records that addr uses the key k
+func (r *KeyRing) remember(addr net.Addr, k *RingKey, now time.Time) {
+	key := addr.String()
+	r.mu.RLock()
+	a, ok := r.addrs[key]
+	fresh := ok && a.id == k.Name && now.Sub(a.seen) < time.Second
+	r.mu.RUnlock()
+	if fresh {
+		return
+	}
+
+	if ok && a.id != k.Name {
+		logAuth.Info("key changed", "remote", key, "from", a.id, "to", k.Name)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addrs[key] = &userAddr{k.Name, now}
+	if now.Sub(r.lastSweep) > userExpire {
+		for key, a := range r.addrs {
+			if now.Sub(a.seen) > userExpire {
+				delete(r.addrs, key)
+			}
+		}
+		r.lastSweep = now
+	}
+}
+
+// Overhead returns the largest overhead of the keys
+func (r *KeyRing) Overhead() int {
+	overhead := 0
+	for _, k := range r.keys {
+		if n := k.crypt.Overhead(); n > overhead {
+			overhead = n
+		}
+	}
+	return overhead
+}
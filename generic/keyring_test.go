@@ -0,0 +1,65 @@
+package generic
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestKeyRing(t *testing.T) {
+	oldKey, _ := DeriveKey("old", "pbkdf2", "kcp-go", "iter=1")
+	newKey, _ := DeriveKey("new", "pbkdf2", "kcp-go", "iter=1")
+	ringKey := func(name, method string, key []byte) *RingKey {
+		k, err := NewRingKey(name, method, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+
+	prev := ringKey("previous", "aes", oldKey)
+	prev.Until = time.Now().Add(time.Hour)
+	server := NewKeyRing(true, prev, ringKey("current", "aes-gcm", newKey))
+	if server.Overhead() != aeadHeaderSize+16 {
+		t.Fatal("unexpected overhead", server.Overhead())
+	}
+
+	// a client switching to the new key, another one not yet
+	next := ringKey("next", "aes-gcm", newKey)
+	next.From = time.Now().Add(time.Hour)
+	switching := NewKeyRing(false, ringKey("current", "aes", oldKey), next)
+	staying := ringKey("current", "aes", oldKey).crypt
+	switchingAddr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1}
+
+	data := []byte("hello")
+	roundTrip := func(c PacketCrypt, addr net.Addr, key string) {
+		t.Helper()
+		p, _ := c.Seal(nil, data, addr)
+		if got, err := server.Open(nil, p, addr); err != nil || !bytes.Equal(got, data) {
+			t.Fatal("open failed", err)
+		}
+		if k := server.Lookup(addr); k == nil || k.Name != key {
+			t.Fatal("unexpected key", k)
+		}
+		reply, _ := server.Seal(nil, data, addr)
+		if got, err := c.Open(nil, reply, addr); err != nil || !bytes.Equal(got, data) {
+			t.Fatal("reply failed", err)
+		}
+	}
+	roundTrip(staying, testAddr, "previous")
+	roundTrip(switching, switchingAddr, "previous")
+
+	// the switching client moves to the new key, the server follows
+	next.From = time.Now()
+	roundTrip(switching, switchingAddr, "current")
+	roundTrip(staying, testAddr, "previous")
+
+	// the grace period is over
+	prev.Until = time.Now()
+	p, _ := staying.Seal(nil, data, testAddr)
+	if _, err := server.Open(nil, p, testAddr); err == nil {
+		t.Fatal("previous key accepted after the grace period")
+	}
+	roundTrip(switching, switchingAddr, "current")
+}
@@ -0,0 +1,242 @@
+package generic
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// a knock is | KEY ID(8B) | TIME(8B) | NONCE(16B) | IP(16B) | MAC(16B) |,
+	// the key id is the one of the user, or zero for the key of the server.
+	knockNonceSize  = 16
+	knockSignedSize = KeyIDSize + 8 + knockNonceSize + net.IPv6len
+	knockSize       = knockSignedSize + tokenMACSize
+	knockLabel      = "kcptun knock"
+)
+
+// knockMAC computes the MAC of the signed part of knock with key
+func knockMAC(key, knock []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(knockLabel))
+	m.Write(knock[:knockSignedSize])
+	return m.Sum(nil)[:tokenMACSize]
+}
+
+// NewKnock creates a knock asking to admit ip, or the source address of the
+// knock if ip is nil, authenticated with key of the key id of user.
+func NewKnock(key []byte, user string, ip net.IP) ([]byte, error) {
+	knock := make([]byte, knockSize)
+	if user != "" {
+		id := KeyID(user)
+		copy(knock, id[:])
+	}
+	binary.BigEndian.PutUint64(knock[KeyIDSize:], uint64(time.Now().UnixNano()))
+	if _, err := io.ReadFull(rand.Reader, knock[KeyIDSize+8:KeyIDSize+8+knockNonceSize]); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if ip != nil {
+		copy(knock[KeyIDSize+8+knockNonceSize:], ip.To16())
+	}
+	copy(knock[knockSignedSize:], knockMAC(key, knock))
+	return knock, nil
+}
+
+// SendKnock sends a knock to the udp address addr
+func SendKnock(addr string, key []byte, user string, ip net.IP) error {
+	knock, err := NewKnock(key, user, ip)
+	if err != nil {
+		return err
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write(knock)
+	return errors.WithStack(err)
+}
+
+// Knocker admits the addresses of the clients which sent a valid knock to
+// its knock port, for ttl after their latest packet, packets of other
+// addresses are dropped by the connections it guards, see Gate.
+type Knocker struct {
+	// keys returns the keys accepted for a key id, and the ttl of the
+	// addresses admitted, no keys if unknown
+	keys func(id [KeyIDSize]byte) ([][]byte, time.Duration)
+
+	admitted  map[string]*knockAdmission // by ip
+	nonces    map[[knockNonceSize]byte]time.Time
+	lastSweep time.Time
+	mu        sync.RWMutex
+}
+
+type knockAdmission struct {
+	ttl   time.Duration
+	until time.Time
+}
+
+// NewKnocker creates a Knocker, keys returns the keys accepted for a key id
+// and the ttl of the addresses admitted with them.
+func NewKnocker(keys func(id [KeyIDSize]byte) ([][]byte, time.Duration)) *Knocker {
+	k := new(Knocker)
+	k.keys = keys
+	k.admitted = make(map[string]*knockAdmission)
+	k.nonces = make(map[[knockNonceSize]byte]time.Time)
+	k.lastSweep = time.Now()
+	return k
+}
+
+// Serve reads the knocks sent to conn until it's closed
+func (k *Knocker) Serve(conn net.PacketConn) error {
+	buf := make([]byte, mtuLimit)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		ip, err := k.verify(buf[:n], addr)
+		if err != nil {
+			atomic.AddUint64(&DefaultSnmp.BadKnocks, 1)
+			continue
+		}
+		logKnock.Info("knock admitted", "remote", addr, "ip", ip)
+	}
+}
+
+// verify checks a knock from addr, and admits the address it asks for
+func (k *Knocker) verify(knock []byte, addr net.Addr) (string, error) {
+	if len(knock) != knockSize {
+		return "", errors.WithStack(errAuthentication)
+	}
+	var id [KeyIDSize]byte
+	copy(id[:], knock)
+	keys, ttl := k.keys(id)
+	valid := false
+	for _, key := range keys {
+		if hmac.Equal(knockMAC(key, knock), knock[knockSignedSize:]) {
+			valid = true
+		}
+	}
+	if !valid {
+		return "", errors.WithStack(errAuthentication)
+	}
+	ts := time.Unix(0, int64(binary.BigEndian.Uint64(knock[KeyIDSize:])))
+	now := time.Now()
+	if ts.Before(now.Add(-tokenSkew)) || ts.After(now.Add(tokenSkew)) {
+		return "", errors.New("knock out of the clock skew tolerated")
+	}
+
+	ip := net.IP(knock[KeyIDSize+8+knockNonceSize : knockSignedSize])
+	if ip.IsUnspecified() {
+		ip = addrIP(addr)
+	}
+	var nonce [knockNonceSize]byte
+	copy(nonce[:], knock[KeyIDSize+8:])
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, seen := k.nonces[nonce]; seen {
+		return "", errors.WithStack(errReplay)
+	}
+	k.nonces[nonce] = ts.Add(tokenSkew)
+	k.admitted[ip.String()] = &knockAdmission{ttl, now.Add(ttl)}
+	if now.Sub(k.lastSweep) > tokenSweepGap {
+		for nonce, expire := range k.nonces {
+			if now.After(expire) {
+				delete(k.nonces, nonce)
+			}
+		}
+		for ip, a := range k.admitted {
+			if now.After(a.until) {
+				delete(k.admitted, ip)
+			}
+		}
+		k.lastSweep = now
+	}
+	return ip.String(), nil
+}
+
+// pass reports whether the packets of addr are admitted, and extends the
+// admission of addr.
+func (k *Knocker) pass(addr net.Addr) bool {
+	key := addrIP(addr).String()
+	now := time.Now()
+	k.mu.RLock()
+	a, ok := k.admitted[key]
+	var until time.Time
+	if ok {
+		until = a.until
+	}
+	k.mu.RUnlock()
+	if !ok || now.After(until) {
+		return false
+	}
+	if until.Sub(now) < a.ttl-time.Second { // extended at most once a second
+		k.mu.Lock()
+		a.until = now.Add(a.ttl)
+		k.mu.Unlock()
+	}
+	return true
+}
+
+// addrIP returns the IP of addr, unspecified if it has none
+func addrIP(addr net.Addr) net.IP {
+	if caddr, ok := addr.(*ConvAddr); ok {
+		addr = caddr.Addr
+	}
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return net.IPv6unspecified
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip
+	}
+	return net.IPv6unspecified
+}
+
+// Gate returns conn dropping the packets of addresses not admitted
+func (k *Knocker) Gate(conn net.PacketConn) *KnockGate {
+	return &KnockGate{conn, k}
+}
+
+// KnockGate is a net.PacketConn dropping the packets of the addresses not
+// admitted by a Knocker, see Knocker.Gate.
+type KnockGate struct {
+	net.PacketConn
+	knocker *Knocker
+}
+
+// ReadFrom implements the PacketConn ReadFrom method.
+func (g *KnockGate) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		n, addr, err = g.PacketConn.ReadFrom(p)
+		if err != nil || g.knocker.pass(addr) {
+			return n, addr, err
+		}
+		atomic.AddUint64(&DefaultSnmp.KnockDrops, 1)
+	}
+}
+
+// SetReadBuffer sets the socket read buffer of the underlying connection
+func (g *KnockGate) SetReadBuffer(bytes int) error { return SetReadBuffer(g.PacketConn, bytes) }
+
+// SetWriteBuffer sets the socket write buffer of the underlying connection
+func (g *KnockGate) SetWriteBuffer(bytes int) error { return SetWriteBuffer(g.PacketConn, bytes) }
+
+// SetDSCP sets DSCP of the underlying connection
+func (g *KnockGate) SetDSCP(dscp int) error { return SetDSCP(g.PacketConn, dscp) }
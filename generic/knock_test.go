@@ -0,0 +1,54 @@
+package generic
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestKnocker(t *testing.T) {
+	ttl := 200 * time.Millisecond
+	k := NewKnocker(func(id [KeyIDSize]byte) ([][]byte, time.Duration) {
+		if id == KeyID("alice") {
+			return [][]byte{make([]byte, 32)}, time.Hour
+		}
+		return [][]byte{testKey}, ttl
+	})
+	client := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}
+	other := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 2}
+
+	if k.pass(client) {
+		t.Fatal("address admitted without a knock")
+	}
+	forged, _ := NewKnock(make([]byte, 32), "", nil)
+	if _, err := k.verify(forged, client); err == nil || k.pass(client) {
+		t.Fatal("forged knock accepted")
+	}
+
+	// a knock admits its source address, on any port
+	knock, _ := NewKnock(testKey, "", nil)
+	if ip, err := k.verify(knock, client); err != nil || ip != "10.0.0.1" {
+		t.Fatal("knock rejected", ip, err)
+	}
+	if !k.pass(&net.UDPAddr{IP: client.IP, Port: 3}) || k.pass(other) {
+		t.Fatal("unexpected admission")
+	}
+	if _, err := k.verify(knock, other); err == nil {
+		t.Fatal("replayed knock accepted")
+	}
+
+	// a knock for another address, of a user
+	knock, _ = NewKnock(make([]byte, 32), "alice", other.IP)
+	if ip, err := k.verify(knock, client); err != nil || ip != "10.0.0.2" || !k.pass(other) {
+		t.Fatal("knock of the user rejected", ip, err)
+	}
+
+	// the admission expires without traffic
+	time.Sleep(ttl + 50*time.Millisecond)
+	if k.pass(client) {
+		t.Fatal("admission not expired")
+	}
+	if !k.pass(other) {
+		t.Fatal("ttl of the user ignored")
+	}
+}
@@ -0,0 +1,111 @@
+package generic
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// bucket is a token bucket of bytes, which may run into debt
+type bucket struct {
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+	mu     sync.Mutex
+}
+
+// take takes n bytes from the bucket, and sleeps until they are paid for
+func (b *bucket) take(n int) {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	wait := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+
+	if wait >= paceMinSleep {
+		time.Sleep(wait)
+	}
+}
+
+// tryTake takes n tokens from the bucket if it holds them, false otherwise
+func (b *bucket) tryTake(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// LimitConn is a net.Conn limited to a rate in bytes per second in each
+// direction, when reads are slowed down the window of the peer fills up.
+type LimitConn struct {
+	net.Conn
+	rd, wr *bucket
+}
+
+// NewLimitConn limits conn to rate bytes per second in each direction, with
+// a burst of a tenth of a second.
+func NewLimitConn(conn net.Conn, rate int) *LimitConn {
+	burst := float64(rate) / 10
+	if burst < 16384 {
+		burst = 16384
+	}
+	now := time.Now()
+	return &LimitConn{
+		Conn: conn,
+		rd:   &bucket{rate: float64(rate), burst: burst, tokens: burst, last: now},
+		wr:   &bucket{rate: float64(rate), burst: burst, tokens: burst, last: now},
+	}
+}
+
+// Read implements the Conn Read method.
+func (c *LimitConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	c.rd.take(n)
+	return n, err
+}
+
+// Write implements the Conn Write method.
+func (c *LimitConn) Write(p []byte) (n int, err error) {
+	c.wr.take(len(p))
+	return c.Conn.Write(p)
+}
+
+// ParseClasses parses bandwidth classes like "basic=1048576,premium=0",
+// in bytes per second, 0 for no limit.
+func ParseClasses(s string) (map[string]int, error) {
+	classes := make(map[string]int)
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			return nil, errors.Errorf("bandwidth class %q is not name=rate", kv)
+		}
+		rate, err := strconv.Atoi(strings.TrimSpace(kv[i+1:]))
+		if err != nil || rate < 0 {
+			return nil, errors.Errorf("invalid bandwidth class: %v", kv)
+		}
+		classes[strings.TrimSpace(kv[:i])] = rate
+	}
+	return classes, nil
+}
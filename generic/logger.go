@@ -0,0 +1,411 @@
+package generic
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Level is the severity of a log entry
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string { return levelNames[l] }
+
+// parseLevel parses a level name
+func parseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if s == name {
+			return Level(i), nil
+		}
+	}
+	return 0, errors.Errorf("unknown log level: %v", s)
+}
+
+// LogConfig is the config of the logs
+type LogConfig struct {
+	Output  string // a file, "syslog", "journald", or stderr if empty
+	Format  string // "text" or "json"
+	Level   string // eg: "info,stream=debug", the level of every component, then of some
+	MaxSize int64  // of the file in bytes before it is rotated, never if 0
+	Keep    int    // rotated files kept
+}
+
+// logEntry is an entry logged
+type logEntry struct {
+	time      time.Time
+	level     Level
+	component string
+	caller    string
+	event     string
+	fields    []interface{} // key, value pairs
+}
+
+// logSink writes the entries logged somewhere
+type logSink interface {
+	write(e *logEntry, format string) error
+	reopen() error
+	Close() error
+}
+
+// logs is the config of the logs in use
+var logs = struct {
+	level  Level
+	levels map[string]Level // by component
+	format string
+	sink   logSink
+	files  []*fileSink // reopened with the sink, like the access log
+	mu     sync.RWMutex
+}{level: LevelInfo, format: "text", sink: &writerSink{w: os.Stderr}}
+
+// SetupLog sets the logs up as configured, and has the log package log
+// through them at the info level, as the component main
+func SetupLog(config LogConfig) error {
+	if config.Format != "text" && config.Format != "json" {
+		return errors.Errorf("unknown log format: %v", config.Format)
+	}
+	level, levels, err := parseLevels(config.Level)
+	if err != nil {
+		return err
+	}
+	var sink logSink
+	switch config.Output {
+	case "":
+		sink = &writerSink{w: os.Stderr}
+	case "syslog":
+		sink, err = newSyslogSink()
+	case "journald":
+		sink, err = newJournalSink()
+	default:
+		sink, err = newFileSink(config.Output, config.MaxSize, config.Keep)
+	}
+	if err != nil {
+		return err
+	}
+
+	logs.mu.Lock()
+	old := logs.sink
+	logs.level, logs.levels, logs.format, logs.sink = level, levels, config.Format, sink
+	logs.mu.Unlock()
+	old.Close()
+
+	log.SetFlags(log.Lshortfile)
+	log.SetOutput(stdLog{})
+	return nil
+}
+
+// ReopenLog reopens the log files, after they were moved away
+func ReopenLog() error {
+	logs.mu.RLock()
+	defer logs.mu.RUnlock()
+	if err := logs.sink.reopen(); err != nil {
+		return err
+	}
+	for _, f := range logs.files {
+		if err := f.reopen(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseLevels parses levels like "info,stream=debug,acl=warn"
+func parseLevels(s string) (Level, map[string]Level, error) {
+	level := LevelInfo
+	levels := make(map[string]Level)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		l, err := parseLevel(kv[len(kv)-1])
+		if err != nil {
+			return 0, nil, err
+		}
+		if len(kv) == 1 {
+			level = l
+		} else {
+			levels[kv[0]] = l
+		}
+	}
+	return level, levels, nil
+}
+
+// the loggers of the components of this package
+var (
+	logACL     = NewLogger("acl")
+	logAccess  = NewLogger("access")
+	logAuth    = NewLogger("auth")
+	logBan     = NewLogger("ban")
+	logCapture = NewLogger("capture")
+	logConv    = NewLogger("conv")
+	logHook    = NewLogger("hook")
+	logKnock   = NewLogger("knock")
+	logSnmp    = NewLogger("snmp")
+)
+
+// Logger logs the events of a component, with fields like "session",
+// "stream", "remote" and "local"
+type Logger struct {
+	component string
+	fields    []interface{}
+}
+
+// NewLogger creates the logger of component
+func NewLogger(component string) *Logger {
+	return &Logger{component: component}
+}
+
+// With returns a logger adding the key, value pairs to every entry
+func (l *Logger) With(fields ...interface{}) *Logger {
+	return &Logger{component: l.component, fields: append(append([]interface{}{}, l.fields...), fields...)}
+}
+
+// Enabled reports whether the entries at level are logged
+func (l *Logger) Enabled(level Level) bool {
+	logs.mu.RLock()
+	defer logs.mu.RUnlock()
+	min, ok := logs.levels[l.component]
+	if !ok {
+		min = logs.level
+	}
+	return level >= min
+}
+
+// Debug logs event with the key, value pairs of fields at the debug level
+func (l *Logger) Debug(event string, fields ...interface{}) { l.log(LevelDebug, event, fields) }
+
+// Info logs event at the info level
+func (l *Logger) Info(event string, fields ...interface{}) { l.log(LevelInfo, event, fields) }
+
+// Warn logs event at the warn level
+func (l *Logger) Warn(event string, fields ...interface{}) { l.log(LevelWarn, event, fields) }
+
+// Error logs event at the error level
+func (l *Logger) Error(event string, fields ...interface{}) { l.log(LevelError, event, fields) }
+
+func (l *Logger) log(level Level, event string, fields []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	e := &logEntry{time: time.Now(), level: level, component: l.component, event: event}
+	if _, file, line, ok := runtime.Caller(2); ok {
+		e.caller = filepath.Base(file) + ":" + strconv.Itoa(line)
+	}
+	e.fields = append(append(e.fields, l.fields...), fields...)
+	writeEntry(e)
+}
+
+func writeEntry(e *logEntry) {
+	logs.mu.RLock()
+	defer logs.mu.RUnlock()
+	if err := logs.sink.write(e, logs.format); err != nil {
+		fmt.Fprintln(os.Stderr, "log:", err)
+	}
+}
+
+// stdLog writes the lines of the log package as entries of the component main
+type stdLog struct{}
+
+func (stdLog) Write(p []byte) (int, error) {
+	if !(&Logger{component: "main"}).Enabled(LevelInfo) {
+		return len(p), nil
+	}
+	e := &logEntry{time: time.Now(), level: LevelInfo, component: "main"}
+	line := strings.TrimSuffix(string(p), "\n")
+	if i := strings.Index(line, ": "); i > 0 && strings.Contains(line[:i], ".go:") {
+		e.caller, line = line[:i], line[i+2:]
+	}
+	e.event = line
+	writeEntry(e)
+	return len(p), nil
+}
+
+// logValue returns a value of a field as logged
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case net.Addr:
+		if v == nil {
+			return nil
+		}
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+// text formats e as "time LEVEL component caller: event key=value ..."
+func (e *logEntry) text(withTime bool) []byte {
+	var b bytes.Buffer
+	if withTime {
+		b.WriteString(e.time.Format("2006/01/02 15:04:05 "))
+	}
+	fmt.Fprintf(&b, "%-5s %v", strings.ToUpper(e.level.String()), e.component)
+	if e.caller != "" {
+		b.WriteString(" " + e.caller)
+	}
+	b.WriteString(": " + e.event)
+	for i := 0; i+1 < len(e.fields); i += 2 {
+		s := fmt.Sprint(logValue(e.fields[i+1]))
+		if s == "" || strings.ContainsAny(s, " =\"") {
+			s = strconv.Quote(s)
+		}
+		fmt.Fprintf(&b, " %v=%v", e.fields[i], s)
+	}
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+// json formats e as a json object of its fields, in order
+func (e *logEntry) json(withTime bool) []byte {
+	var b bytes.Buffer
+	field := func(key string, value interface{}) {
+		v, err := json.Marshal(value)
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(value))
+		}
+		k, _ := json.Marshal(key)
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	if withTime {
+		field("time", e.time.Format(time.RFC3339Nano))
+	}
+	field("level", e.level.String())
+	field("component", e.component)
+	if e.caller != "" {
+		field("caller", e.caller)
+	}
+	field("event", e.event)
+	for i := 0; i+1 < len(e.fields); i += 2 {
+		field(fmt.Sprint(e.fields[i]), logValue(e.fields[i+1]))
+	}
+	return append(append([]byte{'{'}, b.Bytes()...), '}', '\n')
+}
+
+func (e *logEntry) format(format string, withTime bool) []byte {
+	if format == "json" {
+		return e.json(withTime)
+	}
+	return e.text(withTime)
+}
+
+// writerSink writes the entries to w
+type writerSink struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+func (s *writerSink) write(e *logEntry, format string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.w.Write(e.format(format, true))
+	return errors.WithStack(err)
+}
+
+func (s *writerSink) reopen() error { return nil }
+func (s *writerSink) Close() error  { return nil }
+
+// fileSink writes the entries to a file, rotated to path.1, path.2...
+// once larger than maxSize, and reopened when moved away
+type fileSink struct {
+	path    string
+	maxSize int64
+	keep    int
+	f       *os.File
+	size    int64
+	mu      sync.Mutex
+}
+
+func newFileSink(path string, maxSize int64, keep int) (*fileSink, error) {
+	s := &fileSink{path: path, maxSize: maxSize, keep: keep}
+	return s, s.open()
+}
+
+func (s *fileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.WithStack(err)
+	}
+	s.f, s.size = f, info.Size()
+	return nil
+}
+
+func (s *fileSink) write(e *logEntry, format string) error {
+	_, err := s.Write(e.format(format, true))
+	return err
+}
+
+// Write writes b to the file, rotated first if b would make it too large
+func (s *fileSink) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(b)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := s.f.Write(b)
+	s.size += int64(n)
+	return n, errors.WithStack(err)
+}
+
+// rotate renames the file to path.1, the older ones shifted up to path.keep
+func (s *fileSink) rotate() error {
+	s.f.Close()
+	os.Remove(s.path + "." + strconv.Itoa(s.keep))
+	for i := s.keep - 1; i > 0; i-- {
+		os.Rename(s.path+"."+strconv.Itoa(i), s.path+"."+strconv.Itoa(i+1))
+	}
+	if s.keep > 0 {
+		os.Rename(s.path, s.path+".1")
+	} else {
+		os.Remove(s.path)
+	}
+	return s.open()
+}
+
+func (s *fileSink) reopen() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.f.Close()
+	return s.open()
+}
+
+func (s *fileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return errors.WithStack(s.f.Close())
+}
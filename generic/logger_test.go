@@ -0,0 +1,87 @@
+package generic
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestLogger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kcptun.log")
+	if err := SetupLog(LogConfig{Output: path, Format: "json", Level: "warn,session=debug"}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		SetupLog(LogConfig{Format: "text", Level: "info"})
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	}()
+	if SetupLog(LogConfig{Format: "xml"}) == nil || SetupLog(LogConfig{Format: "text", Level: "info,stream=loud"}) == nil {
+		t.Fatal("invalid config accepted")
+	}
+
+	slog := NewLogger("session").With("session", 7, "remote", "10.0.0.1:4000")
+	slog.Debug("session opened", "smux", 2)
+	NewLogger("stream").Info("stream opened")
+	NewLogger("stream").Error("smux failed", "err", errors.New("broken pipe"))
+	log.Println("version:", "SELFBUILD")
+
+	b, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 {
+		t.Fatal("unexpected entries", string(b))
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["level"] != "debug" || entry["component"] != "session" || entry["event"] != "session opened" ||
+		entry["session"] != 7.0 || entry["smux"] != 2.0 || !strings.HasPrefix(entry["caller"].(string), "logger_test.go:") {
+		t.Fatal("unexpected entry", lines[0])
+	}
+	if !strings.Contains(lines[1], `"component":"stream","caller"`) || !strings.Contains(lines[1], `"err":"broken pipe"`) {
+		t.Fatal("unexpected entry", lines[1])
+	}
+
+	e := &logEntry{level: LevelInfo, component: "main", caller: "main.go:1", event: "stream opened", fields: []interface{}{"target", "a b", "stream", 3}}
+	if text := string(e.text(false)); text != "INFO  main main.go:1: stream opened target=\"a b\" stream=3\n" {
+		t.Fatal("unexpected text", text)
+	}
+}
+
+func TestLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kcptun.log")
+	s, err := newFileSink(path, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	e := &logEntry{component: "main", event: strings.Repeat("x", 40)}
+	for i := 0; i < 8; i++ {
+		if err := s.write(e, "text"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		if info, err := os.Stat(name); err != nil || info.Size() > 100 {
+			t.Fatal("not rotated", name, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Fatal("too many files kept")
+	}
+
+	// moved away then reopened
+	os.Rename(path, path+".old")
+	s.reopen()
+	s.write(e, "text")
+	if b, _ := os.ReadFile(path); !bytes.Contains(b, []byte(e.event)) {
+		t.Fatal("not reopened")
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package generic
+
+import "github.com/pkg/errors"
+
+func newSyslogSink() (logSink, error) {
+	return nil, errors.New("syslog not supported")
+}
+
+func newJournalSink() (logSink, error) {
+	return nil, errors.New("journald not supported")
+}
@@ -0,0 +1,111 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package generic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/syslog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// syslogSink writes the entries to the local syslog
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func newSyslogSink() (logSink, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, filepath.Base(os.Args[0]))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &syslogSink{w}, nil
+}
+
+func (s *syslogSink) write(e *logEntry, format string) error {
+	msg := string(e.format(format, false))
+	switch e.level {
+	case LevelDebug:
+		return s.w.Debug(msg)
+	case LevelWarn:
+		return s.w.Warning(msg)
+	case LevelError:
+		return s.w.Err(msg)
+	}
+	return s.w.Info(msg)
+}
+
+func (s *syslogSink) reopen() error { return nil }
+func (s *syslogSink) Close() error  { return s.w.Close() }
+
+const journalSocket = "/run/systemd/journal/socket"
+
+// journalPriorities are the syslog priorities of the levels
+var journalPriorities = []int{7, 6, 4, 3}
+
+// journalSink writes the entries to journald with the native protocol, the
+// fields of the entries as KCPTUN_KEY fields
+type journalSink struct {
+	conn *net.UnixConn
+}
+
+func newJournalSink() (logSink, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &journalSink{conn}, nil
+}
+
+func (s *journalSink) write(e *logEntry, format string) error {
+	var b bytes.Buffer
+	journalField(&b, "MESSAGE", strings.TrimSuffix(string(e.format(format, false)), "\n"))
+	journalField(&b, "PRIORITY", strconv.Itoa(journalPriorities[e.level]))
+	journalField(&b, "SYSLOG_IDENTIFIER", filepath.Base(os.Args[0]))
+	journalField(&b, "KCPTUN_COMPONENT", e.component)
+	journalField(&b, "KCPTUN_EVENT", e.event)
+	if e.caller != "" {
+		journalField(&b, "CODE_FILE", e.caller)
+	}
+	for i := 0; i+1 < len(e.fields); i += 2 {
+		journalField(&b, "KCPTUN_"+journalKey(fmt.Sprint(e.fields[i])), fmt.Sprint(logValue(e.fields[i+1])))
+	}
+	_, err := s.conn.Write(b.Bytes())
+	return errors.WithStack(err)
+}
+
+// journalField appends a field, with its length if the value has newlines
+func journalField(b *bytes.Buffer, key, value string) {
+	if !strings.Contains(value, "\n") {
+		b.WriteString(key + "=" + value + "\n")
+		return
+	}
+	b.WriteString(key + "\n")
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value + "\n")
+}
+
+// journalKey returns key in upper case, the other characters than letters
+// and digits as underscores
+func journalKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, key)
+}
+
+func (s *journalSink) reopen() error { return nil }
+func (s *journalSink) Close() error  { return s.conn.Close() }
@@ -0,0 +1,143 @@
+package generic
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"unicode"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// gauges of kcp.Snmp, all other fields are counters
+var kcpGauges = map[string]bool{"MaxConn": true, "CurrEstab": true}
+
+// MetricsHandler serves the metrics in the Prometheus text format
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteMetrics(w)
+	})
+}
+
+// WriteMetrics writes every counter of kcp.DefaultSnmp and DefaultSnmp, the
+// streams, the compression ratios and the statistics of every session to
+// w, in the Prometheus text format.
+func WriteMetrics(w io.Writer) {
+	kcpSnmp := kcp.DefaultSnmp.Copy()
+	v := reflect.ValueOf(kcpSnmp).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		if kcpGauges[name] {
+			writeMetric(w, "kcp_"+snakeCase(name), "gauge", v.Field(i).Uint())
+		} else {
+			writeMetric(w, "kcp_"+snakeCase(name)+"_total", "counter", v.Field(i).Uint())
+		}
+	}
+	snmp := DefaultSnmp.Copy()
+	v = reflect.ValueOf(snmp).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		writeMetric(w, "kcptun_"+snakeCase(v.Type().Field(i).Name)+"_total", "counter", v.Field(i).Uint())
+	}
+	streams := snmp.StreamsOpened - snmp.StreamsClosed
+	if snmp.StreamsClosed > snmp.StreamsOpened { // closed meanwhile
+		streams = 0
+	}
+	writeMetric(w, "kcptun_streams", "gauge", streams)
+	fmt.Fprintln(w, "# TYPE kcptun_compression_ratio gauge")
+	for _, dir := range []struct {
+		name      string
+		raw, wire uint64
+	}{{"in", snmp.CompRawIn, snmp.CompWireIn}, {"out", snmp.CompRawOut, snmp.CompWireOut}} {
+		if dir.wire > 0 {
+			fmt.Fprintf(w, "kcptun_compression_ratio{direction=%q} %g\n", dir.name, float64(dir.raw)/float64(dir.wire))
+		}
+	}
+
+	// sessions, by listener and transport, and each with its statistics,
+	// labelled by id as several sessions may share the remote address
+	list := Sessions()
+	counts := make(map[string]int)
+	var keys []string
+	for _, s := range list {
+		key := fmt.Sprintf("listener=%q,transport=%q", s.Listener, s.Transport)
+		if counts[key] == 0 {
+			keys = append(keys, key)
+		}
+		counts[key]++
+	}
+	fmt.Fprintln(w, "# TYPE kcptun_sessions gauge")
+	for _, key := range keys {
+		fmt.Fprintf(w, "kcptun_sessions{%v} %v\n", key, counts[key])
+	}
+	for _, m := range []struct {
+		name, typ string
+		value     func(s *SessionSnapshot) interface{}
+	}{
+		{"kcptun_session_srtt_seconds", "gauge", func(s *SessionSnapshot) interface{} { return s.SRTT.Seconds() }},
+		{"kcptun_session_rto_seconds", "gauge", func(s *SessionSnapshot) interface{} { return s.RTO.Seconds() }},
+		{"kcptun_session_duration_seconds", "gauge", func(s *SessionSnapshot) interface{} { return s.Duration.Seconds() }},
+		{"kcptun_session_streams", "gauge", func(s *SessionSnapshot) interface{} { return len(s.StreamsAlive) }},
+		{"kcptun_session_bytes_in_total", "counter", func(s *SessionSnapshot) interface{} { return s.BytesIn }},
+		{"kcptun_session_bytes_out_total", "counter", func(s *SessionSnapshot) interface{} { return s.BytesOut }},
+		{"kcptun_session_packets_in_total", "counter", func(s *SessionSnapshot) interface{} { return s.PktsIn }},
+		{"kcptun_session_packets_out_total", "counter", func(s *SessionSnapshot) interface{} { return s.PktsOut }},
+		{"kcptun_session_wire_bytes_in_total", "counter", func(s *SessionSnapshot) interface{} { return s.WireIn }},
+		{"kcptun_session_wire_bytes_out_total", "counter", func(s *SessionSnapshot) interface{} { return s.WireOut }},
+		{"kcptun_session_retrans_segs_total", "counter", func(s *SessionSnapshot) interface{} { return s.Retrans }},
+		{"kcptun_session_fec_recovered_total", "counter", func(s *SessionSnapshot) interface{} { return s.Recovered }},
+		{"kcptun_session_comp_saved_bytes", "gauge", func(s *SessionSnapshot) interface{} { return s.CompSaved }},
+	} {
+		fmt.Fprintf(w, "# TYPE %v %v\n", m.name, m.typ)
+		for i := range list {
+			s := &list[i]
+			fmt.Fprintf(w, "%v{listener=%q,remote=%q,transport=%q,session=\"%v\"} %v\n", m.name, s.Listener, s.Remote, s.Transport, s.ID, m.value(s))
+		}
+	}
+}
+
+// writeMetric writes a metric without labels
+func writeMetric(w io.Writer, name, typ string, value uint64) {
+	fmt.Fprintf(w, "# TYPE %v %v\n%v %v\n", name, typ, name, value)
+}
+
+// snakeCase converts a field name like InCsumErrors or FECErrs to in_csum_errors or fec_errs
+func snakeCase(name string) string {
+	var b strings.Builder
+	runes := []rune(name)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) &&
+			(unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// countWriter counts the bytes written to w in n
+type countWriter struct {
+	w io.Writer
+	n *uint64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddUint64(c.n, uint64(n))
+	return n, err
+}
+
+// countReader counts the bytes read from r in n
+type countReader struct {
+	r io.Reader
+	n *uint64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddUint64(c.n, uint64(n))
+	return n, err
+}
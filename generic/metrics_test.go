@@ -0,0 +1,61 @@
+package generic
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+func TestMetrics(t *testing.T) {
+	for name, want := range map[string]string{
+		"InCsumErrors": "in_csum_errors",
+		"FECErrs":      "fec_errs",
+		"KCPInErrors":  "kcp_in_errors",
+		"ACLDrops":     "acl_drops",
+		"BytesSent":    "bytes_sent",
+	} {
+		if got := snakeCase(name); got != want {
+			t.Fatal("unexpected name", got, "of", name)
+		}
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, err := kcp.NewConn2(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}, nil, 0, 0, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	stats := TrackSession(sess, "127.0.0.1:29900")
+
+	var buf bytes.Buffer
+	WriteMetrics(&buf)
+	labels := fmt.Sprintf(`{listener="127.0.0.1:29900",remote="127.0.0.1:9",transport="udp",session="%v"}`, stats.ID())
+	for _, line := range []string{
+		"# TYPE kcp_curr_estab gauge",
+		"# TYPE kcp_in_csum_errors_total counter",
+		"# TYPE kcptun_streams_opened_total counter",
+		"kcptun_streams 0",
+		`kcptun_sessions{listener="127.0.0.1:29900",transport="udp"} 1`,
+		"kcptun_session_rto_seconds" + labels,
+		"kcptun_session_bytes_in_total" + labels + " 0",
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Fatal("missing metric", line)
+		}
+	}
+
+	stats.Close()
+	stats.Close()
+	buf.Reset()
+	WriteMetrics(&buf)
+	if strings.Contains(buf.String(), "kcptun_sessions{") {
+		t.Fatal("session still exported")
+	}
+}
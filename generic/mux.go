@@ -0,0 +1,258 @@
+package generic
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// backlog of packets per conversation before dropping
+const muxBacklog = 128
+
+// ConnMux shares a single net.PacketConn among many KCP sessions,
+// incoming packets are demultiplexed by conversation id.
+//
+// FEC parity shards carry no conversation id, they're delivered to the
+// conversation of the data shards of their FEC group from the same remote
+// address, see fecOwners.
+type ConnMux struct {
+	conn                     net.PacketConn
+	block                    kcp.BlockCrypt
+	dataShards, parityShards int
+
+	conns map[uint32]*MuxConn
+	flows map[string]*fecOwners // by remote address, with FEC
+	mu    sync.Mutex
+
+	die       chan struct{}
+	readError error
+}
+
+// NewConnMux creates a ConnMux over conn, block is used to extract the
+// conversation id of incoming packets, with the FEC parameters of KCP.
+func NewConnMux(conn net.PacketConn, block kcp.BlockCrypt, dataShards, parityShards int) *ConnMux {
+	m := new(ConnMux)
+	m.conn = conn
+	m.block = block
+	m.dataShards = dataShards
+	m.parityShards = parityShards
+	m.conns = make(map[uint32]*MuxConn)
+	m.flows = make(map[string]*fecOwners)
+	m.die = make(chan struct{})
+	go m.readLoop()
+	return m
+}
+
+func (m *ConnMux) readLoop() {
+	buf := make([]byte, mtuLimit)
+	for {
+		n, addr, err := m.conn.ReadFrom(buf)
+		if err != nil {
+			m.mu.Lock()
+			m.readError = errors.WithStack(err)
+			close(m.die)
+			m.mu.Unlock()
+			return
+		}
+
+		s, ok := peekShard(m.block, buf[:n])
+		if !ok {
+			continue
+		}
+		m.mu.Lock()
+		conv := s.conv
+		if s.fec && m.dataShards > 0 {
+			conv, ok = m.trackFEC(s, addr)
+		}
+		if c, found := m.conns[conv]; ok && found {
+			c.input(buf[:n], addr)
+		}
+		m.mu.Unlock()
+	}
+}
+
+// trackFEC follows the FEC groups of the shard s from addr, and returns its
+// conversation, m.mu held
+func (m *ConnMux) trackFEC(s kcpShard, addr net.Addr) (conv uint32, ok bool) {
+	now := time.Now()
+	key := addr.String()
+	flow, known := m.flows[key]
+	if !known {
+		if s.parity {
+			return 0, false
+		}
+		for k, f := range m.flows {
+			if now.Sub(f.lastSeen) > convExpire {
+				delete(m.flows, k)
+			}
+		}
+		flow = newFECOwners(m.dataShards, m.parityShards)
+		m.flows[key] = flow
+	}
+	flow.lastSeen = now
+	if s.parity {
+		return flow.parity(s.seqid)
+	}
+	flow.data(s.seqid, s.conv)
+	return s.conv, true
+}
+
+// Open registers a new conversation, it returns a net.PacketConn receiving
+// the packets of this conversation only.
+func (m *ConnMux) Open() (*MuxConn, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	select {
+	case <-m.die:
+		return nil, m.readError
+	default:
+	}
+
+	var conv uint32
+	for {
+		if err := binary.Read(rand.Reader, binary.LittleEndian, &conv); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if _, ok := m.conns[conv]; !ok {
+			break
+		}
+	}
+
+	c := new(MuxConn)
+	c.Conv = conv
+	c.mux = m
+	c.chPackets = make(chan muxPacket, muxBacklog)
+	c.die = make(chan struct{})
+	m.conns[conv] = c
+	return c, nil
+}
+
+// IsClosed returns true if the underlying connection has failed
+func (m *ConnMux) IsClosed() bool {
+	select {
+	case <-m.die:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close closes the underlying connection
+func (m *ConnMux) Close() error { return m.conn.Close() }
+
+type muxPacket struct {
+	bts  []byte
+	addr net.Addr
+}
+
+// MuxConn is a conversation opened on a ConnMux
+type MuxConn struct {
+	Conv uint32
+
+	mux       *ConnMux
+	chPackets chan muxPacket
+	rd        time.Time
+	rdMu      sync.Mutex
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+// input queues a copy of an incoming packet, m.mu held
+func (c *MuxConn) input(p []byte, addr net.Addr) {
+	buf := peekBuf.Get().([]byte)
+	select {
+	case c.chPackets <- muxPacket{buf[:copy(buf, p)], addr}:
+	default: // drop like a full socket buffer
+		peekBuf.Put(buf)
+	}
+}
+
+// ReadFrom implements the PacketConn ReadFrom method.
+func (c *MuxConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	var deadline <-chan time.Time
+	c.rdMu.Lock()
+	rd := c.rd
+	c.rdMu.Unlock()
+	if !rd.IsZero() {
+		timer := time.NewTimer(time.Until(rd))
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	select {
+	case pkt := <-c.chPackets:
+		n = copy(p, pkt.bts)
+		peekBuf.Put(pkt.bts[:cap(pkt.bts)])
+		return n, pkt.addr, nil
+	case <-deadline:
+		return 0, nil, errors.WithStack(errTimeout)
+	case <-c.mux.die:
+		return 0, nil, c.mux.readError
+	case <-c.die:
+		return 0, nil, errors.WithStack(io.ErrClosedPipe)
+	}
+}
+
+// WriteTo implements the PacketConn WriteTo method.
+func (c *MuxConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	select {
+	case <-c.die:
+		return 0, errors.WithStack(io.ErrClosedPipe)
+	default:
+		return c.mux.conn.WriteTo(p, addr)
+	}
+}
+
+// Close unregisters the conversation, the underlying connection stays open.
+func (c *MuxConn) Close() error {
+	var once bool
+	c.dieOnce.Do(func() {
+		close(c.die)
+		once = true
+	})
+	if !once {
+		return errors.WithStack(io.ErrClosedPipe)
+	}
+
+	c.mux.mu.Lock()
+	delete(c.mux.conns, c.Conv)
+	c.mux.mu.Unlock()
+	return nil
+}
+
+// LocalAddr returns the local address of the underlying connection
+func (c *MuxConn) LocalAddr() net.Addr { return c.mux.conn.LocalAddr() }
+
+// SetDeadline implements the Conn SetDeadline method.
+func (c *MuxConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	c.SetWriteDeadline(t)
+	return nil
+}
+
+// SetReadDeadline implements the Conn SetReadDeadline method.
+func (c *MuxConn) SetReadDeadline(t time.Time) error {
+	c.rdMu.Lock()
+	c.rd = t
+	c.rdMu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline is not supported, the underlying connection is shared.
+func (c *MuxConn) SetWriteDeadline(t time.Time) error { return errInvalidOperation }
+
+// SetReadBuffer sets the socket read buffer of the underlying connection
+func (c *MuxConn) SetReadBuffer(bytes int) error { return SetReadBuffer(c.mux.conn, bytes) }
+
+// SetWriteBuffer sets the socket write buffer of the underlying connection
+func (c *MuxConn) SetWriteBuffer(bytes int) error { return SetWriteBuffer(c.mux.conn, bytes) }
+
+// SetDSCP sets DSCP of the underlying connection
+func (c *MuxConn) SetDSCP(dscp int) error { return SetDSCP(c.mux.conn, dscp) }
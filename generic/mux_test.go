@@ -0,0 +1,112 @@
+package generic
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// muxRead reads a packet from c, nil if none arrives in time
+func muxRead(c *MuxConn) []byte {
+	buf := make([]byte, mtuLimit)
+	c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	n, _, err := c.ReadFrom(buf)
+	if err != nil {
+		return nil
+	}
+	return buf[:n]
+}
+
+func TestConnMux(t *testing.T) {
+	peer, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	defer peer.Close()
+	conn, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	m := NewConnMux(conn, nil, 2, 1)
+	a, err := m.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := m.Open()
+	if a.Conv == b.Conv {
+		t.Fatal("conversations not distinct")
+	}
+
+	// both conversations share the socket, each receives its own packets
+	a.WriteTo(segment(a.Conv, 0, "to peer"), peer.LocalAddr())
+	buf := make([]byte, mtuLimit)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, err := peer.ReadFrom(buf); err != nil || !bytes.Equal(buf[:n], segment(a.Conv, 0, "to peer")) {
+		t.Fatal("not sent", err)
+	}
+	peer.WriteTo(segment(b.Conv, 0, "b"), conn.LocalAddr())
+	peer.WriteTo(segment(a.Conv, 0, "a"), conn.LocalAddr())
+	if p := muxRead(a); !bytes.Equal(p, segment(a.Conv, 0, "a")) {
+		t.Fatal("unexpected packet of a", p)
+	}
+	if p := muxRead(b); !bytes.Equal(p, segment(b.Conv, 0, "b")) {
+		t.Fatal("unexpected packet of b", p)
+	}
+
+	// unknown conversations are dropped, parity shards go to the
+	// conversation of the data shards of their group
+	peer.WriteTo(segment(a.Conv+b.Conv+1, 0, "unknown"), conn.LocalAddr())
+	shards := fecShards(t, 3, segment(a.Conv, 1, "a1"), segment(a.Conv, 2, "a2"))
+	peer.WriteTo(shards[0], conn.LocalAddr())
+	peer.WriteTo(shards[2], conn.LocalAddr())
+	if p := muxRead(a); !bytes.Equal(p, shards[0]) {
+		t.Fatal("unexpected data shard", p)
+	}
+	if p := muxRead(a); !bytes.Equal(p, shards[2]) {
+		t.Fatal("parity shard not delivered", p)
+	}
+	if p := muxRead(b); p != nil {
+		t.Fatal("unexpected packet", p)
+	}
+
+	// the parity shards of a group shared by both conversations, or of an
+	// unknown group, are dropped
+	other := fecShards(t, 3, segment(b.Conv, 1, "b1"), segment(b.Conv, 2, "b2"))
+	unknown := fecShards(t, 6, segment(b.Conv, 3, "b3"), segment(b.Conv, 4, "b4"))
+	peer.WriteTo(other[0], conn.LocalAddr())
+	peer.WriteTo(other[2], conn.LocalAddr())
+	peer.WriteTo(unknown[2], conn.LocalAddr())
+	if p := muxRead(b); !bytes.Equal(p, other[0]) {
+		t.Fatal("unexpected data shard", p)
+	}
+	if p := muxRead(a); p != nil {
+		t.Fatal("unexpected packet", p)
+	}
+	if p := muxRead(b); p != nil {
+		t.Fatal("unexpected packet", p)
+	}
+
+	// closed, b no longer receives
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if b.Close() == nil {
+		t.Fatal("closed twice")
+	}
+	if _, _, err := b.ReadFrom(buf); err == nil {
+		t.Fatal("read from a closed conversation")
+	}
+	if m.IsClosed() {
+		t.Fatal("closed with a conversation")
+	}
+
+	// closing the mux ends every conversation
+	m.Close()
+	for i := 0; i < 100 && !m.IsClosed(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !m.IsClosed() {
+		t.Fatal("not closed")
+	}
+	if _, _, err := a.ReadFrom(buf); err == nil {
+		t.Fatal("read from a closed mux")
+	}
+	if _, err := m.Open(); err == nil {
+		t.Fatal("opened on a closed mux")
+	}
+}
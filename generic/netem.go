@@ -0,0 +1,470 @@
+package generic
+
+import (
+	"container/heap"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// packets queued per direction before dropping, like netem's default limit
+const netemLimit = 1000
+
+// Impairment describes the network conditions emulated in one direction,
+// in the terms of tc-netem(8).
+type Impairment struct {
+	Delay     time.Duration // fixed delay of every packet
+	Jitter    time.Duration // uniformly distributed in [-Jitter, +Jitter] around Delay
+	Loss      float64       // random loss probability, 0 to 1
+	Duplicate float64       // duplication probability
+	Reorder   float64       // probability of a packet being sent immediately, ahead of the delayed ones
+	Rate      int           // link bandwidth in bits per second, 0 for unlimited
+
+	// Gilbert-Elliott burst loss, used instead of Loss if GEModel is set
+	GEModel bool
+	GEP     float64 // transition probability from good to bad state
+	GER     float64 // transition probability from bad to good state
+	GELossB float64 // loss probability in bad state, 1-h
+	GELossG float64 // loss probability in good state, 1-k
+}
+
+// ParseImpairment parses a tc-netem like specification, eg:
+//
+//	"delay 100ms 20ms loss 1% duplicate 0.5% reorder 5% rate 2mbit"
+//	"loss gemodel 1% 10% [70% [0.1%]]"
+func ParseImpairment(spec string) (*Impairment, error) {
+	im := new(Impairment)
+	args := strings.Fields(spec)
+	next := func() (string, bool) {
+		if len(args) == 0 || isNetemKeyword(args[0]) {
+			return "", false
+		}
+		arg := args[0]
+		args = args[1:]
+		return arg, true
+	}
+	percent := func(kw string) (float64, error) {
+		arg, ok := next()
+		if !ok {
+			return 0, errors.Errorf("netem: %v needs a percentage", kw)
+		}
+		p, err := strconv.ParseFloat(strings.TrimSuffix(arg, "%"), 64)
+		if err != nil || p < 0 || p > 100 {
+			return 0, errors.Errorf("netem: invalid percentage %v for %v", arg, kw)
+		}
+		return p / 100, nil
+	}
+
+	var err error
+	for len(args) > 0 {
+		kw := args[0]
+		args = args[1:]
+		switch kw {
+		case "delay":
+			arg, ok := next()
+			if !ok {
+				return nil, errors.New("netem: delay needs a time")
+			}
+			if im.Delay, err = time.ParseDuration(arg); err != nil {
+				return nil, errors.WithStack(err)
+			}
+			if arg, ok := next(); ok {
+				if im.Jitter, err = time.ParseDuration(arg); err != nil {
+					return nil, errors.WithStack(err)
+				}
+			}
+		case "loss":
+			if len(args) > 0 && args[0] == "gemodel" {
+				args = args[1:]
+				im.GEModel = true
+				if im.GEP, err = percent("gemodel"); err != nil {
+					return nil, err
+				}
+				// with r omitted it's the simple Gilbert model, r = 1 - p
+				im.GER = 1 - im.GEP
+				im.GELossB = 1
+				if len(args) > 0 && !isNetemKeyword(args[0]) {
+					if im.GER, err = percent("gemodel"); err != nil {
+						return nil, err
+					}
+				}
+				if len(args) > 0 && !isNetemKeyword(args[0]) {
+					if im.GELossB, err = percent("gemodel"); err != nil {
+						return nil, err
+					}
+				}
+				if len(args) > 0 && !isNetemKeyword(args[0]) {
+					if im.GELossG, err = percent("gemodel"); err != nil {
+						return nil, err
+					}
+				}
+			} else if im.Loss, err = percent(kw); err != nil {
+				return nil, err
+			}
+		case "duplicate":
+			if im.Duplicate, err = percent(kw); err != nil {
+				return nil, err
+			}
+		case "reorder":
+			if im.Reorder, err = percent(kw); err != nil {
+				return nil, err
+			}
+		case "rate":
+			arg, ok := next()
+			if !ok {
+				return nil, errors.New("netem: rate needs a bandwidth")
+			}
+			if im.Rate, err = parseBitRate(arg); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, errors.Errorf("netem: unknown parameter %v", kw)
+		}
+	}
+	return im, nil
+}
+
+func isNetemKeyword(s string) bool {
+	switch s {
+	case "delay", "loss", "duplicate", "reorder", "rate":
+		return true
+	}
+	return false
+}
+
+// parseBitRate parses a bandwidth like "512kbit" or "10mbit"
+func parseBitRate(s string) (int, error) {
+	units := []struct {
+		suffix string
+		scale  float64
+	}{{"gbit", 1e9}, {"mbit", 1e6}, {"kbit", 1e3}, {"bit", 1}}
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			v, err := strconv.ParseFloat(strings.TrimSuffix(s, u.suffix), 64)
+			if err != nil || v <= 0 {
+				break
+			}
+			return int(v * u.scale), nil
+		}
+	}
+	return 0, errors.Errorf("netem: invalid rate %v", s)
+}
+
+// netemPacket is a packet scheduled for delivery
+type netemPacket struct {
+	bts  []byte
+	addr net.Addr
+	at   time.Time
+	seq  uint64 // keeps packets due at the same time in order
+}
+
+type netemHeap []netemPacket
+
+func (h netemHeap) Len() int { return len(h) }
+func (h netemHeap) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].at.Before(h[j].at)
+}
+func (h netemHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *netemHeap) Push(x interface{}) { *h = append(*h, x.(netemPacket)) }
+func (h *netemHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+// netem applies an Impairment to the packets of one direction, and
+// delivers them when due
+type netem struct {
+	im       *Impairment
+	rng      *rand.Rand
+	bad      bool      // Gilbert-Elliott state
+	linkBusy time.Time // until when the emulated link is busy sending
+	seq      uint64
+
+	queue   netemHeap
+	mu      sync.Mutex
+	wake    chan struct{}
+	deliver func(p []byte, addr net.Addr)
+}
+
+func newNetem(im *Impairment, seed int64, deliver func(p []byte, addr net.Addr), die <-chan struct{}) *netem {
+	n := new(netem)
+	n.im = im
+	n.rng = rand.New(rand.NewSource(seed))
+	n.wake = make(chan struct{}, 1)
+	n.deliver = deliver
+	go n.run(die)
+	return n
+}
+
+// lost decides whether the next packet is lost, n.mu held
+func (n *netem) lost() bool {
+	im := n.im
+	if !im.GEModel {
+		return im.Loss > 0 && n.rng.Float64() < im.Loss
+	}
+
+	var lost bool
+	if n.bad {
+		lost = n.rng.Float64() < im.GELossB
+		if n.rng.Float64() < im.GER {
+			n.bad = false
+		}
+	} else {
+		lost = im.GELossG > 0 && n.rng.Float64() < im.GELossG
+		if n.rng.Float64() < im.GEP {
+			n.bad = true
+		}
+	}
+	return lost
+}
+
+// input schedules a copy of p according to the impairment
+func (n *netem) input(p []byte, addr net.Addr) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.lost() {
+		return
+	}
+	copies := 1
+	if n.im.Duplicate > 0 && n.rng.Float64() < n.im.Duplicate {
+		copies = 2
+	}
+
+	now := time.Now()
+	for i := 0; i < copies; i++ {
+		if len(n.queue) >= netemLimit {
+			return
+		}
+
+		at := now
+		if n.im.Rate > 0 { // serialization on the emulated link
+			if n.linkBusy.After(at) {
+				at = n.linkBusy
+			}
+			at = at.Add(time.Duration(float64(len(p)*8) / float64(n.im.Rate) * float64(time.Second)))
+			n.linkBusy = at
+		}
+		if n.im.Reorder == 0 || n.rng.Float64() >= n.im.Reorder {
+			delay := n.im.Delay
+			if n.im.Jitter > 0 {
+				delay += time.Duration((n.rng.Float64()*2 - 1) * float64(n.im.Jitter))
+			}
+			if delay > 0 {
+				at = at.Add(delay)
+			}
+		}
+
+		buf := peekBuf.Get().([]byte)
+		n.seq++
+		heap.Push(&n.queue, netemPacket{buf[:copy(buf, p)], addr, at, n.seq})
+	}
+
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers the packets when due
+func (n *netem) run(die <-chan struct{}) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		n.mu.Lock()
+		for len(n.queue) > 0 && !n.queue[0].at.After(time.Now()) {
+			pkt := heap.Pop(&n.queue).(netemPacket)
+			n.mu.Unlock()
+			n.deliver(pkt.bts, pkt.addr)
+			peekBuf.Put(pkt.bts[:cap(pkt.bts)])
+			n.mu.Lock()
+		}
+		wait := time.Hour
+		if len(n.queue) > 0 {
+			wait = time.Until(n.queue[0].at)
+		}
+		n.mu.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-n.wake:
+		case <-die:
+			return
+		}
+	}
+}
+
+// NetemConn is a net.PacketConn emulating lossy, slow or unstable networks
+// on the packets it sends and receives, with independent impairments per
+// direction. Random decisions are drawn from a seeded source, the same
+// seed and traffic give the same losses.
+type NetemConn struct {
+	conn net.PacketConn
+	out  *netem
+	in   *netem
+
+	chPackets chan netemPacket // packets delivered by in
+	rd        time.Time
+	rdMu      sync.Mutex
+
+	die       chan struct{}
+	dieOnce   sync.Once
+	readError error
+	errMu     sync.Mutex
+}
+
+// NewNetemConn impairs the packets sent to conn with out, and the packets
+// received from it with in, nil for no impairment.
+func NewNetemConn(conn net.PacketConn, out, in *Impairment, seed int64) *NetemConn {
+	c := new(NetemConn)
+	c.conn = conn
+	c.die = make(chan struct{})
+	if out != nil {
+		c.out = newNetem(out, seed, func(p []byte, addr net.Addr) { c.conn.WriteTo(p, addr) }, c.die)
+	}
+	if in != nil {
+		c.chPackets = make(chan netemPacket, netemLimit)
+		c.in = newNetem(in, seed+1, c.received, c.die)
+		go c.readLoop()
+	}
+	return c
+}
+
+// received queues a copy of a packet delivered by c.in
+func (c *NetemConn) received(p []byte, addr net.Addr) {
+	buf := peekBuf.Get().([]byte)
+	select {
+	case c.chPackets <- netemPacket{bts: buf[:copy(buf, p)], addr: addr}:
+	default:
+		peekBuf.Put(buf)
+	}
+}
+
+func (c *NetemConn) readLoop() {
+	buf := make([]byte, mtuLimit)
+	for {
+		n, addr, err := c.conn.ReadFrom(buf)
+		if err != nil {
+			c.errMu.Lock()
+			c.readError = errors.WithStack(err)
+			c.errMu.Unlock()
+			c.Close()
+			return
+		}
+		c.in.input(buf[:n], addr)
+	}
+}
+
+// ReadFrom implements the PacketConn ReadFrom method.
+func (c *NetemConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	if c.in == nil {
+		return c.conn.ReadFrom(p)
+	}
+
+	var deadline <-chan time.Time
+	c.rdMu.Lock()
+	rd := c.rd
+	c.rdMu.Unlock()
+	if !rd.IsZero() {
+		timer := time.NewTimer(time.Until(rd))
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	select {
+	case pkt := <-c.chPackets:
+		n = copy(p, pkt.bts)
+		peekBuf.Put(pkt.bts[:cap(pkt.bts)])
+		return n, pkt.addr, nil
+	case <-deadline:
+		return 0, nil, errors.WithStack(errTimeout)
+	case <-c.die:
+		c.errMu.Lock()
+		err := c.readError
+		c.errMu.Unlock()
+		if err == nil {
+			err = errors.WithStack(io.ErrClosedPipe)
+		}
+		return 0, nil, err
+	}
+}
+
+// WriteTo implements the PacketConn WriteTo method.
+func (c *NetemConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	if c.out == nil {
+		return c.conn.WriteTo(p, addr)
+	}
+	select {
+	case <-c.die:
+		return 0, errors.WithStack(io.ErrClosedPipe)
+	default:
+	}
+	if len(p) > mtuLimit {
+		return 0, errors.WithStack(io.ErrShortBuffer)
+	}
+	c.out.input(p, addr)
+	return len(p), nil
+}
+
+// Close discards the packets in flight and closes the underlying connection
+func (c *NetemConn) Close() error {
+	var once bool
+	c.dieOnce.Do(func() {
+		close(c.die)
+		once = true
+	})
+	if !once {
+		return errors.WithStack(io.ErrClosedPipe)
+	}
+	return c.conn.Close()
+}
+
+// LocalAddr returns the local address of the underlying connection
+func (c *NetemConn) LocalAddr() net.Addr { return c.conn.LocalAddr() }
+
+// SetDeadline implements the Conn SetDeadline method.
+func (c *NetemConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline implements the Conn SetReadDeadline method.
+func (c *NetemConn) SetReadDeadline(t time.Time) error {
+	if c.in == nil {
+		return c.conn.SetReadDeadline(t)
+	}
+	c.rdMu.Lock()
+	c.rd = t
+	c.rdMu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline implements the Conn SetWriteDeadline method.
+func (c *NetemConn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
+
+// SetReadBuffer sets the socket read buffer of the underlying connection
+func (c *NetemConn) SetReadBuffer(bytes int) error { return SetReadBuffer(c.conn, bytes) }
+
+// SetWriteBuffer sets the socket write buffer of the underlying connection
+func (c *NetemConn) SetWriteBuffer(bytes int) error { return SetWriteBuffer(c.conn, bytes) }
+
+// SetDSCP sets DSCP of the underlying connection
+func (c *NetemConn) SetDSCP(dscp int) error { return SetDSCP(c.conn, dscp) }
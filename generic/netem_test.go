@@ -0,0 +1,71 @@
+package generic
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseImpairment(t *testing.T) {
+	im, err := ParseImpairment("delay 100ms 20ms loss 1% duplicate 0.5% reorder 5% rate 2mbit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Impairment{Delay: 100 * time.Millisecond, Jitter: 20 * time.Millisecond, Loss: 0.01, Duplicate: 0.005, Reorder: 0.05, Rate: 2000000}
+	if !reflect.DeepEqual(im, expected) {
+		t.Fatalf("got %+v, expected %+v", im, expected)
+	}
+
+	im, err = ParseImpairment("loss gemodel 1% 10% 70%")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = &Impairment{GEModel: true, GEP: 0.01, GER: 0.1, GELossB: 0.7}
+	if !reflect.DeepEqual(im, expected) {
+		t.Fatalf("got %+v, expected %+v", im, expected)
+	}
+
+	for _, spec := range []string{"delay", "loss 120%", "rate 10", "jitter 1ms"} {
+		if _, err := ParseImpairment(spec); err == nil {
+			t.Fatalf("%q accepted", spec)
+		}
+	}
+}
+
+// the same seed drops the same packets
+func TestNetemSeed(t *testing.T) {
+	run := func(seed int64) []uint32 {
+		var delivered []uint32
+		var mu sync.Mutex
+		die := make(chan struct{})
+		defer close(die)
+
+		im := &Impairment{GEModel: true, GEP: 0.05, GER: 0.3, GELossB: 1, GELossG: 0.01, Duplicate: 0.01}
+		n := newNetem(im, seed, func(p []byte, addr net.Addr) {
+			mu.Lock()
+			delivered = append(delivered, binary.LittleEndian.Uint32(p))
+			mu.Unlock()
+		}, die)
+
+		pkt := make([]byte, 4)
+		for i := uint32(0); i < 1000; i++ {
+			binary.LittleEndian.PutUint32(pkt, i)
+			n.input(pkt, nil)
+		}
+		time.Sleep(100 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		return delivered
+	}
+
+	a, b := run(42), run(42)
+	if len(a) == 1000 || !reflect.DeepEqual(a, b) {
+		t.Fatalf("not reproducible: %v packets then %v packets", len(a), len(b))
+	}
+	if c := run(43); reflect.DeepEqual(a, c) {
+		t.Fatal("different seeds gave the same losses")
+	}
+}
@@ -0,0 +1,246 @@
+package generic
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+const (
+	paceBacklog       = 1024                   // queued packets per destination before dropping
+	paceGain          = 1.25                   // headroom over the rate of the window
+	paceMinSleep      = time.Millisecond       // shorter waits are accumulated, timers can't do better
+	paceEstimateEvery = 100 * time.Millisecond // how often the rate estimate is refreshed
+	paceIdle          = 5 * time.Minute        // destinations idle longer are forgotten
+)
+
+// PacedConn is a net.PacketConn spreading the outgoing packets of each
+// destination over time, instead of sending a whole KCP window at every
+// flush. Packets leave through a token bucket refilled at the lesser of the
+// configured rate and the rate estimated for the destination, up to a burst
+// allowance; without either, packets are sent as they come.
+//
+// WriteTo never blocks, packets are dropped when the queue is full.
+type PacedConn struct {
+	conn  net.PacketConn
+	rate  int // bytes per second, 0 for no cap
+	burst int // bytes allowed to leave back-to-back
+
+	flows      map[string]*pacedFlow
+	estimators map[string]*paceEstimator // by destination, as long as their session
+	mu         sync.Mutex
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+type pacedPacket struct {
+	bts  []byte
+	addr net.Addr
+	ts   time.Time
+}
+
+// pacedFlow is the queue of packets to one destination
+type pacedFlow struct {
+	chPackets chan pacedPacket
+}
+
+// paceEstimator is the rate estimate of a destination in bytes per second
+type paceEstimator struct {
+	estimate func() int
+}
+
+// NewPacedConn paces packets written to conn at rate bytes per second at
+// most(0 for no cap), with burst bytes allowed back-to-back.
+func NewPacedConn(conn net.PacketConn, rate, burst int) *PacedConn {
+	c := new(PacedConn)
+	c.conn = conn
+	c.rate = rate
+	c.burst = burst
+	c.flows = make(map[string]*pacedFlow)
+	c.estimators = make(map[string]*paceEstimator)
+	c.die = make(chan struct{})
+	return c
+}
+
+// SetEstimator sets the rate estimator of packets to addr, see
+// WindowEstimator, until unset is called as the session ends. The estimator
+// outlives the queue of addr, forgotten while idle.
+func (c *PacedConn) SetEstimator(addr net.Addr, estimate func() int) (unset func()) {
+	key := addr.String()
+	e := &paceEstimator{estimate}
+	c.mu.Lock()
+	c.estimators[key] = e
+	c.mu.Unlock()
+	return func() {
+		c.mu.Lock()
+		if c.estimators[key] == e {
+			delete(c.estimators, key)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// flow returns the queue of addr, creating it if needed, c.mu held
+func (c *PacedConn) flow(addr net.Addr) *pacedFlow {
+	key := addr.String()
+	f, ok := c.flows[key]
+	if !ok {
+		f = &pacedFlow{chPackets: make(chan pacedPacket, paceBacklog)}
+		c.flows[key] = f
+		go c.pace(key, f)
+	}
+	return f
+}
+
+// pace sends the packets of a flow through the token bucket
+func (c *PacedConn) pace(key string, f *pacedFlow) {
+	ticker := time.NewTicker(paceIdle)
+	defer ticker.Stop()
+
+	var estimate func() int
+	var rate int
+	var estimated time.Time
+	tokens := float64(c.burst)
+	last := time.Now()
+	active := last
+
+	for {
+		select {
+		case pkt := <-f.chPackets:
+			now := time.Now()
+			if now.Sub(estimated) >= paceEstimateEvery {
+				estimate = nil
+				c.mu.Lock()
+				if e, ok := c.estimators[key]; ok {
+					estimate = e.estimate
+				}
+				c.mu.Unlock()
+				rate = c.rate
+				if estimate != nil { // called outside c.mu, it may lock the session
+					if r := estimate(); r > 0 && (rate == 0 || r < rate) {
+						rate = r
+					}
+				}
+				estimated = now
+			}
+
+			if rate > 0 {
+				tokens += now.Sub(last).Seconds() * float64(rate)
+				if tokens > float64(c.burst) {
+					tokens = float64(c.burst)
+				}
+				last = now
+				// the bucket goes into debt for waits too short to sleep
+				if wait := time.Duration(-tokens / float64(rate) * float64(time.Second)); wait >= paceMinSleep {
+					select {
+					case <-time.After(wait):
+					case <-c.die:
+						return
+					}
+					now = time.Now()
+					tokens += now.Sub(last).Seconds() * float64(rate)
+					last = now
+				}
+				tokens -= float64(len(pkt.bts))
+			}
+
+			c.conn.WriteTo(pkt.bts, pkt.addr)
+			atomic.AddUint64(&DefaultSnmp.PacedPkts, 1)
+			atomic.AddUint64(&DefaultSnmp.PacingDelay, uint64(now.Sub(pkt.ts)/time.Microsecond))
+			peekBuf.Put(pkt.bts[:cap(pkt.bts)])
+			active = now
+		case <-ticker.C:
+			c.mu.Lock()
+			if time.Since(active) >= paceIdle && len(f.chPackets) == 0 {
+				delete(c.flows, key)
+				c.mu.Unlock()
+				return
+			}
+			c.mu.Unlock()
+		case <-c.die:
+			return
+		}
+	}
+}
+
+// WindowEstimator estimates the rate of sess as the largest its send window
+// allows, sndwnd packets of mtu bytes per smoothed RTT, with some headroom
+// for the window to open up; it's not a measured bandwidth, and it's 0
+// until the RTT is measured.
+func WindowEstimator(sess *kcp.UDPSession, sndwnd, mtu int) func() int {
+	return func() int {
+		srtt := sess.GetSRTT()
+		if srtt <= 0 {
+			return 0
+		}
+		return int(float64(sndwnd*mtu) * paceGain * 1000 / float64(srtt))
+	}
+}
+
+// ReadFrom implements the PacketConn ReadFrom method.
+func (c *PacedConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	return c.conn.ReadFrom(p)
+}
+
+// WriteTo implements the PacketConn WriteTo method, the packet is queued.
+func (c *PacedConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	select {
+	case <-c.die:
+		return 0, errors.WithStack(io.ErrClosedPipe)
+	default:
+	}
+	if len(p) > mtuLimit {
+		return c.conn.WriteTo(p, addr)
+	}
+
+	buf := peekBuf.Get().([]byte)
+	c.mu.Lock()
+	select {
+	case c.flow(addr).chPackets <- pacedPacket{buf[:copy(buf, p)], addr, time.Now()}:
+	default:
+		peekBuf.Put(buf)
+		atomic.AddUint64(&DefaultSnmp.PacingDrops, 1)
+	}
+	c.mu.Unlock()
+	return len(p), nil
+}
+
+// Close discards the queued packets and closes the underlying connection
+func (c *PacedConn) Close() error {
+	var once bool
+	c.dieOnce.Do(func() {
+		close(c.die)
+		once = true
+	})
+	if !once {
+		return errors.WithStack(io.ErrClosedPipe)
+	}
+	return c.conn.Close()
+}
+
+// LocalAddr returns the local address of the underlying connection
+func (c *PacedConn) LocalAddr() net.Addr { return c.conn.LocalAddr() }
+
+// SetDeadline implements the Conn SetDeadline method.
+func (c *PacedConn) SetDeadline(t time.Time) error { return c.conn.SetDeadline(t) }
+
+// SetReadDeadline implements the Conn SetReadDeadline method.
+func (c *PacedConn) SetReadDeadline(t time.Time) error { return c.conn.SetReadDeadline(t) }
+
+// SetWriteDeadline implements the Conn SetWriteDeadline method.
+func (c *PacedConn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
+
+// SetReadBuffer sets the socket read buffer of the underlying connection
+func (c *PacedConn) SetReadBuffer(bytes int) error { return SetReadBuffer(c.conn, bytes) }
+
+// SetWriteBuffer sets the socket write buffer of the underlying connection
+func (c *PacedConn) SetWriteBuffer(bytes int) error { return SetWriteBuffer(c.conn, bytes) }
+
+// SetDSCP sets DSCP of the underlying connection
+func (c *PacedConn) SetDSCP(dscp int) error { return SetDSCP(c.conn, dscp) }
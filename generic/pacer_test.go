@@ -0,0 +1,67 @@
+package generic
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPacedConn(t *testing.T) {
+	const rate, burst, size, count = 100000, 10000, 1000, 60
+
+	src, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	dst.SetReadBuffer(1 << 20)
+
+	conn := NewPacedConn(src, rate, burst)
+	defer conn.Close()
+
+	start := time.Now()
+	pkt := make([]byte, size)
+	for i := 0; i < count; i++ {
+		if _, err := conn.WriteTo(pkt, dst.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatal("WriteTo blocked for", elapsed)
+	}
+
+	buf := make([]byte, mtuLimit)
+	dst.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < count; i++ {
+		if _, _, err := dst.ReadFrom(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the burst leaves at once, the rest at rate
+	expected := time.Duration(float64(count*size-burst) / rate * float64(time.Second))
+	if elapsed := time.Since(start); elapsed < expected*9/10 || elapsed > expected*2 {
+		t.Fatalf("paced %v bytes in %v, expected %v", count*size, elapsed, expected)
+	}
+}
+
+func TestPaceEstimator(t *testing.T) {
+	conn := NewPacedConn(nil, 0, 0)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	unsetOld := conn.SetEstimator(addr, func() int { return 1 })
+	unset := conn.SetEstimator(addr, func() int { return 2 })
+
+	// kept without a queue, until the session of the estimator ends
+	unsetOld()
+	if e := conn.estimators[addr.String()]; e == nil || e.estimate() != 2 || len(conn.flows) != 0 {
+		t.Fatal("estimator of the current session removed")
+	}
+	unset()
+	if len(conn.estimators) != 0 {
+		t.Fatal("estimator not removed")
+	}
+}
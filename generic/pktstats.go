@@ -0,0 +1,212 @@
+package generic
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+const fecGroupsKept = 64 // FEC groups followed per session
+
+// wireStats are the statistics of the packets of a session
+type wireStats struct {
+	pktsIn, pktsOut   uint64
+	bytesIn, bytesOut uint64
+	retrans           uint64
+	recovered         uint64
+
+	nextSN    uint32 // of the next new segment sent
+	snValid   bool
+	groups    map[uint32]*fecGroup
+	lastGroup uint32
+}
+
+// statsConv is the last conversation seen at an address
+type statsConv struct {
+	conv     uint32
+	lastSeen time.Time
+}
+
+// fecGroup counts the shards received of a FEC group
+type fecGroup struct {
+	data, total int
+	done        bool
+}
+
+// PacketStatsConn is a net.PacketConn beneath KCP counting the packets of
+// every tracked session, see TrackSession, packets must be plaintext.
+//
+// Retransmissions are the data segments sent with a sequence number already
+// sent. FEC recoveries are inferred like the FEC decoder of kcp-go does
+// them: a group missing data shards is recovered once as many shards as
+// there are data shards arrived.
+type PacketStatsConn struct {
+	net.PacketConn
+	dataShards, parityShards int
+
+	convs map[string]*statsConv // last conversation by address, for the parity shards
+	mu    sync.Mutex
+}
+
+// NewPacketStatsConn counts the packets over conn, with the FEC parameters of KCP
+func NewPacketStatsConn(conn net.PacketConn, dataShards, parityShards int) *PacketStatsConn {
+	c := new(PacketStatsConn)
+	c.PacketConn = conn
+	c.dataShards = dataShards
+	c.parityShards = parityShards
+	c.convs = make(map[string]*statsConv)
+	return c
+}
+
+// ReadFrom implements the PacketConn ReadFrom method.
+func (c *PacketStatsConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	n, addr, err = c.PacketConn.ReadFrom(p)
+	if err == nil {
+		c.count(p[:n], addr, true)
+	}
+	return n, addr, err
+}
+
+// WriteTo implements the PacketConn WriteTo method.
+func (c *PacketStatsConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	n, err = c.PacketConn.WriteTo(p, addr)
+	if err == nil {
+		c.count(p, addr, false)
+	}
+	return n, err
+}
+
+// SetReadBuffer sets the socket read buffer of the underlying connection
+func (c *PacketStatsConn) SetReadBuffer(bytes int) error { return SetReadBuffer(c.PacketConn, bytes) }
+
+// SetWriteBuffer sets the socket write buffer of the underlying connection
+func (c *PacketStatsConn) SetWriteBuffer(bytes int) error { return SetWriteBuffer(c.PacketConn, bytes) }
+
+// SetDSCP sets DSCP of the underlying connection
+func (c *PacketStatsConn) SetDSCP(dscp int) error { return SetDSCP(c.PacketConn, dscp) }
+
+// count counts the packet p from or to addr in the statistics of its session
+func (c *PacketStatsConn) count(p []byte, addr net.Addr, in bool) {
+	conv, ok := peekPlainConv(p)
+	if caddr, isConv := addr.(*ConvAddr); isConv {
+		conv, ok = caddr.Conv, true
+	}
+	key := addr.String()
+	c.mu.Lock()
+	now := time.Now()
+	sc, found := c.convs[key]
+	if ok {
+		if !found {
+			for k, v := range c.convs {
+				if now.Sub(v.lastSeen) > convExpire {
+					delete(c.convs, k)
+				}
+			}
+			sc = new(statsConv)
+			c.convs[key] = sc
+		}
+		sc.conv, sc.lastSeen = conv, now
+	} else if found {
+		conv, ok = sc.conv, true
+		sc.lastSeen = now
+	}
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+	s := lookupConv(conv)
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := &s.wire
+	if in {
+		w.pktsIn++
+		w.bytesIn += uint64(len(p))
+	} else {
+		w.pktsOut++
+		w.bytesOut += uint64(len(p))
+	}
+
+	segments := p
+	if c.dataShards > 0 && len(p) >= fecHeaderSize {
+		switch binary.LittleEndian.Uint16(p[4:]) {
+		case typeData:
+			if in {
+				w.fecShard(binary.LittleEndian.Uint32(p), true, c.dataShards, c.parityShards)
+			}
+			if len(p) < fecHeaderSizePlus2 {
+				return
+			}
+			segments = p[fecHeaderSizePlus2:]
+		case typeParity:
+			if in {
+				w.fecShard(binary.LittleEndian.Uint32(p), false, c.dataShards, c.parityShards)
+			}
+			return
+		}
+	}
+	if !in {
+		w.countRetrans(segments)
+	}
+}
+
+// countRetrans counts the data segments of a packet sent again
+func (w *wireStats) countRetrans(segments []byte) {
+	for len(segments) >= kcp.IKCP_OVERHEAD {
+		sn := binary.LittleEndian.Uint32(segments[12:])
+		length := binary.LittleEndian.Uint32(segments[20:])
+		if segments[4] == kcp.IKCP_CMD_PUSH {
+			if w.snValid && int32(sn-w.nextSN) < 0 {
+				w.retrans++
+			} else {
+				w.nextSN, w.snValid = sn+1, true
+			}
+		}
+		if uint64(length) > uint64(len(segments)-kcp.IKCP_OVERHEAD) {
+			return
+		}
+		segments = segments[kcp.IKCP_OVERHEAD+int(length):]
+	}
+}
+
+// fecShard counts a shard received of the FEC group of seqid
+func (w *wireStats) fecShard(seqid uint32, data bool, dataShards, parityShards int) {
+	if w.groups == nil {
+		w.groups = make(map[uint32]*fecGroup)
+	}
+	id := seqid / uint32(dataShards+parityShards)
+	g, ok := w.groups[id]
+	if !ok {
+		g = new(fecGroup)
+		w.groups[id] = g
+		if int32(id-w.lastGroup) > 0 {
+			w.lastGroup = id
+		}
+		if len(w.groups) > fecGroupsKept {
+			for gid := range w.groups {
+				if int32(w.lastGroup-gid) >= fecGroupsKept/2 {
+					delete(w.groups, gid)
+				}
+			}
+		}
+	}
+	if g.done {
+		return
+	}
+	g.total++
+	if data {
+		g.data++
+	}
+	if g.data == dataShards {
+		g.done = true
+	} else if g.total >= dataShards {
+		w.recovered += uint64(dataShards - g.data)
+		g.done = true
+	}
+}
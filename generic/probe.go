@@ -0,0 +1,275 @@
+package generic
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// a token is | CONV(4B) | MARKER(2B) | TIME(8B) | NONCE(16B) | MAC(16B) |,
+	// the marker is neither a FEC type nor a KCP command, so tokens are routed
+	// like the packets of their conversation.
+	tokenMarker     = 0xfffe
+	tokenNonceSize  = 16
+	tokenMACSize    = 16
+	tokenSignedSize = 4 + 2 + 8 + tokenNonceSize
+	tokenSize       = tokenSignedSize + tokenMACSize
+	tokenLabel      = "kcptun probe"
+
+	tokenSkew     = time.Minute            // clock difference tolerated between peers
+	tokenRetry    = 200 * time.Millisecond // tokens of unconfirmed conversations are resent this often
+	tokenRefresh  = 30 * time.Second       // tokens of confirmed conversations, for NAT rebinding
+	admitExpire   = 10 * time.Minute       // peers idle longer must present a token again
+	tokenSweepGap = time.Minute
+)
+
+// tokenMAC computes the MAC of the signed part of token with key
+func tokenMAC(key, token []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(tokenLabel))
+	m.Write(token[:tokenSignedSize])
+	return m.Sum(nil)[:tokenMACSize]
+}
+
+// isToken reports whether p is shaped as a token
+func isToken(p []byte) bool {
+	return len(p) == tokenSize && binary.LittleEndian.Uint16(p[4:]) == tokenMarker
+}
+
+// NewToken creates a token of the conversation conv, authenticated with key
+func NewToken(key []byte, conv uint32) ([]byte, error) {
+	token := make([]byte, tokenSize)
+	binary.LittleEndian.PutUint32(token, conv)
+	binary.LittleEndian.PutUint16(token[4:], tokenMarker)
+	binary.BigEndian.PutUint64(token[6:], uint64(time.Now().UnixNano()))
+	if _, err := io.ReadFull(rand.Reader, token[14:tokenSignedSize]); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	copy(token[tokenSignedSize:], tokenMAC(key, token))
+	return token, nil
+}
+
+// TokenConn is the client side of ProbeGuard, it sends a token ahead of the
+// first packets of every conversation until the server answers, and then
+// from time to time, so the peer stays admitted across NAT rebinding.
+type TokenConn struct {
+	net.PacketConn
+	key func() []byte
+
+	convs     map[uint32]*tokenConv
+	lastSweep time.Time
+	mu        sync.Mutex
+}
+
+type tokenConv struct {
+	confirmed bool
+	lastToken time.Time
+	lastSeen  time.Time
+}
+
+// NewTokenConn sends tokens authenticated with the key returned by key over conn
+func NewTokenConn(conn net.PacketConn, key func() []byte) *TokenConn {
+	c := new(TokenConn)
+	c.PacketConn = conn
+	c.key = key
+	c.convs = make(map[uint32]*tokenConv)
+	return c
+}
+
+// ReadFrom implements the PacketConn ReadFrom method, a packet of a
+// conversation confirms the server admitted it.
+func (c *TokenConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	n, addr, err = c.PacketConn.ReadFrom(p)
+	if err == nil {
+		if conv, ok := peekPlainConv(p[:n]); ok {
+			c.mu.Lock()
+			if tc, ok := c.convs[conv]; ok {
+				tc.confirmed = true
+			}
+			c.mu.Unlock()
+		}
+	}
+	return n, addr, err
+}
+
+// WriteTo implements the PacketConn WriteTo method.
+func (c *TokenConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	if conv, ok := peekPlainConv(p); ok && c.tokenDue(conv) {
+		token, err := NewToken(c.key(), conv)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := c.PacketConn.WriteTo(token, addr); err != nil {
+			return 0, err
+		}
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// SetReadBuffer sets the socket read buffer of the underlying connection
+func (c *TokenConn) SetReadBuffer(bytes int) error { return SetReadBuffer(c.PacketConn, bytes) }
+
+// SetWriteBuffer sets the socket write buffer of the underlying connection
+func (c *TokenConn) SetWriteBuffer(bytes int) error { return SetWriteBuffer(c.PacketConn, bytes) }
+
+// SetDSCP sets DSCP of the underlying connection
+func (c *TokenConn) SetDSCP(dscp int) error { return SetDSCP(c.PacketConn, dscp) }
+
+// tokenDue reports whether a token must precede the next packet of conv
+func (c *TokenConn) tokenDue(conv uint32) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.Sub(c.lastSweep) > admitExpire {
+		for conv, tc := range c.convs {
+			if now.Sub(tc.lastSeen) > admitExpire {
+				delete(c.convs, conv)
+			}
+		}
+		c.lastSweep = now
+	}
+
+	tc, ok := c.convs[conv]
+	if !ok {
+		tc = new(tokenConv)
+		c.convs[conv] = tc
+	}
+	tc.lastSeen = now
+	interval := tokenRetry
+	if tc.confirmed {
+		interval = tokenRefresh
+	}
+	if now.Sub(tc.lastToken) < interval {
+		return false
+	}
+	tc.lastToken = now
+	return true
+}
+
+// ProbeGuard is a net.PacketConn letting through the packets of the peers
+// which presented a valid token only, so KCP never answers active probes.
+//
+// A token is bound to a conversation, it carries a timestamp and a nonce,
+// and is authenticated with the key of the peer; tokens out of the clock
+// skew tolerated or already seen are rejected. Every token is checked in
+// full, and nothing is ever sent in response to a rejected packet.
+type ProbeGuard struct {
+	net.PacketConn
+	key func(addr net.Addr) []byte
+
+	admitted  map[string]time.Time               // peers, by address, and when last seen
+	nonces    map[[tokenNonceSize]byte]time.Time // nonces seen, until they expire
+	lastSweep time.Time
+	mu        sync.RWMutex
+}
+
+// NewProbeGuard guards conn, key returns the key of the tokens from addr
+func NewProbeGuard(conn net.PacketConn, key func(addr net.Addr) []byte) *ProbeGuard {
+	g := new(ProbeGuard)
+	g.PacketConn = conn
+	g.key = key
+	g.admitted = make(map[string]time.Time)
+	g.nonces = make(map[[tokenNonceSize]byte]time.Time)
+	g.lastSweep = time.Now()
+	return g
+}
+
+// ReadFrom implements the PacketConn ReadFrom method, tokens are consumed,
+// and packets of peers not admitted are dropped.
+func (g *ProbeGuard) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		n, addr, err = g.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+		key := addr.String()
+		if isToken(p[:n]) {
+			if err := g.verify(p[:n], addr); err != nil {
+				atomic.AddUint64(&DefaultSnmp.BadTokens, 1)
+			} else {
+				g.admit(key, true)
+			}
+			continue
+		}
+		if g.admit(key, false) {
+			return n, addr, nil
+		}
+		atomic.AddUint64(&DefaultSnmp.ProbeDrops, 1)
+	}
+}
+
+// verify checks a token from addr, and records its nonce
+func (g *ProbeGuard) verify(token []byte, addr net.Addr) error {
+	key := g.key(addr)
+	if key == nil { // a user revoked, or an address forgotten
+		return errors.WithStack(errAuthentication)
+	}
+	mac := tokenMAC(key, token)
+	ts := time.Unix(0, int64(binary.BigEndian.Uint64(token[6:])))
+	if !hmac.Equal(mac, token[tokenSignedSize:]) {
+		return errors.WithStack(errAuthentication)
+	}
+	now := time.Now()
+	if ts.Before(now.Add(-tokenSkew)) || ts.After(now.Add(tokenSkew)) {
+		return errors.New("token out of the clock skew tolerated")
+	}
+
+	var nonce [tokenNonceSize]byte
+	copy(nonce[:], token[14:tokenSignedSize])
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, seen := g.nonces[nonce]; seen {
+		return errors.WithStack(errReplay)
+	}
+	g.nonces[nonce] = ts.Add(tokenSkew)
+	return nil
+}
+
+// admit reports whether the peer key is admitted, admitting it with token
+func (g *ProbeGuard) admit(key string, token bool) bool {
+	now := time.Now()
+	g.mu.RLock()
+	seen, ok := g.admitted[key]
+	g.mu.RUnlock()
+	if ok && now.Sub(seen) < time.Second {
+		return true
+	} else if (!ok || now.Sub(seen) > admitExpire) && !token {
+		return false
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.admitted[key] = now
+	if now.Sub(g.lastSweep) > tokenSweepGap {
+		for nonce, expire := range g.nonces {
+			if now.After(expire) {
+				delete(g.nonces, nonce)
+			}
+		}
+		for key, seen := range g.admitted {
+			if now.Sub(seen) > admitExpire {
+				delete(g.admitted, key)
+			}
+		}
+		g.lastSweep = now
+	}
+	return true
+}
+
+// SetReadBuffer sets the socket read buffer of the underlying connection
+func (g *ProbeGuard) SetReadBuffer(bytes int) error { return SetReadBuffer(g.PacketConn, bytes) }
+
+// SetWriteBuffer sets the socket write buffer of the underlying connection
+func (g *ProbeGuard) SetWriteBuffer(bytes int) error { return SetWriteBuffer(g.PacketConn, bytes) }
+
+// SetDSCP sets DSCP of the underlying connection
+func (g *ProbeGuard) SetDSCP(dscp int) error { return SetDSCP(g.PacketConn, dscp) }
@@ -0,0 +1,87 @@
+package generic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProbeGuard(t *testing.T) {
+	listen := func() net.PacketConn {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	server := listen()
+	defer server.Close()
+	guard := NewProbeGuard(server, func(net.Addr) []byte { return testKey })
+
+	// a KCP segment of conversation 1
+	segment := make([]byte, 32)
+	binary.LittleEndian.PutUint32(segment, 1)
+	segment[4] = 81
+
+	// expect reads the next packet let through, nil if none
+	expect := func(want []byte) {
+		t.Helper()
+		buf := make([]byte, 1500)
+		server.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, _, err := guard.ReadFrom(buf)
+		if want == nil && err == nil {
+			t.Fatal("probe let through")
+		} else if want != nil && (err != nil || !bytes.Equal(buf[:n], want)) {
+			t.Fatal("packet dropped", err)
+		}
+	}
+
+	// garbage, and a token of another key
+	prober := listen()
+	defer prober.Close()
+	drops := atomic.LoadUint64(&DefaultSnmp.ProbeDrops)
+	prober.WriteTo(segment, server.LocalAddr())
+	expect(nil)
+	if atomic.LoadUint64(&DefaultSnmp.ProbeDrops) != drops+1 {
+		t.Fatal("probe not counted")
+	}
+	forged, _ := NewToken(make([]byte, 32), 1)
+	prober.WriteTo(forged, server.LocalAddr())
+	prober.WriteTo(segment, server.LocalAddr())
+	expect(nil)
+
+	// a client presenting a token
+	client := listen()
+	defer client.Close()
+	tc := NewTokenConn(client, func() []byte { return testKey })
+	tc.WriteTo(segment, server.LocalAddr())
+	expect(segment)
+	tc.WriteTo(segment, server.LocalAddr()) // no token needed anymore
+	expect(segment)
+
+	// the token replayed by the prober
+	token, _ := NewToken(testKey, 1)
+	client.WriteTo(token, server.LocalAddr())
+	client.WriteTo(segment, server.LocalAddr())
+	expect(segment)
+	prober.WriteTo(token, server.LocalAddr())
+	prober.WriteTo(segment, server.LocalAddr())
+	expect(nil)
+
+	// a stale token
+	binary.BigEndian.PutUint64(token[6:], uint64(time.Now().Add(-2*tokenSkew).UnixNano()))
+	copy(token[tokenSignedSize:], tokenMAC(testKey, token))
+	prober.WriteTo(token, server.LocalAddr())
+	prober.WriteTo(segment, server.LocalAddr())
+	expect(nil)
+
+	// a token of the empty key, for an address without a key
+	guard.key = func(net.Addr) []byte { return nil }
+	empty, _ := NewToken(nil, 1)
+	if err := guard.verify(empty, prober.LocalAddr()); err == nil {
+		t.Fatal("token of the empty key accepted")
+	}
+}
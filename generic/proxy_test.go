@@ -0,0 +1,122 @@
+package generic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// a minimal SOCKS5 server supporting username/password and UDP ASSOCIATE
+func socks5Server(t *testing.T, user, pass string) net.Listener {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		ctrl, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer ctrl.Close()
+
+		buf := make([]byte, 512)
+		io.ReadFull(ctrl, buf[:2])
+		io.ReadFull(ctrl, buf[:buf[1]])
+		ctrl.Write([]byte{socksVersion, socksAuthPassword})
+		io.ReadFull(ctrl, buf[:2])
+		u := make([]byte, buf[1])
+		io.ReadFull(ctrl, u)
+		io.ReadFull(ctrl, buf[:1])
+		p := make([]byte, buf[0])
+		io.ReadFull(ctrl, p)
+		if string(u) != user || string(p) != pass {
+			ctrl.Write([]byte{1, 1})
+			return
+		}
+		ctrl.Write([]byte{1, 0})
+		io.ReadFull(ctrl, buf[:10])
+
+		relay, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		defer relay.Close()
+		port := relay.LocalAddr().(*net.UDPAddr).Port
+		ctrl.Write([]byte{socksVersion, 0, 0, socksAtypIPv4, 0, 0, 0, 0, byte(port >> 8), byte(port)})
+
+		// relay packets between the client and the targets
+		go func() {
+			var client *net.UDPAddr
+			for {
+				n, from, err := relay.ReadFromUDP(buf)
+				if err != nil {
+					return
+				}
+				if client == nil || from.String() == client.String() {
+					client = from
+					dst := &net.UDPAddr{IP: net.IP(buf[4:8]), Port: int(binary.BigEndian.Uint16(buf[8:]))}
+					relay.WriteTo(buf[10:n], dst)
+				} else {
+					hdr := []byte{0, 0, 0, socksAtypIPv4}
+					hdr = append(hdr, from.IP.To4()...)
+					hdr = append(hdr, byte(from.Port>>8), byte(from.Port))
+					relay.WriteTo(append(hdr, buf[:n]...), client)
+				}
+			}
+		}()
+		io.Copy(io.Discard, ctrl)
+	}()
+	return lis
+}
+
+func TestSOCKS5Conn(t *testing.T) {
+	lis := socks5Server(t, "user", "pass")
+	defer lis.Close()
+
+	p, err := ParseProxy("socks5://user:pass@" + lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := DialSOCKS5(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	echo, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		n, from, err := echo.ReadFrom(buf)
+		if err == nil {
+			echo.WriteTo(buf[:n], from)
+		}
+	}()
+
+	msg := []byte("hello")
+	if _, err := conn.WriteTo(msg, echo.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	n, from, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], msg) || from.String() != echo.LocalAddr().String() {
+		t.Fatal("mismatch", buf[:n], from)
+	}
+}
+
+func TestSOCKS5AuthFailure(t *testing.T) {
+	lis := socks5Server(t, "user", "pass")
+	defer lis.Close()
+
+	if _, err := ParseProxy("http://" + lis.Addr().String()); err == nil {
+		t.Fatal("http proxy accepted")
+	}
+	p, _ := ParseProxy("socks5://user:wrong@" + lis.Addr().String())
+	if _, err := DialSOCKS5(p); err == nil {
+		t.Fatal("expected authentication failure")
+	}
+}
@@ -0,0 +1,191 @@
+package generic
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// routeMagic starts a route, unlike the version of smux starting a session
+const routeMagic = 0xff
+
+// maxRouteLen is the maximum length of the name of a route
+const maxRouteLen = 255
+
+// WriteRoute writes the name of the route of a session before smux, see ReadRoute
+func WriteRoute(w io.Writer, route string) error {
+	if len(route) > maxRouteLen {
+		return errors.Errorf("route name too long: %v", route)
+	}
+	_, err := w.Write(append([]byte{routeMagic, byte(len(route))}, route...))
+	return errors.WithStack(err)
+}
+
+// ReadRoute reads the name of the route of a session from conn, the
+// default route "" if the session starts with smux, and returns conn with
+// the bytes buffered. A session of the default route sends nothing before
+// its first stream or keepalive, timeout must be the keepalive timeout of
+// smux, which would close a session silent for longer anyway.
+func ReadRoute(conn net.Conn, timeout time.Duration) (net.Conn, string, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	br := bufio.NewReader(conn)
+	buffered := &bufferedConn{conn, br}
+	magic, err := br.Peek(1)
+	if err != nil {
+		return nil, "", errors.WithStack(err)
+	}
+	if magic[0] != routeMagic {
+		return buffered, "", nil
+	}
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, "", errors.WithStack(err)
+	}
+	name := make([]byte, hdr[1])
+	if _, err := io.ReadFull(br, name); err != nil {
+		return nil, "", errors.WithStack(err)
+	}
+	return buffered, string(name), nil
+}
+
+// bufferedConn is a net.Conn read through a bufio.Reader
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// Routes are the targets of the server by route name, the target of the
+// default route "" being the target of the server, changed at runtime.
+type Routes struct {
+	targets map[string]string
+	mu      sync.RWMutex
+}
+
+// NewRoutes creates the routes to targets, with target as the default route
+func NewRoutes(target string, targets map[string]string) *Routes {
+	r := &Routes{targets: map[string]string{"": target}}
+	for name, target := range targets {
+		r.targets[name] = target
+	}
+	return r
+}
+
+// ParseRoutes parses routes like "name=target"
+func ParseRoutes(list []string) (map[string]string, error) {
+	routes := make(map[string]string)
+	for _, route := range list {
+		kv := strings.SplitN(route, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, errors.Errorf("invalid route: %v", route)
+		}
+		routes[kv[0]] = kv[1]
+	}
+	return routes, nil
+}
+
+// Target returns the target of the route name, false if none
+func (r *Routes) Target(name string) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	target, ok := r.targets[name]
+	return target, ok
+}
+
+// Set adds the route name to target, or changes its target, the streams
+// opened are kept
+func (r *Routes) Set(name, target string) error {
+	if len(name) > maxRouteLen {
+		return errors.Errorf("route name too long: %v", name)
+	}
+	if target == "" {
+		return errors.Errorf("no target for route: %v", name)
+	}
+	r.mu.Lock()
+	r.targets[name] = target
+	r.mu.Unlock()
+	return nil
+}
+
+// Delete removes the route name, the default route cannot be removed
+func (r *Routes) Delete(name string) error {
+	if name == "" {
+		return errors.New("the default route cannot be removed")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.targets[name]; !ok {
+		return errors.Errorf("no such route: %v", name)
+	}
+	delete(r.targets, name)
+	return nil
+}
+
+// List returns the targets by route name, the default route under ""
+func (r *Routes) List() map[string]string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	routes := make(map[string]string, len(r.targets))
+	for name, target := range r.targets {
+		routes[name] = target
+	}
+	return routes
+}
+
+// SaveJSONConfig sets the fields of the json config file at path, keeping
+// the other fields as they are
+func SaveJSONConfig(path string, fields map[string]interface{}) error {
+	if path == "" {
+		return errors.New("no config file")
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	config := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(b, &config); err != nil {
+		return errors.Wrap(err, path)
+	}
+	for name, value := range fields {
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		config[name] = raw
+	}
+	if b, err = json.MarshalIndent(config, "", "\t"); err != nil {
+		return errors.WithStack(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// replaced at once
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return errors.WithStack(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode()); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp.Name(), path))
+}
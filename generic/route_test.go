@@ -0,0 +1,74 @@
+package generic
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRoute(t *testing.T) {
+	for _, route := range []string{"", "ssh"} {
+		c1, c2 := net.Pipe()
+		go func() {
+			if route != "" {
+				WriteRoute(c1, route)
+			}
+			c1.Write([]byte{2, 0}) // smux
+			c1.Close()
+		}()
+		conn, got, err := ReadRoute(c2, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rest, _ := io.ReadAll(conn)
+		if got != route || len(rest) != 2 || rest[0] != 2 {
+			t.Fatal("unexpected route", got, rest)
+		}
+	}
+
+	routes, err := ParseRoutes([]string{"ssh=127.0.0.1:22", "web=/tmp/web.sock"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseRoutes([]string{"ssh"}); err == nil {
+		t.Fatal("route without target accepted")
+	}
+	r := NewRoutes("127.0.0.1:80", routes)
+	if target, ok := r.Target("web"); !ok || target != "/tmp/web.sock" {
+		t.Fatal("unexpected target", target)
+	}
+	if r.Delete("") == nil || r.Delete("ftp") == nil || r.Delete("web") != nil {
+		t.Fatal("unexpected removals")
+	}
+	r.Set("", "127.0.0.1:8080")
+	if target, _ := r.Target(""); target != "127.0.0.1:8080" || len(r.List()) != 2 {
+		t.Fatal("unexpected routes", r.List())
+	}
+}
+
+func TestSaveJSONConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.json")
+	os.WriteFile(path, []byte(`{"key": "secret", "target": "127.0.0.1:80"}`), 0600)
+	if err := SaveJSONConfig(path, map[string]interface{}{"target": "127.0.0.1:8080", "routes": map[string]string{"ssh": "127.0.0.1:22"}}); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := os.ReadFile(path)
+	var config struct {
+		Key    string            `json:"key"`
+		Target string            `json:"target"`
+		Routes map[string]string `json:"routes"`
+	}
+	if err := json.Unmarshal(b, &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Key != "secret" || config.Target != "127.0.0.1:8080" || config.Routes["ssh"] != "127.0.0.1:22" {
+		t.Fatal("unexpected config", string(b))
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Fatal("mode not kept", info.Mode())
+	}
+}
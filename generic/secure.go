@@ -0,0 +1,186 @@
+package generic
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	recordHeaderSize = 3 // | PHASE(1B) | LENGTH(2B) |
+	maxRecordPayload = 16384
+	rekeyInfo        = "kcptun rekey"
+)
+
+// recordKey is the key of one direction, ratcheted forward on rekeying
+type recordKey struct {
+	key     []byte
+	aead    cipher.AEAD
+	phase   byte // flips at every rekey
+	counter uint64
+	bytes   int64
+	since   time.Time
+}
+
+func newRecordKey(key []byte) (*recordKey, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &recordKey{key: key, aead: aead, since: time.Now()}, nil
+}
+
+// ratchet replaces the key by the next one, the old key is forgotten
+func (k *recordKey) ratchet() error {
+	next := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, k.key, []byte(rekeyInfo)), next); err != nil {
+		return errors.WithStack(err)
+	}
+	nk, err := newRecordKey(next)
+	if err != nil {
+		return err
+	}
+	nk.phase = k.phase ^ 1
+	*k = *nk
+	return nil
+}
+
+func (k *recordKey) nonce(buf []byte) []byte {
+	n := nonce(buf[:k.aead.NonceSize()], k.counter)
+	k.counter++
+	return n
+}
+
+// SecureConn is a net.Conn encrypting a reliable stream into records with
+// the keys established by a handshake, see HandshakeConfig.
+//
+// A record is | PHASE(1B) | LENGTH(2B) | CIPHERTEXT | TAG(16B) |, nonces are
+// implicit record counters. Every direction is rekeyed after some volume or
+// time by ratcheting its key, the phase bit flips to tell the peer.
+type SecureConn struct {
+	conn net.Conn
+	h    *HandshakeConfig
+
+	w   *recordKey
+	wmu sync.Mutex
+
+	r       *recordKey
+	pending []byte // decrypted but unread
+	rbuf    []byte
+	rmu     sync.Mutex
+}
+
+func newSecureConn(conn net.Conn, wkey, rkey []byte, h *HandshakeConfig) (*SecureConn, error) {
+	c := new(SecureConn)
+	c.conn = conn
+	c.h = h
+	var err error
+	if c.w, err = newRecordKey(wkey); err != nil {
+		return nil, err
+	}
+	if c.r, err = newRecordKey(rkey); err != nil {
+		return nil, err
+	}
+	c.rbuf = make([]byte, maxRecordPayload+chacha20poly1305.Overhead)
+	return c, nil
+}
+
+// Read implements the Conn Read method.
+func (c *SecureConn) Read(p []byte) (n int, err error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	if len(c.pending) == 0 {
+		var hdr [recordHeaderSize]byte
+		if _, err := io.ReadFull(c.conn, hdr[:]); err != nil {
+			return 0, errors.WithStack(err)
+		}
+		size := int(binary.BigEndian.Uint16(hdr[1:]))
+		if size > len(c.rbuf) {
+			return 0, errors.New("record too large")
+		}
+		if _, err := io.ReadFull(c.conn, c.rbuf[:size]); err != nil {
+			return 0, errors.WithStack(err)
+		}
+
+		if hdr[0] != c.r.phase {
+			if err := c.r.ratchet(); err != nil {
+				return 0, err
+			}
+		}
+		var nbuf [chacha20poly1305.NonceSize]byte
+		plain, err := c.r.aead.Open(c.rbuf[:0], c.r.nonce(nbuf[:]), c.rbuf[:size], hdr[:])
+		if err != nil {
+			atomic.AddUint64(&DefaultSnmp.CryptErrs, 1)
+			return 0, errors.WithStack(errAuthentication)
+		}
+		c.pending = plain
+	}
+
+	n = copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write implements the Conn Write method.
+func (c *SecureConn) Write(p []byte) (n int, err error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	buf := make([]byte, 0, len(p)+(len(p)/maxRecordPayload+1)*(recordHeaderSize+chacha20poly1305.Overhead))
+	for len(p) > 0 {
+		if (c.h.RekeyBytes > 0 && c.w.bytes >= c.h.RekeyBytes) ||
+			(c.h.RekeyInterval > 0 && time.Since(c.w.since) >= c.h.RekeyInterval) {
+			if err := c.w.ratchet(); err != nil {
+				return n, err
+			}
+		}
+
+		sz := len(p)
+		if sz > maxRecordPayload {
+			sz = maxRecordPayload
+		}
+		var hdr [recordHeaderSize]byte
+		hdr[0] = c.w.phase
+		binary.BigEndian.PutUint16(hdr[1:], uint16(sz+chacha20poly1305.Overhead))
+		buf = append(buf, hdr[:]...)
+
+		var nbuf [chacha20poly1305.NonceSize]byte
+		buf = c.w.aead.Seal(buf, c.w.nonce(nbuf[:]), p[:sz], hdr[:])
+		c.w.bytes += int64(sz)
+		p = p[sz:]
+		n += sz
+	}
+
+	if _, err := c.conn.Write(buf); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return n, nil
+}
+
+// Close closes the underlying connection
+func (c *SecureConn) Close() error { return c.conn.Close() }
+
+// LocalAddr returns the local address of the underlying connection
+func (c *SecureConn) LocalAddr() net.Addr { return c.conn.LocalAddr() }
+
+// RemoteAddr returns the remote address of the underlying connection
+func (c *SecureConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// SetDeadline implements the Conn SetDeadline method.
+func (c *SecureConn) SetDeadline(t time.Time) error { return c.conn.SetDeadline(t) }
+
+// SetReadDeadline implements the Conn SetReadDeadline method.
+func (c *SecureConn) SetReadDeadline(t time.Time) error { return c.conn.SetReadDeadline(t) }
+
+// SetWriteDeadline implements the Conn SetWriteDeadline method.
+func (c *SecureConn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
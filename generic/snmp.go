@@ -1,46 +1,94 @@
 package generic
 
 import (
-	"encoding/csv"
 	"fmt"
-	"log"
-	"os"
-	"path/filepath"
-	"time"
-
-	kcp "github.com/xtaci/kcp-go/v5"
+	"reflect"
+	"sync/atomic"
 )
 
-func SnmpLogger(path string, interval int) {
-	if path == "" || interval == 0 {
-		return
+// Snmp defines kcptun's own counters, complementing kcp.DefaultSnmp,
+// all fields are uint64 and updated atomically.
+type Snmp struct {
+	PacedPkts     uint64 // packets sent through a pacer
+	PacingDelay   uint64 // accumulated time paced packets spent queued, in microseconds
+	PacingDrops   uint64 // packets dropped by a full pacer queue
+	CryptErrs     uint64 // packets failing authentication
+	ReplayDrops   uint64 // replayed or stale packets dropped
+	UnknownKeys   uint64 // packets with the key id of no user
+	ProbeDrops    uint64 // packets of peers without a valid token dropped
+	BadTokens     uint64 // tokens failing authentication, stale or replayed
+	KnockDrops    uint64 // packets of addresses not admitted by a knock dropped
+	BadKnocks     uint64 // knocks failing authentication, stale or replayed
+	Bans          uint64 // sources banned for repeated failures
+	BanDrops      uint64 // packets of banned sources dropped
+	ACLDrops      uint64 // packets of sources denied by the ACL dropped
+	ACLRejects    uint64 // connections of sources denied by the ACL refused
+	StreamsOpened uint64 // smux streams opened
+	StreamsClosed uint64 // smux streams closed
+	Reconnects    uint64 // sessions replaced after they expired or died
+	Hooks         uint64 // hooks run
+	HookDrops     uint64 // hook events dropped, fired too often or queued too long
+	HookFailures  uint64 // hooks failing or timing out
+	CompRawIn     uint64 // bytes read from compressed streams, decompressed
+	CompWireIn    uint64 // bytes read from compressed streams, compressed
+	CompRawOut    uint64 // bytes written to compressed streams, before compression
+	CompWireOut   uint64 // bytes written to compressed streams, compressed
+}
+
+func newSnmp() *Snmp {
+	return new(Snmp)
+}
+
+// counters returns pointers to all fields of s
+func (s *Snmp) counters() []*uint64 {
+	v := reflect.ValueOf(s).Elem()
+	fields := make([]*uint64, v.NumField())
+	for i := range fields {
+		fields[i] = v.Field(i).Addr().Interface().(*uint64)
 	}
-	ticker := time.NewTicker(time.Duration(interval) * time.Second)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-ticker.C:
-			// split path into dirname and filename
-			logdir, logfile := filepath.Split(path)
-			// only format logfile
-			f, err := os.OpenFile(logdir+time.Now().Format(logfile), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			w := csv.NewWriter(f)
-			// write header in empty file
-			if stat, err := f.Stat(); err == nil && stat.Size() == 0 {
-				if err := w.Write(append([]string{"Unix"}, kcp.DefaultSnmp.Header()...)); err != nil {
-					log.Println(err)
-				}
-			}
-			if err := w.Write(append([]string{fmt.Sprint(time.Now().Unix())}, kcp.DefaultSnmp.ToSlice()...)); err != nil {
-				log.Println(err)
-			}
-			// kcp.DefaultSnmp.Reset()
-			w.Flush()
-			f.Close()
-		}
+	return fields
+}
+
+// Header returns all field names
+func (s *Snmp) Header() []string {
+	t := reflect.TypeOf(s).Elem()
+	names := make([]string, t.NumField())
+	for i := range names {
+		names[i] = t.Field(i).Name
+	}
+	return names
+}
+
+// ToSlice returns current snmp info as slice
+func (s *Snmp) ToSlice() []string {
+	snmp := s.Copy()
+	var values []string
+	for _, p := range snmp.counters() {
+		values = append(values, fmt.Sprint(*p))
 	}
+	return values
+}
+
+// Copy make a copy of current snmp snapshot
+func (s *Snmp) Copy() *Snmp {
+	d := newSnmp()
+	dst := d.counters()
+	for i, p := range s.counters() {
+		*dst[i] = atomic.LoadUint64(p)
+	}
+	return d
+}
+
+// Reset values to zero
+func (s *Snmp) Reset() {
+	for _, p := range s.counters() {
+		atomic.StoreUint64(p, 0)
+	}
+}
+
+// DefaultSnmp is the global kcptun snmp counter
+var DefaultSnmp *Snmp
+
+func init() {
+	DefaultSnmp = newSnmp()
 }
@@ -0,0 +1,235 @@
+package generic
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// SnmpLogConfig configures SnmpLogger and SessionLogger
+type SnmpLogConfig struct {
+	Path     string // aware of the time format of golang, like: ./snmp-20060102.log
+	Interval int    // seconds between records
+	Format   string // "csv" or "jsonl"
+	Delta    bool   // counters of the interval and their rates, instead of cumulative counters
+	Keep     int    // log files kept, 0 for all
+	MaxSize  int64  // bytes of the log files kept, 0 for no limit
+}
+
+// CheckSnmpFormat returns an error if format is not a format of the snmp log
+func CheckSnmpFormat(format string) error {
+	if format != "csv" && format != "jsonl" {
+		return errors.Errorf("unknown snmp log format: %v", format)
+	}
+	return nil
+}
+
+// rates derived from the counters of an interval, in delta mode
+var snmpRatesHeader = []string{"Interval", "RxBps", "TxBps", "LossRatio", "RetransRatio", "FECRecoveryRatio"}
+
+// SnmpLogger appends kcp.DefaultSnmp and DefaultSnmp to the log file every
+// interval, the counters either cumulative or of the interval with their
+// rates, then removes the log files beyond retention.
+func SnmpLogger(config SnmpLogConfig) {
+	if config.Path == "" || config.Interval == 0 {
+		return
+	}
+	header := append(append([]string{"Unix"}, kcp.DefaultSnmp.Header()...), DefaultSnmp.Header()...)
+	if config.Delta {
+		header = append(header, snmpRatesHeader...)
+	}
+
+	prevKCP, prev, prevTime := kcp.DefaultSnmp.Copy(), DefaultSnmp.Copy(), time.Now()
+	ticker := time.NewTicker(time.Duration(config.Interval) * time.Second)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		curKCP, cur := kcp.DefaultSnmp.Copy(), DefaultSnmp.Copy()
+		kcpValues, values := snmpValues(curKCP, nil), snmpValues(cur, nil)
+		var rates []interface{}
+		if config.Delta {
+			kcpValues, values = snmpValues(curKCP, prevKCP), snmpValues(cur, prev)
+			rates = snmpRates(curKCP, prevKCP, now.Sub(prevTime))
+			prevKCP, prev, prevTime = curKCP, cur, now
+		}
+		record := append(append(append([]interface{}{now.Unix()}, kcpValues...), values...), rates...)
+		if err := writeLog(config.Path, config.Format, header, [][]interface{}{record}); err != nil {
+			logSnmp.Error("snmp log failed", "err", err)
+			return
+		}
+		pruneLogs(config.Path, config.Keep, config.MaxSize)
+	}
+}
+
+// snmpValues returns the counters of snmp, a *kcp.Snmp or a *Snmp, minus
+// those of prev if not nil, gauges are never subtracted
+func snmpValues(snmp, prev interface{}) []interface{} {
+	v := reflect.ValueOf(snmp).Elem()
+	_, isKCP := snmp.(*kcp.Snmp)
+	values := make([]interface{}, v.NumField())
+	for i := range values {
+		value := v.Field(i).Uint()
+		if prev != nil && !(isKCP && kcpGauges[v.Type().Field(i).Name]) {
+			value -= reflect.ValueOf(prev).Elem().Field(i).Uint()
+		}
+		values[i] = value
+	}
+	return values
+}
+
+// snmpRates returns the rates of the counters of KCP over interval d, see
+// snmpRatesHeader: throughput, the ratio of the segments sent inferred as
+// lost and sent again, and the ratio of the lost data shards FEC recovered.
+func snmpRates(cur, prev *kcp.Snmp, d time.Duration) []interface{} {
+	ratio := func(a, b uint64) float64 {
+		if b == 0 {
+			return 0
+		}
+		return float64(a) / float64(b)
+	}
+	secs := d.Seconds()
+	recovered := cur.FECRecovered - prev.FECRecovered
+	return []interface{}{
+		secs,
+		float64(cur.BytesReceived-prev.BytesReceived) / secs,
+		float64(cur.BytesSent-prev.BytesSent) / secs,
+		ratio(cur.LostSegs-prev.LostSegs, cur.OutSegs-prev.OutSegs),
+		ratio(cur.RetransSegs-prev.RetransSegs, cur.OutSegs-prev.OutSegs),
+		ratio(recovered, recovered+cur.FECShortShards-prev.FECShortShards),
+	}
+}
+
+// writeLog appends the records to the time formatted log file at path, as
+// csv with the header in a new file, or as JSON Lines of objects keyed by
+// the header, without the nil values.
+func writeLog(path, format string, header []string, records [][]interface{}) error {
+	// split path into dirname and filename, only format filename
+	logdir, logfile := filepath.Split(path)
+	f, err := os.OpenFile(logdir+time.Now().Format(logfile), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if format == "jsonl" { // keys in the order of the header
+		var buf bytes.Buffer
+		for _, record := range records {
+			sep := byte('{')
+			for i, value := range record {
+				if value == nil {
+					continue
+				}
+				buf.WriteByte(sep)
+				sep = ','
+				key, _ := json.Marshal(header[i])
+				v, err := json.Marshal(value)
+				if err != nil {
+					return err
+				}
+				buf.Write(key)
+				buf.WriteByte(':')
+				buf.Write(v)
+			}
+			if sep == '{' {
+				buf.WriteByte(sep)
+			}
+			buf.WriteString("}\n")
+		}
+		_, err := f.Write(buf.Bytes())
+		return err
+	}
+
+	w := csv.NewWriter(f)
+	// write header in empty file
+	if stat, err := f.Stat(); err == nil && stat.Size() == 0 {
+		w.Write(header)
+	}
+	for _, record := range records {
+		row := make([]string, len(header))
+		for i, value := range record {
+			switch value := value.(type) {
+			case nil:
+			case float64:
+				row[i] = strconv.FormatFloat(value, 'g', 6, 64)
+			default:
+				row[i] = fmt.Sprint(value)
+			}
+		}
+		w.Write(row)
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// pruneLogs removes the oldest log files of path beyond keep files or
+// maxSize bytes, never the newest one. The files of path are those named
+// after its time format, with the ".sessions" of the session log counted
+// with their snmp log.
+func pruneLogs(path string, keep int, maxSize int64) {
+	if keep <= 0 && maxSize <= 0 {
+		return
+	}
+	logdir, logfile := filepath.Split(path)
+	dir := logdir
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		logSnmp.Error("snmp log pruning failed", "err", err)
+		return
+	}
+
+	type logGroup struct {
+		at    time.Time
+		names []string
+		size  int64
+	}
+	groups := make(map[string]*logGroup)
+	for _, e := range entries {
+		base := strings.TrimSuffix(e.Name(), ".sessions")
+		at, err := time.ParseInLocation(logfile, base, time.Local)
+		if err != nil || e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		g, ok := groups[base]
+		if !ok {
+			g = &logGroup{at: at}
+			groups[base] = g
+		}
+		g.names = append(g.names, e.Name())
+		g.size += info.Size()
+	}
+
+	list := make([]*logGroup, 0, len(groups))
+	for _, g := range groups {
+		list = append(list, g)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].at.After(list[j].at) })
+	var total int64
+	for i, g := range list {
+		total += g.size
+		if i == 0 || ((keep <= 0 || i < keep) && (maxSize <= 0 || total <= maxSize)) {
+			continue
+		}
+		for _, name := range g.names {
+			if err := os.Remove(logdir + name); err != nil {
+				logSnmp.Error("snmp log pruning failed", "err", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package generic
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+func TestSnmpRates(t *testing.T) {
+	prev := &kcp.Snmp{BytesReceived: 1000, OutSegs: 100, CurrEstab: 5}
+	cur := &kcp.Snmp{BytesReceived: 3000, BytesSent: 500, OutSegs: 200, LostSegs: 5, RetransSegs: 10, FECRecovered: 3, FECShortShards: 1, CurrEstab: 2}
+	rates := snmpRates(cur, prev, 2*time.Second)
+	for i, want := range []float64{2, 1000, 250, 0.05, 0.1, 0.75} {
+		if rates[i].(float64) != want {
+			t.Fatal("unexpected", snmpRatesHeader[i], rates[i])
+		}
+	}
+	values := snmpValues(cur, prev)
+	if values[0].(uint64) != 500 || values[1].(uint64) != 2000 || values[5].(uint64) != 2 {
+		t.Fatal("unexpected deltas", values)
+	}
+}
+
+func TestSnmpLogFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "snmp-20060102.log")
+	header := []string{"Unix", "Stream", "Ratio"}
+	if err := writeLog(path, "jsonl", header, [][]interface{}{{int64(1), nil, 0.5}}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, time.Now().Format("snmp-20060102.log")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal(b, &record); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := record["Stream"]; ok || record["Ratio"] != 0.5 || len(record) != 2 {
+		t.Fatal("unexpected record", record)
+	}
+
+	// 3 days of logs, with the session logs of the last two days
+	for _, name := range []string{"snmp-20260101.log", "snmp-20260102.log", "snmp-20260102.log.sessions",
+		"snmp-20260103.log", "snmp-20260103.log.sessions", "other.log"} {
+		os.WriteFile(filepath.Join(dir, name), []byte(strings.Repeat("x", 100)), 0600)
+	}
+	pruneLogs(path, 0, 500)
+	if _, err := os.Stat(filepath.Join(dir, "snmp-20260101.log")); err == nil {
+		t.Fatal("log beyond the size kept")
+	}
+	pruneLogs(path, 2, 0)
+	names, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(names) != 4 { // today, 20260103 with its sessions and other.log
+		t.Fatal("unexpected logs kept", names)
+	}
+}
@@ -0,0 +1,68 @@
+package generic
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+var (
+	errInvalidOperation = errors.New("invalid operation")
+	errTimeout          = errors.New("timeout")
+)
+
+// the same optional interfaces as kcp-go probes on a net.PacketConn,
+// wrappers of net.PacketConn implement them to reach the sockets beneath.
+type (
+	setReadBuffer interface {
+		SetReadBuffer(bytes int) error
+	}
+
+	setWriteBuffer interface {
+		SetWriteBuffer(bytes int) error
+	}
+
+	setDSCP interface {
+		SetDSCP(int) error
+	}
+)
+
+// SetReadBuffer sets the socket read buffer of conn if supported
+func SetReadBuffer(conn net.PacketConn, bytes int) error {
+	if nc, ok := conn.(setReadBuffer); ok {
+		return nc.SetReadBuffer(bytes)
+	}
+	return errInvalidOperation
+}
+
+// SetWriteBuffer sets the socket write buffer of conn if supported
+func SetWriteBuffer(conn net.PacketConn, bytes int) error {
+	if nc, ok := conn.(setWriteBuffer); ok {
+		return nc.SetWriteBuffer(bytes)
+	}
+	return errInvalidOperation
+}
+
+// SetDSCP sets the 6bit DSCP field in IPv4 header, or 8bit Traffic Class in IPv6 header of conn
+func SetDSCP(conn net.PacketConn, dscp int) error {
+	if ts, ok := conn.(setDSCP); ok {
+		return ts.SetDSCP(dscp)
+	}
+
+	if nc, ok := conn.(net.Conn); ok {
+		var succeed bool
+		if err := ipv4.NewConn(nc).SetTOS(dscp << 2); err == nil {
+			succeed = true
+		}
+		if err := ipv6.NewConn(nc).SetTrafficClass(dscp); err == nil {
+			succeed = true
+		}
+
+		if succeed {
+			return nil
+		}
+	}
+	return errInvalidOperation
+}
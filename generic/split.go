@@ -0,0 +1,451 @@
+package generic
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+const (
+	// how often an outgoing packet is copied to the downlink of a SplitConn
+	splitMirrorInterval = time.Second
+	// conversations idle for this long are forgotten by ConvConn
+	convExpire = 10 * time.Minute
+)
+
+// SplitConn is a net.PacketConn which sends packets over one transport and
+// receives packets from another, so a kcp.UDPSession can run over asymmetric
+// paths.
+//
+// Every splitMirrorInterval, an outgoing packet is also copied to the
+// downlink, which lets the server pair both flows by conversation id, and
+// keeps the NAT mapping of the downlink alive.
+type SplitConn struct {
+	up       net.PacketConn
+	upAddr   net.Addr
+	down     net.PacketConn
+	downAddr net.Addr
+	block    kcp.BlockCrypt
+
+	lastMirror time.Time
+	mu         sync.Mutex
+}
+
+// NewSplitConn creates a SplitConn sending to upAddr through up, and
+// receiving from downAddr through down, block is used to recognize
+// the packets to mirror.
+func NewSplitConn(up net.PacketConn, upAddr net.Addr, down net.PacketConn, downAddr net.Addr, block kcp.BlockCrypt) *SplitConn {
+	c := new(SplitConn)
+	c.up = up
+	c.upAddr = upAddr
+	c.down = down
+	c.downAddr = downAddr
+	c.block = block
+	return c
+}
+
+// ReadFrom implements the PacketConn ReadFrom method, packets are read
+// from the downlink only.
+func (c *SplitConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		n, addr, err = c.down.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+		// present the downlink as the peer the session dialed
+		if addr.String() == c.downAddr.String() {
+			return n, c.upAddr, nil
+		}
+	}
+}
+
+// WriteTo implements the PacketConn WriteTo method, packets are written
+// to the uplink only, except for the mirrored ones.
+func (c *SplitConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	if n, err = c.up.WriteTo(p, c.upAddr); err != nil {
+		return n, err
+	}
+
+	c.mu.Lock()
+	mirror := time.Since(c.lastMirror) >= splitMirrorInterval
+	c.mu.Unlock()
+	if mirror {
+		if _, ok := PeekConv(c.block, p); ok {
+			if _, err := c.down.WriteTo(p, c.downAddr); err == nil {
+				c.mu.Lock()
+				c.lastMirror = time.Now()
+				c.mu.Unlock()
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close closes both transports
+func (c *SplitConn) Close() error {
+	err := c.up.Close()
+	if err2 := c.down.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// LocalAddr returns the local address of the uplink
+func (c *SplitConn) LocalAddr() net.Addr { return c.up.LocalAddr() }
+
+// SetDeadline implements the Conn SetDeadline method.
+func (c *SplitConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	c.SetWriteDeadline(t)
+	return nil
+}
+
+// SetReadDeadline implements the Conn SetReadDeadline method.
+func (c *SplitConn) SetReadDeadline(t time.Time) error { return c.down.SetReadDeadline(t) }
+
+// SetWriteDeadline implements the Conn SetWriteDeadline method.
+func (c *SplitConn) SetWriteDeadline(t time.Time) error { return c.up.SetWriteDeadline(t) }
+
+// SetReadBuffer sets the socket read buffer of the downlink
+func (c *SplitConn) SetReadBuffer(bytes int) error { return SetReadBuffer(c.down, bytes) }
+
+// SetWriteBuffer sets the socket write buffer of the uplink
+func (c *SplitConn) SetWriteBuffer(bytes int) error { return SetWriteBuffer(c.up, bytes) }
+
+// SetDSCP sets DSCP on both transports
+func (c *SplitConn) SetDSCP(dscp int) error {
+	err := SetDSCP(c.up, dscp)
+	if err2 := SetDSCP(c.down, dscp); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// ConvAddr is the address of a conversation handed out by ConvConn
+type ConvAddr struct {
+	Conv uint32
+	Addr net.Addr // the address which started the conversation
+}
+
+func (a *ConvAddr) Network() string { return "kcp" }
+func (a *ConvAddr) String() string  { return fmt.Sprintf("%v#%08x", a.Addr, a.Conv) }
+
+type (
+	// a flow is a remote address on one of the transports
+	flowKey struct {
+		transport int
+		addr      string
+	}
+
+	convEntry struct {
+		addr     *ConvAddr
+		flows    []net.Addr // remote address on each transport
+		last     int        // transport of the latest packet
+		lastSeen time.Time
+		conflict string // the last address refused, logged once
+	}
+
+	convPacket struct {
+		transport int
+		bts       []byte
+		addr      net.Addr
+	}
+)
+
+// ConvConn merges several transports into a single net.PacketConn for
+// kcp.Listener, keying peers by KCP conversation id instead of the remote
+// address, so a client can split one conversation over two transports.
+//
+// Replies go to the preferred transport if the conversation has been seen
+// on it, or to the transport of the latest packet otherwise.
+//
+// A conversation stays on the first remote address seen on each transport,
+// the packets of another address are dropped, unless roaming is enabled
+// with SetRoaming: anyone sending a packet of the conversation would
+// redirect its replies otherwise.
+//
+// FEC parity shards carry no conversation id, they go to the conversation
+// of the data shards of their FEC group on the same flow, see fecOwners.
+type ConvConn struct {
+	conns                    []net.PacketConn
+	block                    kcp.BlockCrypt
+	prefer                   int
+	dataShards, parityShards int
+	roam                     bool
+
+	convs     map[uint32]*convEntry
+	flows     map[flowKey]*fecOwners // with FEC
+	lastSweep time.Time
+	mu        sync.Mutex
+
+	chPackets chan convPacket
+	rd        time.Time
+	rdMu      sync.Mutex
+
+	die          chan struct{}
+	dieOnce      sync.Once
+	chReadError  chan struct{}
+	readError    error
+	readErrOnce  sync.Once
+	closeErr     error
+	closeErrOnce sync.Once
+}
+
+// NewConvConn creates a ConvConn over conns, prefer is the index of the
+// transport preferred for replies, or -1 for none. block is used to extract
+// the conversation id of incoming packets, with the FEC parameters of KCP.
+func NewConvConn(block kcp.BlockCrypt, prefer, dataShards, parityShards int, conns ...net.PacketConn) *ConvConn {
+	c := new(ConvConn)
+	c.conns = conns
+	c.block = block
+	c.prefer = prefer
+	c.dataShards = dataShards
+	c.parityShards = parityShards
+	c.convs = make(map[uint32]*convEntry)
+	c.flows = make(map[flowKey]*fecOwners)
+	c.lastSweep = time.Now()
+	c.chPackets = make(chan convPacket, 128)
+	c.die = make(chan struct{})
+	c.chReadError = make(chan struct{})
+	for k := range conns {
+		go c.readLoop(k)
+	}
+	return c
+}
+
+func (c *ConvConn) readLoop(transport int) {
+	conn := c.conns[transport]
+	for {
+		buf := peekBuf.Get().([]byte)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			c.readErrOnce.Do(func() {
+				c.readError = errors.WithStack(err)
+				close(c.chReadError)
+			})
+			return
+		}
+
+		select {
+		case c.chPackets <- convPacket{transport, buf[:n], addr}:
+		case <-c.die:
+			return
+		}
+	}
+}
+
+// ReadFrom implements the PacketConn ReadFrom method.
+func (c *ConvConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	var deadline <-chan time.Time
+	c.rdMu.Lock()
+	rd := c.rd
+	c.rdMu.Unlock()
+	if !rd.IsZero() {
+		timer := time.NewTimer(time.Until(rd))
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for {
+		select {
+		case pkt := <-c.chPackets:
+			entry := c.track(pkt)
+			n = copy(p, pkt.bts)
+			peekBuf.Put(pkt.bts[:cap(pkt.bts)])
+			if entry != nil {
+				return n, entry, nil
+			}
+		case <-deadline:
+			return 0, nil, errors.WithStack(errTimeout)
+		case <-c.chReadError:
+			return 0, nil, c.readError
+		case <-c.die:
+			return 0, nil, errors.WithStack(io.ErrClosedPipe)
+		}
+	}
+}
+
+// track associates the flow of a packet to its conversation
+func (c *ConvConn) track(pkt convPacket) *ConvAddr {
+	s, ok := peekShard(c.block, pkt.bts)
+	if !ok {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.lastSweep) > convExpire {
+		c.sweep(now)
+	}
+
+	conv := s.conv
+	if s.fec && c.dataShards > 0 {
+		key := flowKey{pkt.transport, pkt.addr.String()}
+		flow, known := c.flows[key]
+		if !known {
+			if s.parity {
+				return nil
+			}
+			flow = newFECOwners(c.dataShards, c.parityShards)
+			c.flows[key] = flow
+		}
+		flow.lastSeen = now
+		if s.parity {
+			if conv, ok = flow.parity(s.seqid); !ok {
+				return nil
+			}
+		} else {
+			flow.data(s.seqid, conv)
+		}
+	}
+
+	entry, ok := c.convs[conv]
+	if !ok {
+		if s.parity {
+			return nil
+		}
+		entry = &convEntry{
+			addr:  &ConvAddr{Conv: conv, Addr: pkt.addr},
+			flows: make([]net.Addr, len(c.conns)),
+		}
+		c.convs[conv] = entry
+	}
+	if flow := entry.flows[pkt.transport]; flow != nil && !c.roam && flow.String() != pkt.addr.String() {
+		if entry.conflict != pkt.addr.String() {
+			entry.conflict = pkt.addr.String()
+			logConv.Warn("conversation from another address dropped", "conv", fmt.Sprintf("%08x", conv), "remote", flow, "from", pkt.addr)
+		}
+		return nil
+	}
+	entry.flows[pkt.transport] = pkt.addr
+	entry.last = pkt.transport
+	entry.lastSeen = now
+	return entry.addr
+}
+
+// SetRoaming lets the conversations move to the remote address of their
+// latest packet on each transport, the packets must be authenticated
+// beneath c, by an AEAD crypt
+func (c *ConvConn) SetRoaming(roam bool) {
+	c.mu.Lock()
+	c.roam = roam
+	c.mu.Unlock()
+}
+
+// sweep forgets idle conversations and flows
+func (c *ConvConn) sweep(now time.Time) {
+	for conv, entry := range c.convs {
+		if now.Sub(entry.lastSeen) > convExpire {
+			delete(c.convs, conv)
+		}
+	}
+	for key, flow := range c.flows {
+		if now.Sub(flow.lastSeen) > convExpire {
+			delete(c.flows, key)
+		}
+	}
+	c.lastSweep = now
+}
+
+// WriteTo implements the PacketConn WriteTo method, addr must be
+// a *ConvAddr returned by ReadFrom.
+func (c *ConvConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	caddr, ok := addr.(*ConvAddr)
+	if !ok {
+		return 0, errors.WithStack(errInvalidOperation)
+	}
+
+	c.mu.Lock()
+	entry, ok := c.convs[caddr.Conv]
+	if !ok {
+		c.mu.Unlock()
+		return 0, errors.Errorf("unknown conversation: %v", caddr)
+	}
+	transport := entry.last
+	if c.prefer >= 0 && entry.flows[c.prefer] != nil {
+		transport = c.prefer
+	}
+	raddr := entry.flows[transport]
+	c.mu.Unlock()
+
+	return c.conns[transport].WriteTo(p, raddr)
+}
+
+// Close closes all transports
+func (c *ConvConn) Close() error {
+	c.closeErrOnce.Do(func() {
+		close(c.die)
+		for _, conn := range c.conns {
+			if err := conn.Close(); err != nil && c.closeErr == nil {
+				c.closeErr = err
+			}
+		}
+	})
+	return c.closeErr
+}
+
+// LocalAddr returns the local address of the first transport
+func (c *ConvConn) LocalAddr() net.Addr { return c.conns[0].LocalAddr() }
+
+// SetDeadline implements the Conn SetDeadline method.
+func (c *ConvConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	c.SetWriteDeadline(t)
+	return nil
+}
+
+// SetReadDeadline implements the Conn SetReadDeadline method.
+func (c *ConvConn) SetReadDeadline(t time.Time) error {
+	c.rdMu.Lock()
+	c.rd = t
+	c.rdMu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline implements the Conn SetWriteDeadline method.
+func (c *ConvConn) SetWriteDeadline(t time.Time) error {
+	for _, conn := range c.conns {
+		conn.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+// SetReadBuffer sets the socket read buffer of all transports
+func (c *ConvConn) SetReadBuffer(bytes int) error {
+	var err error
+	for _, conn := range c.conns {
+		if e := SetReadBuffer(conn, bytes); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// SetWriteBuffer sets the socket write buffer of all transports
+func (c *ConvConn) SetWriteBuffer(bytes int) error {
+	var err error
+	for _, conn := range c.conns {
+		if e := SetWriteBuffer(conn, bytes); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// SetDSCP sets DSCP on all transports
+func (c *ConvConn) SetDSCP(dscp int) error {
+	var err error
+	for _, conn := range c.conns {
+		if e := SetDSCP(conn, dscp); e != nil {
+			err = e
+		}
+	}
+	return err
+}
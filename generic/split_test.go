@@ -0,0 +1,132 @@
+package generic
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+func TestSplitConn(t *testing.T) {
+	block, _ := kcp.NewAESBlockCrypt(make([]byte, 32))
+	udp1, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp2, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// replies prefer the second transport
+	lis, err := kcp.ServeConn(block, 10, 3, NewConvConn(block, 1, 10, 3, udp1, udp2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go func() {
+		conn, err := lis.AcceptKCP()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+	}()
+
+	up, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	down, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	conn := NewSplitConn(up, udp1.LocalAddr(), down, udp2.LocalAddr(), block)
+	defer conn.Close()
+	sess, err := kcp.NewConn2(udp1.LocalAddr(), block, 10, 3, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	// echo only succeeds if the server replies over the downlink
+	msg := make([]byte, 65536)
+	go sess.Write(msg)
+	sess.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(sess, make([]byte, len(msg))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConvConnFEC(t *testing.T) {
+	conn, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	c := NewConvConn(nil, -1, 2, 1, conn)
+	defer c.Close()
+	peer, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	defer peer.Close()
+	read := func() uint32 {
+		buf := make([]byte, mtuLimit)
+		c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, addr, err := c.ReadFrom(buf)
+		if err != nil {
+			return 0
+		}
+		return addr.(*ConvAddr).Conv
+	}
+
+	// two conversations on one flow, each parity shard goes to the
+	// conversation of its group
+	a := fecShards(t, 3, segment(1, 0, "a0"), segment(1, 1, "a1"))
+	b := fecShards(t, 6, segment(2, 0, "b0"), segment(2, 1, "b1"))
+	for _, p := range [][]byte{a[0], b[0], a[2], b[2]} {
+		peer.WriteTo(p, conn.LocalAddr())
+	}
+	for _, conv := range []uint32{1, 2, 1, 2} {
+		if got := read(); got != conv {
+			t.Fatal("unexpected conversation", got, conv)
+		}
+	}
+
+	// a group shared by both conversations is ambiguous
+	shared := fecShards(t, 9, segment(2, 2, "b2"), segment(2, 3, "b3"))
+	peer.WriteTo(fecShards(t, 9, segment(1, 2, "a2"), segment(1, 3, "a3"))[0], conn.LocalAddr())
+	peer.WriteTo(shared[0], conn.LocalAddr())
+	peer.WriteTo(shared[2], conn.LocalAddr())
+	read()
+	read()
+	if got := read(); got != 0 {
+		t.Fatal("ambiguous parity shard delivered to", got)
+	}
+}
+
+func TestConvConnRoaming(t *testing.T) {
+	for _, roam := range []bool{false, true} {
+		conn, _ := net.ListenPacket("udp", "127.0.0.1:0")
+		c := NewConvConn(nil, -1, 0, 0, conn)
+		c.SetRoaming(roam)
+		first, _ := net.ListenPacket("udp", "127.0.0.1:0")
+		second, _ := net.ListenPacket("udp", "127.0.0.1:0")
+
+		first.WriteTo(segment(5, 0, "first"), conn.LocalAddr())
+		second.WriteTo(segment(5, 1, "second"), conn.LocalAddr())
+		buf := make([]byte, mtuLimit)
+		c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, addr, err := c.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = c.ReadFrom(buf)
+		if (err == nil) != roam {
+			t.Fatal("packet from another address, roaming:", roam, err)
+		}
+
+		// replies go to the first address, unless the conversation moved
+		c.WriteTo([]byte("reply"), addr)
+		to := first
+		if roam {
+			to = second
+		}
+		to.SetReadDeadline(time.Now().Add(time.Second))
+		if _, _, err := to.ReadFrom(buf); err != nil {
+			t.Fatal("reply not received, roaming:", roam)
+		}
+		c.Close()
+		first.Close()
+		second.Close()
+	}
+}
@@ -0,0 +1,394 @@
+package generic
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// SessionStats are the statistics of a session, kept from TrackSession to
+// Close. Packets, retransmissions and FEC recoveries are counted only with
+// a PacketStatsConn beneath KCP.
+type SessionStats struct {
+	id       uint64
+	listener string
+	sess     *kcp.UDPSession
+	closer   io.Closer // closing the session and all above it, the session if nil
+	start    time.Time
+	once     sync.Once
+
+	bytesIn, bytesOut uint64 // KCP payload
+	comp              *CompStream
+
+	wire    wireStats
+	streams map[*StreamStats]struct{}
+	mu      sync.Mutex
+}
+
+// sessions alive, by session and by conversation
+var sessions = struct {
+	m      map[*kcp.UDPSession]*SessionStats
+	byConv map[uint32]*SessionStats
+	lastID uint64
+	mu     sync.RWMutex
+}{
+	m:      make(map[*kcp.UDPSession]*SessionStats),
+	byConv: make(map[uint32]*SessionStats),
+}
+
+// TrackSession keeps the statistics of the session s serving listener,
+// until Close is called, and fires the session_open hooks
+func TrackSession(s *kcp.UDPSession, listener string) *SessionStats {
+	stats := &SessionStats{
+		listener: listener,
+		sess:     s,
+		start:    time.Now(),
+		streams:  make(map[*StreamStats]struct{}),
+	}
+	sessions.mu.Lock()
+	sessions.lastID++
+	stats.id = sessions.lastID
+	sessions.m[s] = stats
+	sessions.byConv[s.GetConv()] = stats
+	sessions.mu.Unlock()
+	FireHook(SessionEvent(EventSessionOpen, stats.Snapshot()))
+	return stats
+}
+
+// ID returns the id of the session, 0 if s is nil
+func (s *SessionStats) ID() uint64 {
+	if s == nil {
+		return 0
+	}
+	return s.id
+}
+
+// Close stops tracking the session, firing its session_close hooks
+func (s *SessionStats) Close() {
+	s.once.Do(func() {
+		sessions.mu.Lock()
+		delete(sessions.m, s.sess)
+		if sessions.byConv[s.sess.GetConv()] == s {
+			delete(sessions.byConv, s.sess.GetConv())
+		}
+		sessions.mu.Unlock()
+		FireHook(SessionEvent(EventSessionClose, s.Snapshot()))
+	})
+}
+
+// lookupConv returns the statistics of the session of conv, nil if unknown
+func lookupConv(conv uint32) *SessionStats {
+	sessions.mu.RLock()
+	defer sessions.mu.RUnlock()
+	return sessions.byConv[conv]
+}
+
+// Conn returns conn counting the payload of the session
+func (s *SessionStats) Conn(conn net.Conn) net.Conn {
+	return &countedConn{conn, s}
+}
+
+type countedConn struct {
+	net.Conn
+	stats *SessionStats
+}
+
+func (c *countedConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	atomic.AddUint64(&c.stats.bytesIn, uint64(n))
+	return n, err
+}
+
+func (c *countedConn) Write(p []byte) (n int, err error) {
+	n, err = c.Conn.Write(p)
+	atomic.AddUint64(&c.stats.bytesOut, uint64(n))
+	return n, err
+}
+
+// SetCloser sets how the session is closed by CloseSession, with all the
+// layers above it
+func (s *SessionStats) SetCloser(c io.Closer) {
+	s.mu.Lock()
+	s.closer = c
+	s.mu.Unlock()
+}
+
+// close closes the session with the layers above it, and stops tracking it
+func (s *SessionStats) close() {
+	s.mu.Lock()
+	closer := s.closer
+	s.mu.Unlock()
+	if closer == nil {
+		closer = s.sess
+	}
+	closer.Close()
+	s.Close()
+}
+
+// SetComp sets the compression of the session, for its savings
+func (s *SessionStats) SetComp(c *CompStream) {
+	s.mu.Lock()
+	s.comp = c
+	s.mu.Unlock()
+}
+
+// StreamStats are the statistics of a stream of a session, see OpenStream
+type StreamStats struct {
+	id                uint32
+	stream            io.Closer
+	start             time.Time
+	bytesIn, bytesOut uint64
+	session           *SessionStats
+}
+
+// OpenStream keeps the statistics of the stream id of the session, until
+// Close is called, stream is closed by CloseStream
+func (s *SessionStats) OpenStream(id uint32, stream io.Closer) *StreamStats {
+	atomic.AddUint64(&DefaultSnmp.StreamsOpened, 1)
+	ss := &StreamStats{id: id, stream: stream, start: time.Now(), session: s}
+	s.mu.Lock()
+	s.streams[ss] = struct{}{}
+	s.mu.Unlock()
+	return ss
+}
+
+// Close stops tracking the stream
+func (ss *StreamStats) Close() {
+	atomic.AddUint64(&DefaultSnmp.StreamsClosed, 1)
+	ss.session.mu.Lock()
+	delete(ss.session.streams, ss)
+	ss.session.mu.Unlock()
+}
+
+// In returns w counting the bytes received from the peer on the stream
+func (ss *StreamStats) In(w io.Writer) io.Writer { return &countWriter{w, &ss.bytesIn} }
+
+// Out returns w counting the bytes sent to the peer on the stream
+func (ss *StreamStats) Out(w io.Writer) io.Writer { return &countWriter{w, &ss.bytesOut} }
+
+// SessionSnapshot is a copy of the statistics of a session
+type SessionSnapshot struct {
+	ID           uint64 // of the process, unlike Conv
+	Listener     string
+	Remote       string
+	Transport    string
+	Conv         uint32
+	Duration     time.Duration
+	BytesIn      uint64 // KCP payload
+	BytesOut     uint64
+	PktsIn       uint64 // with a PacketStatsConn only, down to Recovered
+	PktsOut      uint64
+	WireIn       uint64
+	WireOut      uint64
+	Retrans      uint64 // segments sent again
+	Recovered    uint64 // data shards recovered by FEC
+	SRTT         time.Duration
+	RTO          time.Duration
+	CompSaved    int64 // bytes saved by compression, both ways
+	StreamsAlive []StreamSnapshot
+}
+
+// StreamSnapshot is a copy of the statistics of a stream
+type StreamSnapshot struct {
+	ID       uint32
+	Duration time.Duration
+	BytesIn  uint64
+	BytesOut uint64
+}
+
+// Snapshot copies the statistics of the session
+func (s *SessionStats) Snapshot() SessionSnapshot {
+	now := time.Now()
+	remote, transport := sessionLabels(s.sess)
+	snap := SessionSnapshot{
+		ID:        s.id,
+		Listener:  s.listener,
+		Remote:    remote,
+		Transport: transport,
+		Conv:      s.sess.GetConv(),
+		Duration:  now.Sub(s.start),
+		BytesIn:   atomic.LoadUint64(&s.bytesIn),
+		BytesOut:  atomic.LoadUint64(&s.bytesOut),
+		SRTT:      time.Duration(s.sess.GetSRTT()) * time.Millisecond,
+		RTO:       time.Duration(s.sess.GetRTO()) * time.Millisecond,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap.PktsIn, snap.PktsOut = s.wire.pktsIn, s.wire.pktsOut
+	snap.WireIn, snap.WireOut = s.wire.bytesIn, s.wire.bytesOut
+	snap.Retrans, snap.Recovered = s.wire.retrans, s.wire.recovered
+	if s.comp != nil {
+		rawIn, wireIn, rawOut, wireOut := s.comp.Counters()
+		snap.CompSaved = int64(rawIn) - int64(wireIn) + int64(rawOut) - int64(wireOut)
+	}
+	for ss := range s.streams {
+		snap.StreamsAlive = append(snap.StreamsAlive, StreamSnapshot{
+			ID:       ss.id,
+			Duration: now.Sub(ss.start),
+			BytesIn:  atomic.LoadUint64(&ss.bytesIn),
+			BytesOut: atomic.LoadUint64(&ss.bytesOut),
+		})
+	}
+	sort.Slice(snap.StreamsAlive, func(i, j int) bool { return snap.StreamsAlive[i].ID < snap.StreamsAlive[j].ID })
+	return snap
+}
+
+// String formats the snapshot on one line, without the streams
+func (s SessionSnapshot) String() string {
+	return fmt.Sprintf("listener:%v remote:%v transport:%v conv:%08x duration:%v in:%v out:%v pktsin:%v pktsout:%v wirein:%v wireout:%v retrans:%v recovered:%v srtt:%v rto:%v compsaved:%v streams:%v",
+		s.Listener, s.Remote, s.Transport, s.Conv, s.Duration.Round(time.Second), s.BytesIn, s.BytesOut,
+		s.PktsIn, s.PktsOut, s.WireIn, s.WireOut, s.Retrans, s.Recovered, s.SRTT, s.RTO, s.CompSaved, len(s.StreamsAlive))
+}
+
+// String formats the snapshot on one line
+func (s StreamSnapshot) String() string {
+	return fmt.Sprintf("stream:%v duration:%v in:%v out:%v", s.ID, s.Duration.Round(time.Second), s.BytesIn, s.BytesOut)
+}
+
+// Sessions returns the statistics of the sessions alive, by listener and remote address
+func Sessions() []SessionSnapshot {
+	sessions.mu.RLock()
+	list := make([]*SessionStats, 0, len(sessions.m))
+	for _, s := range sessions.m {
+		list = append(list, s)
+	}
+	sessions.mu.RUnlock()
+
+	snaps := make([]SessionSnapshot, len(list))
+	for i, s := range list {
+		snaps[i] = s.Snapshot()
+	}
+	sort.Slice(snaps, func(i, j int) bool {
+		if snaps[i].Listener != snaps[j].Listener {
+			return snaps[i].Listener < snaps[j].Listener
+		}
+		return snaps[i].Remote < snaps[j].Remote
+	})
+	return snaps
+}
+
+// lookupSession returns the statistics of the session id alive, nil if none
+func lookupSession(id uint64) *SessionStats {
+	sessions.mu.RLock()
+	defer sessions.mu.RUnlock()
+	for _, s := range sessions.m {
+		if s.id == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// CloseSession closes the session id, false if not alive
+func CloseSession(id uint64) bool {
+	s := lookupSession(id)
+	if s == nil {
+		return false
+	}
+	s.close()
+	return true
+}
+
+// CloseStream closes the stream sid of the session id, false if not alive
+func CloseStream(id uint64, sid uint32) bool {
+	s := lookupSession(id)
+	if s == nil {
+		return false
+	}
+	var stream io.Closer
+	s.mu.Lock()
+	for ss := range s.streams {
+		if ss.id == sid {
+			stream = ss.stream
+		}
+	}
+	s.mu.Unlock()
+	if stream == nil {
+		return false
+	}
+	stream.Close()
+	return true
+}
+
+// CloseSessions closes every session alive, returning how many
+func CloseSessions() int {
+	sessions.mu.RLock()
+	list := make([]*SessionStats, 0, len(sessions.m))
+	for _, s := range sessions.m {
+		list = append(list, s)
+	}
+	sessions.mu.RUnlock()
+	for _, s := range list {
+		s.close()
+	}
+	return len(list)
+}
+
+// LogSessions logs the statistics of every session and stream alive
+func LogSessions() {
+	for _, s := range Sessions() {
+		log.Println("KCPTUN SESSION:", s)
+		for _, ss := range s.StreamsAlive {
+			log.Println("KCPTUN SESSION:", s.Remote, ss)
+		}
+	}
+}
+
+var sessionLogHeader = []string{"Unix", "Kind", "Conv", "Stream", "Listener", "Remote", "Transport", "Duration",
+	"BytesIn", "BytesOut", "PktsIn", "PktsOut", "WireIn", "WireOut", "Retrans", "Recovered", "SRTT", "RTO", "CompSaved"}
+
+// SessionLogger appends the statistics of the sessions and their streams
+// every interval to the log file with the ".sessions" suffix, cumulative
+// whatever config.Delta, durations are in milliseconds.
+func SessionLogger(config SnmpLogConfig) {
+	if config.Path == "" || config.Interval == 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(config.Interval) * time.Second)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		var records [][]interface{}
+		for _, s := range Sessions() {
+			conv := fmt.Sprintf("%08x", s.Conv)
+			records = append(records, []interface{}{now.Unix(), "session", conv, nil, s.Listener, s.Remote, s.Transport,
+				s.Duration.Milliseconds(), s.BytesIn, s.BytesOut, s.PktsIn, s.PktsOut, s.WireIn, s.WireOut,
+				s.Retrans, s.Recovered, s.SRTT.Milliseconds(), s.RTO.Milliseconds(), s.CompSaved})
+			for _, ss := range s.StreamsAlive {
+				record := make([]interface{}, len(sessionLogHeader))
+				copy(record, []interface{}{now.Unix(), "stream", conv, ss.ID, s.Listener, s.Remote, s.Transport,
+					ss.Duration.Milliseconds(), ss.BytesIn, ss.BytesOut})
+				records = append(records, record)
+			}
+		}
+		if err := writeLog(config.Path+".sessions", config.Format, sessionLogHeader, records); err != nil {
+			logSnmp.Error("session log failed", "err", err)
+			return
+		}
+	}
+}
+
+// sessionLabels returns the remote and transport labels of the session s
+func sessionLabels(s *kcp.UDPSession) (remote, transport string) {
+	raddr := s.RemoteAddr()
+	remote = raddr.String()
+	if caddr, ok := raddr.(*ConvAddr); ok {
+		raddr = caddr.Addr
+	}
+	switch raddr.(type) {
+	case *net.UDPAddr:
+		transport = "udp"
+	case *net.TCPAddr:
+		transport = "tcp"
+	default:
+		transport = raddr.Network()
+	}
+	return remote, transport
+}
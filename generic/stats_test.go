@@ -0,0 +1,76 @@
+package generic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+func TestSessionStats(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	sess, err := kcp.NewConn2(raddr, nil, 0, 0, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	stats := TrackSession(sess, "127.0.0.1:29900")
+	defer stats.Close()
+
+	// FEC shards with a data segment of sn, of the group of 2 data and 1 parity shards
+	shard := func(seqid uint32, typ uint16, sn uint32) []byte {
+		p := make([]byte, fecHeaderSizePlus2+kcp.IKCP_OVERHEAD)
+		binary.LittleEndian.PutUint32(p, seqid)
+		binary.LittleEndian.PutUint16(p[4:], typ)
+		seg := p[fecHeaderSizePlus2:]
+		binary.LittleEndian.PutUint32(seg, sess.GetConv())
+		seg[4] = kcp.IKCP_CMD_PUSH
+		binary.LittleEndian.PutUint32(seg[12:], sn)
+		return p
+	}
+	c := NewPacketStatsConn(nil, 2, 1)
+	for _, sn := range []uint32{0, 1, 2, 1, 3, 0} {
+		c.count(shard(sn, typeData, sn), raddr, false)
+	}
+	c.count(shard(0, typeData, 0), raddr, true)
+	c.count(shard(2, typeParity, 0), raddr, true) // recovers the data shard 1
+	c.count(shard(3, typeData, 0), raddr, true)
+	c.count(shard(4, typeData, 0), raddr, true)
+
+	// the conversation of an idle address is forgotten
+	c.convs[raddr.String()].lastSeen = time.Now().Add(-convExpire - time.Minute)
+	c.count(segment(7, 0, ""), testAddr, true)
+	if _, ok := c.convs[raddr.String()]; ok || len(c.convs) != 1 {
+		t.Fatal("idle address not forgotten")
+	}
+
+	var buf bytes.Buffer
+	ss := stats.OpenStream(3, nil)
+	ss.In(&buf).Write([]byte("hello"))
+
+	snap := stats.Snapshot()
+	if snap.PktsOut != 6 || snap.PktsIn != 4 || snap.Retrans != 2 || snap.Recovered != 1 {
+		t.Fatal("unexpected packet statistics", snap)
+	}
+	if snap.Listener != "127.0.0.1:29900" || snap.Remote != raddr.String() || snap.Transport != "udp" {
+		t.Fatal("unexpected labels", snap)
+	}
+	if len(snap.StreamsAlive) != 1 || snap.StreamsAlive[0].ID != 3 || snap.StreamsAlive[0].BytesIn != 5 {
+		t.Fatal("unexpected streams", snap.StreamsAlive)
+	}
+	ss.Close()
+	if len(Sessions()) != 1 || len(Sessions()[0].StreamsAlive) != 0 {
+		t.Fatal("stream still tracked")
+	}
+	stats.Close()
+	if len(Sessions()) != 0 {
+		t.Fatal("session still tracked")
+	}
+}
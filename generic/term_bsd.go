@@ -0,0 +1,11 @@
+//go:build darwin || freebsd
+// +build darwin freebsd
+
+package generic
+
+import "golang.org/x/sys/unix"
+
+const (
+	ioctlGetTermios = unix.TIOCGETA
+	ioctlSetTermios = unix.TIOCSETA
+)
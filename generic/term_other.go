@@ -0,0 +1,20 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package generic
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// makeRaw is not supported, the keys are read line by line
+func makeRaw(f *os.File) (func(), error) {
+	return nil, errors.New("raw terminal not supported")
+}
+
+// termSize returns 80x24
+func termSize(f *os.File) (int, int) {
+	return 80, 24
+}
@@ -0,0 +1,39 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package generic
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// makeRaw puts the terminal f in raw mode, reading keys as they are
+// pressed, and returns the function restoring it
+func makeRaw(f *os.File) (func(), error) {
+	fd := int(f.Fd())
+	termios, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	old := *termios
+	termios.Lflag &^= unix.ECHO | unix.ICANON | unix.ISIG | unix.IEXTEN
+	termios.Iflag &^= unix.IXON | unix.ICRNL
+	termios.Cc[unix.VMIN] = 1
+	termios.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, ioctlSetTermios, termios); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return func() { unix.IoctlSetTermios(fd, ioctlSetTermios, &old) }, nil
+}
+
+// termSize returns the columns and rows of the terminal f, 80x24 if unknown
+func termSize(f *os.File) (int, int) {
+	ws, err := unix.IoctlGetWinsize(int(f.Fd()), unix.TIOCGWINSZ)
+	if err != nil || ws.Col == 0 || ws.Row == 0 {
+		return 80, 24
+	}
+	return int(ws.Col), int(ws.Row)
+}
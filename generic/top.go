@@ -0,0 +1,378 @@
+package generic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const topHistory = 20 // samples of the sparklines
+
+// sparks are the bars of the sparklines, lowest first
+var sparks = []rune("▁▂▃▄▅▆▇█")
+
+// topSorts are the orders of the sessions by key
+var topSorts = map[byte]string{
+	't': "throughput",
+	'r': "rtt",
+	'l': "loss",
+	's': "streams",
+	'f': "fec",
+	'a': "age",
+}
+
+// topRow is a session as shown by top, with its rates since the last poll
+type topRow struct {
+	adminSession
+	rx, tx       float64 // bytes per second
+	sent, lost   uint64  // packets sent and retransmitted
+	loss         float64 // retransmitted share of the packets sent
+	fec          float64 // FEC recoveries per second
+	rtts, losses []float64
+	seen         time.Time
+}
+
+// matches reports whether the row contains filter
+func (row *topRow) matches(filter string) bool {
+	for _, s := range []string{strconv.FormatUint(row.ID, 10), row.Remote, row.Listener, row.Transport, row.Conv} {
+		if strings.Contains(strings.ToLower(s), strings.ToLower(filter)) {
+			return true
+		}
+	}
+	return false
+}
+
+// topView is the state of top
+type topView struct {
+	addr    string
+	rows    map[uint64]*topRow
+	sort    byte
+	reverse bool
+	filter  string
+	editing bool // the filter
+	updated time.Time
+	err     error
+}
+
+func newTopView(addr string) *topView {
+	return &topView{addr: addr, rows: make(map[uint64]*topRow), sort: 't'}
+}
+
+// update replaces the rows with the sessions polled at now
+func (v *topView) update(list []adminSession, now time.Time) {
+	rows := make(map[uint64]*topRow, len(list))
+	for _, s := range list {
+		row := &topRow{adminSession: s, seen: now}
+		if prev, ok := v.rows[s.ID]; ok {
+			if d := now.Sub(prev.seen).Seconds(); d > 0 {
+				row.rx = float64(s.BytesIn-prev.BytesIn) / d
+				row.tx = float64(s.BytesOut-prev.BytesOut) / d
+				row.fec = float64(s.Recovered-prev.Recovered) / d
+			}
+			row.sent, row.lost = s.PktsOut-prev.PktsOut, s.Retrans-prev.Retrans
+			if row.sent > 0 {
+				row.loss = float64(row.lost) / float64(row.sent)
+			}
+			row.rtts, row.losses = prev.rtts, prev.losses
+		}
+		row.rtts = appendHistory(row.rtts, float64(s.SRTT))
+		row.losses = appendHistory(row.losses, row.loss)
+		rows[s.ID] = row
+	}
+	v.rows = rows
+	v.updated = now
+	v.err = nil
+}
+
+// appendHistory appends value to the samples of a sparkline
+func appendHistory(history []float64, value float64) []float64 {
+	history = append(history, value)
+	if len(history) > topHistory {
+		history = append([]float64{}, history[len(history)-topHistory:]...)
+	}
+	return history
+}
+
+// value returns the value of row sorted on
+func (v *topView) value(row *topRow) float64 {
+	switch v.sort {
+	case 'r':
+		return float64(row.SRTT)
+	case 'l':
+		return row.loss
+	case 's':
+		return float64(row.Streams)
+	case 'f':
+		return row.fec
+	case 'a':
+		return row.Age
+	}
+	return row.rx + row.tx
+}
+
+// sorted returns the rows matching the filter, highest first unless reversed
+func (v *topView) sorted() []*topRow {
+	var rows []*topRow
+	for _, row := range v.rows {
+		if v.filter == "" || row.matches(v.filter) {
+			rows = append(rows, row)
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		vi, vj := v.value(rows[i]), v.value(rows[j])
+		if vi == vj {
+			return rows[i].ID < rows[j].ID
+		}
+		return (vi > vj) != v.reverse
+	})
+	return rows
+}
+
+// key handles a key pressed, false to quit
+func (v *topView) key(b byte) bool {
+	if b == 3 { // ctrl-c
+		return false
+	}
+	if v.editing {
+		switch {
+		case b == '\r' || b == '\n':
+			v.editing = false
+		case b == 27: // escape
+			v.editing, v.filter = false, ""
+		case b == 127 || b == 8:
+			if len(v.filter) > 0 {
+				v.filter = v.filter[:len(v.filter)-1]
+			}
+		case b >= ' ' && b < 127:
+			v.filter += string(b)
+		}
+		return true
+	}
+	switch {
+	case b == 'q':
+		return false
+	case b == '/':
+		v.editing, v.filter = true, ""
+	case b == 'R':
+		v.reverse = !v.reverse
+	case b == 27:
+		v.filter = ""
+	case topSorts[b] != "":
+		v.sort = b
+	}
+	return true
+}
+
+// render draws the view on a terminal of width columns and height rows
+func (v *topView) render(w io.Writer, width, height int) {
+	rows := v.sorted()
+	var rx, tx, fec float64
+	var streams int
+	var sent, lost uint64
+	for _, row := range v.rows {
+		rx += row.rx
+		tx += row.tx
+		fec += row.fec
+		streams += row.Streams
+		sent += row.sent
+		lost += row.lost
+	}
+	var loss float64
+	if sent > 0 {
+		loss = float64(lost) / float64(sent)
+	}
+
+	order := topSorts[v.sort]
+	if v.reverse {
+		order += " (reversed)"
+	}
+	filter := v.filter
+	if v.editing {
+		filter += "_"
+	}
+	updated := "-"
+	if !v.updated.IsZero() {
+		updated = v.updated.Format("15:04:05")
+	}
+	lines := []string{
+		fmt.Sprintf("kcptun top - %v - %v", v.addr, updated),
+		fmt.Sprintf("sessions: %v  streams: %v  rx: %v/s  tx: %v/s  loss: %.1f%%  fec: %.1f/s",
+			len(v.rows), streams, formatBytes(rx), formatBytes(tx), loss*100, fec),
+		fmt.Sprintf("sort: %v  filter: %v  [t r l s f a] sort [R] reverse [/] filter [q] quit", order, filter),
+		"",
+		fmt.Sprintf("%-6s %-21s %-5s %5s %8s %8s %6s %-*s %6s %-*s %6s %9s",
+			"ID", "REMOTE", "PROTO", "STRMS", "RX/s", "TX/s", "RTT", topHistory, "RTT HISTORY", "LOSS", topHistory, "LOSS HISTORY", "FEC/s", "AGE"),
+	}
+	if v.err != nil {
+		lines[3] = "error: " + v.err.Error()
+	}
+	for _, row := range rows {
+		lines = append(lines, fmt.Sprintf("%-6v %-21v %-5v %5v %8v %8v %6v %v %5.1f%% %v %6.1f %9v",
+			row.ID, row.Remote, row.Transport, row.Streams, formatBytes(row.rx), formatBytes(row.tx),
+			time.Duration(row.SRTT)*time.Millisecond, sparkline(row.rtts), row.loss*100, sparkline(row.losses),
+			row.fec, (time.Duration(row.Age)*time.Second).String()))
+	}
+	if len(lines) > height-1 {
+		lines = lines[:height-1]
+	}
+
+	fmt.Fprint(w, "\x1b[H\x1b[2J")
+	for _, line := range lines {
+		if r := []rune(line); len(r) > width {
+			line = string(r[:width])
+		}
+		fmt.Fprint(w, line, "\r\n")
+	}
+}
+
+// sparkline draws the samples scaled to the highest, padded to topHistory
+func sparkline(samples []float64) string {
+	var high float64
+	for _, s := range samples {
+		if s > high {
+			high = s
+		}
+	}
+	spark := []rune(strings.Repeat(" ", topHistory-len(samples)))
+	for _, s := range samples {
+		i := 0
+		if high > 0 {
+			i = int(s / high * float64(len(sparks)-1))
+		}
+		spark = append(spark, sparks[i])
+	}
+	return string(spark)
+}
+
+// formatBytes formats n bytes in binary units
+func formatBytes(n float64) string {
+	units := "BKMGT"
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f%c", n, units[i])
+	}
+	return fmt.Sprintf("%.1f%c", n, units[i])
+}
+
+// adminClient is a client of the admin API at addr, a unix socket if not host:port
+type adminClient struct {
+	url, token string
+	client     *http.Client
+}
+
+func newAdminClient(addr, token string) *adminClient {
+	c := &adminClient{url: "http://" + addr, token: token, client: &http.Client{Timeout: 5 * time.Second}}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		c.url = "http://unix"
+		c.client.Transport = &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", addr)
+		}}
+	}
+	return c
+}
+
+// get decodes the json served at path into v
+func (c *adminClient) get(path string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, c.url+path, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("%v: %v", path, resp.Status)
+	}
+	return errors.WithStack(json.NewDecoder(resp.Body).Decode(v))
+}
+
+// Top shows the sessions served by the admin API at addr, a unix socket if
+// not host:port, refreshed every interval until q is pressed. The keys are
+// read line by line if stdin is not a terminal.
+func Top(addr, token string, interval time.Duration) error {
+	if addr == "" {
+		return errors.New("no admin API address, see --admin")
+	}
+	if interval <= 0 {
+		return errors.Errorf("invalid interval: %v", interval)
+	}
+	client := newAdminClient(addr, token)
+	view := newTopView(addr)
+	if restore, err := makeRaw(os.Stdin); err == nil {
+		defer restore()
+	}
+	fmt.Print("\x1b[?25l") // hide the cursor
+	defer fmt.Print("\x1b[?25h\r\n")
+
+	keys := make(chan byte)
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, err := os.Stdin.Read(buf)
+			for _, b := range buf[:n] {
+				keys <- b
+			}
+			if err != nil {
+				close(keys)
+				return
+			}
+		}
+	}()
+
+	poll := func() {
+		var list []adminSession
+		if err := client.get("/sessions", &list); err != nil {
+			view.err = err
+			return
+		}
+		view.update(list, time.Now())
+	}
+	draw := func() {
+		var buf bytes.Buffer
+		width, height := termSize(os.Stdout)
+		view.render(&buf, width, height)
+		os.Stdout.Write(buf.Bytes())
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	poll()
+	draw()
+	for {
+		select {
+		case <-ticker.C:
+			poll()
+			draw()
+		case b, ok := <-keys:
+			if !ok { // no terminal, shown until interrupted
+				keys = nil
+				continue
+			}
+			if !view.key(b) {
+				return nil
+			}
+			draw()
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package generic
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTop(t *testing.T) {
+	now := time.Now()
+	v := newTopView("127.0.0.1:6061")
+	v.update([]adminSession{
+		{ID: 1, Remote: "10.0.0.1:4000", Transport: "udp", SRTT: 20},
+		{ID: 2, Remote: "10.0.0.2:4000", Transport: "tcp", SRTT: 80},
+	}, now)
+	v.update([]adminSession{
+		{ID: 1, Remote: "10.0.0.1:4000", Transport: "udp", SRTT: 40, BytesIn: 4096, PktsOut: 100, Retrans: 10, Streams: 1},
+		{ID: 2, Remote: "10.0.0.2:4000", Transport: "tcp", SRTT: 80, BytesIn: 1024, PktsOut: 100, Recovered: 4, Streams: 3},
+	}, now.Add(2*time.Second))
+
+	rows := v.sorted()
+	if len(rows) != 2 || rows[0].ID != 1 || rows[0].rx != 2048 || rows[0].loss != 0.1 || rows[1].fec != 2 {
+		t.Fatal("unexpected rows", rows[0], rows[1])
+	}
+	if sparkline(rows[0].rtts) != strings.Repeat(" ", topHistory-2)+"▄█" {
+		t.Fatal("unexpected sparkline", sparkline(rows[0].rtts))
+	}
+
+	for _, b := range []byte("sR") {
+		v.key(b)
+	}
+	if rows := v.sorted(); rows[0].ID != 1 {
+		t.Fatal("not sorted by streams reversed")
+	}
+	for _, b := range []byte("/tcp\r") {
+		v.key(b)
+	}
+	if rows := v.sorted(); len(rows) != 1 || rows[0].ID != 2 || v.editing {
+		t.Fatal("not filtered", rows)
+	}
+
+	var buf bytes.Buffer
+	v.render(&buf, 200, 24)
+	if !strings.Contains(buf.String(), "sessions: 2  streams: 4  rx: 2.5K/s") || !strings.Contains(buf.String(), "10.0.0.2:4000") ||
+		strings.Contains(buf.String(), "10.0.0.1:4000") {
+		t.Fatal("unexpected view", buf.String())
+	}
+	if v.key('q') {
+		t.Fatal("not quit")
+	}
+
+	if err := Top("127.0.0.1:6061", "", 0); err == nil {
+		t.Fatal("interval of 0 accepted")
+	}
+}
@@ -0,0 +1,384 @@
+package generic
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// KeyIDSize is the size of the key id prefixed to the packets of a user
+	KeyIDSize = 8
+	// addresses of users idle for this long are forgotten
+	userExpire = 10 * time.Minute
+)
+
+var errUnknownKey = errors.New("unknown key id")
+
+// KeyID returns the key id of user, sent in clear so the server selects
+// the key of the user without trial decryption.
+func KeyID(user string) (id [KeyIDSize]byte) {
+	h := sha256.Sum256([]byte("kcptun user " + user))
+	copy(id[:], h[:])
+	return
+}
+
+// KeyIDCrypt is the PacketCrypt of a client logging in as a user, it
+// prefixes the packets sealed by crypt with the key id of the user.
+// Packets from the server carry no key id.
+type KeyIDCrypt struct {
+	id    [KeyIDSize]byte
+	crypt PacketCrypt
+}
+
+// NewKeyIDCrypt creates a KeyIDCrypt of user over crypt
+func NewKeyIDCrypt(user string, crypt PacketCrypt) *KeyIDCrypt {
+	return &KeyIDCrypt{KeyID(user), crypt}
+}
+
+// Seal implements PacketCrypt
+func (c *KeyIDCrypt) Seal(dst, p []byte, addr net.Addr) ([]byte, error) {
+	return c.crypt.Seal(append(dst, c.id[:]...), p, addr)
+}
+
+// Open implements PacketCrypt
+func (c *KeyIDCrypt) Open(dst, p []byte, addr net.Addr) ([]byte, error) {
+	return c.crypt.Open(dst, p, addr)
+}
+
+// Overhead returns the size of the key id and the overhead of crypt
+func (c *KeyIDCrypt) Overhead() int { return KeyIDSize + c.crypt.Overhead() }
+
+// User is an entry of the users file
+type User struct {
+	ID       string   `json:"id"`
+	Key      string   `json:"key"`     // password of the key derivation
+	RawKey   string   `json:"rawkey"`  // hex encoded key, instead of key
+	Crypt    string   `json:"crypt"`   // the default crypt if empty
+	Targets  []string `json:"targets"` // targets allowed, any if empty
+	Disabled bool     `json:"disabled"`
+	KnockTTL int      `json:"knockttl"` // seconds a knock admits the user, the default if 0
+
+	pass  []byte
+	crypt PacketCrypt
+}
+
+// PSK returns the key of the user
+func (u *User) PSK() []byte { return u.pass }
+
+// Overhead returns the size the encryption adds to the packets to the user
+func (u *User) Overhead() int { return u.crypt.Overhead() }
+
+// Allowed tells whether the user may connect to target
+func (u *User) Allowed(target string) bool { return allowedTarget(u.Targets, target) }
+
+// allowedTarget tells whether target is in targets, any target is allowed
+// if targets is empty
+func allowedTarget(targets []string, target string) bool {
+	if len(targets) == 0 {
+		return true
+	}
+	for _, t := range targets {
+		if t == target {
+			return true
+		}
+	}
+	return false
+}
+
+// same reports whether u and v share the key and cipher
+func (u *User) same(v *User) bool {
+	return u.Key == v.Key && u.RawKey == v.RawKey && u.Crypt == v.Crypt
+}
+
+type userAddr struct {
+	id   string
+	seen time.Time
+}
+
+// Users is the PacketCrypt of a server with several users, each with their
+// own key and cipher. Packets from the clients are opened with the key of
+// the user named by their key id, see KeyIDCrypt; packets to an address are
+// sealed with the key of the user last seen there.
+//
+// The users file is a JSON array of User, Reload applies its changes, the
+// sessions of users removed, disabled or with another key are closed.
+type Users struct {
+	path                 string
+	crypt                string // default crypt
+	kdf, salt, kdfParams string
+
+	users     map[string]*User
+	byKeyID   map[[KeyIDSize]byte]*User
+	addrs     map[string]*userAddr
+	sessions  map[string]map[io.Closer]struct{}
+	modTime   time.Time
+	lastSweep time.Time
+	mu        sync.RWMutex
+}
+
+// LoadUsers loads the users file in path, keys are derived with kdf, salt
+// and kdfParams as in DeriveKey, crypt is the cipher of users without one.
+func LoadUsers(path, crypt, kdf, salt, kdfParams string) (*Users, error) {
+	u := &Users{
+		path:      path,
+		crypt:     crypt,
+		kdf:       kdf,
+		salt:      salt,
+		kdfParams: kdfParams,
+		users:     make(map[string]*User),
+		byKeyID:   make(map[[KeyIDSize]byte]*User),
+		addrs:     make(map[string]*userAddr),
+		sessions:  make(map[string]map[io.Closer]struct{}),
+	}
+	if err := u.Reload(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Reload reads the users file again if modified
+func (u *Users) Reload() error {
+	fi, err := os.Stat(u.path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	u.mu.RLock()
+	modified := !fi.ModTime().Equal(u.modTime)
+	u.mu.RUnlock()
+	if !modified {
+		return nil
+	}
+
+	data, err := os.ReadFile(u.path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	var list []*User
+	if err := json.Unmarshal(data, &list); err != nil {
+		return errors.Wrap(err, u.path)
+	}
+
+	users := make(map[string]*User)
+	byKeyID := make(map[[KeyIDSize]byte]*User)
+	for _, user := range list {
+		if user.ID == "" {
+			return errors.Errorf("%v: user without id", u.path)
+		}
+		if _, ok := users[user.ID]; ok {
+			return errors.Errorf("%v: duplicate user %v", u.path, user.ID)
+		}
+		if user.Disabled {
+			continue
+		}
+		if user.Crypt == "" {
+			user.Crypt = u.crypt
+		}
+
+		u.mu.RLock()
+		old := u.users[user.ID]
+		u.mu.RUnlock()
+		if old != nil && old.same(user) { // no need to derive the key again
+			user.pass, user.crypt = old.pass, old.crypt
+		} else if err := u.newCrypt(user); err != nil {
+			return errors.Wrapf(err, "user %v", user.ID)
+		}
+		users[user.ID] = user
+		byKeyID[KeyID(user.ID)] = user
+	}
+
+	var revoked []io.Closer
+	u.mu.Lock()
+	for id, old := range u.users {
+		if user, ok := users[id]; !ok || user.crypt != old.crypt {
+			logAuth.Info("user revoked", "user", id)
+			for s := range u.sessions[id] {
+				revoked = append(revoked, s)
+			}
+			delete(u.sessions, id)
+			for k, a := range u.addrs {
+				if a.id == id {
+					delete(u.addrs, k)
+				}
+			}
+		}
+	}
+	u.users = users
+	u.byKeyID = byKeyID
+	u.modTime = fi.ModTime()
+	u.mu.Unlock()
+
+	for _, s := range revoked {
+		s.Close()
+	}
+	logAuth.Info("users loaded", "users", len(users), "path", u.path)
+	return nil
+}
+
+// newCrypt sets the key and cipher of user
+func (u *Users) newCrypt(user *User) error {
+	var err error
+	if user.RawKey != "" {
+		user.pass, err = DecodeRawKey(user.RawKey)
+	} else {
+		user.pass, err = DeriveKey(user.Key, u.kdf, u.salt, u.kdfParams)
+	}
+	if err != nil {
+		return err
+	}
+	method, block, crypt, err := NewCrypt(user.Crypt, user.pass)
+	if err != nil {
+		return err
+	}
+	user.Crypt = method
+	if crypt == nil {
+		crypt = NewBlockPacketCrypt(block)
+	}
+	user.crypt = crypt
+	return nil
+}
+
+// current reports whether user is not revoked, with u.mu held
+func (u *Users) current(user *User) bool {
+	cur, ok := u.users[user.ID]
+	return ok && cur.crypt == user.crypt
+}
+
+// Watch reloads the users file every interval, until the process exits
+func (u *Users) Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := u.Reload(); err != nil {
+			logAuth.Error("users reload failed", "err", err)
+		}
+	}
+}
+
+// Lookup returns the user last seen at addr, nil if unknown
+func (u *Users) Lookup(addr net.Addr) *User {
+	if caddr, ok := addr.(*ConvAddr); ok {
+		addr = caddr.Addr
+	}
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	if a, ok := u.addrs[addr.String()]; ok {
+		return u.users[a.id]
+	}
+	return nil
+}
+
+// ByID returns the user of id as last loaded, nil if unknown or disabled
+func (u *Users) ByID(id string) *User {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.users[id]
+}
+
+// ByKeyID returns the user of the key id, nil if unknown
+func (u *Users) ByKeyID(id [KeyIDSize]byte) *User {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.byKeyID[id]
+}
+
+// Track registers the session s of user, to be closed if the user is
+// revoked, until untrack is called. Sessions of users already revoked are
+// closed at once.
+func (u *Users) Track(user *User, s io.Closer) (untrack func()) {
+	u.mu.Lock()
+	if !u.current(user) {
+		u.mu.Unlock()
+		s.Close()
+		return func() {}
+	}
+	sessions := u.sessions[user.ID]
+	if sessions == nil {
+		sessions = make(map[io.Closer]struct{})
+		u.sessions[user.ID] = sessions
+	}
+	sessions[s] = struct{}{}
+	u.mu.Unlock()
+
+	return func() {
+		u.mu.Lock()
+		delete(u.sessions[user.ID], s)
+		if len(u.sessions[user.ID]) == 0 {
+			delete(u.sessions, user.ID)
+		}
+		u.mu.Unlock()
+	}
+}
+
+// Seal implements PacketCrypt, packets to addresses of no user fail
+func (u *Users) Seal(dst, p []byte, addr net.Addr) ([]byte, error) {
+	u.mu.RLock()
+	var user *User
+	if a, ok := u.addrs[addr.String()]; ok {
+		user = u.users[a.id]
+	}
+	u.mu.RUnlock()
+	if user == nil {
+		return nil, errors.Wrap(errUnknownKey, addr.String())
+	}
+	return user.crypt.Seal(dst, p, addr)
+}
+
+// Open implements PacketCrypt
+func (u *Users) Open(dst, p []byte, addr net.Addr) ([]byte, error) {
+	if len(p) < KeyIDSize {
+		return nil, errors.WithStack(errUnknownKey)
+	}
+	var id [KeyIDSize]byte
+	copy(id[:], p)
+	user := u.ByKeyID(id)
+	if user == nil {
+		return nil, errors.WithStack(errUnknownKey)
+	}
+
+	dst, err := user.crypt.Open(dst, p[KeyIDSize:], addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// remember the user at addr, only authenticated packets move an address
+	now := time.Now()
+	key := addr.String()
+	u.mu.RLock()
+	a, ok := u.addrs[key]
+	fresh := ok && a.id == user.ID && now.Sub(a.seen) < time.Second
+	u.mu.RUnlock()
+	if !fresh {
+		u.mu.Lock()
+		if u.current(user) { // not revoked meanwhile
+			u.addrs[key] = &userAddr{user.ID, now}
+		}
+		if now.Sub(u.lastSweep) > userExpire {
+			for k, a := range u.addrs {
+				if now.Sub(a.seen) > userExpire {
+					delete(u.addrs, k)
+				}
+			}
+			u.lastSweep = now
+		}
+		u.mu.Unlock()
+	}
+	return dst, nil
+}
+
+// Overhead returns the largest overhead of the ciphers of the users
+func (u *Users) Overhead() int {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	overhead := 0
+	for _, user := range u.users {
+		if n := user.Overhead(); n > overhead {
+			overhead = n
+		}
+	}
+	return overhead
+}
@@ -0,0 +1,125 @@
+package generic
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type closeFlag bool
+
+func (c *closeFlag) Close() error {
+	*c = true
+	return nil
+}
+
+func TestUsers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	write := func(data string, mtime time.Time) {
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, mtime, mtime)
+	}
+	now := time.Now()
+	write(`[
+		{"id": "alice", "key": "alice's key", "crypt": "aes-gcm", "targets": ["127.0.0.1:22"]},
+		{"id": "bob", "key": "bob's key"},
+		{"id": "carol", "key": "carol's key", "disabled": true}
+	]`, now)
+
+	users, err := LoadUsers(path, "salsa20", "pbkdf2", "kcp-go", "iter=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := func(id, key, crypt string) PacketCrypt {
+		pass, _ := DeriveKey(key, "pbkdf2", "kcp-go", "iter=1")
+		_, block, aead, err := NewCrypt(crypt, pass)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if aead == nil {
+			aead = NewBlockPacketCrypt(block)
+		}
+		return NewKeyIDCrypt(id, aead)
+	}
+	alice := client("alice", "alice's key", "aes-gcm")
+	bob := client("bob", "bob's key", "salsa20")
+	carol := client("carol", "carol's key", "salsa20")
+
+	data := []byte("hello")
+	for _, c := range []PacketCrypt{alice, bob} {
+		p, _ := c.Seal(nil, data, testAddr)
+		got, err := users.Open(nil, p, testAddr)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatal("open failed", err)
+		}
+		reply, err := users.Seal(nil, data, testAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := c.Open(nil, reply, testAddr); err != nil || !bytes.Equal(got, data) {
+			t.Fatal("reply failed", err)
+		}
+	}
+	if user := users.Lookup(testAddr); user == nil || user.ID != "bob" {
+		t.Fatal("bob not found at the address")
+	}
+	p, _ := carol.Seal(nil, data, testAddr)
+	if _, err := users.Open(nil, p, testAddr); err == nil {
+		t.Fatal("disabled user accepted")
+	}
+	if users.Overhead() != aeadHeaderSize+16 {
+		t.Fatal("unexpected overhead", users.Overhead())
+	}
+
+	user := users.Lookup(testAddr)
+	if !user.Allowed("127.0.0.1:80") {
+		t.Fatal("bob may connect to any target")
+	}
+	if alice := users.ByKeyID(KeyID("alice")); alice.Allowed("127.0.0.1:80") || !alice.Allowed("127.0.0.1:22") {
+		t.Fatal("alice may connect to their targets only")
+	}
+	var closed closeFlag
+	untrack := users.Track(user, &closed)
+	defer untrack()
+
+	// unchanged users keep their sessions
+	write(`[{"id": "bob", "key": "bob's key"}, {"id": "alice", "key": "alice's key", "crypt": "aes-gcm"}]`, now.Add(time.Second))
+	if err := users.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if closed {
+		t.Fatal("session of an unchanged user closed")
+	}
+	if alice := users.ByID("alice"); alice == nil || !alice.Allowed("127.0.0.1:80") {
+		t.Fatal("targets of alice not reloaded")
+	}
+
+	// bob is revoked by a new key
+	write(`[{"id": "bob", "key": "bob's new key"}]`, now.Add(2*time.Second))
+	if err := users.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !closed {
+		t.Fatal("session of a revoked user not closed")
+	}
+	if users.Lookup(testAddr) != nil {
+		t.Fatal("revoked user still found")
+	}
+	if _, err := users.Seal(nil, data, testAddr); err == nil {
+		t.Fatal("sealed for a revoked user")
+	}
+	p, _ = bob.Seal(nil, data, testAddr)
+	if _, err := users.Open(nil, p, testAddr); err == nil {
+		t.Fatal("old key accepted")
+	}
+
+	write(`[{"id": "bob"}, {"id": "bob"}]`, now.Add(3*time.Second))
+	if err := users.Reload(); err == nil {
+		t.Fatal("duplicate users accepted")
+	}
+}
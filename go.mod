@@ -2,12 +2,15 @@ module github.com/xtaci/kcptun
 
 require (
 	github.com/golang/snappy v0.0.4
+	github.com/klauspost/reedsolomon v1.11.6
 	github.com/pkg/errors v0.9.1
 	github.com/urfave/cli v1.22.12
 	github.com/xtaci/kcp-go/v5 v5.6.2
 	github.com/xtaci/smux v1.5.24
 	github.com/xtaci/tcpraw v1.2.25
 	golang.org/x/crypto v0.5.0
+	golang.org/x/net v0.7.0
+	golang.org/x/sys v0.5.0
 )
 
 require (
@@ -15,13 +18,10 @@ require (
 	github.com/cpuguy83/go-md2man/v2 v2.0.2 // indirect
 	github.com/google/gopacket v1.1.19 // indirect
 	github.com/klauspost/cpuid/v2 v2.2.3 // indirect
-	github.com/klauspost/reedsolomon v1.11.6 // indirect
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
 	github.com/templexxx/cpu v0.1.0 // indirect
 	github.com/templexxx/xorsimd v0.4.2 // indirect
 	github.com/tjfoc/gmsm v1.4.1 // indirect
-	golang.org/x/net v0.7.0 // indirect
-	golang.org/x/sys v0.5.0 // indirect
 )
 
 go 1.17
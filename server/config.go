@@ -7,34 +7,94 @@ import (
 
 // Config for server
 type Config struct {
-	Listen       string `json:"listen"`
-	Target       string `json:"target"`
-	Key          string `json:"key"`
-	Crypt        string `json:"crypt"`
-	Mode         string `json:"mode"`
-	MTU          int    `json:"mtu"`
-	SndWnd       int    `json:"sndwnd"`
-	RcvWnd       int    `json:"rcvwnd"`
-	DataShard    int    `json:"datashard"`
-	ParityShard  int    `json:"parityshard"`
-	DSCP         int    `json:"dscp"`
-	NoComp       bool   `json:"nocomp"`
-	AckNodelay   bool   `json:"acknodelay"`
-	NoDelay      int    `json:"nodelay"`
-	Interval     int    `json:"interval"`
-	Resend       int    `json:"resend"`
-	NoCongestion int    `json:"nc"`
-	SockBuf      int    `json:"sockbuf"`
-	SmuxBuf      int    `json:"smuxbuf"`
-	StreamBuf    int    `json:"streambuf"`
-	SmuxVer      int    `json:"smuxver"`
-	KeepAlive    int    `json:"keepalive"`
-	Log          string `json:"log"`
-	SnmpLog      string `json:"snmplog"`
-	SnmpPeriod   int    `json:"snmpperiod"`
-	Pprof        bool   `json:"pprof"`
-	Quiet        bool   `json:"quiet"`
-	TCP          bool   `json:"tcp"`
+	Listen          string            `json:"listen"`
+	Target          string            `json:"target"`
+	Routes          map[string]string `json:"routes"`
+	Key             string            `json:"key"`
+	KDF             string            `json:"kdf"`
+	KDFSalt         string            `json:"kdfsalt"`
+	KDFParams       string            `json:"kdfparams"`
+	RawKey          string            `json:"rawkey"`
+	PrevKey         string            `json:"prevkey"`
+	PrevRawKey      string            `json:"prevrawkey"`
+	PrevCrypt       string            `json:"prevcrypt"`
+	KeyGrace        int               `json:"keygrace"`
+	Users           string            `json:"users"`
+	Crypt           string            `json:"crypt"`
+	Mode            string            `json:"mode"`
+	MTU             int               `json:"mtu"`
+	SndWnd          int               `json:"sndwnd"`
+	RcvWnd          int               `json:"rcvwnd"`
+	DataShard       int               `json:"datashard"`
+	ParityShard     int               `json:"parityshard"`
+	DSCP            int               `json:"dscp"`
+	NoComp          bool              `json:"nocomp"`
+	AckNodelay      bool              `json:"acknodelay"`
+	NoDelay         int               `json:"nodelay"`
+	Interval        int               `json:"interval"`
+	Resend          int               `json:"resend"`
+	NoCongestion    int               `json:"nc"`
+	SockBuf         int               `json:"sockbuf"`
+	SmuxBuf         int               `json:"smuxbuf"`
+	StreamBuf       int               `json:"streambuf"`
+	SmuxVer         int               `json:"smuxver"`
+	KeepAlive       int               `json:"keepalive"`
+	Log             string            `json:"log"`
+	LogFormat       string            `json:"logformat"`
+	LogLevel        string            `json:"loglevel"`
+	LogMaxSize      int               `json:"logmaxsize"`
+	LogKeep         int               `json:"logkeep"`
+	AccessLog       string            `json:"accesslog"`
+	AccessLogFormat string            `json:"accesslogformat"`
+	AccessLogSample float64           `json:"accesslogsample"`
+	Hooks           []string          `json:"hooks"`
+	HookRate        float64           `json:"hookrate"`
+	HookTimeout     int               `json:"hooktimeout"`
+	AlertLoss       float64           `json:"alertloss"`
+	AlertRTT        int               `json:"alertrtt"`
+	AlertFEC        float64           `json:"alertfec"`
+	AlertPeriod     int               `json:"alertperiod"`
+	Capture         string            `json:"capture"`
+	CaptureSize     int               `json:"capturesize"`
+	CaptureDuration int               `json:"captureduration"`
+	CaptureSmux     bool              `json:"capturesmux"`
+	SnmpLog         string            `json:"snmplog"`
+	SnmpPeriod      int               `json:"snmpperiod"`
+	SnmpFormat      string            `json:"snmpformat"`
+	SnmpDelta       bool              `json:"snmpdelta"`
+	SnmpKeep        int               `json:"snmpkeep"`
+	SnmpMaxSize     int               `json:"snmpmaxsize"`
+	Metrics         string            `json:"metrics"`
+	SessionStats    bool              `json:"sessionstats"`
+	Admin           string            `json:"admin"`
+	AdminToken      string            `json:"admintoken"`
+	Pprof           bool              `json:"pprof"`
+	Quiet           bool              `json:"quiet"`
+	TCP             bool              `json:"tcp"`
+	Downlink        string            `json:"downlink"`
+	ByConv          bool              `json:"byconv"`
+	Pacing          bool              `json:"pacing"`
+	PaceRate        int               `json:"pacerate"`
+	PaceBurst       int               `json:"paceburst"`
+	NetemOut        string            `json:"netemout"`
+	NetemIn         string            `json:"netemin"`
+	NetemSeed       int64             `json:"netemseed"`
+	Handshake       bool              `json:"handshake"`
+	HandshakeKey    string            `json:"handshakekey"`
+	RekeyVolume     int               `json:"rekeyvolume"`
+	RekeyPeriod     int               `json:"rekeyperiod"`
+	OperatorPub     string            `json:"operatorpub"`
+	Revoked         string            `json:"revoked"`
+	Classes         string            `json:"classes"`
+	AntiProbe       bool              `json:"antiprobe"`
+	Allow           []string          `json:"allow"`
+	Deny            []string          `json:"deny"`
+	AutoBan         string            `json:"autoban"`
+	BanTime         int               `json:"bantime"`
+	BanMax          int               `json:"banmax"`
+	BanHook         string            `json:"banhook"`
+	Knock           string            `json:"knock"`
+	KnockTTL        int               `json:"knockttl"`
 }
 
 func parseJSONConfig(config *Config, path string) error {
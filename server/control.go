@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/xtaci/kcptun/generic"
+)
+
+// route is a route as added through the admin API
+type route struct {
+	Name   string `json:"name"`
+	Target string `json:"target"`
+}
+
+// routesHandler serves GET /routes listing the routes, POST /routes adding
+// or changing a route, and DELETE /routes?name=NAME removing it, the
+// default route named "" being the target.
+func routesHandler(routes *generic.Routes) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var rt route
+			if err := json.NewDecoder(r.Body).Decode(&rt); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := routes.Set(rt.Name, rt.Target); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			logRoute.Info("route set", "route", rt.Name, "target", rt.Target)
+		case http.MethodDelete:
+			name := r.URL.Query().Get("name")
+			if err := routes.Delete(name); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			logRoute.Info("route removed", "route", name)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(routes.List())
+	})
+}
+
+// saveHandler serves POST /config/save, saving the routes to the config file at path
+func saveHandler(routes *generic.Routes, path string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		list := routes.List()
+		target := list[""]
+		delete(list, "")
+		if err := generic.SaveJSONConfig(path, map[string]interface{}{"target": target, "routes": list}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logAdmin.Info("config saved", "path", path)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"saved": path})
+	})
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"github.com/xtaci/kcptun/generic"
+)
+
+// credentialCommands are the commands of the operator to manage the
+// credentials of clients, see --operatorpub.
+func credentialCommands() []cli.Command {
+	return []cli.Command{
+		{
+			Name:  "issue",
+			Usage: "issue a credential signed by the operator key",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "operatorkey",
+					Value: "operator.key",
+					Usage: "file of the operator private key, created if absent",
+				},
+				cli.StringFlag{
+					Name:  "user",
+					Usage: "user id of the credential",
+				},
+				cli.DurationFlag{
+					Name:  "expire",
+					Value: 30 * 24 * time.Hour,
+					Usage: "validity of the credential",
+				},
+				cli.StringSliceFlag{
+					Name:  "target",
+					Usage: "target the credential allows, repeatable, any if none",
+				},
+				cli.StringFlag{
+					Name:  "class",
+					Usage: "bandwidth class of the credential, see --classes",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if c.String("user") == "" {
+					return errors.New("--user is required")
+				}
+				key, err := generic.LoadOperatorKey(c.String("operatorkey"))
+				if err != nil {
+					return err
+				}
+				cred := &generic.Credential{
+					User:    c.String("user"),
+					Expires: time.Now().Add(c.Duration("expire")).Unix(),
+					Targets: c.StringSlice("target"),
+					Class:   c.String("class"),
+				}
+				s, err := generic.IssueCredential(key, cred)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(os.Stderr, "operatorpub:", base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)))
+				fmt.Fprintln(os.Stderr, "id:", cred.ID, "expires:", cred.Expiry())
+				fmt.Println(s)
+				return nil
+			},
+		},
+		{
+			Name:      "inspect",
+			Usage:     "print the content of a credential, and verify it with --operatorpub",
+			ArgsUsage: "credential",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "operatorpub",
+					Usage: "public key of the operator, base64 encoded",
+				},
+				cli.StringFlag{
+					Name:  "revoked",
+					Usage: "file of the revoked credential ids",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				cred, _, _, err := generic.ParseCredential(c.Args().First())
+				if err != nil {
+					return err
+				}
+				out, _ := json.MarshalIndent(cred, "", "  ")
+				fmt.Println(string(out))
+				fmt.Println("expires:", cred.Expiry())
+
+				if c.String("operatorpub") == "" {
+					fmt.Println("status: not verified")
+					return nil
+				}
+				pub, err := generic.DecodeOperatorKey(c.String("operatorpub"))
+				if err != nil {
+					return err
+				}
+				v, err := generic.NewCredentialVerifier(pub, c.String("revoked"))
+				if err != nil {
+					return err
+				}
+				if _, err := v.Verify(c.Args().First()); err != nil {
+					fmt.Println("status:", err)
+				} else {
+					fmt.Println("status: valid")
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "revoke",
+			Usage:     "add a credential to the revocation list",
+			ArgsUsage: "credential|id",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "revoked",
+					Value: "revoked.txt",
+					Usage: "file of the revoked credential ids",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				id, comment := c.Args().First(), ""
+				if id == "" {
+					return errors.New("no credential given")
+				}
+				if cred, _, _, err := generic.ParseCredential(id); err == nil {
+					id, comment = cred.ID, "user "+cred.User
+				}
+				if err := generic.RevokeCredential(c.String("revoked"), id, comment); err != nil {
+					return err
+				}
+				fmt.Println("revoked:", id)
+				return nil
+			},
+		},
+	}
+}
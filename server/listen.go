@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/kcptun/generic"
+	"github.com/xtaci/tcpraw"
+)
+
+// stack is how packets are processed beneath the KCP listener
+type stack struct {
+	block    kcp.BlockCrypt
+	crypt    generic.PacketCrypt        // nil if only block encrypts
+	probeKey func(addr net.Addr) []byte // key of the tokens, nil without --antiprobe
+	knocker  *generic.Knocker           // admits the addresses of the raw sockets, nil without --knock
+	banner   *generic.Banner            // bans the sources of failures, nil without --autoban
+	acl      *generic.ACL               // sources allowed, nil without --allow or --deny
+	roam     bool                       // packets are authenticated, their conversations may change address
+}
+
+// listenConv listens on the udp stack of addr, plus the tcp(emulated) stack
+// with --tcp or --downlink, sessions are identified by KCP conversation
+// instead of remote address, so clients may share one socket among
+// sessions, or send and receive over different transports.
+func listenConv(addr string, st *stack, config *Config) (*kcp.Listener, *generic.PacedConn, error) {
+	prefer := -1
+	switch config.Downlink {
+	case "":
+	case "udp":
+		prefer = 0
+	case "tcp":
+		prefer = 1
+	default:
+		return nil, nil, errors.Errorf("unknown transport: %v", config.Downlink)
+	}
+
+	udpconn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	conns := []net.PacketConn{st.raw(udpconn)}
+
+	if config.TCP || config.Downlink != "" {
+		tcpconn, err := tcpraw.Listen("tcp", addr)
+		if err != nil {
+			udpconn.Close()
+			return nil, nil, errors.Wrap(err, "tcpraw.Listen()")
+		}
+		conns = append(conns, st.raw(tcpconn))
+	}
+
+	conn := generic.NewConvConn(st.block, prefer, config.DataShard, config.ParityShard, conns...)
+	conn.SetRoaming(st.roam)
+	return serve(conn, st, config)
+}
+
+// listenUDP listens on the udp stack of addr
+func listenUDP(addr string, st *stack, config *Config) (*kcp.Listener, *generic.PacedConn, error) {
+	udpaddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	conn, err := net.ListenUDP("udp", udpaddr)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	return serve(st.raw(conn), st, config)
+}
+
+// raw wraps the raw socket conn to drop the packets of sources denied,
+// banned, or not admitted by a knock, and to encrypt packets with crypt, if
+// configured
+func (st *stack) raw(conn net.PacketConn) net.PacketConn {
+	if st.acl != nil {
+		conn = st.acl.Gate(conn)
+	}
+	if st.banner != nil {
+		conn = st.banner.Gate(conn)
+	}
+	if st.knocker != nil {
+		conn = st.knocker.Gate(conn)
+	}
+	if st.crypt == nil {
+		return conn
+	}
+	if st.banner != nil {
+		return st.banner.Check(generic.NewCryptConn(conn, st.banner.Crypt(st.crypt)))
+	}
+	return generic.NewCryptConn(conn, st.crypt)
+}
+
+// serve creates a listener over conn, with the network impairments
+// emulated, probes rejected, and through a pacer if configured, the pacer
+// is nil otherwise.
+func serve(conn net.PacketConn, st *stack, config *Config) (*kcp.Listener, *generic.PacedConn, error) {
+	out, in, err := impairments(config)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if out != nil || in != nil {
+		conn = generic.NewNetemConn(conn, out, in, config.NetemSeed)
+	}
+	if st.probeKey != nil {
+		conn = generic.NewProbeGuard(conn, st.probeKey)
+	}
+
+	var pacer *generic.PacedConn
+	if config.Pacing {
+		pacer = generic.NewPacedConn(conn, config.PaceRate, config.PaceBurst)
+		conn = pacer
+	}
+	if config.SessionStats {
+		conn = generic.NewPacketStatsConn(conn, config.DataShard, config.ParityShard)
+	}
+	if capture != nil {
+		conn = capture.Conn(conn)
+	}
+
+	lis, err := kcp.ServeConn(st.block, config.DataShard, config.ParityShard, conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return lis, pacer, nil
+}
+
+// impairments parses the emulated network impairments, nil if not configured
+func impairments(config *Config) (out, in *generic.Impairment, err error) {
+	if config.NetemOut != "" {
+		if out, err = generic.ParseImpairment(config.NetemOut); err != nil {
+			return nil, nil, err
+		}
+	}
+	if config.NetemIn != "" {
+		if in, err = generic.ParseImpairment(config.NetemIn); err != nil {
+			return nil, nil, err
+		}
+	}
+	return out, in, nil
+}
@@ -1,20 +1,18 @@
 package main
 
 import (
-	"crypto/sha1"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"log"
 	"math/rand"
 	"net"
 	"net/http"
-	_ "net/http/pprof"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"golang.org/x/crypto/pbkdf2"
-
 	"github.com/urfave/cli"
 	kcp "github.com/xtaci/kcp-go/v5"
 	"github.com/xtaci/kcptun/generic"
@@ -23,25 +21,149 @@ import (
 )
 
 const (
-	// SALT is use for pbkdf2 key expansion
+	// SALT is the default salt of the key derivation
 	SALT = "kcp-go"
 	// maximum supported smux version
 	maxSmuxVer = 2
 	// stream copy buffer size
 	bufSize = 4096
+	// how often the users file, revocation list and acl files are checked for changes
+	reloadPeriod = 5 * time.Second
 )
 
 // VERSION is injected by buildflags
 var VERSION = "SELFBUILD"
 
-// handle multiplex-ed connection
-func handleMux(conn net.Conn, config *Config) {
-	// check if target is unix domain socket
-	var isUnix bool
-	if _, _, err := net.SplitHostPort(config.Target); err != nil {
-		isUnix = true
+// sessionAuth is how sessions are authenticated, beyond the packet
+// encryption, and routed
+type sessionAuth struct {
+	handshake *generic.HandshakeConfig    // nil without --handshake
+	users     *generic.Users              // nil without --users
+	creds     *generic.CredentialVerifier // nil without --operatorpub
+	classes   map[string]int              // rates of the bandwidth classes
+	banner    *generic.Banner             // nil without --autoban
+	routes    *generic.Routes             // targets by route name
+}
+
+// the loggers of the components of the server
+var (
+	logSession = generic.NewLogger("session")
+	logStream  = generic.NewLogger("stream")
+	logRoute   = generic.NewLogger("route")
+	logAdmin   = generic.NewLogger("admin")
+)
+
+// accessLog logs a record of every stream, if enabled
+var accessLog *generic.AccessLog
+
+// capture records the plaintext of the tunnel, if enabled
+var capture *generic.Capture
+
+// handleSession establishes the session keys and verifies the credential
+// of the client if configured, then serves the multiplexed connection to
+// the target of its route, user is nil without a users file, psk is the key
+// of the session if not the key of the handshake.
+func handleSession(conn net.Conn, config *Config, auth *sessionAuth, user *generic.User, psk []byte) {
+	raddr := conn.RemoteAddr()
+	var stats *generic.SessionStats
+	var conv uint32
+	if s, ok := conn.(*kcp.UDPSession); ok {
+		conv = s.GetConv()
+		stats = generic.TrackSession(s, s.LocalAddr().String())
+		defer stats.Close()
+		conn = stats.Conn(conn)
 	}
-	log.Println("smux version:", config.SmuxVer, "on connection:", conn.LocalAddr(), "->", conn.RemoteAddr())
+	if user != nil { // closed if the user is revoked
+		defer auth.users.Track(user, conn)()
+	}
+	slog := logSession.With("session", stats.ID(), "remote", conn.RemoteAddr(), "local", conn.LocalAddr())
+
+	if handshake := auth.handshake; handshake != nil {
+		if psk != nil {
+			h := *handshake
+			h.PSK = psk
+			handshake = &h
+		}
+		secure, err := handshake.Server(conn)
+		if err != nil {
+			slog.Warn("handshake failed", "err", err)
+			conn.Close()
+			return
+		}
+		conn = secure
+	}
+
+	var cred *generic.Credential
+	if auth.creds != nil {
+		var err error
+		cred, err = auth.creds.AcceptCredential(conn)
+		if err != nil {
+			slog.Warn("credential refused", "err", err)
+			conn.Close()
+			return
+		}
+		rate, ok := auth.classes[cred.Class]
+		if !ok && cred.Class != "" {
+			slog.Warn("unknown bandwidth class", "credential", cred.ID, "class", cred.Class)
+			conn.Close()
+			return
+		}
+		slog.Info("credential accepted", "credential", cred.ID, "user", cred.User, "class", cred.Class)
+		defer auth.creds.Track(cred, conn)()
+		if rate > 0 {
+			conn = generic.NewLimitConn(conn, rate)
+		}
+	}
+
+	if !config.NoComp {
+		comp := generic.NewCompStream(conn)
+		if stats != nil {
+			stats.SetComp(comp)
+		}
+		conn = comp
+	}
+
+	routed, route, err := generic.ReadRoute(conn, smux.DefaultConfig().KeepAliveTimeout)
+	if err != nil {
+		slog.Warn("route failed", "err", err)
+		conn.Close()
+		return
+	}
+	conn = routed
+	if _, ok := auth.routes.Target(route); !ok {
+		slog.Warn("unknown route", "route", route)
+	}
+	// the target of each stream, as routed when it is opened, the streams
+	// being refused while the route is unknown, or to a target the user, as
+	// last reloaded, or the credential may not connect to
+	target := func() (string, string) {
+		target, ok := auth.routes.Target(route)
+		if !ok {
+			return route, generic.EndNoRoute
+		}
+		if user != nil {
+			if cur := auth.users.ByID(user.ID); cur == nil || !cur.Allowed(target) {
+				return target, generic.EndDenied
+			}
+		}
+		if cred != nil && !cred.Allowed(target) {
+			return target, generic.EndDenied
+		}
+		return target, ""
+	}
+	err = handleMux(capture.Stream(conn, conv), config, target, stats, route)
+	if auth.banner != nil && err == smux.ErrInvalidProtocol {
+		auth.banner.Fail(raddr, generic.BanSmux)
+	}
+}
+
+// handle multiplex-ed connection, until the error ending it, target is
+// the target of each stream, with the reason it is refused if it is, stats
+// is nil if the session is not a kcp.UDPSession
+func handleMux(conn net.Conn, config *Config, target func() (string, string), stats *generic.SessionStats, route string) error {
+	slog := logSession.With("session", stats.ID(), "remote", conn.RemoteAddr(), "local", conn.LocalAddr())
+	stlog := logStream.With("session", stats.ID(), "remote", conn.RemoteAddr(), "local", conn.LocalAddr())
+	slog.Info("session opened", "smux", config.SmuxVer, "route", route)
 
 	// stream multiplex
 	smuxConfig := smux.DefaultConfig()
@@ -52,63 +174,99 @@ func handleMux(conn net.Conn, config *Config) {
 
 	mux, err := smux.Server(conn, smuxConfig)
 	if err != nil {
-		log.Println(err)
-		return
+		slog.Error("smux failed", "err", err)
+		return err
 	}
 	defer mux.Close()
+	if stats != nil {
+		stats.SetCloser(mux)
+	}
 
 	for {
 		stream, err := mux.AcceptStream()
 		if err != nil {
-			log.Println(err)
-			return
+			slog.Info("session closed", "err", err)
+			return err
 		}
 
 		go func(p1 *smux.Stream) {
+			record := &generic.AccessRecord{Start: time.Now(), Session: stats.ID(), Stream: p1.ID(), Source: conn.RemoteAddr().String()}
+			target, refused := target()
+			if refused != "" {
+				stlog.Warn("stream refused", "stream", p1.ID(), "route", route, "target", target, "reason", refused)
+				record.Target, record.End = target, refused
+				accessLog.Log(record)
+				p1.Close()
+				return
+			}
+			record.Target = target
+
+			// check if target is unix domain socket
+			var isUnix bool
+			if _, _, err := net.SplitHostPort(target); err != nil {
+				isUnix = true
+			}
 			var p2 net.Conn
 			var err error
 			if !isUnix {
-				p2, err = net.Dial("tcp", config.Target)
+				p2, err = net.Dial("tcp", target)
 			} else {
-				p2, err = net.Dial("unix", config.Target)
+				p2, err = net.Dial("unix", target)
 			}
 
 			if err != nil {
-				log.Println(err)
+				stlog.Warn("target unreachable", "stream", p1.ID(), "target", target, "err", err)
+				record.End = generic.EndDialError
+				accessLog.Log(record)
 				p1.Close()
 				return
 			}
-			handleClient(p1, p2, config.Quiet)
+			handleClient(p1, p2, stats, stlog.With("stream", p1.ID(), "target", target), record)
 		}(stream)
 	}
 }
 
-func handleClient(p1 *smux.Stream, p2 net.Conn, quiet bool) {
-	logln := func(v ...interface{}) {
-		if !quiet {
-			log.Println(v...)
-		}
-	}
-
+// handleClient forwards the stream p1 to p2, logged by stlog, and in the
+// access log with record once both are closed
+func handleClient(p1 *smux.Stream, p2 net.Conn, stats *generic.SessionStats, stlog *generic.Logger, record *generic.AccessRecord) {
 	defer p1.Close()
 	defer p2.Close()
 
-	logln("stream opened", "in:", fmt.Sprint(p1.RemoteAddr(), "(", p1.ID(), ")"), "out:", p2.RemoteAddr())
-	defer logln("stream closed", "in:", fmt.Sprint(p1.RemoteAddr(), "(", p1.ID(), ")"), "out:", p2.RemoteAddr())
+	stlog.Info("stream opened")
+	defer stlog.Info("stream closed")
 
-	// start tunnel & wait for tunnel termination
-	streamCopy := func(dst io.Writer, src io.ReadCloser) {
-		if _, err := generic.Copy(dst, src); err != nil {
-			if err == smux.ErrInvalidProtocol {
-				log.Println("smux", err, "in:", fmt.Sprint(p1.RemoteAddr(), "(", p1.ID(), ")"), "out:", p2.RemoteAddr())
-			}
+	// start tunnel & wait for tunnel termination, the first copy ending
+	// telling how the stream ended
+	var ended sync.Once
+	streamCopy := func(dst io.Writer, src io.ReadCloser, written *int64) {
+		n, err := generic.Copy(dst, src)
+		if err == smux.ErrInvalidProtocol {
+			stlog.Warn("smux failed", "err", err)
 		}
+		*written = n
+		ended.Do(func() { record.End = generic.EndReason(src == p2, err) })
 		p1.Close()
 		p2.Close()
 	}
 
-	go streamCopy(p2, p1)
-	streamCopy(p1, p2)
+	var in, out io.Writer = p2, p1
+	if stats != nil {
+		ss := stats.OpenStream(p1.ID(), p1)
+		defer ss.Close()
+		in, out = ss.In(p2), ss.Out(p1)
+	} else {
+		atomic.AddUint64(&generic.DefaultSnmp.StreamsOpened, 1)
+		defer atomic.AddUint64(&generic.DefaultSnmp.StreamsClosed, 1)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		streamCopy(in, p1, &record.BytesIn)
+		close(done)
+	}()
+	streamCopy(out, p2, &record.BytesOut)
+	<-done
+	accessLog.Log(record)
 }
 
 func checkError(err error) {
@@ -120,10 +278,6 @@ func checkError(err error) {
 
 func main() {
 	rand.Seed(int64(time.Now().Nanosecond()))
-	if VERSION == "SELFBUILD" {
-		// add more log flags for debugging
-		log.SetFlags(log.LstdFlags | log.Lshortfile)
-	}
 
 	myApp := cli.NewApp()
 	myApp.Name = "kcptun"
@@ -140,16 +294,68 @@ func main() {
 			Value: "127.0.0.1:12948",
 			Usage: "target server address, or path/to/unix_socket",
 		},
+		cli.StringSliceFlag{
+			Name:  "route",
+			Usage: `target of the sessions of clients forwarding with a route name, eg: "ssh=127.0.0.1:22", the target being the default route`,
+		},
 		cli.StringFlag{
 			Name:   "key",
 			Value:  "it's a secrect",
 			Usage:  "pre-shared secret between client and server",
 			EnvVar: "KCPTUN_KEY",
 		},
+		cli.StringFlag{
+			Name:  "kdf",
+			Value: "pbkdf2",
+			Usage: "key derivation function: pbkdf2, argon2id, scrypt",
+		},
+		cli.StringFlag{
+			Name:  "kdfsalt",
+			Value: SALT,
+			Usage: "salt of the key derivation, set a deployment-specific one",
+		},
+		cli.StringFlag{
+			Name:  "kdfparams",
+			Value: "",
+			Usage: `cost of the key derivation, eg: "iter=4096" for pbkdf2, "t=3,m=65536,p=4" for argon2id(m in KiB), "n=32768,r=8,p=1" for scrypt`,
+		},
+		cli.StringFlag{
+			Name:   "rawkey",
+			Value:  "",
+			Usage:  "hex encoded 256-bit key used as is, instead of deriving one from --key",
+			EnvVar: "KCPTUN_RAWKEY",
+		},
+		cli.StringFlag{
+			Name:   "prevkey",
+			Value:  "",
+			Usage:  "previous pre-shared secret, still accepted during --keygrace while clients move to --key",
+			EnvVar: "KCPTUN_PREVKEY",
+		},
+		cli.StringFlag{
+			Name:   "prevrawkey",
+			Value:  "",
+			Usage:  "previous raw key, instead of --prevkey",
+			EnvVar: "KCPTUN_PREVRAWKEY",
+		},
+		cli.StringFlag{
+			Name:  "prevcrypt",
+			Value: "",
+			Usage: "crypt of the previous key, the same as --crypt if empty",
+		},
+		cli.IntFlag{
+			Name:  "keygrace",
+			Value: 86400,
+			Usage: "seconds the previous key is accepted after the start, 0 for ever",
+		},
+		cli.StringFlag{
+			Name:  "users",
+			Value: "",
+			Usage: `file of the users with their own key, eg: [{"id":"alice","key":"...","crypt":"aes-gcm","targets":["127.0.0.1:22"]}], reloaded when modified`,
+		},
 		cli.StringFlag{
 			Name:  "crypt",
 			Value: "aes",
-			Usage: "aes, aes-128, aes-192, salsa20, blowfish, twofish, cast5, 3des, tea, xtea, xor, sm4, none, null",
+			Usage: "aes, aes-128, aes-192, salsa20, blowfish, twofish, cast5, 3des, tea, xtea, xor, sm4, none, null, or aes-gcm, chacha20-poly1305 to authenticate every packet, the clocks must be in sync",
 		},
 		cli.StringFlag{
 			Name:  "mode",
@@ -250,34 +456,317 @@ func main() {
 			Value: 60,
 			Usage: "snmp collect period, in seconds",
 		},
+		cli.StringFlag{
+			Name:  "snmpformat",
+			Value: "csv",
+			Usage: "format of the snmp log: csv, jsonl",
+		},
+		cli.BoolFlag{
+			Name:  "snmpdelta",
+			Usage: "log the counters of each period with throughput, loss, retransmit and FEC recovery ratios, instead of cumulative counters",
+		},
+		cli.IntFlag{
+			Name:  "snmpkeep",
+			Value: 0,
+			Usage: "number of time formatted snmp log files kept, 0 to keep all",
+		},
+		cli.IntFlag{
+			Name:  "snmpmaxsize",
+			Value: 0,
+			Usage: "total size of the snmp log files kept, in MB, 0 for no limit",
+		},
 		cli.BoolFlag{
 			Name:  "pprof",
-			Usage: "start profiling server on :6060",
+			Usage: "expose the profiles of net/http/pprof on the admin API",
 		},
 		cli.StringFlag{
 			Name:  "log",
 			Value: "",
-			Usage: "specify a log file to output, default goes to stderr",
+			Usage: `specify a log file to output, reopened on SIGHUP, or "syslog" or "journald", default goes to stderr`,
+		},
+		cli.StringFlag{
+			Name:  "logformat",
+			Value: "text",
+			Usage: "format of the logs, text or json",
+		},
+		cli.StringFlag{
+			Name:  "loglevel",
+			Value: "info",
+			Usage: `level of the logs, debug, info, warn or error, then of some components, eg: "info,session=debug,stream=warn"`,
+		},
+		cli.IntFlag{
+			Name:  "logmaxsize",
+			Value: 0,
+			Usage: "size in MB of the log file and the access log before they are rotated, never if 0",
+		},
+		cli.IntFlag{
+			Name:  "logkeep",
+			Value: 5,
+			Usage: "number of the rotated log files kept",
+		},
+		cli.StringFlag{
+			Name:  "accesslog",
+			Value: "",
+			Usage: `file of the access log, a record of every stream, reopened on SIGHUP, "-" for stdout`,
+		},
+		cli.StringFlag{
+			Name:  "accesslogformat",
+			Value: "text",
+			Usage: "format of the access log, text, json, or a template of the fields {start} {duration} {session} {stream} {source} {target} {bytesin} {bytesout} {end}",
+		},
+		cli.Float64Flag{
+			Name:  "accesslogsample",
+			Value: 1,
+			Usage: "share of the streams in the access log, those ending on an error always are",
+		},
+		cli.StringSliceFlag{
+			Name:  "hook",
+			Usage: `script run, or http(s) URL posted, with a JSON event on session_open, session_close, reconnect, ban and alert, only on some events after a prefix like "ban,alert=", repeatable`,
+		},
+		cli.Float64Flag{
+			Name:  "hookrate",
+			Value: 10,
+			Usage: "events per second run by each hook, the others dropped",
+		},
+		cli.IntFlag{
+			Name:  "hooktimeout",
+			Value: 5,
+			Usage: "seconds a hook may run before it is killed",
+		},
+		cli.Float64Flag{
+			Name:  "alertloss",
+			Usage: "alert when the packets retransmitted by a session exceed this percent, never if 0, enables --sessionstats",
+		},
+		cli.IntFlag{
+			Name:  "alertrtt",
+			Usage: "alert when the smoothed RTT of a session exceeds this many milliseconds, never if 0",
+		},
+		cli.Float64Flag{
+			Name:  "alertfec",
+			Usage: "alert when the FEC errors per second exceed this, never if 0",
+		},
+		cli.IntFlag{
+			Name:  "alertperiod",
+			Value: 10,
+			Usage: "alert check period, in seconds",
+		},
+		cli.StringFlag{
+			Name:  "capture",
+			Value: "",
+			Usage: "pcap file of the decrypted, FEC decoded KCP segments, for Wireshark with examples/kcptun.lua",
+		},
+		cli.IntFlag{
+			Name:  "capturesize",
+			Value: 100,
+			Usage: "MB captured before the capture stops, never if 0",
+		},
+		cli.IntFlag{
+			Name:  "captureduration",
+			Usage: "seconds captured before the capture stops, never if 0",
+		},
+		cli.BoolFlag{
+			Name:  "capturesmux",
+			Usage: "also capture the smux frames",
 		},
 		cli.BoolFlag{
 			Name:  "quiet",
-			Usage: "to suppress the 'stream open/close' messages",
+			Usage: "to suppress the 'stream open/close' messages, as --loglevel stream=warn",
 		},
 		cli.BoolFlag{
 			Name:  "tcp",
 			Usage: "to emulate a TCP connection(linux)",
 		},
+		cli.BoolFlag{
+			Name:  "byconv",
+			Usage: "identify sessions by KCP conversation instead of remote address, required by clients with --sharesock",
+		},
+		cli.StringFlag{
+			Name:  "downlink",
+			Value: "",
+			Usage: "listen on both udp and tcp, and pair the flows of clients with split uplink and downlink, replies go to this transport: udp, tcp",
+		},
+		cli.BoolFlag{
+			Name:  "pacing",
+			Usage: "spread outgoing packets over time instead of sending a whole window at once",
+		},
+		cli.IntFlag{
+			Name:  "pacerate",
+			Value: 0,
+			Usage: "cap of the pacing rate in bytes per second, 0 to derive it from sndwnd*mtu/RTT only",
+		},
+		cli.IntFlag{
+			Name:  "paceburst",
+			Value: 16384,
+			Usage: "bytes allowed to be sent back-to-back when pacing",
+		},
+		cli.StringFlag{
+			Name:  "netemout",
+			Value: "",
+			Usage: `emulate network impairments on outgoing packets, in tc-netem terms, eg: "delay 100ms 20ms loss 1% duplicate 0.5% reorder 5% rate 2mbit", or "loss gemodel 1% 10%" for burst loss`,
+		},
+		cli.StringFlag{
+			Name:  "netemin",
+			Value: "",
+			Usage: "emulate network impairments on incoming packets, see --netemout",
+		},
+		cli.Int64Flag{
+			Name:  "netemseed",
+			Value: 1,
+			Usage: "seed of the random impairments, the same seed reproduces the same conditions",
+		},
+		cli.BoolFlag{
+			Name:  "handshake",
+			Usage: "establish per-session keys with an ephemeral key exchange, both sides must enable it",
+		},
+		cli.StringFlag{
+			Name:  "handshakekey",
+			Value: "",
+			Usage: "file of the server private key for the handshake, created if absent",
+		},
+		cli.IntFlag{
+			Name:  "rekeyvolume",
+			Value: 1024,
+			Usage: "MB sent before the session key is renewed with --handshake, 0 to disable",
+		},
+		cli.IntFlag{
+			Name:  "rekeyperiod",
+			Value: 3600,
+			Usage: "seconds before the session key is renewed with --handshake, 0 to disable",
+		},
+		cli.StringFlag{
+			Name:  "operatorpub",
+			Value: "",
+			Usage: "require clients to present a credential signed by this operator key, base64 encoded, see the issue command, requires --handshake",
+		},
+		cli.StringFlag{
+			Name:  "revoked",
+			Value: "",
+			Usage: "file of the revoked credential ids, reloaded when modified",
+		},
+		cli.StringFlag{
+			Name:  "classes",
+			Value: "",
+			Usage: `bandwidth classes of the credentials in bytes per second, eg: "basic=1048576,premium=0", 0 for no limit`,
+		},
+		cli.BoolFlag{
+			Name:  "antiprobe",
+			Usage: "ignore the packets of clients until they present a token authenticated with the key, both sides must enable it",
+		},
+		cli.StringFlag{
+			Name:  "autoban",
+			Value: "",
+			Usage: `failures per minute of a source before it's banned, eg: "csum=20,kcp=20,smux=3" for packets failing to decrypt, malformed KCP packets, and invalid smux frames`,
+		},
+		cli.IntFlag{
+			Name:  "bantime",
+			Value: 60,
+			Usage: "seconds of the first ban of a source, doubled at every ban",
+		},
+		cli.IntFlag{
+			Name:  "banmax",
+			Value: 86400,
+			Usage: "longest ban in seconds, a source without bans as long starts over",
+		},
+		cli.StringFlag{
+			Name:  "banhook",
+			Value: "",
+			Usage: `script run as "banhook ban IP SECONDS" at every ban, eg: to add the source to an nftables or ipset set, beware that udp sources may be spoofed to get an address banned`,
+		},
+		cli.StringFlag{
+			Name:  "knock",
+			Value: "",
+			Usage: `udp address of the knock port, eg: ":29899", the listeners drop the packets of addresses not admitted by a knock`,
+		},
+		cli.IntFlag{
+			Name:  "knockttl",
+			Value: 60,
+			Usage: "seconds an address stays admitted after its last packet, overridden by the knockttl of users",
+		},
+		cli.StringSliceFlag{
+			Name:  "allow",
+			Usage: `source IPs or CIDRs allowed, eg: "10.0.0.0/8,2001:db8::/32", or "@path" of a file of them, reloaded when modified, all others are denied`,
+		},
+		cli.StringSliceFlag{
+			Name:  "deny",
+			Usage: `source IPs or CIDRs denied, or "@path" of a file of them, reloaded when modified`,
+		},
+		cli.StringFlag{
+			Name:  "metrics",
+			Value: "",
+			Usage: `address of the http server of the Prometheus metrics on /metrics, eg: "127.0.0.1:9100"`,
+		},
+		cli.StringFlag{
+			Name:  "admin",
+			Value: "",
+			Usage: `address of the admin API listing and closing sessions and streams, a unix socket if not host:port, eg: "127.0.0.1:6061"`,
+		},
+		cli.StringFlag{
+			Name:   "admintoken",
+			Value:  "",
+			Usage:  "bearer token of the admin API, required on tcp",
+			EnvVar: "KCPTUN_ADMINTOKEN",
+		},
+		cli.BoolFlag{
+			Name:  "sessionstats",
+			Usage: "count the packets, retransmissions and FEC recoveries of every session, logged with the snmp log",
+		},
 		cli.StringFlag{
 			Name:  "c",
 			Value: "", // when the value is not empty, the config path must exists
 			Usage: "config from json file, which will override the command from shell",
 		},
 	}
+	myApp.Commands = append([]cli.Command{
+		{
+			Name:  "genkey",
+			Usage: "print a random key and kdf salt, and a random raw key",
+			Action: func(c *cli.Context) error {
+				return generic.GenKey(os.Stdout)
+			},
+		},
+		{
+			Name:  "top",
+			Usage: "show the sessions of a running server live, from its admin API",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "admin",
+					Value: "",
+					Usage: `address of the admin API, a unix socket if not host:port, eg: "127.0.0.1:6061"`,
+				},
+				cli.StringFlag{
+					Name:   "admintoken",
+					Value:  "",
+					Usage:  "bearer token of the admin API",
+					EnvVar: "KCPTUN_ADMINTOKEN",
+				},
+				cli.DurationFlag{
+					Name:  "interval",
+					Value: time.Second,
+					Usage: "refresh interval",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return generic.Top(c.String("admin"), c.String("admintoken"), c.Duration("interval"))
+			},
+		},
+	}, credentialCommands()...)
 	myApp.Action = func(c *cli.Context) error {
 		config := Config{}
 		config.Listen = c.String("listen")
 		config.Target = c.String("target")
+		routes, err := generic.ParseRoutes(c.StringSlice("route"))
+		checkError(err)
+		config.Routes = routes
 		config.Key = c.String("key")
+		config.KDF = c.String("kdf")
+		config.KDFSalt = c.String("kdfsalt")
+		config.KDFParams = c.String("kdfparams")
+		config.RawKey = c.String("rawkey")
+		config.PrevKey = c.String("prevkey")
+		config.PrevRawKey = c.String("prevrawkey")
+		config.PrevCrypt = c.String("prevcrypt")
+		config.KeyGrace = c.Int("keygrace")
+		config.Users = c.String("users")
 		config.Crypt = c.String("crypt")
 		config.Mode = c.String("mode")
 		config.MTU = c.Int("mtu")
@@ -298,11 +787,62 @@ func main() {
 		config.SmuxVer = c.Int("smuxver")
 		config.KeepAlive = c.Int("keepalive")
 		config.Log = c.String("log")
+		config.LogFormat = c.String("logformat")
+		config.LogLevel = c.String("loglevel")
+		config.LogMaxSize = c.Int("logmaxsize")
+		config.LogKeep = c.Int("logkeep")
+		config.AccessLog = c.String("accesslog")
+		config.AccessLogFormat = c.String("accesslogformat")
+		config.AccessLogSample = c.Float64("accesslogsample")
+		config.Hooks = c.StringSlice("hook")
+		config.HookRate = c.Float64("hookrate")
+		config.HookTimeout = c.Int("hooktimeout")
+		config.AlertLoss = c.Float64("alertloss")
+		config.AlertRTT = c.Int("alertrtt")
+		config.AlertFEC = c.Float64("alertfec")
+		config.AlertPeriod = c.Int("alertperiod")
+		config.Capture = c.String("capture")
+		config.CaptureSize = c.Int("capturesize")
+		config.CaptureDuration = c.Int("captureduration")
+		config.CaptureSmux = c.Bool("capturesmux")
 		config.SnmpLog = c.String("snmplog")
 		config.SnmpPeriod = c.Int("snmpperiod")
+		config.SnmpFormat = c.String("snmpformat")
+		config.SnmpDelta = c.Bool("snmpdelta")
+		config.SnmpKeep = c.Int("snmpkeep")
+		config.SnmpMaxSize = c.Int("snmpmaxsize")
 		config.Pprof = c.Bool("pprof")
 		config.Quiet = c.Bool("quiet")
 		config.TCP = c.Bool("tcp")
+		config.Downlink = c.String("downlink")
+		config.ByConv = c.Bool("byconv")
+		config.Pacing = c.Bool("pacing")
+		config.PaceRate = c.Int("pacerate")
+		config.PaceBurst = c.Int("paceburst")
+		config.NetemOut = c.String("netemout")
+		config.NetemIn = c.String("netemin")
+		config.NetemSeed = c.Int64("netemseed")
+		config.Handshake = c.Bool("handshake")
+		config.HandshakeKey = c.String("handshakekey")
+		config.RekeyVolume = c.Int("rekeyvolume")
+		config.RekeyPeriod = c.Int("rekeyperiod")
+		config.OperatorPub = c.String("operatorpub")
+		config.Revoked = c.String("revoked")
+		config.Classes = c.String("classes")
+		config.AntiProbe = c.Bool("antiprobe")
+		config.AutoBan = c.String("autoban")
+		config.BanTime = c.Int("bantime")
+		config.BanMax = c.Int("banmax")
+		config.BanHook = c.String("banhook")
+		config.Knock = c.String("knock")
+		config.KnockTTL = c.Int("knockttl")
+
+		config.Metrics = c.String("metrics")
+		config.SessionStats = c.Bool("sessionstats")
+		config.Admin = c.String("admin")
+		config.AdminToken = c.String("admintoken")
+		config.Allow = c.StringSlice("allow")
+		config.Deny = c.StringSlice("deny")
 
 		if c.String("c") != "" {
 			//Now only support json config file
@@ -310,13 +850,50 @@ func main() {
 			checkError(err)
 		}
 
+		// the loss alert needs the packets counted by --sessionstats
+		if config.AlertLoss > 0 {
+			config.SessionStats = true
+		}
+
 		// log redirect
-		if config.Log != "" {
-			f, err := os.OpenFile(config.Log, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-			checkError(err)
-			defer f.Close()
-			log.SetOutput(f)
+		logLevel := config.LogLevel
+		if config.Quiet {
+			logLevel += ",stream=warn"
 		}
+		checkError(generic.SetupLog(generic.LogConfig{
+			Output:  config.Log,
+			Format:  config.LogFormat,
+			Level:   logLevel,
+			MaxSize: int64(config.LogMaxSize) << 20,
+			Keep:    config.LogKeep,
+		}))
+		accessLog, err = generic.NewAccessLog(generic.AccessLogConfig{
+			Path:    config.AccessLog,
+			Format:  config.AccessLogFormat,
+			Sample:  config.AccessLogSample,
+			MaxSize: int64(config.LogMaxSize) << 20,
+			Keep:    config.LogKeep,
+		})
+		checkError(err)
+		hooks, err := generic.NewHooks(generic.HookConfig{Hooks: config.Hooks, Rate: config.HookRate, Timeout: time.Duration(config.HookTimeout) * time.Second})
+		checkError(err)
+		generic.SetHooks(hooks)
+		go generic.WatchAlerts(generic.AlertConfig{
+			Interval: time.Duration(config.AlertPeriod) * time.Second,
+			Loss:     config.AlertLoss,
+			RTT:      time.Duration(config.AlertRTT) * time.Millisecond,
+			FECErrs:  config.AlertFEC,
+		})
+		capture, err = generic.NewCapture(generic.CaptureConfig{
+			Path:         config.Capture,
+			MaxSize:      int64(config.CaptureSize) << 20,
+			Duration:     time.Duration(config.CaptureDuration) * time.Second,
+			Smux:         config.CaptureSmux,
+			Server:       true,
+			DataShards:   config.DataShard,
+			ParityShards: config.ParityShard,
+		})
+		checkError(err)
 
 		switch config.Mode {
 		case "normal":
@@ -333,7 +910,12 @@ func main() {
 		log.Println("smux version:", config.SmuxVer)
 		log.Println("listening on:", config.Listen)
 		log.Println("target:", config.Target)
+		log.Println("routes:", config.Routes)
 		log.Println("encryption:", config.Crypt)
+		log.Println("users:", config.Users)
+		if config.PrevKey != "" || config.PrevRawKey != "" {
+			log.Println("prevcrypt:", config.PrevCrypt, "keygrace:", config.KeyGrace)
+		}
 		log.Println("nodelay parameters:", config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
 		log.Println("sndwnd:", config.SndWnd, "rcvwnd:", config.RcvWnd)
 		log.Println("compression:", !config.NoComp)
@@ -347,59 +929,215 @@ func main() {
 		log.Println("keepalive:", config.KeepAlive)
 		log.Println("snmplog:", config.SnmpLog)
 		log.Println("snmpperiod:", config.SnmpPeriod)
+		log.Println("snmpformat:", config.SnmpFormat, "snmpdelta:", config.SnmpDelta, "snmpkeep:", config.SnmpKeep, "snmpmaxsize:", config.SnmpMaxSize)
+		log.Println("metrics:", config.Metrics)
+		log.Println("sessionstats:", config.SessionStats)
+		log.Println("admin:", config.Admin)
 		log.Println("pprof:", config.Pprof)
+		log.Println("log:", config.Log, "logformat:", config.LogFormat, "loglevel:", config.LogLevel, "logmaxsize:", config.LogMaxSize, "logkeep:", config.LogKeep)
+		log.Println("accesslog:", config.AccessLog, "accesslogformat:", config.AccessLogFormat, "accesslogsample:", config.AccessLogSample)
+		log.Println("hooks:", generic.RedactURLs(config.Hooks), "hookrate:", config.HookRate, "hooktimeout:", config.HookTimeout)
+		log.Println("alertloss:", config.AlertLoss, "alertrtt:", config.AlertRTT, "alertfec:", config.AlertFEC, "alertperiod:", config.AlertPeriod)
+		log.Println("capture:", config.Capture, "capturesize:", config.CaptureSize, "captureduration:", config.CaptureDuration, "capturesmux:", config.CaptureSmux)
 		log.Println("quiet:", config.Quiet)
 		log.Println("tcp:", config.TCP)
+		log.Println("downlink:", config.Downlink)
+		log.Println("byconv:", config.ByConv)
+		log.Println("pacing:", config.Pacing, "pacerate:", config.PaceRate, "paceburst:", config.PaceBurst)
+		if config.NetemOut != "" || config.NetemIn != "" {
+			_, _, err := impairments(&config)
+			checkError(err)
+			log.Printf("netem: out %q, in %q, seed %v", config.NetemOut, config.NetemIn, config.NetemSeed)
+		}
+		log.Println("handshake:", config.Handshake, "handshakekey:", config.HandshakeKey, "rekeyvolume:", config.RekeyVolume, "rekeyperiod:", config.RekeyPeriod)
+		log.Println("antiprobe:", config.AntiProbe)
+		log.Println("allow:", config.Allow, "deny:", config.Deny)
+		log.Println("autoban:", config.AutoBan, "bantime:", config.BanTime, "banmax:", config.BanMax, "banhook:", config.BanHook)
+		log.Println("knock:", config.Knock, "knockttl:", config.KnockTTL)
+		log.Println("operatorpub:", config.OperatorPub, "revoked:", config.Revoked, "classes:", config.Classes)
 
 		// parameters check
 		if config.SmuxVer > maxSmuxVer {
 			log.Fatal("unsupported smux version:", config.SmuxVer)
 		}
 
-		log.Println("initiating key derivation")
-		pass := pbkdf2.Key([]byte(config.Key), []byte(SALT), 4096, 32, sha1.New)
-		log.Println("key derivation done")
-		var block kcp.BlockCrypt
-		switch config.Crypt {
-		case "null":
-			block = nil
-		case "sm4":
-			block, _ = kcp.NewSM4BlockCrypt(pass[:16])
-		case "tea":
-			block, _ = kcp.NewTEABlockCrypt(pass[:16])
-		case "xor":
-			block, _ = kcp.NewSimpleXORBlockCrypt(pass)
-		case "none":
-			block, _ = kcp.NewNoneBlockCrypt(pass)
-		case "aes-128":
-			block, _ = kcp.NewAESBlockCrypt(pass[:16])
-		case "aes-192":
-			block, _ = kcp.NewAESBlockCrypt(pass[:24])
-		case "blowfish":
-			block, _ = kcp.NewBlowfishBlockCrypt(pass)
-		case "twofish":
-			block, _ = kcp.NewTwofishBlockCrypt(pass)
-		case "cast5":
-			block, _ = kcp.NewCast5BlockCrypt(pass[:16])
-		case "3des":
-			block, _ = kcp.NewTripleDESBlockCrypt(pass[:24])
-		case "xtea":
-			block, _ = kcp.NewXTEABlockCrypt(pass[:16])
-		case "salsa20":
-			block, _ = kcp.NewSalsa20BlockCrypt(pass)
-		default:
-			config.Crypt = "aes"
-			block, _ = kcp.NewAESBlockCrypt(pass)
-		}
-
-		go generic.SnmpLogger(config.SnmpLog, config.SnmpPeriod)
-		if config.Pprof {
-			go http.ListenAndServe(":6060", nil)
+		deriveKey := func(password, rawKey string) []byte {
+			if rawKey != "" {
+				key, err := generic.DecodeRawKey(rawKey)
+				checkError(err)
+				log.Println("using raw key")
+				return key
+			}
+			log.Println("initiating key derivation:", config.KDF, config.KDFParams)
+			key, err := generic.DeriveKey(password, config.KDF, config.KDFSalt, config.KDFParams)
+			checkError(err)
+			log.Println("key derivation done")
+			return key
+		}
+		pass := deriveKey(config.Key, config.RawKey)
+		method, block, crypt, err := generic.NewCrypt(config.Crypt, pass)
+		checkError(err)
+		config.Crypt = method
+
+		var ring *generic.KeyRing
+		if config.PrevKey != "" || config.PrevRawKey != "" { // both keys accepted during the grace period
+			if config.Users != "" {
+				log.Fatal("--prevkey doesn't apply to --users, rotate the keys in the users file")
+			}
+			if config.PrevCrypt == "" {
+				config.PrevCrypt = config.Crypt
+			}
+			prev, err := generic.NewRingKey("previous", config.PrevCrypt, deriveKey(config.PrevKey, config.PrevRawKey))
+			checkError(err)
+			if config.KeyGrace > 0 {
+				prev.Until = time.Now().Add(time.Duration(config.KeyGrace) * time.Second)
+				time.AfterFunc(time.Until(prev.Until), func() { log.Println("previous key retired") })
+				log.Println("previous key accepted until:", prev.Until)
+			}
+			cur, err := generic.NewRingKey("current", config.Crypt, pass)
+			checkError(err)
+			ring = generic.NewKeyRing(true, prev, cur)
+			block, crypt = nil, ring
+		}
+
+		auth := new(sessionAuth)
+		auth.routes = generic.NewRoutes(config.Target, config.Routes)
+		var users *generic.Users
+		if config.Users != "" { // the key and crypt of each packet is the one of its user
+			users, err = generic.LoadUsers(config.Users, config.Crypt, config.KDF, config.KDFSalt, config.KDFParams)
+			checkError(err)
+			go users.Watch(reloadPeriod)
+			auth.users = users
+			block, crypt = nil, users
+		}
+
+		st := &stack{block: block, crypt: crypt}
+		// conversations follow their client to a new address only if every
+		// packet is authenticated, the crypt of each user may differ
+		st.roam = generic.Authenticates(config.Crypt) && (ring == nil || generic.Authenticates(config.PrevCrypt)) && users == nil
+		if (config.AntiProbe || config.AutoBan != "" || config.SessionStats || config.Capture != "") && st.crypt == nil {
+			// tokens are encrypted like other packets, failures are seen by source,
+			// and packets are counted and captured in plaintext
+			st.block, st.crypt = nil, generic.NewBlockPacketCrypt(block)
+			crypt = st.crypt
+		}
+		if len(config.Allow) > 0 || len(config.Deny) > 0 {
+			st.acl, err = generic.NewACL(config.Allow, config.Deny)
+			checkError(err)
+			go st.acl.Watch(reloadPeriod)
+		}
+		if config.AutoBan != "" {
+			thresholds, err := generic.ParseBanThresholds(config.AutoBan)
+			checkError(err)
+			st.banner = generic.NewBanner(thresholds, time.Duration(config.BanTime)*time.Second, time.Duration(config.BanMax)*time.Second, config.BanHook)
+			auth.banner = st.banner
+		}
+		if config.AntiProbe {
+			st.probeKey = func(addr net.Addr) []byte {
+				switch {
+				case users != nil:
+					if user := users.Lookup(addr); user != nil {
+						return user.PSK()
+					}
+					return nil
+				case ring != nil:
+					if key := ring.Lookup(addr); key != nil {
+						return key.PSK
+					}
+					return nil
+				default:
+					return pass
+				}
+			}
+		}
+
+		if config.Knock != "" {
+			st.knocker = generic.NewKnocker(func(id [generic.KeyIDSize]byte) ([][]byte, time.Duration) {
+				ttl := time.Duration(config.KnockTTL) * time.Second
+				switch {
+				case users != nil:
+					user := users.ByKeyID(id)
+					if user == nil {
+						return nil, 0
+					}
+					if user.KnockTTL > 0 {
+						ttl = time.Duration(user.KnockTTL) * time.Second
+					}
+					return [][]byte{user.PSK()}, ttl
+				case ring != nil:
+					var keys [][]byte
+					for _, key := range ring.Keys() {
+						keys = append(keys, key.PSK)
+					}
+					return keys, ttl
+				default:
+					return [][]byte{pass}, ttl
+				}
+			})
+			conn, err := net.ListenPacket("udp", config.Knock)
+			checkError(err)
+			log.Printf("Knock on: %v/udp", config.Knock)
+			go func() { checkError(st.knocker.Serve(conn)) }()
+		}
+
+		if config.OperatorPub != "" {
+			// a credential is a bearer token, readable by every holder of
+			// the key without the keys of the handshake
+			if !config.Handshake {
+				log.Fatal("--operatorpub requires --handshake")
+			}
+			pub, err := generic.DecodeOperatorKey(config.OperatorPub)
+			checkError(err)
+			auth.creds, err = generic.NewCredentialVerifier(pub, config.Revoked)
+			checkError(err)
+			go auth.creds.Watch(reloadPeriod)
+			auth.classes, err = generic.ParseClasses(config.Classes)
+			checkError(err)
+		}
+
+		if config.Handshake {
+			if config.HandshakeKey == "" {
+				log.Fatal("--handshake requires --handshakekey")
+			}
+			key, err := generic.LoadStaticKey(config.HandshakeKey)
+			checkError(err)
+			pub, err := generic.PublicKey(key)
+			checkError(err)
+			log.Println("handshake public key:", base64.StdEncoding.EncodeToString(pub))
+			auth.handshake = &generic.HandshakeConfig{
+				PSK:           pass,
+				StaticKey:     key,
+				RekeyBytes:    int64(config.RekeyVolume) << 20,
+				RekeyInterval: time.Duration(config.RekeyPeriod) * time.Second,
+			}
+		}
+
+		checkError(generic.CheckSnmpFormat(config.SnmpFormat))
+		snmpLog := generic.SnmpLogConfig{
+			Path:     config.SnmpLog,
+			Interval: config.SnmpPeriod,
+			Format:   config.SnmpFormat,
+			Delta:    config.SnmpDelta,
+			Keep:     config.SnmpKeep,
+			MaxSize:  int64(config.SnmpMaxSize) << 20,
+		}
+		go generic.SnmpLogger(snmpLog)
+		go generic.SessionLogger(snmpLog)
+		if config.Metrics != "" {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", generic.MetricsHandler())
+			go func() { checkError(http.ListenAndServe(config.Metrics, mux)) }()
+		}
+		if config.Admin != "" {
+			admin := generic.NewAdmin(config.AdminToken, &config, config.Pprof)
+			admin.Handle("/routes", routesHandler(auth.routes))
+			admin.Handle("/config/save", saveHandler(auth.routes, c.String("c")))
+			go func() { checkError(generic.ServeAdmin(config.Admin, admin)) }()
 		}
 
 		// main loop
 		var wg sync.WaitGroup
-		loop := func(lis *kcp.Listener) {
+		loop := func(lis *kcp.Listener, pacer *generic.PacedConn) {
 			defer wg.Done()
 			if err := lis.SetDSCP(config.DSCP); err != nil {
 				log.Println("SetDSCP:", err)
@@ -413,21 +1151,49 @@ func main() {
 
 			for {
 				if conn, err := lis.AcceptKCP(); err == nil {
-					log.Println("remote address:", conn.RemoteAddr())
+					var user *generic.User
+					var psk []byte
+					if users != nil {
+						if user = users.Lookup(conn.RemoteAddr()); user == nil {
+							logSession.Warn("no user", "remote", conn.RemoteAddr())
+							conn.Close()
+							continue
+						}
+						psk = user.PSK()
+						logSession.Info("session accepted", "remote", conn.RemoteAddr(), "user", user.ID)
+					} else if ring != nil {
+						key := ring.Lookup(conn.RemoteAddr())
+						if key == nil {
+							key = ring.Current()
+						}
+						psk = key.PSK
+						logSession.Info("session accepted", "remote", conn.RemoteAddr(), "key", key.Name)
+					} else {
+						logSession.Info("session accepted", "remote", conn.RemoteAddr())
+					}
 					conn.SetStreamMode(true)
 					conn.SetWriteDelay(false)
 					conn.SetNoDelay(config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
-					conn.SetMtu(config.MTU)
+					if user != nil {
+						conn.SetMtu(config.MTU - user.Overhead())
+					} else if crypt != nil { // room for the packet encryption
+						conn.SetMtu(config.MTU - crypt.Overhead())
+					} else {
+						conn.SetMtu(config.MTU)
+					}
 					conn.SetWindowSize(config.SndWnd, config.RcvWnd)
 					conn.SetACKNoDelay(config.AckNodelay)
-
-					if config.NoComp {
-						go handleMux(conn, &config)
-					} else {
-						go handleMux(generic.NewCompStream(conn), &config)
+					unpace := func() {}
+					if pacer != nil {
+						unpace = pacer.SetEstimator(conn.RemoteAddr(), generic.WindowEstimator(conn, config.SndWnd, config.MTU))
 					}
+
+					go func() {
+						defer unpace()
+						handleSession(conn, &config, auth, user, psk)
+					}()
 				} else {
-					log.Printf("%+v", err)
+					logSession.Error("accept failed", "err", err)
 				}
 			}
 		}
@@ -441,13 +1207,26 @@ func main() {
 		// create multiple listener
 		for port := mp.MinPort; port <= mp.MaxPort; port++ {
 			listenAddr := fmt.Sprintf("%v:%v", mp.Host, port)
+			if config.Downlink != "" || config.ByConv { // stacks paired by conversation
+				if config.TCP || config.Downlink != "" {
+					log.Printf("Listening on: %v/udp+tcp", listenAddr)
+				} else {
+					log.Printf("Listening on: %v/udp", listenAddr)
+				}
+				lis, pacer, err := listenConv(listenAddr, st, &config)
+				checkError(err)
+				wg.Add(1)
+				go loop(lis, pacer)
+				continue
+			}
+
 			if config.TCP { // tcp dual stack
 				if conn, err := tcpraw.Listen("tcp", listenAddr); err == nil {
 					log.Printf("Listening on: %v/tcp", listenAddr)
-					lis, err := kcp.ServeConn(block, config.DataShard, config.ParityShard, conn)
+					lis, pacer, err := serve(st.raw(conn), st, &config)
 					checkError(err)
 					wg.Add(1)
-					go loop(lis)
+					go loop(lis, pacer)
 				} else {
 					log.Println(err)
 				}
@@ -455,10 +1234,10 @@ func main() {
 
 			// udp stack
 			log.Printf("Listening on: %v/udp", listenAddr)
-			lis, err := kcp.ListenWithOptions(listenAddr, block, config.DataShard, config.ParityShard)
+			lis, pacer, err := listenUDP(listenAddr, st, &config)
 			checkError(err)
 			wg.Add(1)
-			go loop(lis)
+			go loop(lis, pacer)
 		}
 
 		wg.Wait()
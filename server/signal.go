@@ -9,6 +9,7 @@ import (
 	"syscall"
 
 	kcp "github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/kcptun/generic"
 )
 
 func init() {
@@ -17,13 +18,19 @@ func init() {
 
 func sigHandler() {
 	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, syscall.SIGUSR1)
+	signal.Notify(ch, syscall.SIGUSR1, syscall.SIGHUP)
 	signal.Ignore(syscall.SIGPIPE)
 
 	for {
 		switch <-ch {
 		case syscall.SIGUSR1:
 			log.Printf("KCP SNMP:%+v", kcp.DefaultSnmp.Copy())
+			log.Printf("KCPTUN SNMP:%+v", generic.DefaultSnmp.Copy())
+			generic.LogSessions()
+		case syscall.SIGHUP:
+			if err := generic.ReopenLog(); err != nil {
+				log.Printf("%+v", err)
+			}
 		}
 	}
 }